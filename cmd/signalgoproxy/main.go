@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"signalgoproxy/internal/ctl"
+	"signalgoproxy/internal/selftest"
+	"signalgoproxy/pkg/signalproxy"
+)
+
+func main() {
+	// Dispatch subcommands before parsing the server flags.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			os.Exit(ctl.Run(os.Args[2:], os.Stdout, os.Stderr))
+		case "selftest":
+			os.Exit(selftest.Run(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	// Set a prefix for logs to include file and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	// 1. Create the server from the flags
+	srv, err := signalproxy.NewFromArgs(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 2. Run it until a shutdown signal (this is a blocking operation)
+	if err := srv.RunWithSignals(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,252 @@
+// Package admin serves the operator-facing HTTP endpoints (health checks and diagnostics).
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/proxy"
+	"signalgoproxy/internal/stats"
+)
+
+// Server is the admin HTTP server.
+type Server struct {
+	cfg        *config.Config
+	registry   *proxy.Registry
+	bans       *proxy.BanList
+	httpServer *http.Server
+	listener   net.Listener
+	socketPath string
+}
+
+// Snapshot is the runtime state reported by the /stats endpoint.
+type Snapshot struct {
+	UptimeSeconds     int64                  `json:"uptime_seconds"`
+	ActiveConnections int                    `json:"active_connections"`
+	Goroutines        int                    `json:"goroutines"`
+	Certificate       stats.CertStatus       `json:"certificate"`
+	Counters          map[string]int64       `json:"counters"`
+	SNI               []stats.SNIStats       `json:"sni"`
+	Upstreams         []stats.UpstreamStatus `json:"upstreams,omitempty"`
+	Dials             []stats.DialStats      `json:"dials,omitempty"`
+	Breakers          []proxy.BreakerStatus  `json:"breakers,omitempty"`
+	Bans              []proxy.BanInfo        `json:"bans,omitempty"`
+}
+
+// New creates a new admin server instance.
+func New(cfg *config.Config) *Server {
+	return &Server{
+		cfg:      cfg,
+		registry: proxy.Connections,
+		bans:     proxy.Bans,
+	}
+}
+
+// Handler builds the admin mux. Optional endpoints are only registered when enabled,
+// so they do not exist at all in default deployments.
+func (a *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/readyz", a.serveReady)
+
+	mux.Handle("GET /stats", a.requireToken(http.HandlerFunc(a.serveStats)))
+	mux.Handle("GET /connections", a.requireToken(http.HandlerFunc(a.listConnections)))
+	mux.Handle("DELETE /connections/{id}", a.requireToken(http.HandlerFunc(a.closeConnection)))
+	mux.Handle("GET /bans", a.requireToken(http.HandlerFunc(a.listBans)))
+	mux.Handle("DELETE /bans", a.requireToken(http.HandlerFunc(a.clearBans)))
+	mux.Handle("DELETE /bans/{source...}", a.requireToken(http.HandlerFunc(a.unban)))
+
+	if a.cfg.EnablePprof {
+		mux.Handle("/debug/pprof/", a.requireToken(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", a.requireToken(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", a.requireToken(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", a.requireToken(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", a.requireToken(http.HandlerFunc(pprof.Trace)))
+	}
+
+	return mux
+}
+
+// TakeSnapshot collects the current runtime state for the given connection registry.
+func TakeSnapshot(registry *proxy.Registry) Snapshot {
+	return Snapshot{
+		UptimeSeconds:     int64(time.Since(stats.StartTime).Seconds()),
+		ActiveConnections: registry.Len(),
+		Goroutines:        runtime.NumGoroutine(),
+		Certificate:       stats.Certificate.Status(),
+		Counters:          stats.Default.Snapshot(),
+		SNI:               stats.SNI.Snapshot(),
+		Upstreams:         stats.Upstreams.Snapshot(),
+		Dials:             stats.Dials.Snapshot(),
+		Breakers:          proxy.CircuitBreakers(),
+		Bans:              proxy.Bans.List(),
+	}
+}
+
+// serveReady reports whether the proxy serves a trusted certificate and can
+// reach its upstreams. It fails while the self-signed fallback certificate is in
+// use, or when the health checks found every upstream unreachable, so that
+// monitoring notices.
+func (a *Server) serveReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if stats.Certificate.Status().Fallback {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready: serving self-signed fallback certificate\n"))
+		return
+	}
+	if stats.Upstreams.AllUnhealthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready: no upstream is reachable\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// serveStats responds with a JSON snapshot of the runtime state.
+func (a *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	a.writeJSON(w, TakeSnapshot(a.registry))
+}
+
+// listConnections responds with a JSON list of all active connections.
+func (a *Server) listConnections(w http.ResponseWriter, r *http.Request) {
+	a.writeJSON(w, a.registry.List())
+}
+
+// listBans responds with a JSON list of the banned sources.
+func (a *Server) listBans(w http.ResponseWriter, r *http.Request) {
+	a.writeJSON(w, a.bans.List())
+}
+
+// clearBans lifts all bans.
+func (a *Server) clearBans(w http.ResponseWriter, r *http.Request) {
+	n := a.bans.Clear()
+	a.cfg.Log().Printf("Lifted %d bans via admin API", n)
+	a.saveBans()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unban lifts the ban of the source in the path, an IP address or an IPv6
+// prefix as listed by GET /bans.
+func (a *Server) unban(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+	if !a.bans.Unban(source) {
+		http.Error(w, "ban not found", http.StatusNotFound)
+		return
+	}
+	a.cfg.Log().Printf("Lifted ban of %s via admin API", source)
+	a.saveBans()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveBans saves the bans to -ban-file, if set, so that lifted bans are not
+// restored after a restart.
+func (a *Server) saveBans() {
+	if a.cfg.BanFile == "" {
+		return
+	}
+	if err := a.bans.Save(a.cfg.BanFile); err != nil {
+		a.cfg.Log().Printf("Failed to save bans to %s: %v", a.cfg.BanFile, err)
+	}
+}
+
+// closeConnection force-closes the connection identified by the path ID.
+func (a *Server) closeConnection(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !a.registry.Close(id) {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+	a.cfg.Log().Printf("Connection %s closed via admin API", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON writes v as an indented JSON response.
+func (a *Server) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		a.cfg.Log().Printf("Error writing admin response: %v", err)
+	}
+}
+
+// requireToken wraps a handler with a bearer token check if an admin token is configured.
+func (a *Server) requireToken(next http.Handler) http.Handler {
+	if a.cfg.AdminToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ParseListenAddr splits an admin address into a network and an address.
+// Addresses prefixed with "unix:" refer to a unix domain socket path.
+func ParseListenAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// Listen binds the admin listener on a TCP address or a unix socket.
+func (a *Server) Listen() error {
+	network, address := ParseListenAddr(a.cfg.AdminListen)
+
+	var listener net.Listener
+	var err error
+	if network == "unix" {
+		listener, err = a.listenUnix(address)
+	} else {
+		listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return err
+	}
+	a.listener = listener
+	a.httpServer = &http.Server{
+		Handler: a.Handler(),
+	}
+	return nil
+}
+
+// Serve serves admin requests until the server is shut down.
+func (a *Server) Serve() {
+	a.cfg.Log().Printf("Starting admin server on %s.", a.listener.Addr())
+	if err := a.httpServer.Serve(a.listener); !errors.Is(err, http.ErrServerClosed) {
+		a.cfg.Log().Printf("Admin server error: %v", err)
+	}
+	a.cfg.Log().Println("Admin server stopped.")
+}
+
+// Shutdown gracefully stops the admin server and removes its unix socket, if any.
+func (a *Server) Shutdown(ctx context.Context) error {
+	err := a.httpServer.Shutdown(ctx)
+	if a.socketPath != "" {
+		if rmErr := os.Remove(a.socketPath); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			a.cfg.Log().Printf("Failed to remove admin socket %s: %v", a.socketPath, rmErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,310 @@
+// Package admin serves the operator-facing HTTP endpoints (health checks and diagnostics).
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/proxy"
+	"signalgoproxy/internal/stats"
+)
+
+// TestHandler checks which endpoints are registered and how they are guarded.
+func TestHandler(t *testing.T) {
+	testCases := []struct {
+		name           string
+		cfg            *config.Config
+		path           string
+		authHeader     string
+		expectedStatus int
+	}{
+		{
+			name:           "Health endpoint",
+			cfg:            &config.Config{},
+			path:           "/healthz",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Pprof absent by default",
+			cfg:            &config.Config{},
+			path:           "/debug/pprof/",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Pprof enabled without token",
+			cfg:            &config.Config{EnablePprof: true},
+			path:           "/debug/pprof/",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Pprof enabled, token missing",
+			cfg:            &config.Config{EnablePprof: true, AdminToken: "secret"},
+			path:           "/debug/pprof/",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Pprof enabled, wrong token",
+			cfg:            &config.Config{EnablePprof: true, AdminToken: "secret"},
+			path:           "/debug/pprof/",
+			authHeader:     "Bearer wrong",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Pprof enabled, correct token",
+			cfg:            &config.Config{EnablePprof: true, AdminToken: "secret"},
+			path:           "/debug/pprof/",
+			authHeader:     "Bearer secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Health endpoint does not require token",
+			cfg:            &config.Config{EnablePprof: true, AdminToken: "secret"},
+			path:           "/healthz",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := New(tc.cfg).Handler()
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.authHeader != "" {
+				req.Header.Set("Authorization", tc.authHeader)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+		})
+	}
+}
+
+// TestReadiness checks that the readiness endpoint fails while the fallback
+// certificate is served, or while the health checks reach no upstream.
+func TestReadiness(t *testing.T) {
+	handler := New(&config.Config{AdminToken: "secret"}).Handler()
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, ready())
+
+	stats.Certificate.SetFallback(true)
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+	stats.Certificate.SetFallback(false)
+
+	// Not ready while no upstream is reachable
+	defer stats.Upstreams.Retain(nil)
+	stats.Upstreams.Record("chat.signal.org:443", time.Second, errors.New("timeout"))
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+	stats.Upstreams.Record("cdn.signal.org:443", 10*time.Millisecond, nil)
+	assert.Equal(t, http.StatusOK, ready())
+}
+
+// TestConnectionsAPI lists and force-closes a connection while data is flowing.
+func TestConnectionsAPI(t *testing.T) {
+	a := New(&config.Config{})
+	a.registry = proxy.NewRegistry()
+	handler := a.Handler()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	tc := a.registry.Register(proxy.NewConnID(), serverConn)
+
+	// Keep writing into the connection until it is closed.
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for {
+			if _, err := clientConn.Write([]byte("data")); err != nil {
+				return
+			}
+		}
+	}()
+	go io.Copy(io.Discard, serverConn)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/connections", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var infos []proxy.ConnInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	require.Len(t, infos, 1)
+	assert.Equal(t, tc.ID, infos[0].ID)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/connections/"+tc.ID, nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	select {
+	case <-writerDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed by the admin API")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/connections/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// TestBansAPI lists the banned sources with their remaining ban time.
+func TestBansAPI(t *testing.T) {
+	a := New(&config.Config{})
+	a.bans = proxy.NewBanList(1, time.Minute, 10)
+	a.bans.Offend("192.0.2.1", proxy.OffenseUnknownSNI, time.Hour, log.New(io.Discard, "", 0))
+
+	rec := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bans", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var bans []proxy.BanInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &bans))
+	require.Len(t, bans, 1)
+	assert.Equal(t, "192.0.2.1", bans[0].IP)
+	assert.InDelta(t, 3600, bans[0].RemainingSeconds, 5)
+}
+
+// TestLiftBansAPI lifts single bans, including IPv6 prefixes, and all bans,
+// and checks that the ban file is updated.
+func TestLiftBansAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	a := New(&config.Config{BanFile: path})
+	a.bans = proxy.NewBanList(1, time.Minute, 10)
+	logger := log.New(io.Discard, "", 0)
+	for _, source := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::/64"} {
+		a.bans.Offend(source, proxy.OffenseUnknownSNI, time.Hour, logger)
+	}
+	handler := a.Handler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/bans/2001:db8::/64", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.False(t, a.bans.Banned("2001:db8::/64"))
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/bans/192.0.2.3", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	saved := proxy.NewBanList(1, time.Minute, 10)
+	n, err := saved.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/bans", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, a.bans.List())
+
+	saved = proxy.NewBanList(1, time.Minute, 10)
+	n, err = saved.Load(path)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+// TestConnectionsAPIRequiresToken checks that the connections endpoints are protected.
+func TestConnectionsAPIRequiresToken(t *testing.T) {
+	handler := New(&config.Config{AdminToken: "secret"}).Handler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/connections", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+// TestUnixSocketLifecycle checks stale socket replacement, directory creation,
+// socket mode, and cleanup on shutdown.
+func TestUnixSocketLifecycle(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "run", "admin.sock")
+	require.NoError(t, os.MkdirAll(filepath.Dir(socket), 0755))
+
+	// Leave a stale socket behind, as a crashed process would.
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	_, err = os.Stat(socket)
+	require.NoError(t, err, "stale socket should exist before startup")
+
+	a := New(&config.Config{AdminListen: "unix:" + socket, AdminSocketMode: 0600})
+	require.NoError(t, a.Listen())
+	go a.Serve()
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) { return net.Dial("unix", socket) },
+	}}
+	resp, err := client.Get("http://admin/healthz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, a.Shutdown(context.Background()))
+	_, err = os.Stat(socket)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "socket should be removed on shutdown")
+}
+
+// TestUnixSocketRefusesRegularFile checks that a non-socket file is never removed.
+func TestUnixSocketRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+
+	a := New(&config.Config{AdminListen: "unix:" + path, AdminSocketMode: 0600})
+	assert.Error(t, a.Listen())
+	_, err := os.Stat(path)
+	assert.NoError(t, err)
+}
+
+// TestListenPrivate checks that the socket is created accessible to its owner
+// only, and that the umask of the process is left as it was.
+func TestListenPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no file modes on Windows")
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "before"), nil, 0o644))
+	before, err := os.Stat(filepath.Join(dir, "before"))
+	require.NoError(t, err)
+
+	listener, err := listenPrivate(filepath.Join(dir, "admin.sock"))
+	require.NoError(t, err)
+	defer listener.Close()
+
+	info, err := os.Stat(filepath.Join(dir, "admin.sock"))
+	require.NoError(t, err)
+	assert.Zero(t, info.Mode().Perm()&0o077, "socket mode %v", info.Mode().Perm())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "after"), nil, 0o644))
+	after, err := os.Stat(filepath.Join(dir, "after"))
+	require.NoError(t, err)
+	assert.Equal(t, before.Mode().Perm(), after.Mode().Perm(), "umask not restored")
+}
+
+// TestParseListenAddr checks the network selection for admin addresses.
+func TestParseListenAddr(t *testing.T) {
+	network, address := ParseListenAddr("127.0.0.1:9090")
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "127.0.0.1:9090", address)
+
+	network, address = ParseListenAddr("unix:/run/signalgoproxy/admin.sock")
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/signalgoproxy/admin.sock", address)
+}
@@ -0,0 +1,100 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listenUnix binds a unix domain socket at path, replacing a stale socket left
+// behind by a previous run and applying the configured mode and ownership.
+func (a *Server) listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	// No one else may connect before the mode is applied
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	a.socketPath = path
+
+	if err := os.Chmod(path, a.cfg.AdminSocketMode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket mode: %w", err)
+	}
+
+	if a.cfg.AdminSocketOwner != "" {
+		uid, gid, err := lookupOwner(a.cfg.AdminSocketOwner)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set socket owner: %w", err)
+		}
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket removes an existing socket file at path. It refuses to
+// remove anything that is not a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace %s: not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// lookupOwner resolves a "user:group" (or "user") specification into numeric IDs.
+// A missing group leaves the group unchanged (-1).
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+
+	uid := -1
+	if userName != "" {
+		id, err := strconv.Atoi(userName)
+		if err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("unknown socket owner user '%s': %w", userName, err)
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+
+	gid := -1
+	if groupName != "" {
+		id, err := strconv.Atoi(groupName)
+		if err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("unknown socket owner group '%s': %w", groupName, err)
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package admin
+
+import "net"
+
+// listenPrivate binds a unix domain socket at path. Without a umask, its
+// mode is only restricted once the configured mode is applied.
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package admin
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes the changes of the process umask.
+var umaskMu sync.Mutex
+
+// listenPrivate binds a unix domain socket at path that only its owner can
+// connect to until the configured mode is applied. The umask is process-wide,
+// so files created by other goroutines meanwhile are private too.
+func listenPrivate(path string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,94 @@
+// Package ctl implements the "ctl" subcommand, a small client for the admin endpoints.
+package ctl
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"signalgoproxy/internal/admin"
+)
+
+// commands maps ctl commands to admin endpoint paths.
+var commands = map[string]string{
+	"health":      "/healthz",
+	"stats":       "/stats",
+	"connections": "/connections",
+}
+
+// Run executes the ctl subcommand with the given arguments and returns the exit code.
+func Run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	var adminListen, adminToken string
+	fs.StringVar(&adminListen, "admin-listen", "unix:/run/signalgoproxy/admin.sock", "Address of the admin listener to connect to.")
+	fs.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for protected admin endpoints.")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: signalgoproxy ctl [flags] health|stats|connections")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command '%s'.\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+
+	client, baseURL := newClient(adminListen)
+	req, err := http.NewRequest(http.MethodGet, baseURL+path, nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to build request: %v\n", err)
+		return 1
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to reach admin endpoint at %s: %v\n", adminListen, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(stderr, "Admin endpoint returned %s\n", resp.Status)
+		return 1
+	}
+	if _, err := io.Copy(stdout, resp.Body); err != nil {
+		fmt.Fprintf(stderr, "Failed to read response: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// newClient returns an HTTP client and base URL for the given admin address,
+// dialing unix sockets directly when needed.
+func newClient(adminListen string) (*http.Client, string) {
+	network, address := admin.ParseListenAddr(adminListen)
+	if network != "unix" {
+		return &http.Client{Timeout: 10 * time.Second}, "http://" + address
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", address)
+		},
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}, "http://admin"
+}
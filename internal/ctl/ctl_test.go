@@ -0,0 +1,65 @@
+// Package ctl implements the "ctl" subcommand, a small client for the admin endpoints.
+package ctl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/admin"
+	"signalgoproxy/internal/config"
+)
+
+// TestRunOverUnixSocket queries a real admin server listening on a unix socket.
+func TestRunOverUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	srv := admin.New(&config.Config{AdminListen: "unix:" + socket, AdminSocketMode: 0600})
+	require.NoError(t, srv.Listen())
+	go srv.Serve()
+	defer srv.Shutdown(context.Background())
+
+	var stdout, stderr bytes.Buffer
+	code := Run([]string{"-admin-listen", "unix:" + socket, "stats"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stderr.String())
+
+	var snapshot admin.Snapshot
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &snapshot))
+	assert.Greater(t, snapshot.Goroutines, 0)
+}
+
+// TestRunOverTCP checks the TCP transport and token forwarding.
+func TestRunOverTCP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	var stdout, stderr bytes.Buffer
+	code := Run([]string{"-admin-listen", addr, "-admin-token", "secret", "health"}, &stdout, &stderr)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "ok\n", stdout.String())
+
+	stdout.Reset()
+	code = Run([]string{"-admin-listen", addr, "-admin-token", "wrong", "health"}, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr.String(), "401")
+}
+
+// TestRunUsageErrors checks argument validation.
+func TestRunUsageErrors(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, Run(nil, &stdout, &stderr))
+	assert.Equal(t, 2, Run([]string{"bogus"}, &stdout, &stderr))
+}
@@ -0,0 +1,31 @@
+// Package fdlimit inspects and raises the process file descriptor limit.
+package fdlimit
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrUnsupported is returned on platforms without file descriptor limits.
+var ErrUnsupported = errors.New("file descriptor limits are not supported on this platform")
+
+// fdDirs are the directories listing the open descriptors of the current process.
+var fdDirs = []string{"/proc/self/fd", "/dev/fd"}
+
+// Open returns the number of file descriptors currently open in this process.
+func Open() (int, error) {
+	for _, dir := range fdDirs {
+		f, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		// The directory handle itself was open while listing.
+		return len(names) - 1, nil
+	}
+	return 0, ErrUnsupported
+}
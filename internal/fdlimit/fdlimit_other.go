@@ -0,0 +1,14 @@
+//go:build !unix
+
+package fdlimit
+
+// Limit returns the current soft limit on open file descriptors.
+func Limit() (uint64, error) {
+	return 0, ErrUnsupported
+}
+
+// Raise raises the soft file descriptor limit to the hard limit. It returns the
+// soft limit before and after the change.
+func Raise() (before, after uint64, err error) {
+	return 0, 0, ErrUnsupported
+}
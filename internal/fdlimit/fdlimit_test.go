@@ -0,0 +1,41 @@
+package fdlimit
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenCountsNewDescriptors checks that opening a file is reflected in the count.
+func TestOpenCountsNewDescriptors(t *testing.T) {
+	before, err := Open()
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip("descriptor counting is not supported on this platform")
+	}
+	require.NoError(t, err)
+
+	f, err := os.Open(os.DevNull)
+	require.NoError(t, err)
+	defer f.Close()
+
+	after, err := Open()
+	require.NoError(t, err)
+	assert.Equal(t, before+1, after)
+}
+
+// TestRaise checks that raising the limit never lowers it.
+func TestRaise(t *testing.T) {
+	before, after, err := Raise()
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip("file descriptor limits are not supported on this platform")
+	}
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, after, before)
+
+	limit, err := Limit()
+	require.NoError(t, err)
+	assert.Equal(t, after, limit)
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package fdlimit
+
+import "syscall"
+
+// Limit returns the current soft limit on open file descriptors.
+func Limit() (uint64, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, err
+	}
+	return uint64(rlim.Cur), nil
+}
+
+// Raise raises the soft file descriptor limit to the hard limit. It returns the
+// soft limit before and after the change.
+func Raise() (before, after uint64, err error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, 0, err
+	}
+	before = uint64(rlim.Cur)
+	if rlim.Cur >= rlim.Max {
+		return before, before, nil
+	}
+
+	rlim.Cur = rlim.Max
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return before, before, err
+	}
+	return before, uint64(rlim.Cur), nil
+}
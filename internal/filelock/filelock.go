@@ -0,0 +1,12 @@
+// Package filelock provides exclusive advisory locks on files, used to keep
+// several instances from sharing state such as the certificate cache.
+package filelock
+
+import "errors"
+
+var (
+	// ErrLocked is returned when another process holds the lock.
+	ErrLocked = errors.New("file is locked by another process")
+	// ErrUnsupported is returned on platforms without file locking.
+	ErrUnsupported = errors.New("file locking is not supported on this platform")
+)
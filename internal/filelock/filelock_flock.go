@@ -0,0 +1,48 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Lock is an exclusive lock held on a file.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire takes an exclusive lock on path without blocking, creating the file if
+// needed, and records the process ID in it. If another process holds the lock,
+// the returned error wraps ErrLocked and names the holder's process ID.
+func Acquire(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			if pid, _ := os.ReadFile(path); len(pid) > 0 {
+				return nil, fmt.Errorf("%w (pid %s)", ErrLocked, strings.TrimSpace(string(pid)))
+			}
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{file: f}, nil
+}
+
+// Release releases the lock.
+func (l *Lock) Release() error {
+	return l.file.Close()
+}
@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package filelock
+
+// Lock is an exclusive lock held on a file.
+type Lock struct{}
+
+// Acquire takes an exclusive lock on path. It always fails with ErrUnsupported
+// on this platform.
+func Acquire(path string) (*Lock, error) {
+	return nil, ErrUnsupported
+}
+
+// Release releases the lock.
+func (l *Lock) Release() error {
+	return nil
+}
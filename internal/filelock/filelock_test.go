@@ -0,0 +1,40 @@
+package filelock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAcquire checks that a held lock is refused and can be taken after release.
+func TestAcquire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".lock")
+
+	lock, err := Acquire(path)
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip("file locking is not supported on this platform")
+	}
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), strings.TrimSpace(string(content)))
+
+	// flock locks belong to the open file, so a second open conflicts even
+	// within the same process.
+	_, err = Acquire(path)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.ErrorContains(t, err, "pid "+strconv.Itoa(os.Getpid()))
+
+	require.NoError(t, lock.Release())
+
+	lock, err = Acquire(path)
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+}
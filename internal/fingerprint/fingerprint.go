@@ -0,0 +1,97 @@
+// Package fingerprint computes JA3 fingerprints of TLS ClientHello messages.
+//
+// JA3 concatenates the legacy version, cipher suites, extensions, supported
+// groups and EC point formats of a ClientHello as decimal values, and hashes the
+// result with MD5. GREASE values (RFC 8701) are ignored, since clients randomize them.
+package fingerprint
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// extensionSupportedVersions is the supported_versions extension (RFC 8446).
+const extensionSupportedVersions = 43
+
+// ClientHello holds the ClientHello fields used for fingerprinting.
+type ClientHello struct {
+	Version      uint16
+	CipherSuites []uint16
+	Extensions   []uint16
+	Curves       []uint16
+	PointFormats []uint8
+}
+
+// FromClientHelloInfo extracts the fingerprinted fields from a ClientHelloInfo.
+func FromClientHelloInfo(info *tls.ClientHelloInfo) ClientHello {
+	h := ClientHello{
+		CipherSuites: slices.Clone(info.CipherSuites),
+		Extensions:   slices.Clone(info.Extensions),
+		PointFormats: slices.Clone(info.SupportedPoints),
+	}
+	for _, curve := range info.SupportedCurves {
+		h.Curves = append(h.Curves, uint16(curve))
+	}
+
+	// crypto/tls does not expose the legacy version field. Clients sending
+	// supported_versions must set it to TLS 1.2; otherwise crypto/tls derives
+	// SupportedVersions from it, so it is the highest listed version.
+	if slices.Contains(info.Extensions, extensionSupportedVersions) {
+		h.Version = tls.VersionTLS12
+	} else {
+		for _, v := range info.SupportedVersions {
+			h.Version = max(h.Version, v)
+		}
+	}
+	return h
+}
+
+// JA3String returns the JA3 string of the ClientHello.
+func (h ClientHello) JA3String() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(h.Version)))
+	b.WriteByte(',')
+	writeList(&b, h.CipherSuites)
+	b.WriteByte(',')
+	writeList(&b, h.Extensions)
+	b.WriteByte(',')
+	writeList(&b, h.Curves)
+	b.WriteByte(',')
+	for i, format := range h.PointFormats {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(format)))
+	}
+	return b.String()
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello as a hex-encoded MD5 hash.
+func (h ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeList writes values joined by '-', skipping GREASE values.
+func writeList(b *strings.Builder, values []uint16) {
+	first := true
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		if !first {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(v)))
+		first = false
+	}
+}
+
+// isGREASE reports whether v is a GREASE value of the form 0x?a?a.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
@@ -0,0 +1,98 @@
+package fingerprint
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestJA3 checks the JA3 string and hash against known test vectors.
+func TestJA3(t *testing.T) {
+	testCases := []struct {
+		name           string
+		hello          ClientHello
+		expectedString string
+		expectedHash   string
+	}{
+		{
+			name: "Reference vector",
+			hello: ClientHello{
+				Version:      769,
+				CipherSuites: []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				Extensions:   []uint16{0, 10, 11},
+				Curves:       []uint16{23, 24, 25},
+				PointFormats: []uint8{0},
+			},
+			expectedString: "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+			expectedHash:   "ada70206e40642a3e4461f35503241d5",
+		},
+		{
+			name: "GREASE values are ignored",
+			hello: ClientHello{
+				Version:      771,
+				CipherSuites: []uint16{0x0a0a, 4865, 4866},
+				Extensions:   []uint16{0x1a1a, 0, 43, 0xfafa},
+				Curves:       []uint16{0x2a2a, 29, 23},
+				PointFormats: []uint8{0},
+			},
+			expectedString: "771,4865-4866,0-43,29-23,0",
+		},
+		{
+			name:           "Empty lists",
+			hello:          ClientHello{Version: 771, CipherSuites: []uint16{4865}},
+			expectedString: "771,4865,,,",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedString, tc.hello.JA3String())
+			if tc.expectedHash != "" {
+				assert.Equal(t, tc.expectedHash, tc.hello.JA3())
+			}
+			assert.Len(t, tc.hello.JA3(), 32)
+		})
+	}
+}
+
+// TestIsGREASE checks the GREASE value detection.
+func TestIsGREASE(t *testing.T) {
+	for i := uint16(0); i < 16; i++ {
+		assert.True(t, isGREASE(i<<12|0x0a00|i<<4|0x0a), "0x%04x", i<<12|0x0a00|i<<4|0x0a)
+	}
+	for _, v := range []uint16{0x0000, 0x0a0b, 0x1a2a, 0x1301, 0xc02b} {
+		assert.False(t, isGREASE(v), "0x%04x", v)
+	}
+}
+
+// TestFromClientHelloInfo fingerprints a real crypto/tls ClientHello.
+func TestFromClientHelloInfo(t *testing.T) {
+	infos := make(chan *tls.ClientHelloInfo, 1)
+	serverConfig := &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			infos <- info
+			return nil, nil
+		},
+	}
+
+	client, server := net.Pipe()
+	go tls.Server(server, serverConfig).Handshake()
+	go tls.Client(client, &tls.Config{ServerName: "proxy.test", MaxVersion: tls.VersionTLS13}).Handshake()
+
+	h := FromClientHelloInfo(<-infos)
+	client.Close()
+	server.Close()
+
+	assert.Equal(t, uint16(tls.VersionTLS12), h.Version, "TLS 1.3 clients send a legacy version of TLS 1.2")
+	assert.Contains(t, h.Extensions, uint16(0), "server_name should be present")
+	assert.Contains(t, h.Extensions, uint16(extensionSupportedVersions))
+
+	fields := strings.Split(h.JA3String(), ",")
+	require.Len(t, fields, 5)
+	assert.Equal(t, "771", fields[0])
+	assert.Contains(t, fields[3], "29", "X25519 should be a supported group")
+}
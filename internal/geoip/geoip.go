@@ -0,0 +1,83 @@
+// Package geoip looks up the countries of client addresses in a MaxMind
+// database, such as GeoLite2-Country.
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// Unknown is the country code of addresses without a known country.
+const Unknown = "??"
+
+// countryRecord holds the fields of a database record used for lookups.
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	// RegisteredCountry is the country where the network is registered, for
+	// networks without a located country, such as some anycast ranges.
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// DB is a country database that can be reloaded while in use. It is safe for
+// concurrent use.
+type DB struct {
+	path   string
+	reader atomic.Pointer[maxminddb.Reader]
+}
+
+// New creates a database for the file at path. It reports every address as
+// Unknown until Reload succeeds.
+func New(path string) *DB {
+	return &DB{path: path}
+}
+
+// Reload reads the database file again. On error, the previous database stays
+// in use.
+//
+// The file is read into memory rather than mapped, so that lookups still
+// using the previous database are not affected when it is replaced.
+func (db *DB) Reload() error {
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return fmt.Errorf("failed to read GeoIP database: %w", err)
+	}
+	reader, err := maxminddb.OpenBytes(data)
+	if err != nil {
+		return fmt.Errorf("failed to load GeoIP database %s: %w", db.path, err)
+	}
+	db.reader.Store(reader)
+	return nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country of addr, or
+// Unknown if db is nil, not loaded, or has no country for addr.
+func (db *DB) Country(addr netip.Addr) string {
+	if db == nil || !addr.IsValid() {
+		return Unknown
+	}
+	reader := db.reader.Load()
+	if reader == nil {
+		return Unknown
+	}
+
+	var record countryRecord
+	if err := reader.Lookup(addr.Unmap().WithZone("")).Decode(&record); err != nil {
+		return Unknown
+	}
+	switch {
+	case record.Country.ISOCode != "":
+		return record.Country.ISOCode
+	case record.RegisteredCountry.ISOCode != "":
+		return record.RegisteredCountry.ISOCode
+	default:
+		return Unknown
+	}
+}
@@ -0,0 +1,136 @@
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestDB writes a country database to path, in the layout of
+// GeoLite2-Country, mapping each network to the record of a country code. An
+// empty country code stands for a network with only a registered country,
+// which is then "ZZ".
+func writeTestDB(t *testing.T, path string, networks map[string]string) {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType:            "GeoLite2-Country",
+		IncludeReservedNetworks: true,
+	})
+	require.NoError(t, err)
+	for network, country := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		require.NoError(t, err)
+		record := mmdbtype.Map{}
+		if country != "" {
+			record["country"] = mmdbtype.Map{"iso_code": mmdbtype.String(country)}
+		}
+		record["registered_country"] = mmdbtype.Map{"iso_code": mmdbtype.String("ZZ")}
+		require.NoError(t, tree.Insert(ipNet, record))
+	}
+
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = tree.WriteTo(f)
+	require.NoError(t, err)
+}
+
+// TestCountry checks the lookups of IPv4, IPv6 and unknown addresses.
+func TestCountry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeTestDB(t, path, map[string]string{
+		"192.0.2.0/24":     "DE",
+		"198.51.100.0/24":  "",
+		"2001:db8:1::/48":  "NL",
+		"2001:db8:2::/48":  "",
+		"203.0.113.128/25": "JP",
+	})
+	db := New(path)
+	require.NoError(t, db.Reload())
+
+	testCases := []struct {
+		name     string
+		addr     netip.Addr
+		expected string
+	}{
+		{name: "IPv4", addr: netip.MustParseAddr("192.0.2.1"), expected: "DE"},
+		{name: "IPv4-mapped", addr: netip.MustParseAddr("::ffff:192.0.2.1"), expected: "DE"},
+		{name: "IPv6", addr: netip.MustParseAddr("2001:db8:1::1"), expected: "NL"},
+		{name: "IPv6 with zone", addr: netip.MustParseAddr("2001:db8:1::1%eth0"), expected: "NL"},
+		{name: "Registered country", addr: netip.MustParseAddr("198.51.100.1"), expected: "ZZ"},
+		{name: "IPv6 registered country", addr: netip.MustParseAddr("2001:db8:2::1"), expected: "ZZ"},
+		{name: "Not found", addr: netip.MustParseAddr("203.0.113.1"), expected: Unknown},
+		{name: "Invalid", addr: netip.Addr{}, expected: Unknown},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, db.Country(tc.addr))
+		})
+	}
+}
+
+// TestCountryWithoutDatabase checks that a missing or broken database reports
+// every address as Unknown.
+func TestCountryWithoutDatabase(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	var nilDB *DB
+	assert.Equal(t, Unknown, nilDB.Country(addr))
+
+	dir := t.TempDir()
+	missing := New(filepath.Join(dir, "missing.mmdb"))
+	assert.ErrorContains(t, missing.Reload(), "failed to read GeoIP database")
+	assert.Equal(t, Unknown, missing.Country(addr))
+
+	path := filepath.Join(dir, "broken.mmdb")
+	require.NoError(t, os.WriteFile(path, []byte("not a database"), 0o644))
+	broken := New(path)
+	assert.ErrorContains(t, broken.Reload(), "failed to load GeoIP database")
+	assert.Equal(t, Unknown, broken.Country(addr))
+}
+
+// TestReload checks that a reload replaces the database while lookups run,
+// and that a failed reload keeps the previous one.
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeTestDB(t, path, map[string]string{"192.0.2.0/24": "DE"})
+	db := New(path)
+	require.NoError(t, db.Reload())
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if country := db.Country(addr); country != "DE" && country != "FR" {
+					t.Errorf("unexpected country %q during reload", country)
+					return
+				}
+			}
+		}()
+	}
+	writeTestDB(t, path, map[string]string{"192.0.2.0/24": "FR"})
+	require.NoError(t, db.Reload())
+	close(stop)
+	wg.Wait()
+	assert.Equal(t, "FR", db.Country(addr))
+
+	require.NoError(t, os.WriteFile(path, []byte("truncated"), 0o644))
+	assert.Error(t, db.Reload())
+	assert.Equal(t, "FR", db.Country(addr))
+}
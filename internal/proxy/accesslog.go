@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"signalgoproxy/internal/config"
+)
+
+// Close reasons reported in the access log.
+const (
+	CloseClientEOF     = "client_eof"
+	CloseUpstreamEOF   = "upstream_eof"
+	CloseClientReset   = "client_reset"
+	CloseUpstreamReset = "upstream_reset"
+	CloseIdleTimeout   = "idle_timeout"
+	CloseForced        = "closed"
+	CloseShutdown      = "shutdown"
+	CloseError         = "error"
+	CloseDenied        = "denied"
+	CloseServed        = "served"
+	CloseSNILimit      = "sni_limit"
+	CloseByteLimit     = "byte_limit"
+)
+
+// Close directions reported in the access log: the side whose socket ended
+// the relay, or the proxy itself if it closed the connection.
+const (
+	DirectionClient   = "client"
+	DirectionUpstream = "upstream"
+	DirectionProxy    = "proxy"
+)
+
+// ActionProxy is the access log action of a connection relayed to its routed
+// upstream. Connections for an inner SNI without a route are logged with their
+// config.UnknownSNIAction instead.
+const ActionProxy = "proxy"
+
+// ActionPassthrough is the access log action of a connection relayed to a
+// backend of config.Passthrough, which is not a Signal upstream.
+const ActionPassthrough = "passthrough"
+
+// ActionUpstreamProxy is the access log action of a connection relayed to the
+// Signal proxy of config.UpstreamProxy.
+const ActionUpstreamProxy = "upstream_proxy"
+
+// relayResult is the outcome of one relay direction.
+type relayResult struct {
+	fromClient bool
+	bytes      int64
+	err        error
+	readErr    bool // err was returned by the source, not the destination
+}
+
+// side returns the peer whose socket ended the relay direction: the source
+// for EOF and read errors, the destination for write errors.
+func (r relayResult) side() string {
+	if (r.err == nil || r.readErr) == r.fromClient {
+		return DirectionClient
+	}
+	return DirectionUpstream
+}
+
+// accessRecord summarizes a proxied connection when it ends.
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	ID        string    `json:"id"`
+	ClientIP  string    `json:"client_ip"`
+	Country   string    `json:"country,omitempty"`
+	SNI       string    `json:"sni"`
+	Upstream  string    `json:"upstream"`
+	Action    string    `json:"action"`
+	Duration  float64   `json:"duration_seconds"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Reason    string    `json:"reason"`
+	Direction string    `json:"direction,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// closeReason classifies why a relay ended from the direction that finished
+// first, and returns the reason and the side that caused it. forced is the
+// reason recorded if the connection was force-closed through the registry; it
+// takes precedence over the errors this caused.
+func closeReason(first relayResult, forced string) (reason, direction string) {
+	side := first.side()
+	switch {
+	case forced != "":
+		return forced, DirectionProxy
+	case errors.Is(first.err, net.ErrClosed):
+		return CloseForced, DirectionProxy
+	case errors.Is(first.err, os.ErrDeadlineExceeded), errors.Is(first.err, syscall.ETIMEDOUT):
+		return CloseIdleTimeout, side
+	case errors.Is(first.err, syscall.ECONNRESET), errors.Is(first.err, syscall.EPIPE), errors.Is(first.err, io.ErrClosedPipe):
+		if side == DirectionClient {
+			return CloseClientReset, side
+		}
+		return CloseUpstreamReset, side
+	case first.err != nil:
+		return CloseError, side
+	case side == DirectionClient:
+		return CloseClientEOF, side
+	default:
+		return CloseUpstreamEOF, side
+	}
+}
+
+// errorTracker remembers the error returned by its reader, other than io.EOF,
+// so that a relay error can be attributed to the source or the destination.
+type errorTracker struct {
+	r   io.Reader
+	err error
+}
+
+func (t *errorTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
+}
+
+// logAccess writes rec to logger in the configured log format. JSON records
+// are written as bare lines, without the logger's prefix, so that they can
+// be parsed directly.
+func logAccess(logger *log.Logger, format config.LogFormat, rec accessRecord) {
+	if format == config.LogFormatJSON {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			logger.Printf("Failed to encode access log record: %v", err)
+			return
+		}
+		logger.Writer().Write(append(line, '\n'))
+		return
+	}
+
+	msg := fmt.Sprintf("Connection closed: client=%s sni=%s upstream=%s action=%s duration=%s in=%d out=%d reason=%s",
+		rec.ClientIP, rec.SNI, rec.Upstream, rec.Action, time.Duration(rec.Duration*float64(time.Second)).Round(time.Millisecond), rec.BytesIn, rec.BytesOut, rec.Reason)
+	if rec.Direction != "" {
+		msg += " direction=" + rec.Direction
+	}
+	if rec.Error != "" {
+		msg += " error=" + rec.Error
+	}
+	logger.Print(msg)
+}
@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+	"signalgoproxy/internal/stealth"
+	"signalgoproxy/internal/testutil"
+)
+
+// lockedBuffer is a log destination that is safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Lines returns the lines written so far.
+func (b *lockedBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+// String returns everything written so far.
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestCloseReason tests the classification of relay endings.
+func TestCloseReason(t *testing.T) {
+	reset := &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	brokenPipe := &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}
+	testCases := []struct {
+		name              string
+		first             relayResult
+		forced            string
+		expected          string
+		expectedDirection string
+	}{
+		{name: "Client EOF", first: relayResult{fromClient: true}, expected: CloseClientEOF, expectedDirection: DirectionClient},
+		{name: "Upstream EOF", first: relayResult{fromClient: false}, expected: CloseUpstreamEOF, expectedDirection: DirectionUpstream},
+		{name: "Idle timeout", first: relayResult{err: fmt.Errorf("read: %w", os.ErrDeadlineExceeded), readErr: true}, expected: CloseIdleTimeout, expectedDirection: DirectionUpstream},
+		{name: "Keepalive timeout", first: relayResult{fromClient: true, err: syscall.ETIMEDOUT, readErr: true}, expected: CloseIdleTimeout, expectedDirection: DirectionClient},
+		{name: "Client reset on read", first: relayResult{fromClient: true, err: reset, readErr: true}, expected: CloseClientReset, expectedDirection: DirectionClient},
+		{name: "Upstream reset on read", first: relayResult{err: reset, readErr: true}, expected: CloseUpstreamReset, expectedDirection: DirectionUpstream},
+		{name: "Upstream broken pipe on write", first: relayResult{fromClient: true, err: brokenPipe}, expected: CloseUpstreamReset, expectedDirection: DirectionUpstream},
+		{name: "Client closed pipe on write", first: relayResult{err: io.ErrClosedPipe}, expected: CloseClientReset, expectedDirection: DirectionClient},
+		{name: "Use of closed connection", first: relayResult{fromClient: true, err: net.ErrClosed, readErr: true}, expected: CloseForced, expectedDirection: DirectionProxy},
+		{name: "Error", first: relayResult{fromClient: true, err: errors.New("tls: bad record MAC"), readErr: true}, expected: CloseError, expectedDirection: DirectionClient},
+		{name: "Force-closed", first: relayResult{err: net.ErrClosed}, forced: CloseForced, expected: CloseForced, expectedDirection: DirectionProxy},
+		{name: "Shutdown", first: relayResult{err: os.ErrDeadlineExceeded}, forced: CloseShutdown, expected: CloseShutdown, expectedDirection: DirectionProxy},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reason, direction := closeReason(tc.first, tc.forced)
+			assert.Equal(t, tc.expected, reason)
+			assert.Equal(t, tc.expectedDirection, direction)
+		})
+	}
+}
+
+// reset closes conn with an RST instead of a FIN.
+func reset(conn net.Conn) {
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+}
+
+// TestRelayCloseReasons ends relays over loopback TCP in each way and checks
+// the classified reason and direction in the access log.
+func TestRelayCloseReasons(t *testing.T) {
+	const sni = "relayclose.test"
+	testCases := []struct {
+		name              string
+		fromClient        bool
+		rst               bool
+		expected          string
+		expectedDirection string
+	}{
+		{name: "Client EOF", fromClient: true, expected: CloseClientEOF, expectedDirection: DirectionClient},
+		{name: "Upstream EOF", expected: CloseUpstreamEOF, expectedDirection: DirectionUpstream},
+		{name: "Client reset", fromClient: true, rst: true, expected: CloseClientReset, expectedDirection: DirectionClient},
+		{name: "Upstream reset", rst: true, expected: CloseUpstreamReset, expectedDirection: DirectionUpstream},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+			signalUpstreams[sni] = ln.Addr().String()
+			defer delete(signalUpstreams, sni)
+
+			client, serverConn := tcpPair(t)
+			logs := &lockedBuffer{}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newTestHandler(&config.Config{LogFormat: config.LogFormatJSON}, log.New(logs, "", 0)).Serve(serverConn, NewConnID())
+			}()
+
+			_, err = client.Write(buildTestClientHello(t, sni))
+			require.NoError(t, err)
+			upstream, err := ln.Accept()
+			require.NoError(t, err)
+			defer upstream.Close()
+			// Wait for the ClientHello, so that the relay is running
+			_, err = io.ReadFull(upstream, make([]byte, len(buildTestClientHello(t, sni))))
+			require.NoError(t, err)
+
+			before := stats.Default.Get("relay_closed:" + tc.expectedDirection + ":" + tc.expected)
+			// End one side, then close the other once the proxy passed the end on
+			ending, other := upstream, client
+			if tc.fromClient {
+				ending, other = client, upstream
+			}
+			if tc.rst {
+				reset(ending)
+			} else {
+				ending.Close()
+			}
+			other.SetReadDeadline(time.Now().Add(2 * time.Second))
+			io.Copy(io.Discard, other)
+			other.Close()
+
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Serve did not return")
+			}
+
+			var rec accessRecord
+			lines := logs.Lines()
+			require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &rec))
+			assert.Equal(t, tc.expected, rec.Reason)
+			assert.Equal(t, tc.expectedDirection, rec.Direction)
+			assert.Equal(t, before+1, stats.Default.Get("relay_closed:"+tc.expectedDirection+":"+tc.expected))
+		})
+	}
+}
+
+// TestAccessLogJSON checks the JSON access log record of a proxied connection.
+func TestAccessLogJSON(t *testing.T) {
+	const sni = "accesslog.test"
+	upstream := startTestUpstream(t, sni)
+
+	logs := &lockedBuffer{}
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestHandler(&config.Config{LogFormat: config.LogFormatJSON}, log.New(logs, "", 0)).Serve(serverConn, "0000abcd")
+	}()
+
+	hello := buildTestClientHello(t, sni)
+	_, err := clientConn.Write(append(append([]byte{}, hello...), "ping"...))
+	require.NoError(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(clientConn, make([]byte, len(hello)+4))
+	require.NoError(t, err)
+	clientConn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after the client closed")
+	}
+
+	var rec accessRecord
+	lines := logs.Lines()
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &rec))
+	assert.Equal(t, "0000abcd", rec.ID)
+	assert.Equal(t, sni, rec.SNI)
+	assert.Equal(t, upstream.Addr().String(), rec.Upstream)
+	assert.Equal(t, int64(len(hello)+4), rec.BytesIn)
+	assert.Equal(t, int64(len(hello)+4), rec.BytesOut)
+	assert.Equal(t, CloseClientEOF, rec.Reason)
+	assert.Empty(t, rec.Error)
+}
+
+// countryMap is a config.CountryLookup from a fixed map.
+type countryMap map[netip.Addr]string
+
+func (m countryMap) Country(addr netip.Addr) string {
+	if country, ok := m[addr]; ok {
+		return country
+	}
+	return "??"
+}
+
+// addrConn is a connection with the given remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// TestAccessLogCountry checks that the country of the client tags the log
+// lines and the access log record of its connection, and is counted.
+func TestAccessLogCountry(t *testing.T) {
+	const sni = "country.test"
+	startTestUpstream(t, sni)
+	cfg := &config.Config{
+		LogFormat: config.LogFormatJSON,
+		GeoIP:     countryMap{netip.MustParseAddr("192.0.2.1"): "DE"},
+	}
+
+	testCases := []struct {
+		name     string
+		remote   net.Addr
+		expected string
+	}{
+		{name: "Known", remote: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 54321}, expected: "DE"},
+		{name: "Unknown", remote: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, expected: "??"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := stats.Default.Get("country:" + tc.expected)
+			logs := &lockedBuffer{}
+			clientConn, serverConn := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newTestHandler(cfg, log.New(logs, "", 0)).Serve(addrConn{serverConn, tc.remote}, NewConnID())
+			}()
+
+			hello := buildTestClientHello(t, sni)
+			_, err := clientConn.Write(hello)
+			require.NoError(t, err)
+			clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = io.ReadFull(clientConn, make([]byte, len(hello)))
+			require.NoError(t, err)
+			clientConn.Close()
+			<-done
+
+			lines := logs.Lines()
+			var rec accessRecord
+			require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &rec))
+			assert.Equal(t, tc.expected, rec.Country)
+			for _, line := range lines[:len(lines)-1] {
+				assert.Contains(t, line, "] ["+tc.expected+"] ", "every line follows the connection ID with the country")
+			}
+			assert.Equal(t, before+1, stats.Default.Get("country:"+tc.expected))
+		})
+	}
+}
+
+// TestUnknownSNIAction checks what a client with an unrouted inner SNI sees
+// under each unknown SNI action, and that the action is access-logged.
+func TestUnknownSNIAction(t *testing.T) {
+	decoy := startTestUpstream(t, "decoy.test")
+
+	testCases := []struct {
+		name             string
+		serverName       string
+		action           config.UnknownSNIAction
+		expectedUpstream string
+		expectedAction   string
+		expectedReason   string
+	}{
+		{name: "Drop by default", serverName: "unknown.test", expectedAction: "drop", expectedReason: CloseDenied},
+		{name: "Forward", serverName: "unknown.test", action: config.UnknownSNIForward, expectedUpstream: decoy.Addr().String(), expectedAction: "forward", expectedReason: CloseClientEOF},
+		{name: "Stealth", serverName: "Example.com", action: config.UnknownSNIStealth, expectedAction: "stealth", expectedReason: CloseServed},
+		{name: "Stealth for a foreign domain drops", serverName: "unknown.test", action: config.UnknownSNIStealth, expectedAction: "drop", expectedReason: CloseDenied},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := &lockedBuffer{}
+			cfg := &config.Config{
+				Domain:            "example.com",
+				StealthMode:       config.StealthNginx,
+				UnknownSNIAction:  tc.action,
+				UnknownSNIForward: decoy.Addr().String(),
+				InnerTLS:          testutil.TLSConfig(t, "example.com"),
+				LogFormat:         config.LogFormatJSON,
+			}
+			clientConn, serverConn := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newTestHandler(cfg, log.New(logs, "", 0)).Serve(serverConn, NewConnID())
+			}()
+			clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			switch tc.expectedAction {
+			case "stealth":
+				innerConn := tls.Client(clientConn, &tls.Config{ServerName: tc.serverName, InsecureSkipVerify: true})
+				require.NoError(t, innerConn.Handshake())
+				// Pipes do not buffer, and the page is written once the request is read.
+				go innerConn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				resp, err := http.ReadResponse(bufio.NewReader(innerConn), nil)
+				require.NoError(t, err)
+				assert.Equal(t, stealth.ServerVersion(stealth.NginxServer, "example.com"), resp.Header.Get("Server"))
+				resp.Body.Close()
+			case "forward":
+				// The decoy echoes the raw inner ClientHello.
+				hello := buildTestClientHello(t, tc.serverName)
+				_, err := clientConn.Write(hello)
+				require.NoError(t, err)
+				_, err = io.ReadFull(clientConn, make([]byte, len(hello)))
+				require.NoError(t, err)
+			default:
+				_, err := clientConn.Write(buildTestClientHello(t, tc.serverName))
+				require.NoError(t, err)
+				n, err := clientConn.Read(make([]byte, 1))
+				assert.Zero(t, n)
+				assert.ErrorIs(t, err, io.EOF)
+			}
+			clientConn.Close()
+			<-done
+
+			var rec accessRecord
+			lines := logs.Lines()
+			require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &rec))
+			assert.Equal(t, tc.serverName, rec.SNI)
+			assert.Equal(t, tc.expectedUpstream, rec.Upstream)
+			assert.Equal(t, tc.expectedAction, rec.Action)
+			assert.Equal(t, tc.expectedReason, rec.Reason)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// authFreeGuesses is the number of credentials a source may present to
+	// the protected paths within authGuessWindow before its answers are
+	// delayed by -stealth-auth-delay.
+	authFreeGuesses = 3
+	// authGuessWindow is the time over which guesses are counted.
+	authGuessWindow = 10 * time.Minute
+	// maxAuthSources bounds the number of sources tracked; the least recently
+	// guessing ones are forgotten first.
+	maxAuthSources = 10000
+)
+
+// authGuesses counts the credentials presented to the protected paths of the
+// stealth personas by each source.
+var authGuesses = newSourceCounter(authGuessWindow, maxAuthSources)
+
+// sourceEntry holds the count of one source since start.
+type sourceEntry struct {
+	source string
+	count  int
+	start  time.Time
+}
+
+// sourceCounter counts events of sources, keyed by SourceKey, within fixed
+// windows. It tracks at most a fixed number of sources, evicting the least
+// recently counted one first. It is safe for concurrent use.
+type sourceCounter struct {
+	window     time.Duration
+	maxSources int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	sources map[string]*list.Element
+	lru     *list.List // Of *sourceEntry, most recently counted first
+}
+
+// newSourceCounter creates a counter of the events within window, tracking at
+// most maxSources sources.
+func newSourceCounter(window time.Duration, maxSources int) *sourceCounter {
+	return &sourceCounter{
+		window:     window,
+		maxSources: maxSources,
+		now:        time.Now,
+		sources:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// add adds n to the count of source and returns its count in the current
+// window, n included. Adding 0 reads the count without tracking the source.
+func (c *sourceCounter) add(source string, n int) int {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.sources[source]
+	if !ok {
+		if n == 0 {
+			return 0
+		}
+		elem = c.lru.PushFront(&sourceEntry{source: source, start: now})
+		c.sources[source] = elem
+		if c.lru.Len() > c.maxSources {
+			oldest := c.lru.Remove(c.lru.Back()).(*sourceEntry)
+			delete(c.sources, oldest.source)
+		}
+	}
+	c.lru.MoveToFront(elem)
+	e := elem.Value.(*sourceEntry)
+	if now.Sub(e.start) >= c.window {
+		e.count = 0
+		e.start = now
+	}
+	e.count += n
+	return e.count
+}
+
+// authPath reports whether urlPath is under one of the -stealth-auth-paths
+// prefixes, matched like the prefix locations of nginx.
+func authPath(urlPath string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
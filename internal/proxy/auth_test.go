@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAuthPath tests matching request paths against the -stealth-auth-paths
+// prefixes.
+func TestAuthPath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		prefixes []string
+		expected bool
+	}{
+		{path: "/admin", prefixes: []string{"/admin"}, expected: true},
+		{path: "/admin/login.php", prefixes: []string{"/admin"}, expected: true},
+		{path: "/administrator/", prefixes: []string{"/admin"}, expected: true},
+		{path: "/phpmyadmin/index.php", prefixes: []string{"/admin", "/phpmyadmin/"}, expected: true},
+		{path: "/phpmyadmin", prefixes: []string{"/phpmyadmin/"}},
+		{path: "/blog/admin", prefixes: []string{"/admin"}},
+		{path: "/admin", prefixes: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			assert.Equal(t, tc.expected, authPath(tc.path, tc.prefixes))
+		})
+	}
+}
+
+// TestSourceCounter checks that events are counted per source within the
+// window, and start over after it.
+func TestSourceCounter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	counter := newSourceCounter(10*time.Minute, 100)
+	counter.now = func() time.Time { return now }
+	source, other := "192.0.2.1", "192.0.2.2"
+
+	for i := 1; i <= 5; i++ {
+		assert.Equal(t, i, counter.add(source, 1))
+		now = now.Add(time.Minute)
+	}
+	assert.Equal(t, 5, counter.add(source, 0))
+	assert.Equal(t, 2, counter.add(other, 2))
+	assert.Equal(t, 0, counter.add("192.0.2.3", 0))
+	assert.Len(t, counter.sources, 2)
+
+	now = now.Add(5 * time.Minute)
+	assert.Equal(t, 0, counter.add(source, 0))
+	assert.Equal(t, 1, counter.add(source, 1))
+	assert.Equal(t, 2, counter.add(source, 1))
+}
+
+// TestSourceCounterEviction checks that the least recently counted source is
+// forgotten when the counter is full.
+func TestSourceCounterEviction(t *testing.T) {
+	counter := newSourceCounter(10*time.Minute, 2)
+	counter.add("192.0.2.1", 1)
+	counter.add("192.0.2.2", 1)
+	counter.add("192.0.2.1", 1)
+	counter.add("192.0.2.3", 1)
+
+	assert.Equal(t, 3, counter.add("192.0.2.1", 1))
+	assert.Equal(t, 1, counter.add("192.0.2.2", 1))
+	assert.Len(t, counter.sources, 2)
+}
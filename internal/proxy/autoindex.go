@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stealth"
+)
+
+// autoindexFiles returns the fake tree listed by the autoindex persona: that
+// of -stealth-autoindex-files, or the one generated from the domain if it is
+// not set or cannot be loaded.
+func autoindexFiles(cfg *config.Config, logger *log.Logger) []stealth.FakeFile {
+	if cfg.StealthAutoindexFiles == "" {
+		return stealth.GenerateFakeFiles(cfg.Domain)
+	}
+	// Read on every request, like the robots.txt file
+	data, err := os.ReadFile(cfg.StealthAutoindexFiles)
+	if err != nil {
+		logger.Printf("Failed to read autoindex files %s: %v", cfg.StealthAutoindexFiles, err)
+		return stealth.GenerateFakeFiles(cfg.Domain)
+	}
+	var files []stealth.FakeFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		logger.Printf("Failed to parse autoindex files %s: %v", cfg.StealthAutoindexFiles, err)
+		return stealth.GenerateFakeFiles(cfg.Domain)
+	}
+	return files
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stealth"
+)
+
+// TestAutoindexFiles checks the fake tree of every -stealth-autoindex-files
+// choice, falling back to the generated one.
+func TestAutoindexFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "files.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"path": "pub/notes.txt", "size": 42, "modified": "2024-05-06T07:08:09Z"}]`), 0600))
+	malformed := filepath.Join(dir, "malformed.json")
+	require.NoError(t, os.WriteFile(malformed, []byte(`{"path": "pub/notes.txt"`), 0600))
+	generated := stealth.GenerateFakeFiles("example.com")
+
+	testCases := []struct {
+		name          string
+		files         string
+		expectedFiles []stealth.FakeFile
+	}{
+		{name: "Default", expectedFiles: generated},
+		{
+			name:          "File",
+			files:         path,
+			expectedFiles: []stealth.FakeFile{{Path: "pub/notes.txt", Size: 42, Modified: time.Date(2024, time.May, 6, 7, 8, 9, 0, time.UTC)}},
+		},
+		{name: "Missing file", files: filepath.Join(dir, "missing.json"), expectedFiles: generated},
+		{name: "Malformed file", files: malformed, expectedFiles: generated},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{Domain: "example.com", StealthAutoindexFiles: tc.files}
+			assert.Equal(t, tc.expectedFiles, autoindexFiles(cfg, log.New(io.Discard, "", 0)))
+		})
+	}
+}
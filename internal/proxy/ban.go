@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+const (
+	// banThreshold is the number of offenses within banWindow that bans a source.
+	banThreshold = 20
+	// banWindow is the time over which offenses are counted.
+	banWindow = 10 * time.Minute
+	// maxBanSources bounds the number of sources tracked; the least recently
+	// offending ones are forgotten first.
+	maxBanSources = 10000
+)
+
+// Offense reasons, recorded with the ban they led to.
+const (
+	OffenseClientHelloTooLarge = "client_hello_too_large"
+	OffenseUnparsableHello     = "unparsable_client_hello"
+	OffenseDenylistedSNI       = "denylisted_sni"
+	OffenseUnknownSNI          = "unknown_sni"
+)
+
+// Bans tracks the sources that repeatedly send unknown inner SNIs or
+// unparsable ClientHellos, and bans them when -ban-duration is set.
+var Bans = NewBanList(banThreshold, banWindow, maxBanSources)
+
+// BanInfo describes an active ban. IP is the banned source, an IPv6 prefix
+// unless -ban-ipv6-prefix is 128. Reason is the offense that led to the ban.
+type BanInfo struct {
+	IP               string    `json:"ip"`
+	Reason           string    `json:"reason,omitempty"`
+	Until            time.Time `json:"until"`
+	RemainingSeconds int64     `json:"remaining_seconds"`
+}
+
+// savedBan is a ban in the file of -ban-file.
+type savedBan struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason,omitempty"`
+	Until  time.Time `json:"until"`
+}
+
+// banEntry holds the offenses of one source. Its score decays linearly by
+// the threshold per window, so that a source is banned once it offends more
+// than threshold times within a window.
+type banEntry struct {
+	ip          string
+	score       float64
+	updated     time.Time
+	bannedUntil time.Time
+	reason      string
+}
+
+// BanList counts the offenses of sources, keyed by SourceKey, and bans the
+// worst ones. It tracks at most a fixed number of sources, evicting the least
+// recently offending one first. It is safe for concurrent use.
+type BanList struct {
+	threshold  int
+	window     time.Duration
+	maxSources int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	sources map[string]*list.Element
+	lru     *list.List // Of *banEntry, most recent offense first
+
+	// saveMu orders the saves, so that an older state never replaces a newer one
+	saveMu sync.Mutex
+}
+
+// NewBanList creates a list banning sources after threshold offenses within
+// window, tracking at most maxSources sources.
+func NewBanList(threshold int, window time.Duration, maxSources int) *BanList {
+	return &BanList{
+		threshold:  threshold,
+		window:     window,
+		maxSources: maxSources,
+		now:        time.Now,
+		sources:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Offend records an offense of source for reason, and bans it for duration if
+// it crossed the threshold. It reports whether the source was banned.
+func (b *BanList) Offend(source, reason string, duration time.Duration, logger *log.Logger) bool {
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var e *banEntry
+	if elem, ok := b.sources[source]; ok {
+		b.lru.MoveToFront(elem)
+		e = elem.Value.(*banEntry)
+	} else {
+		e = &banEntry{ip: source, updated: now}
+		b.sources[source] = b.lru.PushFront(e)
+		if b.lru.Len() > b.maxSources {
+			oldest := b.lru.Remove(b.lru.Back()).(*banEntry)
+			delete(b.sources, oldest.ip)
+		}
+	}
+	if now.Before(e.bannedUntil) {
+		return false
+	}
+
+	decay := now.Sub(e.updated).Seconds() / b.window.Seconds() * float64(b.threshold)
+	e.score = max(0, e.score-decay) + 1
+	e.updated = now
+	if e.score < float64(b.threshold) {
+		return false
+	}
+
+	e.score = 0
+	e.bannedUntil = now.Add(duration)
+	e.reason = reason
+	logger.Printf("Banned %s for %s after %d unknown inner SNIs or unparsable ClientHellos within %s, the last one: %s", source, duration, b.threshold, b.window, reason)
+	stats.Inc("sources_banned")
+	return true
+}
+
+// Banned reports whether source is banned.
+func (b *BanList) Banned(source string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elem, ok := b.sources[source]
+	return ok && b.now().Before(elem.Value.(*banEntry).bannedUntil)
+}
+
+// List returns the active bans, sorted by IP.
+func (b *BanList) List() []BanInfo {
+	now := b.now()
+
+	b.mu.Lock()
+	bans := make([]BanInfo, 0)
+	for _, elem := range b.sources {
+		e := elem.Value.(*banEntry)
+		if now.Before(e.bannedUntil) {
+			bans = append(bans, BanInfo{
+				IP:               e.ip,
+				Reason:           e.reason,
+				Until:            e.bannedUntil,
+				RemainingSeconds: int64(e.bannedUntil.Sub(now).Seconds()),
+			})
+		}
+	}
+	b.mu.Unlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Unban lifts the ban of source, and forgets its offenses. It reports whether
+// source was banned.
+func (b *BanList) Unban(source string) bool {
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elem, ok := b.sources[source]
+	if !ok {
+		return false
+	}
+	b.lru.Remove(elem)
+	delete(b.sources, source)
+	return now.Before(elem.Value.(*banEntry).bannedUntil)
+}
+
+// Clear lifts all bans, and forgets all offenses. It returns the number of
+// bans lifted.
+func (b *BanList) Clear() int {
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, elem := range b.sources {
+		if now.Before(elem.Value.(*banEntry).bannedUntil) {
+			n++
+		}
+	}
+	b.sources = make(map[string]*list.Element)
+	b.lru.Init()
+	return n
+}
+
+// Save replaces the file at path with the active bans, as JSON. Offenses
+// below the threshold are not saved.
+func (b *BanList) Save(path string) error {
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+
+	bans := b.List()
+	saved := make([]savedBan, len(bans))
+	for i, ban := range bans {
+		saved[i] = savedBan{IP: ban.IP, Reason: ban.Reason, Until: ban.Until}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// Load restores the bans saved to the file at path by Save, skipping expired
+// ones, and returns the number of bans restored. A missing file restores
+// nothing. A ban already in the list is kept if it lasts longer.
+func (b *BanList) Load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var saved []savedBan
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, fmt.Errorf("invalid ban file %s: %w", path, err)
+	}
+
+	now := b.now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	restored := 0
+	for _, ban := range saved {
+		if ban.IP == "" || !now.Before(ban.Until) {
+			continue
+		}
+		if elem, ok := b.sources[ban.IP]; ok {
+			e := elem.Value.(*banEntry)
+			if ban.Until.After(e.bannedUntil) {
+				e.bannedUntil, e.reason = ban.Until, ban.Reason
+			}
+			restored++
+			continue
+		}
+		if b.lru.Len() >= b.maxSources {
+			break
+		}
+		e := &banEntry{ip: ban.IP, updated: now, bannedUntil: ban.Until, reason: ban.Reason}
+		b.sources[ban.IP] = b.lru.PushBack(e)
+		restored++
+	}
+	return restored, nil
+}
+
+// offend records an offense of conn's source for reason in Bans, if bans are
+// enabled.
+func offend(conn net.Conn, reason string, cfg *config.Config, logger *log.Logger) {
+	if cfg.BanDuration > 0 {
+		Bans.Offend(SourceKey(conn.RemoteAddr(), cfg), reason, cfg.BanDuration, logger)
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBanList checks that a source is banned after the threshold of offenses
+// within the window, for the ban duration.
+func TestBanList(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	bans := NewBanList(5, 10*time.Minute, 100)
+	bans.now = func() time.Time { return now }
+	logger := log.New(io.Discard, "", 0)
+	source, other := "192.0.2.1", "192.0.2.2"
+
+	for i := 0; i < 4; i++ {
+		assert.False(t, bans.Offend(source, OffenseUnknownSNI, time.Hour, logger))
+	}
+	assert.False(t, bans.Banned(source))
+	assert.Empty(t, bans.List())
+
+	// The ban applies to no other source
+	assert.True(t, bans.Offend(source, OffenseUnknownSNI, time.Hour, logger))
+	assert.True(t, bans.Banned(source))
+	assert.False(t, bans.Banned(other))
+
+	now = now.Add(15 * time.Minute)
+	assert.Equal(t, []BanInfo{{IP: "192.0.2.1", Reason: OffenseUnknownSNI, Until: now.Add(45 * time.Minute), RemainingSeconds: 45 * 60}}, bans.List())
+
+	// Offenses while banned do not extend the ban
+	assert.False(t, bans.Offend(source, OffenseUnknownSNI, time.Hour, logger))
+	now = now.Add(45 * time.Minute)
+	assert.False(t, bans.Banned(source))
+	assert.Empty(t, bans.List())
+}
+
+// TestBanListDecay checks that offenses spread out over more than the window
+// never ban a source.
+func TestBanListDecay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	bans := NewBanList(5, 10*time.Minute, 100)
+	bans.now = func() time.Time { return now }
+	logger := log.New(io.Discard, "", 0)
+	source := "192.0.2.1"
+
+	// One offense every three minutes is below 5 per 10 minutes
+	for i := 0; i < 50; i++ {
+		require.False(t, bans.Offend(source, OffenseUnknownSNI, time.Hour, logger))
+		now = now.Add(3 * time.Minute)
+	}
+
+	// A burst on top of the remaining score bans the source
+	banned := false
+	for i := 0; i < 5 && !banned; i++ {
+		banned = bans.Offend(source, OffenseUnknownSNI, time.Hour, logger)
+	}
+	assert.True(t, banned)
+}
+
+// TestBanListEviction checks that the least recently offending source is
+// forgotten once the list is full.
+func TestBanListEviction(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	bans := NewBanList(2, 10*time.Minute, 2)
+	bans.now = func() time.Time { return now }
+	logger := log.New(io.Discard, "", 0)
+	addr := func(i int) string { return fmt.Sprintf("192.0.2.%d", i) }
+
+	bans.Offend(addr(1), OffenseUnknownSNI, time.Hour, logger)
+	bans.Offend(addr(2), OffenseUnknownSNI, time.Hour, logger)
+	bans.Offend(addr(1), OffenseUnknownSNI, time.Hour, logger) // Banned, and now the most recent
+	bans.Offend(addr(3), OffenseUnknownSNI, time.Hour, logger) // Evicts 192.0.2.2
+
+	assert.Len(t, bans.sources, 2)
+	assert.NotContains(t, bans.sources, "192.0.2.2")
+	assert.True(t, bans.Banned(addr(1)))
+
+	// The evicted source starts over
+	assert.False(t, bans.Offend(addr(2), OffenseUnknownSNI, time.Hour, logger))
+	assert.NotContains(t, bans.sources, "192.0.2.1")
+}
+
+// TestBanListUnban checks that lifted bans are forgotten with their offenses.
+func TestBanListUnban(t *testing.T) {
+	bans := NewBanList(1, 10*time.Minute, 100)
+	logger := log.New(io.Discard, "", 0)
+	bans.Offend("192.0.2.1", OffenseUnknownSNI, time.Hour, logger)
+	bans.Offend("2001:db8::/64", OffenseDenylistedSNI, time.Hour, logger)
+
+	assert.True(t, bans.Unban("2001:db8::/64"))
+	assert.False(t, bans.Banned("2001:db8::/64"))
+	assert.False(t, bans.Unban("2001:db8::/64"))
+	assert.Len(t, bans.List(), 1)
+
+	assert.Equal(t, 1, bans.Clear())
+	assert.Empty(t, bans.List())
+	assert.Empty(t, bans.sources)
+}
+
+// TestBanListSaveLoad checks that saved bans are restored with their reason
+// and expiry, except for expired ones.
+func TestBanListSaveLoad(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	path := filepath.Join(t.TempDir(), "bans.json")
+	logger := log.New(io.Discard, "", 0)
+
+	bans := NewBanList(1, 10*time.Minute, 100)
+	bans.now = func() time.Time { return now }
+	bans.Offend("192.0.2.1", OffenseUnparsableHello, time.Hour, logger)
+	bans.Offend("2001:db8::/64", OffenseUnknownSNI, 10*time.Minute, logger)
+	require.NoError(t, bans.Save(path))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// After the restart, the shorter ban has expired
+	restarted := NewBanList(1, 10*time.Minute, 100)
+	restarted.now = func() time.Time { return now.Add(30 * time.Minute) }
+	n, err := restarted.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	restored := restarted.List()
+	require.Len(t, restored, 1)
+	assert.Equal(t, "192.0.2.1", restored[0].IP)
+	assert.Equal(t, OffenseUnparsableHello, restored[0].Reason)
+	assert.True(t, restored[0].Until.Equal(now.Add(time.Hour)))
+	assert.Equal(t, int64(30*60), restored[0].RemainingSeconds)
+	assert.True(t, restarted.Banned("192.0.2.1"))
+	assert.False(t, restarted.Banned("2001:db8::/64"))
+}
+
+// TestBanListLoadErrors checks that a missing ban file restores nothing, and
+// that a corrupt one fails without restoring anything.
+func TestBanListLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	bans := NewBanList(1, 10*time.Minute, 100)
+
+	n, err := bans.Load(filepath.Join(dir, "missing.json"))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	path := filepath.Join(dir, "bans.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"ip": "192.0.2.1", "until": `), 0o600))
+	n, err = bans.Load(path)
+	assert.ErrorContains(t, err, "invalid ban file")
+	assert.Zero(t, n)
+	assert.Empty(t, bans.List())
+}
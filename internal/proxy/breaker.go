@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/stats"
+)
+
+const (
+	// breakerFailures is the number of consecutive dial failures of an upstream
+	// that opens its circuit.
+	breakerFailures = 5
+	// breakerWindow is the time within which the failures must occur.
+	breakerWindow = time.Minute
+	// breakerCooldown is how long an open circuit fails connections immediately
+	// before a probe connection is allowed.
+	breakerCooldown = 30 * time.Second
+	// maxBreakers bounds the number of upstreams with a breaker. Further
+	// upstreams are dialed without one until older entries expire.
+	maxBreakers = 256
+)
+
+// errCircuitOpen is returned for connections to an upstream whose circuit is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Connections are dialed
+	breakerOpen                         // Connections fail immediately
+	breakerHalfOpen                     // One probe connection is being dialed
+)
+
+// String returns the name of the state used in the admin output.
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker is the state of the circuit of one upstream.
+type circuitBreaker struct {
+	state        breakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+}
+
+// BreakerStatus is a point-in-time view of the circuit breaker of an upstream.
+type BreakerStatus struct {
+	Addr     string    `json:"addr"`
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+}
+
+// breakerSet holds the circuit breakers of all upstreams. Upstreams without
+// recent failures have no entry, and closed circuits are dropped once their
+// failures are older than window. It is safe for concurrent use; a nil set
+// allows every connection.
+type breakerSet struct {
+	failures int
+	window   time.Duration
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+// upstreamBreakers guards the connections to every upstream.
+var upstreamBreakers = newBreakerSet(breakerFailures, breakerWindow, breakerCooldown)
+
+// CircuitBreakers returns the circuit breakers of upstreams with recent dial
+// failures, for the admin output.
+func CircuitBreakers() []BreakerStatus {
+	return upstreamBreakers.Snapshot()
+}
+
+// newBreakerSet creates breakers that open after failures consecutive failures
+// within window, and allow a probe after cooldown.
+func newBreakerSet(failures int, window, cooldown time.Duration) *breakerSet {
+	return &breakerSet{
+		failures: failures,
+		window:   window,
+		cooldown: cooldown,
+		now:      time.Now,
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
+
+// allow returns errCircuitOpen if a connection to addr must fail immediately.
+// Once the cool-down of an open circuit has passed, a single caller is let
+// through as the probe, and must report its result with record.
+func (s *breakerSet) allow(addr string, logger *log.Logger) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.breakers[addr]
+	if !ok {
+		return nil
+	}
+	switch b.state {
+	case breakerOpen:
+		if s.now().Sub(b.openedAt) >= s.cooldown {
+			b.state = breakerHalfOpen
+			logger.Printf("Circuit half-open for upstream %s, probing it with the next connection", addr)
+			return nil
+		}
+	case breakerHalfOpen:
+	default:
+		return nil
+	}
+	stats.Inc("upstream_circuit_rejected")
+	return errCircuitOpen
+}
+
+// record reports the result of a connection to addr that allow let through.
+func (s *breakerSet) record(addr string, err error, logger *log.Logger) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.breakers[addr]
+	if err == nil {
+		if ok && b.state == breakerHalfOpen {
+			logger.Printf("Circuit closed for upstream %s, the probe connection succeeded", addr)
+		}
+		delete(s.breakers, addr)
+		return
+	}
+
+	now := s.now()
+	if !ok {
+		s.expireLocked(now)
+		if len(s.breakers) >= maxBreakers {
+			return
+		}
+		b = &circuitBreaker{}
+		s.breakers[addr] = b
+	}
+	switch {
+	case b.state == breakerHalfOpen:
+		b.state = breakerOpen
+		b.openedAt = now
+		logger.Printf("Circuit open again for upstream %s, the probe connection failed: %v", addr, err)
+		return
+	case b.state == breakerOpen:
+		return
+	case b.failures == 0 || now.Sub(b.firstFailure) > s.window:
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= s.failures {
+		b.state = breakerOpen
+		b.openedAt = now
+		logger.Printf("Circuit open for upstream %s after %d consecutive dial failures, failing connections for %s", addr, b.failures, s.cooldown)
+		stats.Inc("upstream_circuit_opened")
+	}
+}
+
+// expireLocked drops the closed circuits whose failures are older than the
+// window, so that upstreams that failed a few times and were not dialed again
+// are not kept. s.mu must be held.
+func (s *breakerSet) expireLocked(now time.Time) {
+	for addr, b := range s.breakers {
+		if b.state == breakerClosed && now.Sub(b.firstFailure) > s.window {
+			delete(s.breakers, addr)
+		}
+	}
+}
+
+// Snapshot returns the breakers of upstreams with recent failures, sorted by address.
+func (s *breakerSet) Snapshot() []BreakerStatus {
+	s.mu.Lock()
+	s.expireLocked(s.now())
+	snapshot := make([]BreakerStatus, 0, len(s.breakers))
+	for addr, b := range s.breakers {
+		snapshot = append(snapshot, BreakerStatus{
+			Addr:     addr,
+			State:    b.state.String(),
+			Failures: b.failures,
+			OpenedAt: b.openedAt,
+		})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Addr < snapshot[j].Addr
+	})
+	return snapshot
+}
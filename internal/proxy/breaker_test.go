@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCircuitBreaker drives the breaker of an upstream through open, half-open
+// and closed with a fake dialer and clock.
+func TestCircuitBreaker(t *testing.T) {
+	const addr = "chat.signal.org:443"
+	now := time.Unix(1700000000, 0)
+	breakers := newBreakerSet(3, time.Minute, 30*time.Second)
+	breakers.now = func() time.Time { return now }
+
+	dialer := &fakeDialer{up: make(map[string]bool)}
+	d := &upstreamDialer{
+		dialContext:  dialer.dialContext,
+		cache:        newDNSCache((&fakeResolver{ips: []net.IP{net.ParseIP("192.0.2.1")}}).lookupIP),
+		cacheTTL:     time.Minute,
+		attemptDelay: time.Second,
+		retryBackoff: time.Millisecond,
+		breakers:     breakers,
+	}
+	logger := log.New(io.Discard, "", 0)
+	connect := func() error {
+		conn, err := d.connect(context.Background(), addr, nil, logger)
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+	state := func() string {
+		snapshot := breakers.Snapshot()
+		if len(snapshot) == 0 {
+			return "closed"
+		}
+		require.Len(t, snapshot, 1)
+		return snapshot[0].State
+	}
+
+	// Closed: failures are dialed until the threshold opens the circuit
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "closed", state())
+		require.Error(t, connect())
+		now = now.Add(time.Second)
+	}
+	assert.Equal(t, "open", state())
+
+	// Open: connections fail without dialing
+	attempts := len(dialer.attempted())
+	assert.ErrorIs(t, connect(), errCircuitOpen)
+	assert.Len(t, dialer.attempted(), attempts)
+
+	// Half-open: after the cool-down a failed probe opens the circuit again
+	now = now.Add(30 * time.Second)
+	require.Error(t, connect())
+	assert.Greater(t, len(dialer.attempted()), attempts)
+	assert.Equal(t, "open", state())
+	assert.ErrorIs(t, connect(), errCircuitOpen)
+
+	// Only one probe is let through while it is being dialed
+	now = now.Add(30 * time.Second)
+	require.NoError(t, breakers.allow(addr, logger))
+	assert.Equal(t, "half-open", state())
+	assert.ErrorIs(t, breakers.allow(addr, logger), errCircuitOpen)
+
+	// A successful probe closes the circuit
+	dialer.mu.Lock()
+	dialer.up["192.0.2.1:443"] = true
+	dialer.mu.Unlock()
+	breakers.record(addr, nil, logger)
+	assert.Equal(t, "closed", state())
+	assert.NoError(t, connect())
+}
+
+// TestCircuitBreakerWindow checks that only failures within the window count
+// towards opening the circuit, and that a success resets them.
+func TestCircuitBreakerWindow(t *testing.T) {
+	const addr = "chat.signal.org:443"
+	now := time.Unix(1700000000, 0)
+	breakers := newBreakerSet(3, time.Minute, 30*time.Second)
+	breakers.now = func() time.Time { return now }
+	logger := log.New(io.Discard, "", 0)
+	failure := assert.AnError
+
+	// Failures spread over more than the window never open it
+	for i := 0; i < 5; i++ {
+		breakers.record(addr, failure, logger)
+		now = now.Add(40 * time.Second)
+		assert.NoError(t, breakers.allow(addr, logger))
+	}
+
+	// A success in between resets the count
+	breakers.record(addr, failure, logger)
+	breakers.record(addr, failure, logger)
+	breakers.record(addr, nil, logger)
+	breakers.record(addr, failure, logger)
+	breakers.record(addr, failure, logger)
+	assert.NoError(t, breakers.allow(addr, logger))
+
+	breakers.record(addr, failure, logger)
+	assert.ErrorIs(t, breakers.allow(addr, logger), errCircuitOpen)
+
+	// Other upstreams are unaffected
+	assert.NoError(t, breakers.allow("cdn.signal.org:443", logger))
+}
+
+// TestCircuitBreakerExpiry checks that upstreams which failed without opening
+// their circuit are forgotten after the window, and that the number of
+// upstreams with a breaker is bounded.
+func TestCircuitBreakerExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	breakers := newBreakerSet(3, time.Minute, 30*time.Second)
+	breakers.now = func() time.Time { return now }
+	logger := log.New(io.Discard, "", 0)
+
+	breakers.record("a.signal.org:443", assert.AnError, logger)
+	for i := 0; i < 3; i++ {
+		breakers.record("b.signal.org:443", assert.AnError, logger)
+	}
+	require.Len(t, breakers.Snapshot(), 2)
+
+	// The open circuit stays, the closed one is dropped
+	now = now.Add(2 * time.Minute)
+	snapshot := breakers.Snapshot()
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, "b.signal.org:443", snapshot[0].Addr)
+
+	for i := 0; i < maxBreakers+10; i++ {
+		breakers.record(fmt.Sprintf("upstream%d.signal.org:443", i), assert.AnError, logger)
+	}
+	assert.Len(t, breakers.Snapshot(), maxBreakers)
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+const (
+	// maxDebugCaptures is the number of captures kept in the capture file. The
+	// oldest is dropped first.
+	maxDebugCaptures = 100
+	// captureWriteInterval is the minimum time between two writes of the
+	// capture file, so that a burst of failures rewrites it once.
+	captureWriteInterval = time.Second
+)
+
+// captureReader records the first bytes read through it, see -debug-capture.
+type captureReader struct {
+	r    io.Reader
+	max  int
+	data []byte
+}
+
+// newCaptureReader returns a reader of r recording its first bytes if
+// -debug-capture is enabled, or nil otherwise.
+func newCaptureReader(r io.Reader, cfg *config.Config) *captureReader {
+	if cfg.DebugCapturer == nil {
+		return nil
+	}
+	max := cfg.DebugCaptureBytes
+	if max <= 0 {
+		max = config.DefaultDebugCaptureBytes
+	}
+	return &captureReader{r: r, max: max}
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if room := c.max - len(c.data); room > 0 {
+		c.data = append(c.data, p[:min(n, room)]...)
+	}
+	return n, err
+}
+
+// save passes the recorded bytes of the connection tc, which failed with
+// cause, to the debug capturer. It does nothing if c is nil, or if nothing
+// was received, as from scanners that only connect.
+func (c *captureReader) save(tc *TrackedConn, cause error, cfg *config.Config) {
+	if c == nil || len(c.data) == 0 {
+		return
+	}
+	cfg.DebugCapturer.Capture(tc.ID, ClientAddr(tc.conn.RemoteAddr()), c.data, cause)
+	stats.Inc("debug_captures")
+}
+
+// captureEntry is one capture of a failed connection.
+type captureEntry struct {
+	time       time.Time
+	id         string
+	clientAddr string
+	data       []byte
+	err        string
+}
+
+// CaptureLog keeps the captures of the last maxDebugCaptures failed
+// connections, and writes them to a file as hex dumps, replacing its previous
+// content. It is safe for concurrent use.
+type CaptureLog struct {
+	path    string
+	pending chan struct{} // Signaled when entries changed since the last write
+
+	mu      sync.Mutex
+	entries []captureEntry // Oldest first
+}
+
+// NewCaptureLog creates a capture log writing to the file at path. The file is
+// written by Run.
+func NewCaptureLog(path string) *CaptureLog {
+	return &CaptureLog{
+		path:    path,
+		pending: make(chan struct{}, 1),
+	}
+}
+
+// Capture records the first bytes of the connection id from clientAddr, and
+// the error it failed with. data is copied.
+func (l *CaptureLog) Capture(id, clientAddr string, data []byte, err error) {
+	entry := captureEntry{time: time.Now(), id: id, clientAddr: clientAddr, data: bytes.Clone(data)}
+	if err != nil {
+		entry.err = err.Error()
+	}
+
+	l.mu.Lock()
+	if len(l.entries) == maxDebugCaptures {
+		copy(l.entries, l.entries[1:])
+		l.entries = l.entries[:len(l.entries)-1]
+	}
+	l.entries = append(l.entries, entry)
+	l.mu.Unlock()
+
+	select {
+	case l.pending <- struct{}{}:
+	default:
+	}
+}
+
+// Run writes the capture file whenever captures were added, at most once per
+// captureWriteInterval, until done is closed. Pending captures are written
+// before it returns.
+func (l *CaptureLog) Run(done <-chan struct{}, logger *log.Logger) {
+	defer func() {
+		select {
+		case <-l.pending:
+			l.writeLogged(logger)
+		default:
+		}
+	}()
+
+	for {
+		select {
+		case <-l.pending:
+			l.writeLogged(logger)
+		case <-done:
+			return
+		}
+
+		timer := time.NewTimer(captureWriteInterval)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// writeLogged writes the capture file, logging failures.
+func (l *CaptureLog) writeLogged(logger *log.Logger) {
+	if err := l.write(); err != nil {
+		logger.Printf("Failed to write debug captures to %s: %v", l.path, err)
+	}
+}
+
+// write replaces the capture file with the current captures. The file is
+// replaced atomically and readable by its owner only, since the captures may
+// hold inner SNIs.
+func (l *CaptureLog) write() error {
+	var b bytes.Buffer
+	l.mu.Lock()
+	for _, e := range l.entries {
+		fmt.Fprintf(&b, "=== Connection %s from %s at %s\n", e.id, e.clientAddr, e.time.UTC().Format(time.RFC3339Nano))
+		fmt.Fprintf(&b, "Error: %s\n", e.err)
+		fmt.Fprintf(&b, "First %d bytes:\n%s\n", len(e.data), hex.Dump(e.data))
+	}
+	l.mu.Unlock()
+
+	return writeFileAtomic(l.path, b.Bytes())
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// recordedCapture is a capture received by captureRecorder.
+type recordedCapture struct {
+	id   string
+	data []byte
+	err  error
+}
+
+// captureRecorder is a config.DebugCapturer keeping the captures in memory.
+type captureRecorder struct {
+	mu       sync.Mutex
+	captures []recordedCapture
+}
+
+func (r *captureRecorder) Capture(id, clientAddr string, data []byte, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.captures = append(r.captures, recordedCapture{id: id, data: append([]byte(nil), data...), err: err})
+}
+
+func (r *captureRecorder) get() []recordedCapture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.captures
+}
+
+// TestDebugCapture checks which failed connections are captured, and that
+// at most the configured number of bytes is kept.
+func TestDebugCapture(t *testing.T) {
+	hello := buildTestClientHello(t, "test.example.com")
+
+	testCases := []struct {
+		name         string
+		input        []byte
+		bytes        int
+		sniffTimeout time.Duration // The client waits for it instead of closing
+		expectedData []byte
+		expectedErr  error
+	}{
+		{name: "Truncated ClientHello", input: hello[:40], bytes: 16, expectedData: hello[:16], expectedErr: ErrTruncatedHello},
+		{name: "No SNI", input: buildTestClientHello(t, ""), expectedData: buildTestClientHello(t, ""), expectedErr: ErrNoSNI},
+		{name: "Sniffing timeout", input: []byte{0x16}, sniffTimeout: 50 * time.Millisecond, expectedData: []byte{0x16}, expectedErr: os.ErrDeadlineExceeded},
+		{name: "Nothing received"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &captureRecorder{}
+			cfg := &config.Config{DebugCapturer: recorder, DebugCaptureBytes: tc.bytes, SniffTimeout: tc.sniffTimeout}
+			clientConn, serverConn := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(serverConn, "0000abcd")
+			}()
+			clientConn.Write(tc.input)
+			if tc.sniffTimeout == 0 {
+				clientConn.Close()
+			}
+			<-done
+			clientConn.Close()
+
+			captures := recorder.get()
+			if tc.expectedData == nil {
+				assert.Empty(t, captures)
+				return
+			}
+			require.Len(t, captures, 1)
+			assert.Equal(t, "0000abcd", captures[0].id)
+			assert.Equal(t, tc.expectedData, captures[0].data)
+			assert.ErrorIs(t, captures[0].err, tc.expectedErr)
+		})
+	}
+}
+
+// TestCaptureLogWrite checks that the capture file keeps the last
+// maxDebugCaptures captures, readable by its owner only.
+func TestCaptureLogWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "captures.log")
+	captures := NewCaptureLog(path)
+	for i := range maxDebugCaptures + 5 {
+		captures.Capture(fmt.Sprintf("%08x", i), "192.0.2.1:54321", []byte("probe"), errors.New("not a TLS handshake"))
+	}
+	require.NoError(t, captures.write())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	content := string(data)
+	assert.Equal(t, maxDebugCaptures, strings.Count(content, "=== Connection "))
+	assert.NotContains(t, content, "=== Connection 00000004 ")
+	assert.Contains(t, content, "=== Connection 00000005 from 192.0.2.1:54321 at ")
+	assert.Contains(t, content, "Error: not a TLS handshake\nFirst 5 bytes:\n00000000  70 72 6f 62 65")
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "the temporary file must be removed")
+}
+
+// TestCaptureLogRun checks that captures are written in the background, and
+// that pending ones are written when it stops.
+func TestCaptureLogRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "captures.log")
+	captures := NewCaptureLog(path)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		captures.Run(done, log.New(io.Discard, "", 0))
+	}()
+
+	captures.Capture("00000001", "192.0.2.1:54321", []byte{0x16}, ErrTruncatedHello)
+	require.Eventually(t, func() bool {
+		data, _ := os.ReadFile(path)
+		return strings.Contains(string(data), "00000001")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Within the write interval, the capture waits for the next write
+	captures.Capture("00000002", "192.0.2.1:54321", []byte{0x16}, ErrTruncatedHello)
+	close(done)
+	<-stopped
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "00000002")
+}
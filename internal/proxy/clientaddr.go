@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+
+	"signalgoproxy/internal/config"
+)
+
+// parseClientAddr parses addr, usually the remote address of a connection,
+// into its canonical IP address and port. IPv4 addresses mapped into IPv6, as
+// accepted on dual-stack listeners, are unmapped so that an IPv4 client always
+// has the same address. The zone of a link-local IPv6 address is kept. ok is
+// false if addr holds no IP address; port is 0 if it holds no port.
+func parseClientAddr(addr net.Addr) (ip netip.Addr, port uint16, ok bool) {
+	if tcpAddr, isTCP := addr.(*net.TCPAddr); isTCP {
+		addrPort := tcpAddr.AddrPort()
+		ip, port = addrPort.Addr(), addrPort.Port()
+	} else if addrPort, err := netip.ParseAddrPort(addr.String()); err == nil {
+		ip, port = addrPort.Addr(), addrPort.Port()
+	} else if parsed, err := netip.ParseAddr(addr.String()); err == nil {
+		ip = parsed
+	}
+	if !ip.IsValid() {
+		return netip.Addr{}, 0, false
+	}
+	return ip.Unmap(), port, true
+}
+
+// ClientAddr returns the canonical form of the client address addr for logs,
+// such as 192.0.2.1:54321 for an IPv4-mapped address, or [2001:db8::1]:54321.
+// Addresses that are not IP addresses are returned unchanged.
+func ClientAddr(addr net.Addr) string {
+	ip, port, ok := parseClientAddr(addr)
+	switch {
+	case !ok:
+		return addr.String()
+	case port == 0:
+		return ip.String()
+	default:
+		return netip.AddrPortFrom(ip, port).String()
+	}
+}
+
+// clientIP returns the canonical IP address of addr, or the whole address if
+// it is not an IP address.
+func clientIP(addr net.Addr) string {
+	ip, _, ok := parseClientAddr(addr)
+	if !ok {
+		return addr.String()
+	}
+	return ip.String()
+}
+
+// SourceKey returns the key that the source of addr is counted and banned by:
+// its canonical IP address, or for IPv6 the prefix of -ban-ipv6-prefix bits
+// containing it, such as 2001:db8::/64, since a single client can use any
+// address of the prefix it was assigned.
+func SourceKey(addr net.Addr, cfg *config.Config) string {
+	ip, _, ok := parseClientAddr(addr)
+	if !ok {
+		return addr.String()
+	}
+	bits := cfg.BanIPv6Prefix
+	if bits == 0 {
+		bits = config.DefaultBanIPv6Prefix
+	}
+	if ip.Is4() || bits >= 128 {
+		return ip.String()
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return ip.String()
+	}
+	return prefix.String()
+}
+
+// clientCountry returns the country of the client at addr, looked up with
+// -geoip-db, or an empty string if no database is configured.
+func clientCountry(addr net.Addr, cfg *config.Config) string {
+	if cfg.GeoIP == nil {
+		return ""
+	}
+	ip, _, _ := parseClientAddr(addr)
+	return cfg.GeoIP.Country(ip)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"signalgoproxy/internal/config"
+)
+
+// stringAddr is a net.Addr with an arbitrary string form.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "test" }
+func (a stringAddr) String() string  { return string(a) }
+
+// TestClientAddr checks the canonical forms of client addresses.
+func TestClientAddr(t *testing.T) {
+	testCases := []struct {
+		name         string
+		addr         net.Addr
+		expectedAddr string
+		expectedIP   string
+	}{
+		{name: "IPv4", addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 54321}, expectedAddr: "192.0.2.1:54321", expectedIP: "192.0.2.1"},
+		{name: "IPv4-mapped", addr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 54321}, expectedAddr: "192.0.2.1:54321", expectedIP: "192.0.2.1"},
+		{name: "IPv4-mapped string", addr: stringAddr("[::ffff:192.0.2.1]:54321"), expectedAddr: "192.0.2.1:54321", expectedIP: "192.0.2.1"},
+		{name: "IPv6", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8:0:0::1"), Port: 54321}, expectedAddr: "[2001:db8::1]:54321", expectedIP: "2001:db8::1"},
+		{name: "Zone", addr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 54321}, expectedAddr: "[fe80::1%eth0]:54321", expectedIP: "fe80::1%eth0"},
+		{name: "Zone string", addr: stringAddr("[fe80::1%eth0]:54321"), expectedAddr: "[fe80::1%eth0]:54321", expectedIP: "fe80::1%eth0"},
+		{name: "No port", addr: stringAddr("2001:db8::1"), expectedAddr: "2001:db8::1", expectedIP: "2001:db8::1"},
+		{name: "Pipe", addr: stringAddr("pipe"), expectedAddr: "pipe", expectedIP: "pipe"},
+		{name: "Hostname", addr: stringAddr("localhost:443"), expectedAddr: "localhost:443", expectedIP: "localhost:443"},
+		{name: "Malformed IPv6", addr: stringAddr("[2001:db8::1:54321"), expectedAddr: "[2001:db8::1:54321", expectedIP: "[2001:db8::1:54321"},
+		{name: "Empty TCP address", addr: &net.TCPAddr{}, expectedAddr: ":0", expectedIP: ":0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedAddr, ClientAddr(tc.addr))
+			assert.Equal(t, tc.expectedIP, clientIP(tc.addr))
+		})
+	}
+}
+
+// TestSourceKey checks that IPv6 sources are keyed by their prefix, and that
+// an IPv4 client has the same key with and without IPv6 mapping.
+func TestSourceKey(t *testing.T) {
+	testCases := []struct {
+		name     string
+		addr     net.Addr
+		prefix   int
+		expected string
+	}{
+		{name: "IPv4", addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, expected: "192.0.2.1"},
+		{name: "IPv4-mapped", addr: stringAddr("[::ffff:192.0.2.1]:2"), prefix: 48, expected: "192.0.2.1"},
+		{name: "Default prefix", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 1}, expected: "2001:db8:1:2::/64"},
+		{name: "Shorter prefix", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 1}, prefix: 48, expected: "2001:db8:1::/48"},
+		{name: "Single addresses", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 1}, prefix: 128, expected: "2001:db8:1:2:3:4:5:6"},
+		{name: "Zone", addr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 1}, expected: "fe80::/64"},
+		{name: "Malformed", addr: stringAddr("pipe"), expected: "pipe"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, SourceKey(tc.addr, &config.Config{BanIPv6Prefix: tc.prefix}))
+		})
+	}
+}
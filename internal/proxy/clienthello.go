@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/cryptobyte"
+	"signalgoproxy/internal/config"
+)
+
+// errClientHelloTooLarge is returned when a ClientHello exceeds the size limit.
+var errClientHelloTooLarge = errors.New("handshake message too large")
+
+// Kinds of ClientHello parse failures. The errors returned by getSNI and
+// parseClientHello wrap one of them, or errClientHelloTooLarge.
+var (
+	// ErrTruncatedHello means the connection ended or failed before the
+	// ClientHello was complete, as when a client gives up mid-handshake.
+	ErrTruncatedHello = errors.New("truncated ClientHello")
+	// ErrNotTLS means the data is not a sequence of TLS handshake records.
+	ErrNotTLS = errors.New("not a TLS handshake")
+	// ErrNotClientHello means the handshake message is not a well-formed
+	// ClientHello.
+	ErrNotClientHello = errors.New("malformed ClientHello")
+	// ErrNoSNI means the ClientHello has no server_name extension.
+	ErrNoSNI = errors.New("SNI not found in ClientHello")
+	// ErrMalformedExtension means an extension of the ClientHello is malformed
+	// or repeated.
+	ErrMalformedExtension = errors.New("malformed ClientHello extension")
+)
+
+// clientHelloErrorKind returns the kind of a ClientHello parse failure reported
+// in the stats: truncated, not_tls, not_client_hello, no_sni,
+// malformed_extension, too_large or error.
+func clientHelloErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrTruncatedHello):
+		return "truncated"
+	case errors.Is(err, ErrNotTLS):
+		return "not_tls"
+	case errors.Is(err, ErrNotClientHello):
+		return "not_client_hello"
+	case errors.Is(err, ErrNoSNI):
+		return "no_sni"
+	case errors.Is(err, ErrMalformedExtension):
+		return "malformed_extension"
+	case errors.Is(err, errClientHelloTooLarge):
+		return "too_large"
+	default:
+		return "error"
+	}
+}
+
+// recordBufSize is the initial capacity of the pooled buffers, enough for a
+// ClientHello in one record of the largest valid size.
+const recordBufSize = 5 + maxTLSRecordLen
+
+// maxPooledBufSize bounds the capacity of buffers returned to the pools, so
+// that the rare huge fragmented ClientHello does not keep its memory pinned.
+const maxPooledBufSize = config.DefaultMaxClientHelloSize
+
+// recordPool holds buffers for reading the TLS records of a ClientHello,
+// headers included, as received.
+var recordPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, recordBufSize)
+		return &b
+	},
+}
+
+// handshakePool holds buffers for reassembling a ClientHello fragmented
+// across several TLS records.
+var handshakePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, recordBufSize)
+		return &b
+	},
+}
+
+// putBuffer returns buf, obtained from pool through bufPtr, to pool unless it
+// grew too large.
+func putBuffer(pool *sync.Pool, bufPtr *[]byte, buf []byte) {
+	if cap(buf) > maxPooledBufSize {
+		return
+	}
+	*bufPtr = buf[:0]
+	pool.Put(bufPtr)
+}
+
+// typeClientHello is the handshake message type of a ClientHello.
+const typeClientHello = 1
+
+// TLS extension types parsed from the ClientHello.
+const (
+	extServerName        uint16 = 0
+	extALPN              uint16 = 16
+	extSupportedVersions uint16 = 43
+	extECH               uint16 = 0xfe0d
+)
+
+// isGREASE reports whether v is one of the reserved GREASE values of RFC 8701,
+// which clients send to keep servers tolerant of unknown values.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// formatALPN formats an ALPN protocol list for log messages.
+func formatALPN(alpn []string) string {
+	if alpn == nil {
+		return "none"
+	}
+	return "[" + strings.Join(alpn, ",") + "]"
+}
+
+// ClientHelloInfo holds the fields of an inner ClientHello used for routing,
+// logging and policy.
+type ClientHelloInfo struct {
+	// ServerName is the host name from the server_name extension.
+	ServerName string
+	// LegacyVersion is the legacy_version field, 0x0303 for TLS 1.2 and 1.3.
+	LegacyVersion uint16
+	// SupportedVersions lists the versions of the supported_versions extension,
+	// in order. It is nil if the extension is missing.
+	SupportedVersions []uint16
+	// CipherSuites lists the offered cipher suites, in order.
+	CipherSuites []uint16
+	// ALPN lists the protocols offered in the ALPN extension, in order. It is
+	// nil if the extension is missing.
+	ALPN []string
+	// Extensions holds the raw data of every extension by type.
+	Extensions map[uint16][]byte
+	// ECH reports whether the ClientHello carries an Encrypted Client Hello
+	// extension. ServerName is then the public name of the outer ClientHello,
+	// while the real server name is encrypted.
+	ECH bool
+}
+
+// getSNI reads from the connection, parses the TLS ClientHello message,
+// and extracts the Server Name Indication (SNI) extension.
+// It returns the found server name, the raw ClientHello bytes, and any error.
+// Parse failures wrap one of the error kinds, such as ErrTruncatedHello.
+func getSNI(reader io.Reader) (string, []byte, error) {
+	info, raw, err := parseClientHello(reader)
+	if err != nil {
+		return "", nil, err
+	}
+	return info.ServerName, raw, nil
+}
+
+// parseClientHello reads a TLS ClientHello message from reader and parses the
+// fields of ClientHelloInfo. It also returns the raw ClientHello bytes, so that
+// they can be replayed to the upstream. A ClientHello fragmented across several
+// TLS records is reassembled, and the raw bytes then contain all of those
+// records exactly as received.
+// This implementation uses cryptobyte for robust and efficient parsing.
+func parseClientHello(reader io.Reader) (*ClientHelloInfo, []byte, error) {
+	return parseClientHelloLimit(reader, config.DefaultMaxClientHelloSize)
+}
+
+// parseClientHelloLimit is like parseClientHello, but fails with
+// errClientHelloTooLarge as soon as the records of the ClientHello, including
+// their headers, would exceed maxLen bytes.
+//
+// Several handshake messages may be coalesced in one record. Complete messages
+// preceding the ClientHello are skipped, and data following it in its last
+// record is ignored; both are part of the returned raw bytes.
+func parseClientHelloLimit(reader io.Reader, maxLen int) (*ClientHelloInfo, []byte, error) {
+	// The records are read into pooled memory, and only the complete
+	// ClientHello is copied out, into a single allocation of its exact size.
+	recordsPtr := recordPool.Get().(*[]byte)
+	records := (*recordsPtr)[:0]
+	defer func() { putBuffer(&recordPool, recordsPtr, records) }()
+	var fragmentsPtr *[]byte
+	var fragments []byte // Handshake bodies of several records, reassembled
+	defer func() {
+		if fragmentsPtr != nil {
+			putBuffer(&handshakePool, fragmentsPtr, fragments)
+		}
+	}()
+
+	offset := 0 // Start of the current handshake message in handshake
+	for {
+		// Read the TLS record header.
+		start := len(records)
+		records = slices.Grow(records, 5)[:start+5]
+		header := records[start:]
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, nil, fmt.Errorf("%w: failed to read TLS record header: %w", ErrTruncatedHello, err)
+		}
+
+		// Check if it's a TLS handshake record.
+		if header[0] != 0x16 { // 0x16 = Handshake
+			if start == 0 {
+				return nil, nil, fmt.Errorf("%w: record type %d", ErrNotTLS, header[0])
+			}
+			return nil, nil, fmt.Errorf("%w: unexpected record type %d in fragmented ClientHello", ErrNotTLS, header[0])
+		}
+
+		// Read the rest of the record. Empty handshake fragments are forbidden.
+		recordLen := int(binary.BigEndian.Uint16(header[3:]))
+		if recordLen == 0 {
+			return nil, nil, fmt.Errorf("%w: empty TLS handshake record", ErrNotTLS)
+		}
+		if recordLen > maxTLSRecordLen {
+			return nil, nil, fmt.Errorf("%w: TLS record too large: %d bytes", ErrNotTLS, recordLen)
+		}
+		// Check the limit before reading, so that a client announcing more than
+		// it may send is dropped without waiting for the bytes.
+		if total := start + len(header) + recordLen; total > maxLen {
+			return nil, nil, fmt.Errorf("%w: more than %d bytes", errClientHelloTooLarge, maxLen)
+		}
+		records = slices.Grow(records, recordLen)[:start+5+recordLen]
+		recordBody := records[start+5:]
+		if _, err := io.ReadFull(reader, recordBody); err != nil {
+			return nil, nil, fmt.Errorf("%w: failed to read TLS record body: %w", ErrTruncatedHello, err)
+		}
+
+		// A single record, the common case, holds the handshake messages as is
+		handshake := records[5:]
+		if start > 0 {
+			if fragmentsPtr == nil {
+				fragmentsPtr = handshakePool.Get().(*[]byte)
+				fragments = append((*fragmentsPtr)[:0], records[5:start]...)
+			}
+			fragments = append(fragments, recordBody...)
+			handshake = fragments
+		}
+
+		// Walk the buffered handshake messages, per their 24-bit lengths, until
+		// the ClientHello is complete.
+		for len(handshake)-offset >= 4 {
+			msg := handshake[offset:]
+			msgLen := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if offset+msgLen > maxLen {
+				return nil, nil, fmt.Errorf("%w: %d bytes", errClientHelloTooLarge, offset+msgLen)
+			}
+			if len(msg) < msgLen {
+				break
+			}
+			if msg[0] == typeClientHello {
+				raw := make([]byte, len(records))
+				copy(raw, records)
+				// The parsed fields may point into the message, so it must not
+				// be pooled memory: in a single record, it is part of raw
+				if start == 0 {
+					msg = raw[5+offset:]
+				} else {
+					msg = bytes.Clone(msg[:msgLen])
+				}
+				info, err := parseClientHelloMessage(msg[:msgLen])
+				if err != nil {
+					return nil, nil, err
+				}
+				return info, raw, nil
+			}
+			offset += msgLen
+		}
+	}
+}
+
+// parseClientHelloMessage parses a reassembled ClientHello handshake message.
+// See RFC 8446, Section 4.1.2. GREASE values are skipped in the cipher suite,
+// supported version and ALPN lists, and GREASE extensions may repeat.
+func parseClientHelloMessage(handshake []byte) (*ClientHelloInfo, error) {
+	// Wrap the handshake message in a cryptobyte.String for parsing.
+	s := cryptobyte.String(handshake)
+
+	var msgType uint8
+	var clientHello cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != typeClientHello || !s.ReadUint24LengthPrefixed(&clientHello) || !s.Empty() {
+		return nil, fmt.Errorf("%w: not a ClientHello message", ErrNotClientHello)
+	}
+
+	// Read legacy version, skip random.
+	info := &ClientHelloInfo{Extensions: make(map[uint16][]byte)}
+	if !clientHello.ReadUint16(&info.LegacyVersion) || !clientHello.Skip(32) {
+		return nil, fmt.Errorf("%w: error parsing ClientHello header", ErrNotClientHello)
+	}
+
+	// Skip legacy session id.
+	var legacySessionID cryptobyte.String
+	if !clientHello.ReadUint8LengthPrefixed(&legacySessionID) {
+		return nil, fmt.Errorf("%w: error parsing session id", ErrNotClientHello)
+	}
+
+	// Read cipher suites.
+	var cipherSuites cryptobyte.String
+	if !clientHello.ReadUint16LengthPrefixed(&cipherSuites) || len(cipherSuites)%2 != 0 {
+		return nil, fmt.Errorf("%w: error parsing cipher suites", ErrNotClientHello)
+	}
+	for !cipherSuites.Empty() {
+		var suite uint16
+		cipherSuites.ReadUint16(&suite)
+		if !isGREASE(suite) {
+			info.CipherSuites = append(info.CipherSuites, suite)
+		}
+	}
+
+	// Skip compression methods.
+	var compressionMethods cryptobyte.String
+	if !clientHello.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, fmt.Errorf("%w: error parsing compression methods", ErrNotClientHello)
+	}
+
+	// Check for extensions.
+	if clientHello.Empty() {
+		return nil, fmt.Errorf("%w: no extensions found", ErrNoSNI)
+	}
+
+	// Parse extensions.
+	var extensions cryptobyte.String
+	if !clientHello.ReadUint16LengthPrefixed(&extensions) {
+		return nil, fmt.Errorf("%w: error parsing extensions", ErrNotClientHello)
+	}
+	if !clientHello.Empty() {
+		return nil, fmt.Errorf("%w: trailing data after ClientHello extensions", ErrNotClientHello)
+	}
+
+	for !extensions.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, fmt.Errorf("%w: error parsing extension", ErrMalformedExtension)
+		}
+		if _, dup := info.Extensions[extType]; dup && !isGREASE(extType) {
+			return nil, fmt.Errorf("%w: duplicate extension %d", ErrMalformedExtension, extType)
+		}
+		info.Extensions[extType] = extData
+
+		switch extType {
+		case extServerName:
+			var serverNameList cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&serverNameList) || serverNameList.Empty() {
+				return nil, fmt.Errorf("%w: error parsing server_name extension", ErrMalformedExtension)
+			}
+
+			var nameType uint8
+			var hostName cryptobyte.String
+			if !serverNameList.ReadUint8(&nameType) || nameType != 0 || !serverNameList.ReadUint16LengthPrefixed(&hostName) || hostName.Empty() { // 0 = host_name
+				return nil, fmt.Errorf("%w: error parsing host_name", ErrMalformedExtension)
+			}
+			info.ServerName = string(hostName)
+		case extALPN:
+			var protocolList cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&protocolList) || protocolList.Empty() {
+				return nil, fmt.Errorf("%w: error parsing ALPN extension", ErrMalformedExtension)
+			}
+			info.ALPN = []string{}
+			for !protocolList.Empty() {
+				var protocol cryptobyte.String
+				if !protocolList.ReadUint8LengthPrefixed(&protocol) || protocol.Empty() {
+					return nil, fmt.Errorf("%w: error parsing ALPN protocol", ErrMalformedExtension)
+				}
+				if len(protocol) == 2 && isGREASE(uint16(protocol[0])<<8|uint16(protocol[1])) {
+					continue
+				}
+				info.ALPN = append(info.ALPN, string(protocol))
+			}
+		case extSupportedVersions:
+			var versionList cryptobyte.String
+			if !extData.ReadUint8LengthPrefixed(&versionList) || versionList.Empty() || len(versionList)%2 != 0 {
+				return nil, fmt.Errorf("%w: error parsing supported_versions extension", ErrMalformedExtension)
+			}
+			for !versionList.Empty() {
+				var version uint16
+				versionList.ReadUint16(&version)
+				if !isGREASE(version) {
+					info.SupportedVersions = append(info.SupportedVersions, version)
+				}
+			}
+		case extECH:
+			info.ECH = true
+		}
+	}
+
+	if info.ServerName == "" {
+		return nil, ErrNoSNI
+	}
+
+	return info, nil
+}
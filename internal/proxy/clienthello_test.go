@@ -0,0 +1,531 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/cryptobyte"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// parseGoClientHello parses the ClientHello that crypto/tls sends for cfg,
+// captured through a pipe. It also returns the bytes parseClientHello consumed.
+func parseGoClientHello(t *testing.T, cfg *tls.Config) (*ClientHelloInfo, []byte, []byte) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		defer clientConn.Close()
+		tls.Client(clientConn, cfg).Handshake()
+	}()
+
+	serverConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var consumed bytes.Buffer
+	info, raw, err := parseClientHello(io.TeeReader(serverConn, &consumed))
+	require.NoError(t, err)
+	return info, raw, consumed.Bytes()
+}
+
+// TestParseClientHelloFromCryptoTLS checks the parsed fields against
+// ClientHellos generated by crypto/tls.
+func TestParseClientHelloFromCryptoTLS(t *testing.T) {
+	testCases := []struct {
+		name              string
+		cfg               *tls.Config
+		expectedALPN      []string
+		expectedSuite     uint16
+		expectTLS13       bool
+		missingExtensions []uint16
+	}{
+		{
+			name:          "TLS 1.3 with ALPN",
+			cfg:           &tls.Config{ServerName: "chat.signal.org", NextProtos: []string{"h2", "http/1.1"}},
+			expectedALPN:  []string{"h2", "http/1.1"},
+			expectedSuite: tls.TLS_AES_128_GCM_SHA256,
+			expectTLS13:   true,
+		},
+		{
+			name: "TLS 1.2 only without ALPN",
+			cfg: &tls.Config{
+				ServerName:   "cdn.signal.org",
+				MaxVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			},
+			expectedSuite:     tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			missingExtensions: []uint16{extALPN},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, raw, consumed := parseGoClientHello(t, tc.cfg)
+
+			assert.Equal(t, tc.cfg.ServerName, info.ServerName)
+			assert.Equal(t, uint16(tls.VersionTLS12), info.LegacyVersion)
+			assert.Equal(t, tc.expectedALPN, info.ALPN)
+			assert.Contains(t, info.CipherSuites, tc.expectedSuite)
+			if tc.expectTLS13 {
+				assert.Contains(t, info.SupportedVersions, uint16(tls.VersionTLS13))
+			} else {
+				assert.NotContains(t, info.SupportedVersions, uint16(tls.VersionTLS13))
+			}
+
+			assert.Contains(t, info.Extensions, extServerName)
+			for _, ext := range tc.missingExtensions {
+				assert.NotContains(t, info.Extensions, ext)
+			}
+			assert.Equal(t, consumed, raw, "the raw ClientHello must be replayed unchanged")
+		})
+	}
+}
+
+// TestParseClientHelloDuplicateExtension checks that a ClientHello repeating an
+// extension, which RFC 8446 forbids, is rejected.
+func TestParseClientHelloDuplicateExtension(t *testing.T) {
+	record := buildTestClientHelloALPN(t, "test.example.com", "h2")
+	i := bytes.LastIndex(record, []byte{0x00, 0x10}) // The ALPN extension type
+	require.Positive(t, i)
+	record[i+1] = 0x00 // Now a second server_name extension
+
+	_, _, err := parseClientHello(bytes.NewReader(record))
+	assert.ErrorIs(t, err, ErrMalformedExtension)
+	assert.ErrorContains(t, err, "duplicate extension 0")
+}
+
+// buildGREASEClientHello builds a ClientHello record for "chat.signal.org"
+// with GREASE values in the cipher suites, supported versions and ALPN, and
+// GREASE extensions interleaved before and after the server_name extension.
+func buildGREASEClientHello(t *testing.T) []byte {
+	t.Helper()
+	var body cryptobyte.Builder
+	body.AddUint16(0x0303)
+	body.AddBytes(make([]byte, 32))
+	body.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	body.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x2a2a) // GREASE
+		b.AddUint16(tls.TLS_AES_128_GCM_SHA256)
+	})
+	body.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+	body.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0a0a) // Empty GREASE extension
+		b.AddUint16(0)
+		b.AddUint16(0x1a1a) // GREASE extension with data
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+		b.AddUint16(extServerName)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(0)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("chat.signal.org")) })
+			})
+		})
+		b.AddUint16(extSupportedVersions)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x3a3a) // GREASE
+				b.AddUint16(tls.VersionTLS13)
+			})
+		})
+		b.AddUint16(extALPN)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte{0x4a, 0x4a}) }) // GREASE
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("http/1.1")) })
+			})
+		})
+		b.AddUint16(0x0a0a) // Repeated GREASE extension
+		b.AddUint16(0)
+	})
+
+	var record cryptobyte.Builder
+	record.AddUint8(0x16)
+	record.AddUint16(0x0301)
+	record.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(1)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(body.BytesOrPanic()) })
+	})
+	return record.BytesOrPanic()
+}
+
+// TestParseClientHelloGREASE checks that GREASE values are tolerated and left
+// out of the parsed lists.
+func TestParseClientHelloGREASE(t *testing.T) {
+	info, _, err := parseClientHello(bytes.NewReader(buildGREASEClientHello(t)))
+	require.NoError(t, err)
+	assert.Equal(t, "chat.signal.org", info.ServerName)
+	assert.Equal(t, []uint16{tls.TLS_AES_128_GCM_SHA256}, info.CipherSuites)
+	assert.Equal(t, []uint16{tls.VersionTLS13}, info.SupportedVersions)
+	assert.Equal(t, []string{"http/1.1"}, info.ALPN)
+	assert.Contains(t, info.Extensions, uint16(0x1a1a))
+	assert.False(t, info.ECH)
+}
+
+// testECHConfigList returns an ECH configuration list with the given public
+// name and a fresh X25519 key, as published in DNS by an ECH server.
+func testECHConfigList(t *testing.T, publicName string) []byte {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	var list cryptobyte.Builder
+	list.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(extECH) // version
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(1)       // config_id
+			b.AddUint16(0x0020) // DHKEM(X25519, HKDF-SHA256)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(key.PublicKey().Bytes()) })
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x0001) // HKDF-SHA256
+				b.AddUint16(0x0001) // AES-128-GCM
+			})
+			b.AddUint8(0) // maximum_name_length
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(publicName)) })
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {}) // extensions
+		})
+	})
+	return list.BytesOrPanic()
+}
+
+// TestParseClientHelloECH checks that an Encrypted Client Hello sent by
+// crypto/tls is detected and its public name reported as the server name.
+func TestParseClientHelloECH(t *testing.T) {
+	info, _, _ := parseGoClientHello(t, &tls.Config{
+		ServerName:                     "secret.example.com",
+		MinVersion:                     tls.VersionTLS13,
+		EncryptedClientHelloConfigList: testECHConfigList(t, "chat.signal.org"),
+	})
+	assert.True(t, info.ECH)
+	assert.Equal(t, "chat.signal.org", info.ServerName)
+	assert.Contains(t, info.Extensions, extECH)
+}
+
+// TestParseClientHelloLimit checks that the size limit covers the announced
+// message length and the records read, and fails before waiting for the bytes.
+func TestParseClientHelloLimit(t *testing.T) {
+	record := buildTestClientHello(t, "test.example.com")
+	payloadLen := len(record) - 5
+
+	var everyByte []int
+	for i := 1; i < payloadLen; i++ {
+		everyByte = append(everyByte, i)
+	}
+
+	testCases := []struct {
+		name        string
+		input       []byte
+		maxLen      int
+		expectError bool
+	}{
+		{name: "Within the limit", input: record, maxLen: len(record)},
+		{name: "Announced message length", input: record, maxLen: len(record) - 1, expectError: true},
+		{name: "Record headers count", input: fragmentRecord(record, everyByte...), maxLen: len(record) + 10, expectError: true},
+		// Only the header arrives, the limit must trigger without reading the body.
+		{name: "Large record announced", input: []byte{0x16, 0x03, 0x01, 0x40, 0x00}, maxLen: 1024, expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, raw, err := parseClientHelloLimit(bytes.NewReader(tc.input), tc.maxLen)
+			if tc.expectError {
+				assert.ErrorIs(t, err, errClientHelloTooLarge)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "test.example.com", info.ServerName)
+			assert.Equal(t, tc.input, raw)
+		})
+	}
+}
+
+// TestParseClientHelloPooledBuffers checks that the returned ClientHello does
+// not share memory with the pooled buffers, whether it came in one record or
+// was reassembled from several.
+func TestParseClientHelloPooledBuffers(t *testing.T) {
+	record := buildTestClientHelloALPN(t, "test.example.com", "http/1.1")
+	testCases := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "Single record", input: record},
+		{name: "Fragmented", input: fragmentRecord(record, 10, 50)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			input := bytes.Clone(tc.input)
+			info, raw, err := parseClientHello(bytes.NewReader(input))
+			require.NoError(t, err)
+
+			// Reuse the pooled buffers for another ClientHello, then overwrite them.
+			other := buildTestClientHello(t, "other.example.org")
+			_, _, err = parseClientHello(bytes.NewReader(fragmentRecord(other, 10)))
+			require.NoError(t, err)
+			for _, pool := range []*sync.Pool{&recordPool, &handshakePool} {
+				bufPtr := pool.Get().(*[]byte)
+				buf := (*bufPtr)[:cap(*bufPtr)]
+				for i := range buf {
+					buf[i] = 0xaa
+				}
+				pool.Put(bufPtr)
+			}
+
+			assert.Equal(t, tc.input, raw)
+			assert.Equal(t, len(raw), cap(raw), "the raw ClientHello should be allocated at its exact size")
+			assert.Equal(t, "test.example.com", info.ServerName)
+			assert.Equal(t, []string{"http/1.1"}, info.ALPN)
+			assert.Equal(t, []byte{0x00, 0x09, 0x08, 'h', 't', 't', 'p', '/', '1', '.', '1'}, info.Extensions[extALPN])
+		})
+	}
+}
+
+// TestGetSNIAllocs checks that reading a ClientHello allocates only the
+// returned copy of its records, and for a fragmented one the reassembled
+// message, on top of what parsing the message allocates.
+func TestGetSNIAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random under the race detector")
+	}
+	record := buildTestClientHelloALPN(t, "test.example.com", "http/1.1")
+	parseAllocs := testing.AllocsPerRun(100, func() {
+		parseClientHelloMessage(record[5:])
+	})
+
+	testCases := []struct {
+		name       string
+		input      []byte
+		readAllocs float64
+	}{
+		{name: "Single record", input: record, readAllocs: 1},
+		{name: "Fragmented", input: fragmentRecord(record, 10, 50), readAllocs: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := bytes.NewReader(tc.input)
+			allocs := testing.AllocsPerRun(100, func() {
+				reader.Reset(tc.input)
+				if _, _, err := getSNI(reader); err != nil {
+					t.Fatal(err)
+				}
+			})
+			assert.LessOrEqual(t, allocs, parseAllocs+tc.readAllocs)
+		})
+	}
+}
+
+// BenchmarkGetSNI measures reading and parsing a ClientHello, as done for
+// every connection.
+func BenchmarkGetSNI(b *testing.B) {
+	record := buildTestClientHelloALPN(b, "chat.signal.org", "http/1.1")
+	inputs := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "Single record", input: record},
+		{name: "Fragmented", input: fragmentRecord(record, 10, 50)},
+	}
+
+	for _, in := range inputs {
+		b.Run(in.name, func(b *testing.B) {
+			reader := bytes.NewReader(in.input)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(in.input)))
+			for i := 0; i < b.N; i++ {
+				reader.Reset(in.input)
+				if _, _, err := getSNI(reader); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestClientHelloTooLargeCounted checks that connections with an oversized
+// inner ClientHello are dropped and counted.
+func TestClientHelloTooLargeCounted(t *testing.T) {
+	before := stats.Default.Get("client_hello_too_large")
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestHandler(&config.Config{MaxClientHelloSize: 64}, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+	}()
+
+	_, err := clientConn.Write(buildTestClientHello(t, "test.example.com"))
+	require.NoError(t, err)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not drop the oversized ClientHello")
+	}
+	assert.Equal(t, before+1, stats.Default.Get("client_hello_too_large"))
+}
+
+// TestClientHelloErrorsCounted checks that inner ClientHellos which cannot be
+// parsed are logged and counted by the kind of failure, and that all but
+// truncated ones count as offenses of the source.
+func TestClientHelloErrorsCounted(t *testing.T) {
+	hello := buildTestClientHello(t, "test.example.com")
+	interleaved := fragmentRecord(hello, 10)
+	interleaved[5+10] = 0x17 // The second record is application data
+	badALPN := buildTestClientHelloALPN(t, "test.example.com", "h2")
+	badALPN[bytes.Index(badALPN, []byte("h2"))-1] = 5 // The protocol length overruns the list
+
+	testCases := []struct {
+		name            string
+		input           []byte
+		expectedErr     error
+		expectedKind    string
+		expectedOffense bool
+	}{
+		{name: "Truncated", input: hello[:len(hello)/2], expectedErr: ErrTruncatedHello, expectedKind: "truncated"},
+		{name: "Interleaved record", input: interleaved, expectedErr: ErrNotTLS, expectedKind: "not_tls", expectedOffense: true},
+		{name: "No SNI", input: buildTestClientHello(t, ""), expectedErr: ErrNoSNI, expectedKind: "no_sni", expectedOffense: true},
+		{name: "Malformed extension", input: badALPN, expectedErr: ErrMalformedExtension, expectedKind: "malformed_extension", expectedOffense: true},
+	}
+	orig := Bans
+	t.Cleanup(func() { Bans = orig })
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := parseClientHello(bytes.NewReader(tc.input))
+			require.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expectedKind, clientHelloErrorKind(err))
+
+			Bans = NewBanList(banThreshold, banWindow, maxBanSources)
+			before := stats.Default.Get("sni_errors:" + tc.expectedKind)
+			logs := &lockedBuffer{}
+			clientConn, serverConn := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newTestHandler(&config.Config{BanDuration: time.Hour}, log.New(logs, "", 0)).Serve(serverConn, NewConnID())
+			}()
+			go func() {
+				clientConn.Write(tc.input)
+				clientConn.Close()
+			}()
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Serve did not drop the connection")
+			}
+			assert.Equal(t, before+1, stats.Default.Get("sni_errors:"+tc.expectedKind))
+			assert.Contains(t, logs.String(), "("+tc.expectedKind+")")
+			Bans.mu.Lock()
+			assert.Equal(t, tc.expectedOffense, Bans.lru.Len() > 0)
+			Bans.mu.Unlock()
+		})
+	}
+}
+
+// TestECHRouting checks that the public name of an encrypted ClientHello is
+// routed only if it is in the routing map, and otherwise handled as unknown.
+func TestECHRouting(t *testing.T) {
+	testCases := []struct {
+		name          string
+		publicName    string
+		expectProxied bool
+	}{
+		{name: "Listed public name", publicName: "ech.test", expectProxied: true},
+		{name: "Public name routable by suffix only", publicName: "ech.signal.org"},
+	}
+
+	startTestUpstream(t, "ech.test")
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, hello := parseGoClientHello(t, &tls.Config{
+				ServerName:                     "secret.example.com",
+				MinVersion:                     tls.VersionTLS13,
+				EncryptedClientHelloConfigList: testECHConfigList(t, tc.publicName),
+			})
+			detected, denied := stats.Default.Get("ech_detected"), stats.Default.Get("sni_denied")
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newTestHandler(&config.Config{AllowSignalSuffix: true}, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+			}()
+			_, err := clientConn.Write(hello)
+			require.NoError(t, err)
+
+			if tc.expectProxied {
+				// The upstream echoes the ClientHello
+				clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				echoed := make([]byte, len(hello))
+				_, err = io.ReadFull(clientConn, echoed)
+				require.NoError(t, err)
+				assert.Equal(t, hello, echoed)
+				clientConn.Close()
+			}
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Serve did not finish")
+			}
+
+			assert.Equal(t, detected+1, stats.Default.Get("ech_detected"))
+			if tc.expectProxied {
+				assert.Equal(t, denied, stats.Default.Get("sni_denied"))
+			} else {
+				assert.Equal(t, denied+1, stats.Default.Get("sni_denied"))
+			}
+		})
+	}
+}
+
+// TestParseClientHelloCoalesced checks ClientHellos sharing their records with
+// other handshake messages, which must be skipped and replayed unchanged.
+func TestParseClientHelloCoalesced(t *testing.T) {
+	clientHello := buildTestClientHello(t, "test.example.com")[5:]
+	helloRequest := []byte{0x00, 0x00, 0x00, 0x00}
+	certificate := []byte{0x0b, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00}
+	// A ClientHello body with a byte after its extensions
+	padded := append(append([]byte{0x01, 0x00}, byte((len(clientHello)-3)>>8), byte(len(clientHello)-3)), clientHello[4:]...)
+	padded = append(padded, 0x00)
+
+	record := func(payloads ...[]byte) []byte {
+		payload := bytes.Join(payloads, nil)
+		return append([]byte{0x16, 0x03, 0x01, byte(len(payload) >> 8), byte(len(payload))}, payload...)
+	}
+
+	testCases := []struct {
+		name        string
+		input       []byte
+		expectedErr error
+	}{
+		{name: "Leading zero-length message", input: record(helloRequest, clientHello)},
+		{name: "Preceding message", input: record(certificate, clientHello)},
+		{name: "Trailing data", input: record(clientHello, []byte{0x14, 0x00, 0x00})},
+		{name: "Coalesced and fragmented", input: fragmentRecord(record(helloRequest, certificate, clientHello), 2, 9, 20)},
+		{name: "Several records before the ClientHello", input: append(record(certificate), record(helloRequest, clientHello)...)},
+		{name: "Trailing data in the ClientHello", input: record(padded), expectedErr: ErrNotClientHello},
+		{name: "Length beyond the records", input: record(clientHello[:len(clientHello)-1]), expectedErr: ErrTruncatedHello},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, raw, err := parseClientHello(bytes.NewReader(tc.input))
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "test.example.com", info.ServerName)
+			assert.Equal(t, tc.input, raw)
+		})
+	}
+}
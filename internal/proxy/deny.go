@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+)
+
+const (
+	// deniedLogInterval is the minimum time between two log lines about the
+	// same denied SNI.
+	deniedLogInterval = time.Minute
+	// maxDeniedLogEntries bounds the memory used for rate-limiting denied SNI
+	// log lines. When it is reached, the rate-limiting state starts over.
+	maxDeniedLogEntries = 4096
+)
+
+// DenyList is a list of lower-case SNI patterns: exact hostnames, or "*."
+// followed by a domain, which matches every name below that domain.
+type DenyList []string
+
+// ParseDenyList validates and normalizes SNI patterns.
+func ParseDenyList(patterns []string) (DenyList, error) {
+	var list DenyList
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if !isValidHostname(strings.TrimPrefix(pattern, "*.")) {
+			return nil, fmt.Errorf("invalid SNI pattern '%s'", pattern)
+		}
+		list = append(list, pattern)
+	}
+	return list, nil
+}
+
+// Match reports whether sni matches one of the patterns, ignoring case.
+func (l DenyList) Match(sni string) bool {
+	sni = strings.ToLower(sni)
+	for _, pattern := range l {
+		if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(sni, "."+domain) {
+				return true
+			}
+		} else if sni == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// denied reports whether serverName is denied by -deny-sni or by the denylist
+// of the routing table.
+func denied(serverName string, cfg *config.Config) bool {
+	if DenyList(cfg.DenySNI).Match(serverName) {
+		return true
+	}
+	if d, ok := cfg.Router.(interface{ Denied(string) bool }); ok {
+		return d.Denied(serverName)
+	}
+	return false
+}
+
+// deniedLog rate-limits log lines about denied SNIs per hostname.
+var deniedLog = struct {
+	sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}{
+	last:       make(map[string]time.Time),
+	suppressed: make(map[string]int),
+}
+
+// logDenied logs that sni was denied, at most once per deniedLogInterval for
+// each hostname. The next line reports how many were not logged.
+func logDenied(logger *log.Logger, sni, clientAddr string) {
+	name := strings.ToLower(sni)
+
+	deniedLog.Lock()
+	if time.Since(deniedLog.last[name]) < deniedLogInterval {
+		deniedLog.suppressed[name]++
+		deniedLog.Unlock()
+		return
+	}
+	if len(deniedLog.last) >= maxDeniedLogEntries {
+		clear(deniedLog.last)
+		clear(deniedLog.suppressed)
+	}
+	suppressed := deniedLog.suppressed[name]
+	deniedLog.last[name] = time.Now()
+	delete(deniedLog.suppressed, name)
+	deniedLog.Unlock()
+
+	if suppressed > 0 {
+		logger.Printf("Denied inner SNI '%s' from %s by denylist (%d more since the last report)", sni, clientAddr, suppressed)
+	} else {
+		logger.Printf("Denied inner SNI '%s' from %s by denylist", sni, clientAddr)
+	}
+}
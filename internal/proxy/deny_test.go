@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// TestDenyList tests SNI pattern matching.
+func TestDenyList(t *testing.T) {
+	list, err := ParseDenyList([]string{"cdn3.signal.org", " *.Example.com ", ""})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		sni      string
+		expected bool
+	}{
+		{sni: "cdn3.signal.org", expected: true},
+		{sni: "CDN3.Signal.org", expected: true},
+		{sni: "cdn2.signal.org", expected: false},
+		{sni: "a.example.com", expected: true},
+		{sni: "a.b.example.com", expected: true},
+		{sni: "example.com", expected: false},
+		{sni: "badexample.com", expected: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.sni, func(t *testing.T) {
+			assert.Equal(t, tc.expected, list.Match(tc.sni))
+		})
+	}
+
+	_, err = ParseDenyList([]string{"cdn*.signal.org"})
+	assert.Error(t, err)
+}
+
+// TestDeniedFromConfig checks that -deny-sni patterns are consulted.
+func TestDeniedFromConfig(t *testing.T) {
+	cfg := &config.Config{DenySNI: []string{"*.signal.org"}}
+	assert.True(t, denied("chat.signal.org", cfg))
+	assert.False(t, denied("signal.org", cfg))
+}
+
+// TestLogDeniedRateLimited checks that repeated denials of one hostname are
+// logged once per interval, while other hostnames are still logged.
+func TestLogDeniedRateLimited(t *testing.T) {
+	logs := &lockedBuffer{}
+	logger := log.New(logs, "", 0)
+	addr := "192.0.2.1:1234"
+
+	for i := 0; i < 5; i++ {
+		logDenied(logger, "flood.test", addr)
+	}
+	logDenied(logger, "other.test", addr)
+
+	lines := logs.Lines()
+	require.Len(t, lines, 2)
+	assert.True(t, strings.Contains(lines[0], "'flood.test'"))
+	assert.True(t, strings.Contains(lines[1], "'other.test'"))
+}
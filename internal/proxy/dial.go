@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+const (
+	// upstreamDialRounds is how many times all addresses of an upstream are tried.
+	upstreamDialRounds = 2
+	// upstreamRetryBackoff is the pause before retrying the addresses of an upstream.
+	upstreamRetryBackoff = 500 * time.Millisecond
+	// connectionAttemptDelay is how long an attempt may run before the next
+	// address is tried in parallel (RFC 8305, section 5).
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+// dialErrorClass returns the class of a dial error reported in stats.Dials:
+// circuit_open, dns, timeout, refused, unreachable, certificate or error.
+func dialErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return "circuit_open"
+	case errors.As(err, &certErr):
+		return "certificate"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	default:
+		return "error"
+	}
+}
+
+// upstreamDialer connects to upstreams, trying every resolved address of the
+// host before giving up.
+type upstreamDialer struct {
+	dialContext  func(ctx context.Context, network, addr string) (net.Conn, error)
+	cache        *dnsCache
+	cacheTTL     time.Duration // zero disables the cache
+	attemptDelay time.Duration
+	retryBackoff time.Duration
+	breakers     *breakerSet     // nil disables the circuit breakers
+	family       config.IPFamily // empty dials both families
+}
+
+// dialTimeout returns the time allowed for connecting to an upstream.
+func dialTimeout(cfg *config.Config) time.Duration {
+	if cfg.DialTimeout > 0 {
+		return cfg.DialTimeout
+	}
+	return config.DefaultDialTimeout
+}
+
+// newUpstreamDialer returns the dialer for upstreams configured in cfg.
+func newUpstreamDialer(cfg *config.Config) *upstreamDialer {
+	return &upstreamDialer{
+		dialContext:  (&net.Dialer{}).DialContext,
+		cache:        upstreamDNS,
+		cacheTTL:     cfg.DNSCacheTTL,
+		attemptDelay: connectionAttemptDelay,
+		retryBackoff: upstreamRetryBackoff,
+		breakers:     upstreamBreakers,
+		family:       cfg.UpstreamIPFamily,
+	}
+}
+
+// dialUpstream connects to an upstream address as configured in cfg.
+func dialUpstream(addr string, cfg *config.Config, logger *log.Logger) (net.Conn, error) {
+	return dialUpstreamVia(&net.Dialer{}, addr, cfg, logger)
+}
+
+// dialUpstreamVia connects to an upstream address as configured in cfg,
+// opening the connections with dialer.
+func dialUpstreamVia(dialer Dialer, addr string, cfg *config.Config, logger *log.Logger) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout(cfg))
+	defer cancel()
+
+	d := newUpstreamDialer(cfg)
+	d.dialContext = dialer.DialContext
+	var proxyURL *url.URL
+	if cfg.UpstreamHTTPProxy != "" {
+		var err error
+		if proxyURL, err = url.Parse(cfg.UpstreamHTTPProxy); err != nil {
+			return nil, fmt.Errorf("invalid upstream HTTP proxy: %w", err)
+		}
+	}
+	return d.connect(ctx, addr, proxyURL, logger)
+}
+
+// connect dials addr, through the HTTP proxy at proxyURL unless it is nil.
+// Connections to an upstream whose circuit is open fail immediately.
+func (d *upstreamDialer) connect(ctx context.Context, addr string, proxyURL *url.URL, logger *log.Logger) (net.Conn, error) {
+	if err := d.breakers.allow(addr, logger); err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyURL != nil {
+		conn, err = d.dialHTTPProxy(ctx, proxyURL, addr, logger)
+	} else {
+		conn, err = d.dial(ctx, addr, logger)
+	}
+	d.breakers.record(addr, err, logger)
+	return conn, err
+}
+
+// resolve returns the addresses of host. cached reports whether they came
+// from the DNS cache.
+func (d *upstreamDialer) resolve(ctx context.Context, host string) (ips []net.IP, cached bool, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, false, nil
+	}
+	if d.cacheTTL > 0 {
+		return d.cache.lookup(ctx, host, d.cacheTTL)
+	}
+	ips, err = d.cache.lookupIP(ctx, "ip", host)
+	return ips, false, err
+}
+
+// dial races connections to the addresses of addr's host, see race. If all of
+// them fail, the host is resolved again and its addresses are retried once
+// after a short backoff. The whole attempt is bounded by ctx.
+func (d *upstreamDialer) dial(ctx context.Context, addr string, logger *log.Logger) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := 0
+	var lastErr error
+	for round := 0; round < upstreamDialRounds; round++ {
+		if round > 0 {
+			select {
+			case <-time.After(d.retryBackoff):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w after %d attempts: %v", ctx.Err(), attempts, lastErr)
+			}
+		}
+
+		ips, cached, err := d.resolve(ctx, host)
+		if err == nil && len(ips) == 0 {
+			err = fmt.Errorf("no addresses found for %s", host)
+		}
+		if err == nil {
+			if ips = filterFamily(ips, d.family); len(ips) == 0 {
+				err = fmt.Errorf("no %s address found for %s", d.family, host)
+			}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		conn, started, winner, err := d.race(ctx, ips, port)
+		attempts += started
+		if err == nil {
+			logger.Printf("Connected to upstream %s at %s after %d attempt(s)", addr, conn.RemoteAddr(), attempts)
+			if round == 0 && winner == 0 {
+				stats.Inc("upstream_dial_first_try")
+			} else {
+				stats.Inc("upstream_dial_retried")
+			}
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w after %d attempts: %v", ctx.Err(), attempts, lastErr)
+		}
+
+		// The host may have moved, resolve it again for the next round
+		if cached {
+			d.cache.invalidate(host)
+		}
+	}
+	return nil, fmt.Errorf("all %d attempts failed, last error: %w", attempts, lastErr)
+}
+
+// nextUpstreamAddr returns the first resolved address of addr's host, in the
+// order in which the dialer tries them, that is not in tried, or "" if there
+// is none. tried holds the addresses of connections that failed; if none of
+// them is a resolved address, because they went through a proxy, there is no
+// next address either.
+func nextUpstreamAddr(ctx context.Context, addr string, tried []string, cfg *config.Config) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	d := newUpstreamDialer(cfg)
+	ips, _, err := d.resolve(ctx, host)
+	if err != nil {
+		return ""
+	}
+
+	next, found := "", false
+	for _, ip := range interleaveFamilies(filterFamily(ips, d.family)) {
+		candidate := net.JoinHostPort(ip.String(), port)
+		if slices.Contains(tried, candidate) {
+			found = true
+		} else if next == "" {
+			next = candidate
+		}
+	}
+	if !found {
+		return ""
+	}
+	return next
+}
+
+// filterFamily returns the addresses of ips in family. IPFamilyAuto and the
+// empty family keep all of them.
+func filterFamily(ips []net.IP, family config.IPFamily) []net.IP {
+	if family == "" || family == config.IPFamilyAuto {
+		return ips
+	}
+	var filtered []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (family == config.IPFamilyIPv4) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// race connects to one of ips using Happy Eyeballs (RFC 8305): the addresses
+// are tried in interleaved family order, and each further attempt starts when
+// the previous one fails or has been running for attemptDelay. The first
+// connection established wins and all other attempts are cancelled. race
+// returns the number of attempts started and the index of the winning one in
+// that order.
+func (d *upstreamDialer) race(ctx context.Context, ips []net.IP, port string) (conn net.Conn, started, winner int, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		attempt int
+		err     error
+	}
+	// Buffered, so that cancelled attempts never block
+	results := make(chan result, len(ips))
+
+	ips = interleaveFamilies(ips)
+	pending := 0
+	startNext := func() {
+		attempt, addr := started, net.JoinHostPort(ips[started].String(), port)
+		started++
+		pending++
+		go func() {
+			conn, err := d.dialContext(ctx, "tcp", addr)
+			results <- result{conn, attempt, err}
+		}()
+	}
+
+	startNext()
+	delay := time.NewTimer(d.attemptDelay)
+	defer delay.Stop()
+
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Close the connections of attempts that succeed after all
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, started, r.attempt, nil
+			}
+			err = r.err
+			if started < len(ips) {
+				startNext()
+				delay.Reset(d.attemptDelay)
+			}
+		case <-delay.C:
+			if started < len(ips) {
+				startNext()
+				delay.Reset(d.attemptDelay)
+			}
+		}
+	}
+	return nil, started, -1, err
+}
+
+// interleaveFamilies orders ips for connection attempts, alternating between
+// IPv6 and IPv4 addresses and starting with IPv6 (RFC 8305, section 4).
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	ordered := make([]net.IP, 0, len(ips))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			ordered = append(ordered, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			ordered = append(ordered, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return ordered
+}
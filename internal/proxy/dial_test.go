@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// fakeDialer accepts connections to the addresses in up, refuses all others,
+// and records every attempt. Attempts to addresses in latency take that long
+// to complete unless cancelled.
+type fakeDialer struct {
+	mu       sync.Mutex
+	up       map[string]bool
+	latency  map[string]time.Duration
+	attempts []string
+}
+
+func (d *fakeDialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.attempts = append(d.attempts, addr)
+	up, latency := d.up[addr], d.latency[addr]
+	d.mu.Unlock()
+
+	select {
+	case <-time.After(latency):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !up {
+		return nil, errors.New("connection refused")
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func (d *fakeDialer) attempted() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.attempts...)
+}
+
+// TestUpstreamDialRetries tests dialing across all addresses and retry rounds.
+func TestUpstreamDialRetries(t *testing.T) {
+	testCases := []struct {
+		name             string
+		firstIPs         []net.IP
+		secondIPs        []net.IP
+		up               []string
+		expectedAttempts []string
+		expectError      bool
+	}{
+		{
+			name:             "First address succeeds",
+			firstIPs:         []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)},
+			up:               []string{"192.0.2.1:443"},
+			expectedAttempts: []string{"192.0.2.1:443"},
+		},
+		{
+			name:             "Second address succeeds",
+			firstIPs:         []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)},
+			up:               []string{"192.0.2.2:443"},
+			expectedAttempts: []string{"192.0.2.1:443", "192.0.2.2:443"},
+		},
+		{
+			name:             "Retry round uses fresh resolution",
+			firstIPs:         []net.IP{net.IPv4(192, 0, 2, 1)},
+			secondIPs:        []net.IP{net.IPv4(192, 0, 2, 3)},
+			up:               []string{"192.0.2.3:443"},
+			expectedAttempts: []string{"192.0.2.1:443", "192.0.2.3:443"},
+		},
+		{
+			name:             "All attempts fail",
+			firstIPs:         []net.IP{net.IPv4(192, 0, 2, 1)},
+			expectedAttempts: []string{"192.0.2.1:443", "192.0.2.1:443"},
+			expectError:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver := &fakeResolver{ips: tc.firstIPs}
+			dialer := &fakeDialer{up: make(map[string]bool)}
+			for _, addr := range tc.up {
+				dialer.up[addr] = true
+			}
+			d := &upstreamDialer{
+				dialContext:  dialer.dialContext,
+				cache:        newDNSCache(resolver.lookupIP),
+				cacheTTL:     time.Minute,
+				attemptDelay: time.Second,
+				retryBackoff: time.Millisecond,
+			}
+
+			// Warm the cache, then move the host for the retry round
+			_, err := d.cache.resolve(context.Background(), "chat.signal.org", time.Minute)
+			require.NoError(t, err)
+			if tc.secondIPs != nil {
+				resolver.set(tc.secondIPs...)
+			}
+
+			conn, err := d.dial(context.Background(), "chat.signal.org:443", log.New(io.Discard, "", 0))
+			if tc.expectError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				conn.Close()
+			}
+			assert.Equal(t, tc.expectedAttempts, dialer.attempted())
+		})
+	}
+}
+
+// TestHappyEyeballs tests racing IPv6 and IPv4 attempts with controlled latencies.
+func TestHappyEyeballs(t *testing.T) {
+	v6, v4 := net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)
+	const v6Addr, v4Addr = "[2001:db8::1]:443", "192.0.2.1:443"
+	const attemptDelay = 100 * time.Millisecond
+
+	testCases := []struct {
+		name             string
+		up               map[string]bool
+		latency          map[string]time.Duration
+		expectedAttempts []string
+		maxElapsed       time.Duration
+	}{
+		{
+			name:             "Fast IPv6 wins alone",
+			up:               map[string]bool{v6Addr: true, v4Addr: true},
+			latency:          map[string]time.Duration{v6Addr: 10 * time.Millisecond},
+			expectedAttempts: []string{v6Addr},
+			maxElapsed:       attemptDelay,
+		},
+		{
+			name:             "Blackholed IPv6 falls back to IPv4 after the delay",
+			up:               map[string]bool{v4Addr: true},
+			latency:          map[string]time.Duration{v6Addr: time.Hour},
+			expectedAttempts: []string{v6Addr, v4Addr},
+			maxElapsed:       3 * attemptDelay,
+		},
+		{
+			name:             "Refused IPv6 falls back to IPv4 immediately",
+			up:               map[string]bool{v4Addr: true},
+			expectedAttempts: []string{v6Addr, v4Addr},
+			maxElapsed:       attemptDelay / 2,
+		},
+		{
+			name:             "Slow IPv6 beats slower IPv4",
+			up:               map[string]bool{v6Addr: true, v4Addr: true},
+			latency:          map[string]time.Duration{v6Addr: 2 * attemptDelay, v4Addr: time.Hour},
+			expectedAttempts: []string{v6Addr, v4Addr},
+			maxElapsed:       4 * attemptDelay,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialer := &fakeDialer{up: tc.up, latency: tc.latency}
+			d := &upstreamDialer{
+				dialContext:  dialer.dialContext,
+				attemptDelay: attemptDelay,
+			}
+
+			start := time.Now()
+			conn, _, _, err := d.race(context.Background(), []net.IP{v4, v6}, "443")
+			elapsed := time.Since(start)
+			require.NoError(t, err)
+			conn.Close()
+
+			assert.Equal(t, tc.expectedAttempts, dialer.attempted())
+			assert.Less(t, elapsed, tc.maxElapsed)
+		})
+	}
+}
+
+// TestInterleaveFamilies tests the address order for connection attempts.
+func TestInterleaveFamilies(t *testing.T) {
+	ips := []net.IP{
+		net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3),
+		net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"),
+	}
+	var ordered []string
+	for _, ip := range interleaveFamilies(ips) {
+		ordered = append(ordered, ip.String())
+	}
+	assert.Equal(t, []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}, ordered)
+}
+
+// TestUpstreamIPFamily checks that only addresses of the selected family are dialed.
+func TestUpstreamIPFamily(t *testing.T) {
+	v6, v4 := net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)
+	testCases := []struct {
+		name             string
+		family           config.IPFamily
+		ips              []net.IP
+		expectedAttempts []string
+		expectedError    string
+	}{
+		{
+			name:             "Auto dials both families",
+			family:           config.IPFamilyAuto,
+			ips:              []net.IP{v4, v6},
+			expectedAttempts: []string{"[2001:db8::1]:443", "192.0.2.1:443"},
+		},
+		{
+			name:             "IPv4 only",
+			family:           config.IPFamilyIPv4,
+			ips:              []net.IP{v4, v6},
+			expectedAttempts: []string{"192.0.2.1:443"},
+		},
+		{
+			name:             "IPv6 only",
+			family:           config.IPFamilyIPv6,
+			ips:              []net.IP{v4, v6},
+			expectedAttempts: []string{"[2001:db8::1]:443"},
+		},
+		{
+			name:          "No address of the family",
+			family:        config.IPFamilyIPv4,
+			ips:           []net.IP{v6},
+			expectedError: "no ipv4 address found for chat.signal.org",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Every address refuses, so that each allowed one is tried
+			dialer := &fakeDialer{up: make(map[string]bool)}
+			d := &upstreamDialer{
+				dialContext:  dialer.dialContext,
+				cache:        newDNSCache((&fakeResolver{ips: tc.ips}).lookupIP),
+				cacheTTL:     time.Minute,
+				attemptDelay: time.Second,
+				retryBackoff: time.Millisecond,
+				family:       tc.family,
+			}
+
+			_, err := d.dial(context.Background(), "chat.signal.org:443", log.New(io.Discard, "", 0))
+			require.Error(t, err)
+			if tc.expectedError != "" {
+				assert.Contains(t, err.Error(), tc.expectedError)
+				assert.Empty(t, dialer.attempted())
+				return
+			}
+			// The failed round is retried, compare the first one only
+			assert.Equal(t, tc.expectedAttempts, dialer.attempted()[:len(tc.expectedAttempts)])
+		})
+	}
+}
+
+// TestDialErrorClass tests the classification of dial errors.
+func TestDialErrorClass(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	testCases := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "Circuit open", err: errCircuitOpen, expected: "circuit_open"},
+		{name: "DNS", err: &net.DNSError{Err: "no such host", Name: "chat.signal.org", IsNotFound: true}, expected: "dns"},
+		{name: "Deadline", err: fmt.Errorf("%w after 2 attempts: %v", context.DeadlineExceeded, refused), expected: "timeout"},
+		{name: "Socket timeout", err: &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, expected: "timeout"},
+		{name: "Refused", err: fmt.Errorf("all 2 attempts failed, last error: %w", refused), expected: "refused"},
+		{name: "Unreachable", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, expected: "unreachable"},
+		{name: "Certificate", err: fmt.Errorf("TLS handshake with upstream proxy failed: %w", &tls.CertificateVerificationError{Err: errNoPinnedKey}), expected: "certificate"},
+		{name: "Other", err: errors.New("HTTP proxy refused CONNECT"), expected: "error"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, dialErrorClass(tc.err))
+		})
+	}
+}
+
+// TestDialLatencyRecorded checks that connections to upstreams record their
+// latency, and failed ones the class of their error.
+func TestDialLatencyRecorded(t *testing.T) {
+	up := startTestUpstream(t, "latency.test").Addr().String()
+	down := closedAddr(t)
+	logger := log.New(io.Discard, "", 0)
+	dial := NewHandler(&config.Config{}).dialDirect
+
+	conn := connectUpstream(up, []byte("hello"), dial, false, stats.Default, &config.Config{}, logger)
+	require.NotNil(t, conn)
+	conn.Close()
+	assert.Nil(t, connectUpstream(down, []byte("hello"), dial, false, stats.Default, &config.Config{}, logger))
+
+	dials := make(map[string]stats.DialStats)
+	for _, d := range stats.Dials.Snapshot() {
+		dials[d.Addr] = d
+	}
+	assert.Equal(t, int64(1), dials[up].Count)
+	assert.Positive(t, dials[up].P99Ms)
+	assert.Empty(t, dials[up].Failures)
+	assert.Zero(t, dials[down].Count)
+	assert.Equal(t, map[string]int64{"refused": 1}, dials[down].Failures)
+}
+
+// TestDialTimeout checks that -dial-timeout bounds connecting to an upstream,
+// and that its expiration is counted apart from sniff timeouts.
+func TestDialTimeout(t *testing.T) {
+	const sni = "dial-timeout.test"
+	startTestUpstream(t, sni)
+	// An HTTP proxy that never answers CONNECT stalls the dial
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer stalled.Close()
+	go func() {
+		for {
+			conn, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cfg := &config.Config{
+		SniffTimeout:      5 * time.Second,
+		DialTimeout:       100 * time.Millisecond,
+		UpstreamHTTPProxy: "http://" + stalled.Addr().String(),
+	}
+	dialTimeouts := stats.Default.Get("dial_timeouts")
+	sniffTimeouts := stats.Default.Get("sniff_timeouts")
+	logs := &lockedBuffer{}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestHandler(cfg, log.New(logs, "", 0)).Serve(serverConn, NewConnID())
+	}()
+
+	start := time.Now()
+	_, err = clientConn.Write(buildTestClientHello(t, sni))
+	require.NoError(t, err)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not give up on the stalled dial")
+	}
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Contains(t, logs.String(), "Timed out connecting to upstream")
+	assert.Equal(t, dialTimeouts+1, stats.Default.Get("dial_timeouts"))
+	assert.Equal(t, sniffTimeouts, stats.Default.Get("sniff_timeouts"))
+}
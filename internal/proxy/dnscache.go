@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// dnsRefreshTimeout bounds a background refresh of a cached resolution.
+const dnsRefreshTimeout = 5 * time.Second
+
+// upstreamDNS caches the resolutions of upstream hosts for all connections.
+var upstreamDNS = newDNSCache(net.DefaultResolver.LookupIP)
+
+// dnsEntry is a cached resolution of one host.
+type dnsEntry struct {
+	ips        []net.IP
+	expires    time.Time
+	refreshing bool
+}
+
+// dnsCache caches upstream host resolutions. The standard resolver does not
+// expose record TTLs, so entries live for a configured TTL instead. An entry
+// that is used shortly before it expires is refreshed in the background, so
+// that busy hosts never wait for a lookup. It is safe for concurrent use.
+type dnsCache struct {
+	lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+// newDNSCache creates an empty cache resolving hosts with lookupIP.
+func newDNSCache(lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)) *dnsCache {
+	return &dnsCache{
+		lookupIP: lookupIP,
+		entries:  make(map[string]*dnsEntry),
+	}
+}
+
+// cached returns the cached addresses of host if the entry has not expired.
+// Within the last fifth of its lifetime, the entry is refreshed in the background.
+func (c *dnsCache) cached(host string, ttl time.Duration) ([]net.IP, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[host]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	if time.Until(entry.expires) < ttl/5 && !entry.refreshing {
+		entry.refreshing = true
+		go c.refresh(host, ttl)
+	}
+	return entry.ips, true
+}
+
+// resolve looks host up and caches the result for ttl.
+func (c *dnsCache) resolve(ctx context.Context, host string, ttl time.Duration) ([]net.IP, error) {
+	ips, err := c.lookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[host] = &dnsEntry{ips: ips, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+	return ips, nil
+}
+
+// refresh resolves host again in the background. On failure the current entry
+// is kept until it expires.
+func (c *dnsCache) refresh(host string, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsRefreshTimeout)
+	defer cancel()
+
+	if _, err := c.resolve(ctx, host, ttl); err != nil {
+		stats.Inc("dns_refresh_errors")
+		c.mu.Lock()
+		if entry, ok := c.entries[host]; ok {
+			entry.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// invalidate drops the cached entry of host.
+func (c *dnsCache) invalidate(host string) {
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+}
+
+// lookup returns the addresses of host, from the cache if possible. cached
+// reports whether they came from the cache.
+func (c *dnsCache) lookup(ctx context.Context, host string, ttl time.Duration) (ips []net.IP, cached bool, err error) {
+	if ips, ok := c.cached(host, ttl); ok {
+		stats.Inc("dns_cache_hits")
+		return ips, true, nil
+	}
+	stats.Inc("dns_cache_misses")
+	ips, err = c.resolve(ctx, host, ttl)
+	return ips, false, err
+}
+
+// warm resolves every host in hosts. Failures are ignored: hosts that cannot be
+// resolved yet are looked up on first use.
+func (c *dnsCache) warm(hosts []string, ttl time.Duration) {
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), dnsRefreshTimeout)
+			defer cancel()
+			c.resolve(ctx, host, ttl)
+		}(host)
+	}
+	wg.Wait()
+}
+
+// upstreamHosts returns the distinct host names of the upstream addresses in routes.
+func upstreamHosts(routes StaticRouter) []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, addr := range routes {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil || seen[host] {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// WarmDNSCache resolves the upstream hosts of the configured routing map, so that
+// the first connections do not wait for DNS. It does nothing if the cache is
+// disabled or the upstreams are reached through an HTTP proxy, which resolves them.
+func WarmDNSCache(cfg *config.Config) {
+	if cfg.DNSCacheTTL <= 0 || cfg.UpstreamHTTPProxy != "" {
+		return
+	}
+
+	upstreamDNS.warm(upstreamHosts(configuredRoutes(cfg)), cfg.DNSCacheTTL)
+}
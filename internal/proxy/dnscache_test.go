@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver resolves every host to the current ips and counts lookups.
+type fakeResolver struct {
+	mu      sync.Mutex
+	ips     []net.IP
+	lookups int
+}
+
+func (r *fakeResolver) set(ips ...net.IP) {
+	r.mu.Lock()
+	r.ips = ips
+	r.mu.Unlock()
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func (r *fakeResolver) lookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return r.ips, nil
+}
+
+// TestDNSCacheLookup checks that lookups are served from the cache until invalidated.
+func TestDNSCacheLookup(t *testing.T) {
+	resolver := &fakeResolver{ips: []net.IP{net.IPv4(127, 0, 0, 1)}}
+	cache := newDNSCache(resolver.lookupIP)
+
+	_, cached, err := cache.lookup(context.Background(), "chat.signal.org", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, cached)
+
+	ips, cached, err := cache.lookup(context.Background(), "chat.signal.org", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, "127.0.0.1", ips[0].String())
+	assert.Equal(t, 1, resolver.count())
+
+	cache.invalidate("chat.signal.org")
+	_, cached, err = cache.lookup(context.Background(), "chat.signal.org", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, cached)
+	assert.Equal(t, 2, resolver.count())
+}
+
+// TestDNSCacheRefresh checks that an entry close to expiry is refreshed in the background.
+func TestDNSCacheRefresh(t *testing.T) {
+	resolver := &fakeResolver{ips: []net.IP{net.IPv4(127, 0, 0, 1)}}
+	cache := newDNSCache(resolver.lookupIP)
+
+	_, err := cache.resolve(context.Background(), "chat.signal.org", time.Minute)
+	require.NoError(t, err)
+
+	// Move the entry into the refresh window; the stale address is still served
+	cache.mu.Lock()
+	cache.entries["chat.signal.org"].expires = time.Now().Add(5 * time.Second)
+	cache.mu.Unlock()
+	resolver.set(net.IPv4(127, 0, 0, 2))
+
+	ips, ok := cache.cached("chat.signal.org", time.Minute)
+	require.True(t, ok)
+	assert.Equal(t, "127.0.0.1", ips[0].String())
+
+	assert.Eventually(t, func() bool {
+		ips, ok := cache.cached("chat.signal.org", time.Minute)
+		return ok && ips[0].String() == "127.0.0.2"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, resolver.count())
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"log"
+	"os"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stealth"
+)
+
+// favicon returns the /favicon.ico of -stealth-favicon, or false to answer
+// with the 404 page like a stock install without one.
+func favicon(cfg *config.Config, logger *log.Logger) ([]byte, bool) {
+	switch cfg.StealthFavicon {
+	case "":
+		return nil, false
+	case config.StealthFaviconGeneric:
+		return stealth.GenericFavicon, true
+	}
+	// Read on every request, like the robots.txt file
+	icon, err := os.ReadFile(cfg.StealthFavicon)
+	if err != nil {
+		logger.Printf("Failed to read favicon file %s: %v", cfg.StealthFavicon, err)
+		return nil, false
+	}
+	return icon, true
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stealth"
+)
+
+// TestFavicon checks the /favicon.ico of every -stealth-favicon choice.
+func TestFavicon(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "favicon.ico")
+	require.NoError(t, os.WriteFile(path, []byte{0x00, 0x00, 0x01, 0x00, 0xff}, 0600))
+
+	testCases := []struct {
+		name         string
+		favicon      string
+		expectedIcon []byte
+		expectedOK   bool
+	}{
+		{name: "Default"},
+		{name: "Generic", favicon: config.StealthFaviconGeneric, expectedIcon: stealth.GenericFavicon, expectedOK: true},
+		{name: "File", favicon: path, expectedIcon: []byte{0x00, 0x00, 0x01, 0x00, 0xff}, expectedOK: true},
+		{name: "Missing file", favicon: filepath.Join(t.TempDir(), "missing.ico")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			icon, ok := favicon(&config.Config{StealthFavicon: tc.favicon}, log.New(io.Discard, "", 0))
+			assert.Equal(t, tc.expectedOK, ok)
+			assert.Equal(t, tc.expectedIcon, icon)
+		})
+	}
+}
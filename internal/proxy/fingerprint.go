@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"signalgoproxy/internal/stats"
+)
+
+// maxJA3Counters bounds the number of distinct per-fingerprint counters, so that
+// clients sending random ClientHellos cannot grow the stats without limit.
+const maxJA3Counters = 256
+
+// fingerprinted is implemented by client connections that recorded the
+// ClientHello of their outer TLS handshake.
+type fingerprinted interface {
+	JA3() string
+}
+
+// ja3Seen holds the fingerprints that have their own counter.
+var ja3Seen = struct {
+	sync.Mutex
+	m map[string]struct{}
+}{m: make(map[string]struct{})}
+
+// clientJA3 returns the JA3 fingerprint of the outer TLS handshake, or an empty
+// string if it was not recorded.
+func clientJA3(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	if f, ok := tlsConn.NetConn().(fingerprinted); ok {
+		return f.JA3()
+	}
+	return ""
+}
+
+// countJA3 counts a connection with the given fingerprint in st. Fingerprints
+// beyond the first maxJA3Counters distinct ones are counted as "ja3:other".
+func countJA3(ja3 string, st *stats.Stats) {
+	ja3Seen.Lock()
+	_, seen := ja3Seen.m[ja3]
+	if !seen && len(ja3Seen.m) < maxJA3Counters {
+		ja3Seen.m[ja3] = struct{}{}
+		seen = true
+	}
+	ja3Seen.Unlock()
+
+	if seen {
+		st.Inc("ja3:" + ja3)
+	} else {
+		st.Inc("ja3:other")
+	}
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"signalgoproxy/internal/stats"
+)
+
+// TestCountJA3Cap checks that fingerprints beyond the cap share one counter.
+func TestCountJA3Cap(t *testing.T) {
+	ja3Seen.Lock()
+	saved := ja3Seen.m
+	ja3Seen.m = make(map[string]struct{})
+	ja3Seen.Unlock()
+	defer func() {
+		ja3Seen.Lock()
+		ja3Seen.m = saved
+		ja3Seen.Unlock()
+	}()
+
+	st := stats.New()
+	for i := 0; i < maxJA3Counters+10; i++ {
+		countJA3(fmt.Sprintf("test-%d", i), st)
+	}
+	countJA3("test-0", st)
+
+	assert.Equal(t, int64(2), st.Get("ja3:test-0"))
+	assert.Equal(t, int64(10), st.Get("ja3:other"))
+}
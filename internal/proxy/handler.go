@@ -2,19 +2,27 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"context"
 	"crypto/tls"
-	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"golang.org/x/crypto/cryptobyte"
 	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
 	"signalgoproxy/internal/stealth"
 )
 
@@ -45,211 +53,864 @@ var signalUpstreams = map[string]string{
 	"updates2.signal.org":     "updates2.signal.org:443",
 }
 
-// HandleConnection is the main handler for incoming TLS connections.
-func HandleConnection(conn net.Conn, cfg *config.Config) {
+// DefaultUpstreams returns a copy of the built-in routing map.
+func DefaultUpstreams() map[string]string {
+	return maps.Clone(signalUpstreams)
+}
+
+// Dialer opens network connections. *net.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Handler serves the connections accepted by the proxy: it sniffs their
+// protocol, routes the inner SNI of Signal TLS and relays it to the upstream.
+// Create it with NewHandler; its fields must not change while it serves
+// connections.
+type Handler struct {
+	// Config holds the options of the handled connections.
+	Config *config.Config
+	// Router resolves inner SNIs to upstream addresses.
+	Router config.Router
+	// Dialer connects to upstreams, passthrough backends and decoys, also
+	// ahead for the pool of -upstream-pool-size, for -verify-upstreams and for
+	// CheckUpstreams.
+	Dialer Dialer
+	// Stats receives the counters of the handler. Lower layers, such as the
+	// upstream dialer and the ban list, count in stats.Default.
+	Stats *stats.Stats
+	// Logger receives the messages about the handled connections, prefixed
+	// with their ID.
+	Logger *log.Logger
+}
+
+// NewHandler creates a handler for the connections of cfg, routing with the
+// router of cfg, dialing with a net.Dialer and counting in stats.Default.
+func NewHandler(cfg *config.Config) *Handler {
+	return &Handler{
+		Config: cfg,
+		Router: routerOf(cfg),
+		Dialer: &net.Dialer{},
+		Stats:  stats.Default,
+		Logger: cfg.Log(),
+	}
+}
+
+// Handle serves conn under a new connection ID.
+func (h *Handler) Handle(conn net.Conn) {
+	h.Serve(conn, NewConnID())
+}
+
+// Serve serves conn under the connection ID id, which the caller may already
+// have used for its own messages about conn, see NewConnLogger.
+func (h *Handler) Serve(conn net.Conn, id string) {
 	defer conn.Close()
+	cfg := h.Config
+	logger := NewConnLogger(h.Logger, id)
+
+	tc := Connections.Register(id, conn)
+	defer Connections.Remove(tc.ID)
+	h.Stats.Inc("connections_total")
 
-	bufReader := bufio.NewReader(conn)
+	ja3 := clientJA3(conn)
+	if ja3 != "" {
+		tc.setJA3(ja3)
+		countJA3(ja3, h.Stats)
+	}
+	if country := clientCountry(conn.RemoteAddr(), cfg); country != "" {
+		tc.setCountry(country)
+		h.Stats.Inc("country:" + country)
+		// Tag every message about the connection with the country of its client
+		logger = log.New(logger.Writer(), logger.Prefix()+"["+country+"] ", logger.Flags())
+	}
+
+	// Bound sniffing and SNI parsing so that stalled clients cannot pin the goroutine
+	if cfg.SniffTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(cfg.SniffTimeout))
+	}
+
+	// Failed connections can be inspected with -debug-capture
+	var reader io.Reader = conn
+	capture := newCaptureReader(conn, cfg)
+	if capture != nil {
+		reader = capture
+	}
+	bufReader := bufio.NewReader(reader)
 
-	protocol, _, err := sniffProtocol(bufReader)
+	protocol, peeked, err := sniffProtocol(bufReader)
 	if err != nil {
-		log.Printf("Protocol sniffing error: %v", err)
+		capture.save(tc, err, cfg)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Printf("Protocol sniffing timed out for %s", ClientAddr(conn.RemoteAddr()))
+			h.Stats.Inc("sniff_timeouts")
+			return
+		}
+		logger.Printf("Protocol sniffing error: %v", err)
+		h.Stats.Inc("sniff_errors")
 		return
 	}
+	logger.Printf("Connection from %s detected as %s", ClientAddr(conn.RemoteAddr()), protocol)
+	tc.setProtocol(protocol)
+	h.Stats.Inc("protocol_" + protocol.String())
 
 	switch protocol {
 	case ProtoSignalTLS:
-		handleSignalProxy(bufReader, conn)
+		h.handleSignalProxy(bufReader, conn, tc, capture, ja3, logger)
 	case ProtoHTTP:
-		handleStealth(bufReader, conn, cfg)
+		h.handleStealth(bufReader, conn, logger)
 	default:
-		log.Printf("Unknown protocol from %s, closing connection.", conn.RemoteAddr())
+		if protocol.IsProbe() {
+			logger.Printf("Probe from %s identified as %s (JA3 %s), closing connection.", ClientAddr(conn.RemoteAddr()), protocol, ja3)
+			return
+		}
+		if cfg.Debug {
+			logger.Printf("Debug: first bytes from %s: %s", ClientAddr(conn.RemoteAddr()), hex.EncodeToString(peeked))
+		}
+		h.handleUnknown(bufReader, conn, ja3, logger)
 	}
 }
 
-// handleSignalProxy handles traffic destined for Signal.
-func handleSignalProxy(reader io.Reader, clientConn net.Conn) {
-	serverName, rawClientHello, err := getSNI(reader)
+// handleUnknown answers a connection of an unrecognized protocol according to
+// cfg.UnknownProtocolAction.
+func (h *Handler) handleUnknown(reader io.Reader, conn net.Conn, ja3 string, logger *log.Logger) {
+	cfg := h.Config
+	switch cfg.UnknownProtocolAction {
+	case config.UnknownHTTP400:
+		response := badRequestResponse(cfg)
+		if response == nil {
+			// Without a persona there is no web server to imitate.
+			logger.Printf("Unknown protocol from %s (JA3 %s), closing connection.", ClientAddr(conn.RemoteAddr()), ja3)
+			return
+		}
+		logger.Printf("Unknown protocol from %s (JA3 %s), responding with 400 Bad Request.", ClientAddr(conn.RemoteAddr()), ja3)
+		h.Stats.Inc("unknown_http400")
+		if _, err := conn.Write(response); err != nil {
+			logger.Printf("Error writing 400 response: %v", err)
+		}
+	case config.UnknownTarpit:
+		if !tarpits.acquire() {
+			logger.Printf("Unknown protocol from %s (JA3 %s), tarpit full, closing connection.", ClientAddr(conn.RemoteAddr()), ja3)
+			return
+		}
+		logger.Printf("Unknown protocol from %s (JA3 %s), tarpitting for up to %s.", ClientAddr(conn.RemoteAddr()), ja3, tarpits.duration)
+		h.Stats.Inc("unknown_tarpitted")
+		tarpits.hold(reader, conn, tarpitResponse(cfg))
+	default:
+		logger.Printf("Unknown protocol from %s (JA3 %s), closing connection.", ClientAddr(conn.RemoteAddr()), ja3)
+	}
+}
+
+// handleSignalProxy handles traffic destined for Signal. capture, if not nil,
+// holds the first bytes of the connection for -debug-capture.
+func (h *Handler) handleSignalProxy(reader io.Reader, clientConn net.Conn, tc *TrackedConn, capture *captureReader, ja3 string, logger *log.Logger) {
+	cfg := h.Config
+	maxHelloLen := cfg.MaxClientHelloSize
+	if maxHelloLen == 0 {
+		maxHelloLen = config.DefaultMaxClientHelloSize
+	}
+	hello, rawClientHello, err := parseClientHelloLimit(reader, maxHelloLen)
 	if err != nil {
-		log.Printf("Failed to get inner SNI from %s: %v", clientConn.RemoteAddr(), err)
+		capture.save(tc, err, cfg)
+		if errors.Is(err, errClientHelloTooLarge) {
+			logger.Printf("Inner ClientHello from %s exceeds the size limit: %v", ClientAddr(clientConn.RemoteAddr()), err)
+			h.Stats.Inc("client_hello_too_large")
+			offend(clientConn, OffenseClientHelloTooLarge, cfg, logger)
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Printf("Timed out reading inner ClientHello from %s", ClientAddr(clientConn.RemoteAddr()))
+			h.Stats.Inc("sniff_timeouts")
+			return
+		}
+		kind := clientHelloErrorKind(err)
+		logger.Printf("Failed to get inner SNI from %s (%s): %v", ClientAddr(clientConn.RemoteAddr()), kind, err)
+		h.Stats.Inc("sni_errors")
+		h.Stats.Inc("sni_errors:" + kind)
+		// A client giving up on a poor link is no probe
+		if !errors.Is(err, ErrTruncatedHello) {
+			offend(clientConn, OffenseUnparsableHello, cfg, logger)
+		}
 		return
 	}
-	log.Printf("Inner SNI '%s' detected from %s", serverName, clientConn.RemoteAddr())
+	serverName := hello.ServerName
+	logger.Printf("Inner SNI '%s' detected from %s (JA3 %s, ALPN %s)", serverName, ClientAddr(clientConn.RemoteAddr()), ja3, formatALPN(hello.ALPN))
+	tc.setSNI(serverName)
+	if hello.ECH {
+		logger.Printf("Inner ClientHello from %s uses Encrypted Client Hello, the inner SNI is encrypted and '%s' is its public name", ClientAddr(clientConn.RemoteAddr()), serverName)
+		h.Stats.Inc("ech_detected")
+	}
 
-	upstreamAddr, ok := signalUpstreams[strings.ToLower(serverName)]
+	if len(cfg.RequireALPN) > 0 && !slices.ContainsFunc(hello.ALPN, func(p string) bool { return slices.Contains(cfg.RequireALPN, p) }) {
+		logger.Printf("Rejected inner ClientHello from %s: ALPN %s does not match the required protocols", ClientAddr(clientConn.RemoteAddr()), formatALPN(hello.ALPN))
+		h.Stats.Inc("alpn_rejected")
+		return
+	}
+
+	if denied(serverName, cfg) {
+		logDenied(logger, serverName, ClientAddr(clientConn.RemoteAddr()))
+		h.Stats.Inc("sni_denylisted")
+		offend(clientConn, OffenseDenylistedSNI, cfg, logger)
+		return
+	}
+
+	action := ActionProxy
+	dial := h.dialUpstream
+	var upstreamAddr string
+	var bySuffix, ok bool
+	if cfg.UpstreamProxy != "" {
+		// The next proxy routes the inner SNI itself
+		action, dial = ActionUpstreamProxy, h.dialUpstreamProxy
+		upstreamAddr, ok = cfg.UpstreamProxy, true
+	} else {
+		upstreamAddr, bySuffix, ok = route(serverName, h.Router, cfg)
+	}
+	if ok && action == ActionProxy && isOwnDomain(serverName, cfg) {
+		// Routing our own domain would at best reach ourselves again
+		logger.Printf("Inner SNI '%s' is our own domain, not routing it to avoid a proxy loop", serverName)
+		h.Stats.Inc("sni_loops")
+		ok = false
+	}
+	if ok && bySuffix && hello.ECH {
+		// The public name only says where the encrypted name may be served, so
+		// it is trusted for listed names alone
+		logger.Printf("Inner SNI '%s' is the public name of an encrypted ClientHello, not routing it by suffix", serverName)
+		ok = false
+	}
 	if !ok {
-		log.Printf("Denied connection for unknown inner SNI: %s", serverName)
+		if upstreamAddr, ok = passthrough(serverName, cfg); ok {
+			logger.Printf("Passing inner SNI '%s' through to %s", serverName, upstreamAddr)
+			h.Stats.Inc("sni_passthrough")
+			action = ActionPassthrough
+			dial = h.dialDirect
+		}
+	}
+	if !ok {
+		switch cfg.UnknownSNIAction {
+		case config.UnknownSNIStealth:
+			if !strings.EqualFold(serverName, cfg.Domain) || cfg.InnerTLS == nil {
+				logger.Printf("Cannot serve the stealth page for unknown inner SNI %s, it is not our domain", serverName)
+				h.dropUnknownSNI(clientConn, tc, serverName, logger)
+				return
+			}
+			h.serveInnerStealth(reader, clientConn, rawClientHello, tc, serverName, logger)
+			return
+		case config.UnknownSNIForward:
+			logger.Printf("Forwarding connection for unknown inner SNI %s to decoy %s", serverName, cfg.UnknownSNIForward)
+			h.Stats.Inc("sni_forwarded")
+			action = string(config.UnknownSNIForward)
+			upstreamAddr = cfg.UnknownSNIForward
+			// The decoy is usually local, so it is not reached through the upstream proxy
+			dial = h.dialDirect
+		default:
+			h.dropUnknownSNI(clientConn, tc, serverName, logger)
+			return
+		}
+	}
+	if bySuffix {
+		logger.Printf("Inner SNI '%s' is not in the routing map, routing by suffix to %s", serverName, upstreamAddr)
+		h.Stats.Inc("sni_suffix_routed")
+	}
+
+	// The slot is released by the deferred call on every return path, also
+	// when the handler panics or the connection is closed on shutdown
+	sniStats := stats.SNI.Get(strings.ToLower(serverName))
+	active := sniStats.Active.Add(1)
+	defer sniStats.Active.Add(-1)
+	if cfg.MaxConnsPerSNI > 0 && active > int64(cfg.MaxConnsPerSNI) {
+		h.rejectSNILimit(clientConn, tc, serverName, action, logger)
 		return
 	}
 
-	upstreamConn, err := net.DialTimeout("tcp", upstreamAddr, 10*time.Second)
-	if err != nil {
-		log.Printf("Failed to connect to upstream %s: %v", upstreamAddr, err)
+	// Only the upstreams of the routing map are pooled, not whatever name a
+	// client sends under -allow-signal-suffix
+	pooled := action == ActionProxy && !bySuffix
+	upstreamConn := connectUpstream(upstreamAddr, rawClientHello, dial, pooled, h.Stats, cfg, logger)
+	if upstreamConn == nil {
 		return
 	}
 	defer upstreamConn.Close()
+	if action == ActionProxy {
+		verifyUpstreamInBackground(upstreamAddr, serverName, h.dialUpstream, h.Stats, cfg, logger)
+	}
+	markDSCP(clientConn, upstreamConn, serverName, cfg, logger)
 
-	if _, err = upstreamConn.Write(rawClientHello); err != nil {
-		log.Printf("Failed to write inner ClientHello to upstream: %v", err)
+	if !tc.setUpstream(upstreamAddr, upstreamConn) {
+		logger.Printf("Connection for %s was closed before proxying started", serverName)
 		return
 	}
 
-	log.Printf("Proxying traffic for %s to %s", serverName, upstreamAddr)
+	// The relay phase is long-lived and must not inherit the sniffing deadline
+	clientConn.SetReadDeadline(time.Time{})
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	sniStats.Connections.Add(1)
+	tc.bytesIn.Add(int64(len(rawClientHello)))
+	sniStats.BytesIn.Add(int64(len(rawClientHello)))
+
+	logger.Printf("Proxying traffic for %s to %s", serverName, upstreamAddr)
+	if action == ActionProxy || action == ActionUpstreamProxy {
+		h.Stats.Inc("signal_proxied")
+	}
+
+	// Both directions count toward the limit, starting with the ClientHello
+	limit := newByteLimit(cfg.MaxBytesPerConn, int64(len(rawClientHello)), func() { tc.closeWith(CloseByteLimit) })
+	results := make(chan relayResult, 2)
 
 	go func() {
-		defer wg.Done()
-		bufPtr := bufferPool.Get().(*[]byte)
-		defer bufferPool.Put(bufPtr)
-		io.CopyBuffer(upstreamConn, clientConn, *bufPtr)
-		if tcpConn, ok := upstreamConn.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
-		}
+		// Bytes the client sent right after the ClientHello may still sit in
+		// the buffer of the sniffing reader.
+		r := relayDirection(upstreamConn, clientSource(reader, clientConn), true, &tc.bytesIn, &sniStats.BytesIn, limit, cfg)
+		closeWrite(upstreamConn)
+		results <- r
 	}()
 
 	go func() {
-		defer wg.Done()
-		bufPtr := bufferPool.Get().(*[]byte)
-		defer bufferPool.Put(bufPtr)
-		io.CopyBuffer(clientConn, upstreamConn, *bufPtr)
-		if tlsConn, ok := clientConn.(*tls.Conn); ok {
-			tlsConn.CloseWrite()
-		}
+		r := relayDirection(clientConn, upstreamConn, false, &tc.bytesOut, &sniStats.BytesOut, limit, cfg)
+		closeWrite(clientConn)
+		results <- r
 	}()
 
-	wg.Wait()
-	log.Printf("Connection for %s closed", serverName)
+	// The direction that ends first tells why the connection ended
+	first := <-results
+	second := <-results
+	bytesIn, bytesOut := first.bytes, second.bytes
+	if !first.fromClient {
+		bytesIn, bytesOut = second.bytes, first.bytes
+	}
+	bytesIn += int64(len(rawClientHello))
+
+	h.Stats.Add("bytes_in", bytesIn)
+	h.Stats.Add("bytes_out", bytesOut)
+
+	rec := accessRecord{
+		Time:     time.Now(),
+		ID:       tc.ID,
+		ClientIP: clientIP(clientConn.RemoteAddr()),
+		Country:  tc.country,
+		SNI:      serverName,
+		Upstream: upstreamAddr,
+		Action:   action,
+		Duration: time.Since(tc.started).Seconds(),
+		BytesIn:  bytesIn,
+		BytesOut: bytesOut,
+	}
+	rec.Reason, rec.Direction = closeReason(first, tc.forcedCloseReason())
+	if rec.Reason == CloseError {
+		rec.Error = first.err.Error()
+	}
+	if rec.Reason == CloseByteLimit {
+		logger.Printf("Truncated connection for %s after %d bytes, the limit is %d bytes", serverName, bytesIn+bytesOut, cfg.MaxBytesPerConn)
+		h.Stats.Inc("conn_byte_limited")
+	}
+	h.Stats.Inc("relay_closed:" + rec.Direction + ":" + rec.Reason)
+	logAccess(logger, cfg.LogFormat, rec)
+}
+
+// dropUnknownSNI closes a connection for an inner SNI without a route.
+func (h *Handler) dropUnknownSNI(clientConn net.Conn, tc *TrackedConn, serverName string, logger *log.Logger) {
+	cfg := h.Config
+	logger.Printf("Denied connection for unknown inner SNI: %s", serverName)
+	h.Stats.Inc("sni_denied")
+	offend(clientConn, OffenseUnknownSNI, cfg, logger)
+	logAccess(logger, cfg.LogFormat, accessRecord{
+		Time:     time.Now(),
+		ID:       tc.ID,
+		ClientIP: clientIP(clientConn.RemoteAddr()),
+		Country:  tc.country,
+		SNI:      serverName,
+		Action:   string(config.UnknownSNIDrop),
+		Duration: time.Since(tc.started).Seconds(),
+		Reason:   CloseDenied,
+	})
+}
+
+// rejectSNILimit logs a connection rejected because -max-conns-per-sni
+// connections are already proxied for its inner SNI.
+func (h *Handler) rejectSNILimit(clientConn net.Conn, tc *TrackedConn, serverName, action string, logger *log.Logger) {
+	cfg := h.Config
+	logger.Printf("Rejected connection for %s from %s: sni concurrency limit of %d reached", serverName, ClientAddr(clientConn.RemoteAddr()), cfg.MaxConnsPerSNI)
+	h.Stats.Inc("sni_concurrency_limited")
+	logAccess(logger, cfg.LogFormat, accessRecord{
+		Time:     time.Now(),
+		ID:       tc.ID,
+		ClientIP: clientIP(clientConn.RemoteAddr()),
+		Country:  tc.country,
+		SNI:      serverName,
+		Action:   action,
+		Duration: time.Since(tc.started).Seconds(),
+		Reason:   CloseSNILimit,
+	})
+}
+
+// dialUpstream connects to an upstream as configured in cfg, through h.Dialer.
+func (h *Handler) dialUpstream(addr string, cfg *config.Config, logger *log.Logger) (net.Conn, error) {
+	return dialUpstreamVia(h.Dialer, addr, cfg, logger)
+}
+
+// dialUpstreamProxy connects to the Signal proxy of -upstream-proxy, through
+// h.Dialer.
+func (h *Handler) dialUpstreamProxy(addr string, cfg *config.Config, logger *log.Logger) (net.Conn, error) {
+	return dialUpstreamProxyVia(h.dialUpstream, addr, cfg, logger)
+}
+
+// dialDirect connects to addr without -upstream-http-proxy, for the decoy
+// backend of config.UnknownSNIForward and the backends of config.Passthrough.
+func (h *Handler) dialDirect(addr string, cfg *config.Config, logger *log.Logger) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout(cfg))
+	defer cancel()
+	return h.Dialer.DialContext(ctx, "tcp", addr)
+}
+
+// replayConn is a connection whose reads are served from r, which replays bytes
+// already consumed from the connection before reading from it again.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// serveInnerStealth terminates the inner TLS connection with our own certificate
+// and serves the stealth page inside it, like a web server hosting our domain.
+func (h *Handler) serveInnerStealth(reader io.Reader, clientConn net.Conn, rawClientHello []byte, tc *TrackedConn, serverName string, logger *log.Logger) {
+	cfg := h.Config
+	logger.Printf("Serving the stealth page for unknown inner SNI %s to %s", serverName, ClientAddr(clientConn.RemoteAddr()))
+	h.Stats.Inc("sni_stealth_served")
+
+	rec := accessRecord{
+		ID:       tc.ID,
+		ClientIP: clientIP(clientConn.RemoteAddr()),
+		Country:  tc.country,
+		SNI:      serverName,
+		Action:   string(config.UnknownSNIStealth),
+		Reason:   CloseServed,
+	}
+
+	// The sniffing deadline still bounds the inner handshake and the request
+	innerConn := tls.Server(replayConn{clientConn, io.MultiReader(bytes.NewReader(rawClientHello), reader)}, cfg.InnerTLS)
+	if err := innerConn.Handshake(); err != nil {
+		logger.Printf("Inner TLS handshake with %s failed: %v", ClientAddr(clientConn.RemoteAddr()), err)
+		rec.Reason = CloseError
+		rec.Error = err.Error()
+	} else {
+		h.handleStealth(bufio.NewReader(innerConn), innerConn, logger)
+		innerConn.Close()
+	}
+
+	rec.Time = time.Now()
+	rec.Duration = time.Since(tc.started).Seconds()
+	logAccess(logger, cfg.LogFormat, rec)
+}
+
+// maxStealthBodySize caps how much of a request body handleStealth drains
+// before responding, so that the client is not reset while still sending. The
+// connection of a request with a larger body is closed after the response.
+const maxStealthBodySize = 64 << 10
+
+// maxStealthHeaderSize bounds the request line and headers of a stealth
+// request together, like the large_client_header_buffers of nginx. Larger
+// heads are answered with the 400 page of the persona without being read.
+const maxStealthHeaderSize = 8 << 10
+
+// errHeaderTooLarge reports a request head over maxStealthHeaderSize.
+var errHeaderTooLarge = errors.New("request header too large")
+
+// bufferHead waits until the head of the next request, up to the empty line
+// ending its headers, is buffered in r, which must hold maxStealthHeaderSize
+// bytes. It returns errHeaderTooLarge for a longer head, so that the request
+// is never read past the limit, and the read error if the head is cut short.
+func bufferHead(r *bufio.Reader) error {
+	for scanned := 0; ; {
+		buf, _ := r.Peek(r.Buffered())
+		// Only the newly buffered bytes, and the two before them that may
+		// start the end of the head, are scanned again
+		tail := buf[max(scanned-2, 0):]
+		if bytes.Contains(tail, []byte("\n\n")) || bytes.Contains(tail, []byte("\n\r\n")) {
+			return nil
+		}
+		if len(buf) >= maxStealthHeaderSize {
+			return errHeaderTooLarge
+		}
+		scanned = len(buf)
+		if _, err := r.Peek(len(buf) + 1); err != nil {
+			return err
+		}
+	}
+}
+
+// badRequestResponse returns the 400 Bad Request page of the persona of cfg,
+// or nil without a persona to imitate.
+func badRequestResponse(cfg *config.Config) []byte {
+	if cfg.StealthMode == config.StealthProxy {
+		return stealth.GetNginxBadRequestResponse().Bytes()
+	}
+	if p, ok := personaOf(cfg); ok {
+		return p.badRequest().WithServer(p.server).Bytes()
+	}
+	return nil
+}
+
+// requestSummary describes req for the stealth log messages.
+func requestSummary(req *http.Request) string {
+	return fmt.Sprintf("%s %s (Host %q, User-Agent %q)", req.Method, req.URL.RequestURI(), req.Host, req.UserAgent())
+}
+
+// acceptsGzip reports whether req advertises support for gzip in its
+// Accept-Encoding header, with a non-zero quality.
+func acceptsGzip(req *http.Request) bool {
+	for _, field := range req.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(field, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			quality, err := strconv.ParseFloat(q, 64)
+			return err == nil && quality > 0
+		}
+	}
+	return false
 }
 
 // handleStealth responds to HTTP requests with a stealth page to provide camouflage.
-func handleStealth(clientReader *bufio.Reader, conn net.Conn, cfg *config.Config) {
-	var response []byte
+// The first request is read from clientReader before responding, within the
+// read deadline already set on conn, and a malformed one gets the 400 page of
+// the persona, like a real web server would send. Like a real web server, it
+// then keeps the connection alive for more requests.
+func (h *Handler) handleStealth(clientReader *bufio.Reader, conn net.Conn, logger *log.Logger) {
+	cfg := h.Config
+	clientReader = bufio.NewReaderSize(clientReader, maxStealthHeaderSize)
 
 	switch cfg.StealthMode {
-	case config.StealthNginx:
-		log.Printf("Stealth mode: Serving full fake Nginx page to %s", conn.RemoteAddr())
-		response = stealth.GetNginxResponse()
-	case config.StealthApache:
-		log.Printf("Stealth mode: Serving full fake Apache page to %s", conn.RemoteAddr())
-		response = stealth.GetApacheResponse()
 	case config.StealthProxy:
-		log.Printf("Stealth mode: Proxying to %s for %s", cfg.ProxyURL, conn.RemoteAddr())
-		stealth.ProxyRequest(clientReader, conn, cfg.ProxyURL)
+		if err := bufferHead(clientReader); errors.Is(err, errHeaderTooLarge) {
+			logger.Printf("Stealth mode: Request header from %s over %d bytes, serving fake Nginx 400 page", ClientAddr(conn.RemoteAddr()), maxStealthHeaderSize)
+			h.Stats.Inc("stealth_header_too_large")
+			conn.Write(stealth.GetNginxBadRequestResponse().Close().Bytes())
+			return
+		}
+		logger.Printf("Stealth mode: Proxying to %s for %s", cfg.ProxyURL, ClientAddr(conn.RemoteAddr()))
+		domain := cfg.Domain
+		if cfg.StealthIgnoreHost {
+			domain = ""
+		}
+		stealth.ProxyRequest(clientReader, conn, cfg.ProxyURL, domain, logger)
 		return
 	case config.StealthNone:
 		// In "none" mode, just close the connection.
 		return
-	default:
+	}
+	p, ok := personaOf(cfg)
+	if !ok {
 		// Fallback for an unknown stealth mode.
-		log.Printf("Unknown stealth mode '%s', closing connection.", cfg.StealthMode)
+		logger.Printf("Unknown stealth mode '%s', closing connection.", cfg.StealthMode)
 		return
 	}
+	vhost, ok := defaultVhostOf(cfg)
+	if !ok || cfg.StealthIgnoreHost {
+		vhost = p
+	}
 
-	_, err := conn.Write(response)
-	if err != nil {
-		log.Printf("Error writing stealth response: %v", err)
+	// Serve requests until the client closes the connection or leaves it
+	// idle, or the connection has served its share of them
+	for served := 1; h.serveStealthRequest(p, vhost, served, clientReader, conn, logger); served++ {
+		conn.SetReadDeadline(time.Now().Add(cfg.StealthKeepAliveTimeout))
 	}
+	conn.SetReadDeadline(time.Time{})
 }
 
-// getSNI reads from the connection, parses the TLS ClientHello message,
-// and extracts the Server Name Indication (SNI) extension.
-// It returns the found server name, the raw ClientHello bytes, and any error.
-// This implementation uses cryptobyte for robust and efficient parsing.
-func getSNI(reader io.Reader) (string, []byte, error) {
-	// Read the TLS record header.
-	header := make([]byte, 5)
-	if _, err := io.ReadFull(reader, header); err != nil {
-		return "", nil, fmt.Errorf("failed to read TLS record header: %w", err)
+// serveStealthRequest reads a request from clientReader and answers it as p,
+// or as vhost if it is for another host than the domain, the served-th
+// request on conn. It reports whether the connection is kept
+// alive for another request.
+func (h *Handler) serveStealthRequest(p, vhost persona, served int, clientReader *bufio.Reader, conn net.Conn, logger *log.Logger) bool {
+	cfg := h.Config
+
+	// The head is buffered first, so that an endless one is cut off at the
+	// limit instead of being read into memory
+	err := bufferHead(clientReader)
+	var req *http.Request
+	if err == nil {
+		req, err = http.ReadRequest(clientReader)
 	}
-
-	// Check if it's a TLS handshake record.
-	if header[0] != 0x16 { // 0x16 = Handshake
-		return "", nil, errors.New("not a TLS handshake record")
+	if err != nil {
+		idle := errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF)
+		switch {
+		case served > 1 && idle:
+			// A kept-alive connection that was not used again
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			logger.Printf("Stealth mode: Timed out reading the request from %s", ClientAddr(conn.RemoteAddr()))
+			h.Stats.Inc("sniff_timeouts")
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			logger.Printf("Stealth mode: %s closed the connection before sending a full request", ClientAddr(conn.RemoteAddr()))
+		case errors.Is(err, errHeaderTooLarge):
+			logger.Printf("Stealth mode: Request header from %s over %d bytes, serving fake %s 400 page", ClientAddr(conn.RemoteAddr()), maxStealthHeaderSize, p.name)
+			h.Stats.Inc("stealth_header_too_large")
+			h.countStealthResponse(p, "400")
+			if err := h.writeStealthResponse(conn, p, nil, p.badRequest().WithServer(p.server), false, false, served); err != nil {
+				logger.Printf("Error writing stealth response: %v", err)
+			}
+		default:
+			logger.Printf("Stealth mode: Malformed request from %s (%v), serving fake %s 400 page", ClientAddr(conn.RemoteAddr()), err, p.name)
+			h.Stats.Inc("stealth_bad_requests")
+			h.countStealthResponse(p, "400")
+			if err := h.writeStealthResponse(conn, p, nil, p.badRequest().WithServer(p.server), false, false, served); err != nil {
+				logger.Printf("Error writing stealth response: %v", err)
+			}
+		}
+		return false
 	}
-
-	// Read the rest of the record.
-	recordLen := int(binary.BigEndian.Uint16(header[3:]))
-	recordBody := make([]byte, recordLen)
-	if _, err := io.ReadFull(reader, recordBody); err != nil {
-		return "", nil, fmt.Errorf("failed to read TLS record body: %w", err)
+	// Drain the body so that closing the connection does not reset it before
+	// the client has read the response, and to reach the next request.
+	n, err := io.Copy(io.Discard, io.LimitReader(req.Body, maxStealthBodySize+1))
+	req.Body.Close()
+	drained := err == nil && n <= maxStealthBodySize
+
+	summary := requestSummary(req)
+	if !cfg.StealthIgnoreHost && !stealth.MatchesHost(req.Host, cfg.Domain) {
+		// Requests by IP address, or for a host the server does not know, reach
+		// the default server rather than the site
+		h.Stats.Inc("stealth_default_vhost")
+		p = vhost
 	}
 
-	fullRecord := append(header, recordBody...)
-
-	// Wrap the record body in a cryptobyte.String for parsing.
-	s := cryptobyte.String(recordBody)
-
-	// Parse the ClientHello message.
-	// See RFC 8446, Section 4.1.2.
-	var msgType uint8
-	var clientHello cryptobyte.String
-	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&clientHello) { // 1 = ClientHello
-		return "", nil, errors.New("not a ClientHello message")
+	// A source over its rate limits, or any over the global one, is told so
+	// by the persona or held in the tarpit, whatever it asks for
+	action, exceeded := stealthRates.limit(SourceKey(conn.RemoteAddr(), cfg), cfg)
+	if exceeded != "" {
+		h.Stats.Inc("stealth_rate_limited")
+		h.Stats.Inc("stealth_rate_limited:" + exceeded)
+		if action == config.StealthRateTarpit && tarpits.acquire() {
+			logger.Printf("Stealth mode: %s is over the %s rate limit, tarpitting it for %s", ClientAddr(conn.RemoteAddr()), exceeded, summary)
+			h.Stats.Inc("stealth_rate_tarpitted")
+			tarpits.hold(clientReader, conn, tarpitResponse(cfg))
+			return false
+		}
 	}
 
-	// Skip legacy version and random.
-	if !clientHello.Skip(2) || !clientHello.Skip(32) {
-		return "", nil, errors.New("error parsing ClientHello header")
+	// Like a stock install, only the default page exists, and only for the
+	// methods files are served to
+	var response stealth.Response
+	methodResponse, badMethod := p.methodResponse(req.Method)
+	switch {
+	case exceeded != "":
+		// Also when the tarpit has no free slot
+		response = p.tooManyRequests()
+		logger.Printf("Stealth mode: %s is over the %s rate limit, serving fake %s 429 page for %s", ClientAddr(conn.RemoteAddr()), exceeded, p.name, summary)
+	case req.RequestURI == "*":
+		// A target asking about the server rather than a path
+		response = p.asteriskResponse(req.Method)
+		logger.Printf("Stealth mode: Serving fake %s %s page to %s for %s", p.name, response.Status, ClientAddr(conn.RemoteAddr()), summary)
+		if req.Method == http.MethodOptions {
+			h.Stats.Inc("stealth_options")
+		} else {
+			h.Stats.Inc("stealth_bad_requests")
+		}
+	case req.Method == http.MethodTrace && p.trace != nil:
+		// Disabled for the whole server, whatever the path
+		response = p.trace()
+		logger.Printf("Stealth mode: Serving fake %s %s page to %s for %s", p.name, response.Status, ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_bad_method")
+	case forbiddenPath(req.URL.Path, cfg.StealthForbidden):
+		// Nobody but a vulnerability scanner asks a fresh install for these
+		logger.Printf("Probe from %s for forbidden path %s, serving fake %s 403 page", ClientAddr(conn.RemoteAddr()), summary, p.name)
+		h.Stats.Inc("stealth_forbidden")
+		response = p.forbidden()
+	case authPath(req.URL.Path, cfg.StealthAuthPaths):
+		// Challenged whatever the credentials, which are never logged
+		presented := req.Header.Get("Authorization") != ""
+		logger.Printf("Probe from %s for protected path %s (credentials presented: %t), serving fake %s 401 page", ClientAddr(conn.RemoteAddr()), summary, presented, p.name)
+		response = p.unauthorized(cfg.StealthAuthRealm)
+		if !presented {
+			h.Stats.Inc("stealth_auth")
+			break
+		}
+		h.Stats.Inc("stealth_auth_guesses")
+		if authGuesses.add(SourceKey(conn.RemoteAddr(), cfg), 1) > authFreeGuesses && cfg.StealthAuthDelay > 0 {
+			// Like a server slowing down brute force, without telling
+			time.Sleep(cfg.StealthAuthDelay)
+		}
+	case req.Method == http.MethodOptions && p.options != nil:
+		// Answered by the server itself, whether or not the path exists
+		response = p.options()
+		logger.Printf("Stealth mode: Serving fake %s OPTIONS response to %s for %s", p.name, ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_options")
+	case p.errorCode != 0:
+		// Every path and method is passed to the application that is down
+		response = p.serverError(p.errorCode)
+		if p.errorCode == http.StatusServiceUnavailable && cfg.StealthErrorRetryAfter > 0 {
+			response = response.AddHeader(stealth.Header{Name: "Retry-After", Value: strconv.Itoa(int(cfg.StealthErrorRetryAfter.Seconds()))})
+		}
+		logger.Printf("Stealth mode: Serving fake %s %s page to %s for %s", p.name, response.Status, ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_error")
+	case badMethod:
+		response = methodResponse
+		logger.Printf("Stealth mode: Serving fake %s %s page to %s for %s", p.name, response.Status, ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_bad_method")
+	case req.URL.Path == "/robots.txt":
+		// Crawlers and some censorship scanners fetch it first
+		h.Stats.Inc("stealth_robots")
+		body, ok := robotsTxt(cfg, logger)
+		if !ok {
+			logger.Printf("Probe from %s for %s, serving fake %s 404 page", ClientAddr(conn.RemoteAddr()), summary, p.name)
+			response = p.notFound()
+			break
+		}
+		logger.Printf("Probe from %s for %s, serving %s robots.txt", ClientAddr(conn.RemoteAddr()), summary, cfg.StealthRobots)
+		response = p.file(cfg.Domain, p.plainText, body)
+	case req.URL.Path == "/favicon.ico":
+		// Browsers showing the page fetch it right away
+		icon, ok := favicon(cfg, logger)
+		if !ok {
+			logger.Printf("Stealth mode: Serving fake %s 404 page to %s for %s", p.name, ClientAddr(conn.RemoteAddr()), summary)
+			response = p.notFound()
+			break
+		}
+		logger.Printf("Stealth mode: Serving favicon to %s for %s", ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_favicon")
+		response = p.file(cfg.Domain, p.icon, icon)
+	case p.autoindex:
+		// Directories are listed and files exist but cannot be read
+		response = stealth.GetNginxAutoindex(cmp.Or(req.Host, cfg.Domain), req.URL.Path, autoindexFiles(cfg, logger))
+		logger.Printf("Stealth mode: Serving fake %s autoindex %s page to %s for %s", p.name, response.Status, ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_autoindex")
+	case p.wordpress:
+		// The blog answers its own paths, and its 404 page for the others
+		response = stealth.GetWordPress(cmp.Or(req.Host, cfg.Domain), req.Method, req.URL)
+		logger.Printf("Stealth mode: Serving fake %s %s page to %s for %s", p.name, response.Status, ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_wordpress")
+	case p.mirror:
+		// The copy of the site is served path for path, with the headers of
+		// nginx, and nothing is fetched for the request
+		response = mirrorResponse(cfg, p, req.URL.Path)
+		logger.Printf("Stealth mode: Serving mirrored %s page to %s for %s", response.Status, ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_mirror")
+	case p.isIndex(req.URL.Path):
+		logger.Printf("Stealth mode: Serving full fake %s page to %s for %s", p.name, ClientAddr(conn.RemoteAddr()), summary)
+		response = p.page(cfg.Domain)
+	default:
+		logger.Printf("Stealth mode: Serving fake %s 404 page to %s for %s", p.name, ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_not_found")
+		response = p.notFound()
 	}
 
-	// Skip legacy session id.
-	var legacySessionID cryptobyte.String
-	if !clientHello.ReadUint8LengthPrefixed(&legacySessionID) {
-		return "", nil, errors.New("error parsing session id")
+	// Every page claims the release of the persona, error pages included
+	response = response.WithServer(p.server)
+	if p.gzip != nil && acceptsGzip(req) {
+		response = p.gzip(response)
 	}
-
-	// Skip cipher suites.
-	var cipherSuites cryptobyte.String
-	if !clientHello.ReadUint16LengthPrefixed(&cipherSuites) {
-		return "", nil, errors.New("error parsing cipher suites")
+	// A client revalidating its cached copy with matching validators gets 304
+	response = response.Conditional(req)
+	if response.Status == "304 Not Modified" {
+		h.Stats.Inc("stealth_not_modified")
+	}
+	// Accept-Ranges is honored, with 206 for a satisfiable range and 416 otherwise
+	if ranged := response.Range(req); ranged.Status != response.Status {
+		h.Stats.Inc("stealth_ranges")
+		response = ranged
 	}
 
-	// Skip compression methods.
-	var compressionMethods cryptobyte.String
-	if !clientHello.ReadUint8LengthPrefixed(&compressionMethods) {
-		return "", nil, errors.New("error parsing compression methods")
+	if !req.ProtoAtLeast(1, 1) && response.Get("Transfer-Encoding") == "chunked" {
+		// HTTP/1.0 has no chunks, so the end of the connection ends the body
+		response = response.With("Transfer-Encoding", "").Close()
 	}
 
-	// Check for extensions.
-	if clientHello.Empty() {
-		return "", nil, errors.New("no extensions found")
+	// Record what was asked and answered, for the study of the probes
+	class := classifyStealthRequest(req, cfg.StealthAuthPaths)
+	h.Stats.Inc("probe_class:" + class)
+	h.countStealthResponse(p, response.Status[:3])
+	status, _ := strconv.Atoi(response.Status[:3])
+	logProbe(logger, cfg.LogFormat, probeRecord{
+		Time:      time.Now(),
+		Event:     probeLogEvent,
+		ClientIP:  clientIP(conn.RemoteAddr()),
+		Method:    req.Method,
+		Path:      req.URL.RequestURI(),
+		Host:      req.Host,
+		UserAgent: req.UserAgent(),
+		Status:    status,
+		Class:     class,
+	})
+
+	// A source already taken for a scanner gets its answers slowly, each on a
+	// connection of its own, so that none is held longer than the limit
+	slow := false
+	if cfg.StealthSlowScanners > 0 {
+		source := SourceKey(conn.RemoteAddr(), cfg)
+		slow = scannerScores.add(source, 0) >= scannerScore
+		scannerScores.add(source, scannerPoints(class, status))
+	}
+	if slow && !acquireSlowSlot() {
+		h.Stats.Inc("stealth_slow_full")
+		slow = false
+	}
+	if slow {
+		defer releaseSlowSlot()
+		logger.Printf("Stealth mode: Slowing the answer to scanner %s for %s", ClientAddr(conn.RemoteAddr()), summary)
+		h.Stats.Inc("stealth_slowed")
 	}
 
-	// Parse extensions.
-	var extensions cryptobyte.String
-	if !clientHello.ReadUint16LengthPrefixed(&extensions) {
-		return "", nil, errors.New("error parsing extensions")
+	// Keep the connection unless the client, the limits or the response, like
+	// that to an unknown method, close it
+	keepAlive := !slow && !req.Close && drained && cfg.StealthKeepAliveTimeout > 0 && served < cfg.StealthKeepAliveRequests && response.Get("Connection") != "close"
+	if err := h.writeStealthResponse(conn, p, req, response, keepAlive, slow, served); err != nil {
+		logger.Printf("Error writing stealth response: %v", err)
+		return false
 	}
+	return keepAlive
+}
 
-	var serverName string
-	for !extensions.Empty() {
-		var extType uint16
-		var extData cryptobyte.String
-		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
-			return "", nil, errors.New("error parsing extension")
-		}
+// countStealthResponse counts a response of p with status, the code of its
+// status line, by status and by persona.
+func (h *Handler) countStealthResponse(p persona, status string) {
+	h.Stats.Inc("stealth_status:" + status)
+	h.Stats.Inc("stealth_persona:" + strings.ToLower(p.name))
+}
 
-		if extType == 0 { // 0 = server_name
-			var serverNameList cryptobyte.String
-			if !extData.ReadUint16LengthPrefixed(&serverNameList) || serverNameList.Empty() {
-				return "", nil, errors.New("error parsing server_name extension")
-			}
+// writeStealthResponse writes response to req, the served-th request on conn,
+// with the -stealth-extra-headers added and framed like p frames it for the
+// protocol version of req: kept alive or
+// closed as keepAlive says, and without the body for HEAD. The body is
+// trickled if slow is set. req is nil for a request that could not be parsed,
+// which is answered like HTTP/1.1.
+func (h *Handler) writeStealthResponse(conn net.Conn, p persona, req *http.Request, response stealth.Response, keepAlive, slow bool, served int) error {
+	cfg := h.Config
+	http10 := req != nil && !req.ProtoAtLeast(1, 1)
+
+	if len(cfg.StealthExtraHeaders) > 0 {
+		response = response.AddHeader(extraHeaders(cfg)...)
+	}
 
-			var nameType uint8
-			var hostName cryptobyte.String
-			if !serverNameList.ReadUint8(&nameType) || nameType != 0 || !serverNameList.ReadUint16LengthPrefixed(&hostName) || hostName.Empty() { // 0 = host_name
-				return "", nil, errors.New("error parsing host_name")
-			}
-			serverName = string(hostName)
-			break // Found it
+	switch {
+	case keepAlive:
+		response = response.KeepAlive(cfg.StealthKeepAliveTimeout, cfg.StealthKeepAliveRequests-served)
+		if http10 && response.Get("Connection") == "" {
+			// Unlike HTTP/1.1, HTTP/1.0 connections are only kept alive
+			// when the response says so
+			response = response.With("Connection", "keep-alive")
 		}
+	case http10 && p.echoProto:
+		// Closing is the default of HTTP/1.0, which lighttpd leaves implicit
+		response = response.Close().With("Connection", "")
+	default:
+		response = response.Close()
 	}
-
-	if serverName == "" {
-		return "", nil, errors.New("SNI not found in ClientHello")
+	if http10 && p.echoProto {
+		response.Proto = "HTTP/1.0"
 	}
 
-	return serverName, fullRecord, nil
-}
\ No newline at end of file
+	// HEAD gets the headers of GET, Content-Length included, without the body
+	out := response.Bytes()
+	if req != nil && req.Method == http.MethodHead {
+		out = response.Head()
+	}
+	if slow {
+		return writeSlowly(conn, out, len(response.Head()), cfg.StealthSlowScanners)
+	}
+	_, err := conn.Write(out)
+	return err
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/stats"
+)
+
+// upstreamAddrs returns the distinct upstream addresses of routes, sorted.
+func upstreamAddrs(routes StaticRouter) []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, addr := range routes {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// CheckUpstreams connects to every distinct upstream of the configured routing
+// map in parallel, or to -upstream-proxy if set, through h.Dialer like proxied
+// connections, and records the results in stats.Upstreams. Changes between
+// healthy and unhealthy are logged to logger.
+func (h *Handler) CheckUpstreams(logger *log.Logger) {
+	cfg := h.Config
+	addrs := upstreamAddrs(configuredRoutes(cfg))
+	dial := h.dialUpstream
+	if cfg.UpstreamProxy != "" {
+		// The upstreams are reached through the next proxy only
+		addrs, dial = []string{cfg.UpstreamProxy}, h.dialUpstreamProxy
+	}
+	stats.Upstreams.Retain(addrs)
+
+	// The dial log lines of every check would drown the transitions
+	quiet := log.New(io.Discard, "", 0)
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := dial(addr, cfg, quiet)
+			if err == nil {
+				conn.Close()
+			}
+			status, changed := stats.Upstreams.Record(addr, time.Since(start), err)
+			switch {
+			case !changed:
+			case status.Healthy:
+				logger.Printf("Upstream %s is healthy again (%.1fms)", addr, status.LatencyMs)
+			default:
+				logger.Printf("Upstream %s is unhealthy: %s", addr, status.LastError)
+				h.Stats.Inc("upstream_unhealthy")
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
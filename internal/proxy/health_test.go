@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// closedAddr returns a loopback address on which nothing listens.
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// TestCheckUpstreams checks that every distinct upstream is checked once and
+// that transitions are logged.
+func TestCheckUpstreams(t *testing.T) {
+	defer stats.Upstreams.Retain(nil)
+	up := startTestUpstream(t, "health.test").Addr().String()
+	down := closedAddr(t)
+
+	logs := &lockedBuffer{}
+	cfg := &config.Config{Upstreams: map[string]string{
+		"chat.signal.org":    up,
+		"ud-chat.signal.org": up,
+		"cdn.signal.org":     down,
+	}}
+	h := newTestHandler(cfg, log.New(io.Discard, "", 0))
+	dialer := &countingDialer{}
+	h.Dialer = dialer
+	h.CheckUpstreams(log.New(logs, "", 0))
+
+	// One dial of the healthy upstream, and a retry of the refused one
+	assert.Equal(t, int32(3), dialer.dials.Load())
+	snapshot := stats.Upstreams.Snapshot()
+	require.Len(t, snapshot, 2)
+	byAddr := map[string]stats.UpstreamStatus{snapshot[0].Addr: snapshot[0], snapshot[1].Addr: snapshot[1]}
+	assert.True(t, byAddr[up].Healthy)
+	assert.False(t, byAddr[down].Healthy)
+	assert.NotEmpty(t, byAddr[down].LastError)
+	assert.Equal(t, []string{"Upstream " + down + " is unhealthy: " + byAddr[down].LastError}, logs.Lines())
+
+	// The failed upstream comes back
+	ln, err := net.Listen("tcp", down)
+	require.NoError(t, err)
+	defer ln.Close()
+	h.CheckUpstreams(log.New(logs, "", 0))
+	assert.Contains(t, logs.Lines()[len(logs.Lines())-1], "Upstream "+down+" is healthy again")
+	assert.False(t, stats.Upstreams.AllUnhealthy())
+
+	// A removed route is forgotten
+	cfg.Upstreams = map[string]string{"chat.signal.org": up}
+	h.CheckUpstreams(log.New(logs, "", 0))
+	assert.Len(t, stats.Upstreams.Snapshot(), 1)
+}
+
+// TestCheckUpstreamsHTTPProxy checks that health checks use the configured
+// upstream HTTP proxy, like proxied connections.
+func TestCheckUpstreamsHTTPProxy(t *testing.T) {
+	defer stats.Upstreams.Retain(nil)
+	up := startTestUpstream(t, "health-proxy.test").Addr().String()
+	proxyAddr, tunnels := startConnectProxy(t, "")
+
+	cfg := &config.Config{
+		Upstreams:         map[string]string{"chat.signal.org": up},
+		UpstreamHTTPProxy: "http://" + proxyAddr,
+	}
+	newTestHandler(cfg, log.New(io.Discard, "", 0)).CheckUpstreams(log.New(io.Discard, "", 0))
+
+	assert.Equal(t, int32(1), tunnels.Load())
+	snapshot := stats.Upstreams.Snapshot()
+	require.Len(t, snapshot, 1)
+	assert.True(t, snapshot[0].Healthy)
+}
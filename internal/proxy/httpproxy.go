@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// bufferedConn is a net.Conn whose first reads are served from a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the wrapped connection, see CloseWriter.
+func (c bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// NetConn returns the wrapped connection, so that its socket options can be set.
+func (c bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// dialHTTPProxy connects to target through the HTTP proxy at proxyURL with a
+// CONNECT request. The connection to the proxy itself is made with d.
+func (d *upstreamDialer) dialHTTPProxy(ctx context.Context, proxyURL *url.URL, target string, logger *log.Logger) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	conn, err := d.dial(ctx, proxyAddr, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to HTTP proxy %s: %w", proxyAddr, err)
+	}
+
+	// Bound the CONNECT exchange by the dial deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to HTTP proxy %s: %w", proxyAddr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from HTTP proxy %s: %w", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s refused CONNECT to %s: %s", proxyAddr, target, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	logger.Printf("Tunnel to %s established through HTTP proxy %s", target, proxyAddr)
+	if reader.Buffered() > 0 {
+		return bufferedConn{conn, reader}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// startConnectProxy starts a minimal HTTP CONNECT proxy that requires the given
+// Proxy-Authorization value and counts the tunnels it established.
+func startConnectProxy(t *testing.T, auth string) (addr string, tunnels *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	tunnels = &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				tunnels.Add(1)
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, reader)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String(), tunnels
+}
+
+// TestUpstreamHTTPProxy checks that Signal traffic is relayed through a CONNECT tunnel.
+func TestUpstreamHTTPProxy(t *testing.T) {
+	const sni = "connect.test"
+	startTestUpstream(t, sni)
+	// "user:pass" in base64
+	proxyAddr, tunnels := startConnectProxy(t, "Basic dXNlcjpwYXNz")
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	cfg := &config.Config{UpstreamHTTPProxy: "http://user:pass@" + proxyAddr}
+	go newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+
+	hello := buildTestClientHello(t, sni)
+	_, err := clientConn.Write(hello)
+	require.NoError(t, err)
+
+	// The upstream echoes everything it receives through the tunnel
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	echoed := make([]byte, len(hello))
+	_, err = io.ReadFull(clientConn, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, hello, echoed)
+	assert.Equal(t, int32(1), tunnels.Load())
+}
+
+// TestUpstreamHTTPProxyRefused checks that a non-200 response fails the dial
+// with the proxy's status line.
+func TestUpstreamHTTPProxyRefused(t *testing.T) {
+	upstream := startTestUpstream(t, "refused.test")
+	proxyAddr, tunnels := startConnectProxy(t, "Basic dXNlcjpwYXNz")
+
+	cfg := &config.Config{UpstreamHTTPProxy: "http://user:wrong@" + proxyAddr}
+	_, err := dialUpstream(upstream.Addr().String(), cfg, log.New(io.Discard, "", 0))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "407 Proxy Authentication Required")
+	assert.Equal(t, int32(0), tunnels.Load())
+}
+
+// TestUpstreamHTTPProxyIPFamily checks that the connection to the HTTP proxy
+// follows the upstream IP family policy.
+func TestUpstreamHTTPProxyIPFamily(t *testing.T) {
+	proxyAddr, tunnels := startConnectProxy(t, "")
+
+	cfg := &config.Config{UpstreamHTTPProxy: "http://" + proxyAddr, UpstreamIPFamily: config.IPFamilyIPv6}
+	_, err := dialUpstream("chat.signal.org:443", cfg, log.New(io.Discard, "", 0))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no ipv6 address found for 127.0.0.1")
+	assert.Equal(t, int32(0), tunnels.Load())
+}
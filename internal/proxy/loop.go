@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+)
+
+// isOwnDomain reports whether serverName is the domain this proxy serves.
+func isOwnDomain(serverName string, cfg *config.Config) bool {
+	return cfg.Domain != "" && strings.EqualFold(serverName, cfg.Domain)
+}
+
+// localAddrsTTL is how long the addresses of this host are cached for
+// pointsToSelf before they are listed again.
+const localAddrsTTL = time.Minute
+
+// localAddrs caches the addresses of the network interfaces of this host.
+var localAddrs = newLocalAddrCache(localAddrsTTL, net.InterfaceAddrs)
+
+// localAddrCache lists the addresses of this host at most once per ttl, or
+// when refreshed. It is safe for concurrent use.
+type localAddrCache struct {
+	ttl  time.Duration
+	list func() ([]net.Addr, error)
+
+	mu      sync.Mutex
+	ips     []net.IP
+	expires time.Time
+}
+
+// newLocalAddrCache creates a cache of the addresses returned by list.
+func newLocalAddrCache(ttl time.Duration, list func() ([]net.Addr, error)) *localAddrCache {
+	return &localAddrCache{ttl: ttl, list: list}
+}
+
+// contains reports whether ip is an address of this host.
+func (c *localAddrCache) contains(ip net.IP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().After(c.expires) {
+		c.refreshLocked()
+	}
+	return slices.ContainsFunc(c.ips, ip.Equal)
+}
+
+// refresh lists the addresses of this host again.
+func (c *localAddrCache) refresh() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshLocked()
+}
+
+// refreshLocked is refresh with c.mu held. On failure the previous addresses
+// are kept until the next attempt.
+func (c *localAddrCache) refreshLocked() error {
+	c.expires = time.Now().Add(c.ttl)
+	addrs, err := c.list()
+	if err != nil {
+		return err
+	}
+	c.ips = c.ips[:0]
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			c.ips = append(c.ips, ipNet.IP)
+		}
+	}
+	return nil
+}
+
+// RefreshLocalAddrs lists the addresses of this host again for the detection
+// of proxy loops, which otherwise happens once a minute.
+func RefreshLocalAddrs() error {
+	return localAddrs.refresh()
+}
+
+// pointsToSelf reports whether addr, the remote address of a connection just
+// dialed, is an address of this host on a port the proxy listens on, so that
+// the connection leads back to the proxy itself.
+func pointsToSelf(addr net.Addr, cfg *config.Config) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	port := strconv.Itoa(tcpAddr.Port)
+	listening := slices.ContainsFunc(slices.Concat(cfg.Listen, cfg.PlainListen), func(listen string) bool {
+		_, listenPort, err := net.SplitHostPort(listen)
+		return err == nil && listenPort == port
+	})
+	if !listening {
+		return false
+	}
+	ip := tcpAddr.IP
+	return ip.IsLoopback() || ip.IsUnspecified() || localAddrs.contains(ip)
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// TestPointsToSelf tests the detection of upstreams that are this proxy.
+func TestPointsToSelf(t *testing.T) {
+	orig := localAddrs
+	localAddrs = newLocalAddrCache(time.Hour, func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("198.51.100.7"), Mask: net.CIDRMask(24, 32)}}, nil
+	})
+	t.Cleanup(func() { localAddrs = orig })
+
+	testCases := []struct {
+		name        string
+		addr        net.Addr
+		listen      []string
+		plainListen []string
+		expected    bool
+	}{
+		{name: "Loopback on a listen port", addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}, listen: []string{":443"}, expected: true},
+		{name: "Unspecified on a listen port", addr: &net.TCPAddr{IP: net.IPv4zero, Port: 8443}, listen: []string{":443", "127.0.0.1:8443"}, expected: true},
+		{name: "Loopback on another port", addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8443}, listen: []string{":443"}, expected: false},
+		{name: "Remote address on a listen port", addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, listen: []string{":443"}, expected: false},
+		{name: "Local address on a listen port", addr: &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443}, listen: []string{":443"}, expected: true},
+		{name: "Loopback on a plain listen port", addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8444}, listen: []string{":443"}, plainListen: []string{"127.0.0.1:8444"}, expected: true},
+		{name: "Not TCP", addr: &net.UnixAddr{Name: "/run/upstream.sock", Net: "unix"}, listen: []string{":443"}, expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, pointsToSelf(tc.addr, &config.Config{Listen: tc.listen, PlainListen: tc.plainListen}))
+		})
+	}
+}
+
+// TestLocalAddrCache checks that the addresses of this host are listed once
+// per TTL, and again on refresh.
+func TestLocalAddrCache(t *testing.T) {
+	var lists atomic.Int32
+	local := net.ParseIP("198.51.100.7")
+	c := newLocalAddrCache(time.Hour, func() ([]net.Addr, error) {
+		lists.Add(1)
+		return []net.Addr{&net.IPNet{IP: local, Mask: net.CIDRMask(24, 32)}}, nil
+	})
+
+	assert.True(t, c.contains(local))
+	assert.False(t, c.contains(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, int32(1), lists.Load())
+
+	require.NoError(t, c.refresh())
+	assert.Equal(t, int32(2), lists.Load())
+
+	// Once expired, the next check lists them again
+	c.expires = time.Now().Add(-time.Second)
+	assert.True(t, c.contains(local))
+	assert.Equal(t, int32(3), lists.Load())
+}
+
+// TestProxyLoop checks that an inner SNI routed back to the proxy itself is cut
+// off at the first connection to itself, before the ClientHello is written to
+// it, instead of recursing.
+func TestProxyLoop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	cfg := &config.Config{
+		Domain:    "proxy.test",
+		Listen:    []string{ln.Addr().String()},
+		Upstreams: map[string]string{"loop.test": ln.Addr().String()},
+	}
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(conn, NewConnID())
+		}
+	}()
+
+	before := stats.Default.Get("sni_loops")
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(buildTestClientHello(t, "loop.test"))
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool { return accepted.Load() == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, before+1, stats.Default.Get("sni_loops"))
+}
+
+// TestOwnDomainNotRouted checks that the proxy's own domain is never routed,
+// even when the routing map lists it.
+func TestOwnDomainNotRouted(t *testing.T) {
+	upstream := startTestUpstream(t, "proxy.test")
+	cfg := &config.Config{
+		Domain:    "proxy.test",
+		Upstreams: map[string]string{"proxy.test": upstream.Addr().String()},
+	}
+
+	before := stats.Default.Get("sni_loops")
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+
+	_, err := clientConn.Write(buildTestClientHello(t, "Proxy.Test"))
+	require.NoError(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, before+1, stats.Default.Get("sni_loops"))
+}
@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+	"signalgoproxy/internal/stealth"
+)
+
+const (
+	// mirrorFetchTimeout bounds a fetch of the mirrored site, the front page
+	// and its files together.
+	mirrorFetchTimeout = 2 * time.Minute
+	// mirrorFileTimeout bounds the fetch of one file.
+	mirrorFileTimeout = 30 * time.Second
+	// maxMirrorFiles bounds the number of files of a snapshot, the front page
+	// included.
+	maxMirrorFiles = 200
+	// maxMirrorRedirects bounds the redirects followed for a file, all of
+	// them within the origin of the site.
+	maxMirrorRedirects = 5
+)
+
+// mirrorRetry is the first pause before fetching the mirrored site again
+// after a failure. It doubles with every further failure, up to the fetch
+// interval.
+var mirrorRetry = time.Minute
+
+// errMirrorTooLarge reports a file that does not fit in what is left of the
+// size limit of the snapshot.
+var errMirrorTooLarge = errors.New("the file exceeds the size limit of the mirror")
+
+// mirrorLinkRels are the link relations of the files a page needs to be
+// shown, which are copied along with it.
+var mirrorLinkRels = []string{"stylesheet", "icon", "apple-touch-icon", "preload", "modulepreload"}
+
+// cssURLPattern matches the url() and @import references of a stylesheet.
+var cssURLPattern = regexp.MustCompile(`url\(\s*['"]?([^'")\s]+)['"]?\s*\)|@import\s+['"]([^'"]+)['"]`)
+
+// mirrorFile is a file of a snapshot of the mirrored site.
+type mirrorFile struct {
+	contentType string
+	body        []byte
+}
+
+// Mirror keeps a snapshot of the front page of a site, see -mirror-url, with
+// the same-origin stylesheets, scripts and images it references, up to a
+// size limit. The snapshot is fetched ahead of time and served as it is, so
+// that requests never reach the site and cannot use the proxy as a relay. A
+// failed fetch keeps the previous snapshot. It is safe for concurrent use.
+type Mirror struct {
+	url      *url.URL
+	interval time.Duration
+	retry    time.Duration
+	maxSize  int
+	client   *http.Client
+
+	mu    sync.RWMutex
+	files map[string]mirrorFile // By URL path, nil until the first snapshot
+}
+
+// NewMirror creates a mirror of the site of cfg. Its snapshot is fetched by
+// Run.
+func NewMirror(cfg *config.Config) (*Mirror, error) {
+	u, err := url.Parse(cfg.MirrorURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror URL: %w", err)
+	}
+	m := &Mirror{
+		url:      u,
+		interval: cfg.MirrorInterval,
+		retry:    mirrorRetry,
+		maxSize:  cfg.MirrorMaxSizeKB * 1024,
+	}
+	if m.interval <= 0 {
+		m.interval = config.DefaultMirrorInterval
+	}
+	if m.maxSize <= 0 {
+		m.maxSize = config.DefaultMirrorMaxSizeKB * 1024
+	}
+	m.client = &http.Client{
+		Timeout: mirrorFileTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxMirrorRedirects {
+				return errors.New("too many redirects")
+			}
+			if !m.sameOrigin(req.URL) {
+				return fmt.Errorf("redirect to %s leaves the origin of the mirror", req.URL.Redacted())
+			}
+			return nil
+		},
+	}
+	return m, nil
+}
+
+// MirrorFile returns the content type and body of the file at urlPath in the
+// snapshot, and false if there is none or no snapshot yet.
+func (m *Mirror) MirrorFile(urlPath string) (string, []byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[urlPath]
+	return f.contentType, f.body, ok
+}
+
+// Update fetches a new snapshot of the site and, if its front page could be
+// fetched, replaces the previous one. Files that cannot be fetched or do not
+// fit are left out. On error the previous snapshot stays in use.
+func (m *Mirror) Update(ctx context.Context, logger *log.Logger) error {
+	files, size, err := m.fetch(ctx)
+	if err != nil {
+		stats.Inc("mirror_errors")
+		return err
+	}
+	m.mu.Lock()
+	m.files = files
+	m.mu.Unlock()
+	stats.Inc("mirror_updates")
+	logger.Printf("Updated the mirror of %s: %d files, %d bytes.", m.url.Redacted(), len(files), size)
+	return nil
+}
+
+// fetch downloads the front page and the files it references, breadth first,
+// and returns them by path with their total size.
+func (m *Mirror) fetch(ctx context.Context) (map[string]mirrorFile, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, mirrorFetchTimeout)
+	defer cancel()
+
+	page, err := m.get(ctx, m.url, m.maxSize)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch the front page: %w", err)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(page.contentType); mediaType != "text/html" {
+		return nil, 0, fmt.Errorf("the front page is %s, not text/html", page.contentType)
+	}
+
+	files := map[string]mirrorFile{"/": page, mirrorPath(m.url): page}
+	size := len(page.body)
+	queue := m.references(m.url, page)
+	for len(queue) > 0 && len(files) < maxMirrorFiles {
+		u := queue[0]
+		queue = queue[1:]
+		if _, ok := files[mirrorPath(u)]; ok {
+			continue
+		}
+		f, err := m.get(ctx, u, m.maxSize-size)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			continue
+		}
+		files[mirrorPath(u)] = f
+		size += len(f.body)
+		queue = append(queue, m.references(u, f)...)
+	}
+	return files, size, nil
+}
+
+// get returns the file at u, at most limit bytes long.
+func (m *Mirror) get(ctx context.Context, u *url.URL, limit int) (mirrorFile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return mirrorFile{}, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return mirrorFile{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return mirrorFile{}, fmt.Errorf("unexpected status %s from %s", resp.Status, u.Redacted())
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return mirrorFile{}, err
+	}
+	if len(body) > limit {
+		return mirrorFile{}, errMirrorTooLarge
+	}
+	// Only the content type of the original headers is kept
+	contentType := resp.Header.Get("Content-Type")
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		contentType = http.DetectContentType(body)
+	}
+	return mirrorFile{contentType: contentType, body: body}, nil
+}
+
+// references returns the same-origin files referenced by f, fetched from u:
+// the stylesheets, scripts and images of a page, and the files imported by a
+// stylesheet. Links to other pages are not followed.
+func (m *Mirror) references(u *url.URL, f mirrorFile) []*url.URL {
+	var refs []string
+	switch mediaType, _, _ := mime.ParseMediaType(f.contentType); mediaType {
+	case "text/html":
+		refs = htmlReferences(f.body)
+	case "text/css":
+		for _, match := range cssURLPattern.FindAllSubmatch(f.body, -1) {
+			refs = append(refs, string(match[1])+string(match[2]))
+		}
+	}
+
+	var urls []*url.URL
+	for _, ref := range refs {
+		ref, err := u.Parse(strings.TrimSpace(ref))
+		if err != nil || !m.sameOrigin(ref) {
+			continue
+		}
+		ref.Fragment = ""
+		urls = append(urls, ref)
+	}
+	return urls
+}
+
+// htmlReferences returns the references of a page to the files it needs to
+// be shown.
+func htmlReferences(body []byte) []string {
+	var refs []string
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return refs
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "link":
+				rels := strings.Fields(strings.ToLower(htmlAttr(t, "rel")))
+				if slices.ContainsFunc(rels, func(rel string) bool { return slices.Contains(mirrorLinkRels, rel) }) {
+					refs = append(refs, htmlAttr(t, "href"))
+				}
+			case "script", "img":
+				refs = append(refs, htmlAttr(t, "src"))
+			}
+		}
+	}
+}
+
+// htmlAttr returns the value of the attribute key of t, or "" if it has none.
+func htmlAttr(t html.Token, key string) string {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// sameOrigin reports whether u has the scheme and host of the mirrored site.
+func (m *Mirror) sameOrigin(u *url.URL) bool {
+	return u.Scheme == m.url.Scheme && strings.EqualFold(u.Host, m.url.Host)
+}
+
+// mirrorPath returns the path u is served on, whatever its query.
+func mirrorPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// Run fetches the snapshot now and then every interval until done is closed.
+// After a failure it retries sooner, backing off exponentially.
+func (m *Mirror) Run(done <-chan struct{}, logger *log.Logger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	retry := m.retry
+	for {
+		wait := m.interval
+		if err := m.Update(ctx, logger); err != nil {
+			logger.Printf("Failed to update the mirror of %s, keeping the previous snapshot: %v", m.url.Redacted(), err)
+			wait = min(retry, m.interval)
+			retry = min(retry*2, m.interval)
+		} else {
+			retry = m.retry
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// mirrorResponse returns the response of p to a request for urlPath, served
+// from the snapshot of -mirror-url. Until the first snapshot, nginx serves its
+// default page.
+func mirrorResponse(cfg *config.Config, p persona, urlPath string) stealth.Response {
+	if cfg.Mirror != nil {
+		if contentType, body, ok := cfg.Mirror.MirrorFile(urlPath); ok {
+			return p.file(cfg.Domain, contentType, body)
+		}
+		if _, _, ok := cfg.Mirror.MirrorFile("/"); ok {
+			return p.notFound()
+		}
+	}
+	if p.isIndex(urlPath) {
+		return p.page(cfg.Domain)
+	}
+	return p.notFound()
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// newMirrorSite serves a front page referencing same-origin files, one of
+// them too large for a small snapshot, and the files of other.
+func newMirrorSite(t *testing.T, other string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, `<!DOCTYPE html><html><head>
+<link rel="stylesheet" href="/css/site.css?v=3">
+<link rel="icon" href="favicon.png">
+<link rel="canonical" href="/about/">
+<script src="`+other+`/tracker.js"></script>
+<script src="/js/app.js#main"></script>
+</head><body><a href="/about/">About</a><img src="/img/large.jpg"><img src="/missing.png"></body></html>`)
+	})
+	mux.HandleFunc("/css/site.css", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		io.WriteString(w, `@import "fonts.css"; body { background: url('../img/bg.png') }`)
+	})
+	mux.HandleFunc("/css/fonts.css", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		io.WriteString(w, `@font-face { src: url(/fonts/a.woff2) }`)
+	})
+	mux.HandleFunc("/fonts/a.woff2", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "font/woff2")
+		io.WriteString(w, "wOF2")
+	})
+	mux.HandleFunc("/img/bg.png", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "\x89PNG\r\n\x1a\n")
+	})
+	mux.HandleFunc("/favicon.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		io.WriteString(w, "\x89PNG\r\n\x1a\n")
+	})
+	mux.HandleFunc("/js/app.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript")
+		io.WriteString(w, "console.log(1)")
+	})
+	mux.HandleFunc("/img/large.jpg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(bytes.Repeat([]byte("x"), 4096))
+	})
+	mux.HandleFunc("/about/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("links to other pages must not be followed")
+	})
+	site := httptest.NewServer(mux)
+	t.Cleanup(site.Close)
+	return site
+}
+
+// TestMirrorUpdate checks that the front page is copied with its same-origin
+// files, those of stylesheets included, that other sites, other pages and
+// files over the size limit are left out, and that a failed fetch keeps the
+// previous snapshot.
+func TestMirrorUpdate(t *testing.T) {
+	var otherRequests atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherRequests.Add(1)
+	}))
+	defer other.Close()
+	site := newMirrorSite(t, other.URL)
+
+	m, err := NewMirror(&config.Config{MirrorURL: site.URL + "/"})
+	require.NoError(t, err)
+	m.maxSize = 2048
+	logger := log.New(io.Discard, "", 0)
+	require.NoError(t, m.Update(context.Background(), logger))
+
+	testCases := []struct {
+		path                string
+		expectedContentType string
+		expectedMissing     bool
+	}{
+		{path: "/", expectedContentType: "text/html; charset=utf-8"},
+		{path: "/css/site.css", expectedContentType: "text/css"},
+		{path: "/css/fonts.css", expectedContentType: "text/css"},
+		{path: "/fonts/a.woff2", expectedContentType: "font/woff2"},
+		{path: "/img/bg.png", expectedContentType: "image/png"},
+		{path: "/favicon.png", expectedContentType: "image/png"},
+		{path: "/js/app.js", expectedContentType: "text/javascript"},
+		{path: "/img/large.jpg", expectedMissing: true},
+		{path: "/missing.png", expectedMissing: true},
+		{path: "/about/", expectedMissing: true},
+		{path: "/tracker.js", expectedMissing: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			contentType, body, ok := m.MirrorFile(tc.path)
+			assert.Equal(t, !tc.expectedMissing, ok)
+			if !tc.expectedMissing {
+				assert.Equal(t, tc.expectedContentType, contentType)
+				assert.NotEmpty(t, body)
+			}
+		})
+	}
+	assert.Zero(t, otherRequests.Load())
+
+	// The site going away keeps the snapshot
+	site.Close()
+	assert.Error(t, m.Update(context.Background(), logger))
+	_, body, ok := m.MirrorFile("/")
+	assert.True(t, ok)
+	assert.Contains(t, string(body), "<!DOCTYPE html>")
+}
+
+// TestMirrorUpdateErrors checks the front pages that cannot be mirrored,
+// including redirects off the origin of the site, which are not followed.
+func TestMirrorUpdateErrors(t *testing.T) {
+	var otherRequests atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherRequests.Add(1)
+		io.WriteString(w, "<html></html>")
+	}))
+	defer other.Close()
+
+	testCases := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{name: "Not found", handler: http.NotFound},
+		{name: "Not a page", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, "{}")
+		}},
+		{name: "Too large", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write(bytes.Repeat([]byte("x"), 2049))
+		}},
+		{name: "Redirect off the origin", handler: func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, other.URL+"/", http.StatusFound)
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			site := httptest.NewServer(tc.handler)
+			defer site.Close()
+			m, err := NewMirror(&config.Config{MirrorURL: site.URL})
+			require.NoError(t, err)
+			m.maxSize = 2048
+
+			assert.Error(t, m.Update(context.Background(), log.New(io.Discard, "", 0)))
+			_, _, ok := m.MirrorFile("/")
+			assert.False(t, ok)
+		})
+	}
+	assert.Zero(t, otherRequests.Load())
+}
+
+// TestMirrorRun checks that a failed fetch is retried sooner than the
+// interval, and that Run returns once done is closed.
+func TestMirrorRun(t *testing.T) {
+	var requests atomic.Int32
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html></html>")
+	}))
+	defer site.Close()
+
+	m, err := NewMirror(&config.Config{MirrorURL: site.URL, MirrorInterval: time.Hour})
+	require.NoError(t, err)
+	m.retry = 10 * time.Millisecond
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		m.Run(done, log.New(io.Discard, "", 0))
+		close(stopped)
+	}()
+	assert.Eventually(t, func() bool {
+		_, _, ok := m.MirrorFile("/")
+		return ok
+	}, time.Second, 5*time.Millisecond)
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+// fakeMirror is a snapshot of a site by path.
+type fakeMirror map[string]string
+
+func (f fakeMirror) MirrorFile(urlPath string) (string, []byte, bool) {
+	body, ok := f[urlPath]
+	return http.DetectContentType([]byte(body)), []byte(body), ok
+}
+
+// TestHandlerStealthMirror checks that the mirror persona serves the files of
+// the snapshot with the headers of nginx, 404 for the others, and the default
+// page of nginx until there is a snapshot.
+func TestHandlerStealthMirror(t *testing.T) {
+	snapshot := fakeMirror{
+		"/":            "<html><title>Bakery</title></html>",
+		"/css/app.css": "body { color: brown }",
+	}
+	testCases := []struct {
+		name             string
+		mirror           config.MirrorSite
+		request          string
+		expectedStatus   string
+		expectedContains string
+		expectedMirror   int64
+	}{
+		{name: "Front page", mirror: snapshot, request: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", expectedStatus: "200 OK", expectedContains: "<title>Bakery</title>", expectedMirror: 1},
+		{name: "Stylesheet", mirror: snapshot, request: "GET /css/app.css?v=2 HTTP/1.1\r\nHost: example.com\r\n\r\n", expectedStatus: "200 OK", expectedContains: "color: brown", expectedMirror: 1},
+		{name: "Missing file", mirror: snapshot, request: "GET /shop/ HTTP/1.1\r\nHost: example.com\r\n\r\n", expectedStatus: "404 Not Found", expectedContains: "<h1>404 Not Found</h1>", expectedMirror: 1},
+		{name: "Hidden file", mirror: snapshot, request: "GET /.env HTTP/1.1\r\nHost: example.com\r\n\r\n", expectedStatus: "403 Forbidden"},
+		{name: "Other method", mirror: snapshot, request: "DELETE / HTTP/1.1\r\nHost: example.com\r\n\r\n", expectedStatus: "405 Not Allowed"},
+		{name: "No snapshot yet", request: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", expectedStatus: "200 OK", expectedContains: "Welcome to nginx!", expectedMirror: 1},
+		{name: "No snapshot yet, other path", request: "GET /about/ HTTP/1.1\r\nHost: example.com\r\n\r\n", expectedStatus: "404 Not Found", expectedMirror: 1},
+		{name: "Empty snapshot", mirror: fakeMirror{}, request: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", expectedStatus: "200 OK", expectedContains: "Welcome to nginx!", expectedMirror: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHandler(&config.Config{
+				Domain:                   "example.com",
+				StealthMode:              config.StealthMirror,
+				StealthForbidden:         []string{".*"},
+				StealthKeepAliveTimeout:  100 * time.Millisecond,
+				StealthKeepAliveRequests: 100,
+				SniffTimeout:             time.Second,
+				Mirror:                   tc.mirror,
+			})
+			h.Stats = stats.New()
+			h.Logger = log.New(io.Discard, "", 0)
+
+			raw := exchange(h, tc.request)
+			response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+			require.NoError(t, err)
+			body, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, response.Status)
+			assert.True(t, strings.HasPrefix(response.Header.Get("Server"), "nginx/"))
+			assert.Contains(t, string(body), tc.expectedContains)
+			assert.Equal(t, tc.expectedMirror, h.Stats.Get("stealth_mirror"))
+		})
+	}
+}
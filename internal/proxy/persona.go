@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stealth"
+)
+
+// persona is a web server imitated by a stealth mode that serves canned pages.
+type persona struct {
+	// name is the name of the web server in log messages.
+	name string
+	// server is the Server header of the release claimed, see serverOf,
+	// which every response of the persona is rewritten to with WithServer.
+	server string
+	// indexPaths are the paths a stock install serves its default page on,
+	// with any other path answered by notFound.
+	indexPaths []string
+	// page and file serve the default page and other static files of the
+	// server for host, with plainText and icon as the content types of text
+	// files and icons in the server's MIME table.
+	page       func(host string) stealth.Response
+	file       func(host, contentType string, body []byte) stealth.Response
+	plainText  string
+	icon       string
+	notFound   func() stealth.Response
+	forbidden  func() stealth.Response
+	badRequest func() stealth.Response
+	// unauthorized serves the 401 page of the server for a path protected by
+	// Basic authentication with realm.
+	unauthorized func(realm string) stealth.Response
+	// tooManyRequests serves the 429 page of the server for a request over
+	// the -stealth-rate-per-source or -stealth-rate-global limits.
+	tooManyRequests func() stealth.Response
+	// serverError serves the 50x page of the server with a status code, and
+	// errorCode is that answering every request, as from a server in front of
+	// an application that is down, or 0.
+	serverError func(code int) stealth.Response
+	errorCode   int
+	// gzip compresses a response for clients accepting gzip, as the server
+	// does in its stock configuration, or is nil if that does not compress.
+	gzip func(stealth.Response) stealth.Response
+
+	// methods are the methods files are served to. The others get
+	// notAllowed, except those missing from knownMethods, which get
+	// notImplemented, if set.
+	methods        []string
+	knownMethods   []string
+	notAllowed     func(method string) stealth.Response
+	notImplemented func(method string) stealth.Response
+	// options answers OPTIONS for any path, as servers listing the methods
+	// they allow do, and serverOptions answers OPTIONS for the server as a
+	// whole, with the asterisk-form target "*". Either is nil if the server
+	// answers OPTIONS like the other methods files are not served to, or
+	// rejects "*" as a bad request.
+	options       func() stealth.Response
+	serverOptions func() stealth.Response
+	// trace answers TRACE before any location applies, as servers with TRACE
+	// disabled do, or is nil if TRACE is answered like the other methods files
+	// are not served to.
+	trace func() stealth.Response
+	// strictMethods is set for servers that only parse methods made of
+	// upper-case letters, "-" and "_", and reject others as bad requests.
+	strictMethods bool
+	// echoProto is set for servers answering with the HTTP version of the
+	// request, rather than with HTTP/1.1 whatever the version.
+	echoProto bool
+	// autoindex is set for the nginx persona listing a fake file tree, which
+	// answers every path from the tree instead of serving the default page.
+	autoindex bool
+	// wordpress is set for the persona of a WordPress blog, which answers
+	// every path like WordPress instead of serving the default page.
+	wordpress bool
+	// mirror is set for the nginx persona serving the snapshot of
+	// -mirror-url, which answers every path from the snapshot instead of
+	// serving the default page.
+	mirror bool
+}
+
+// knownMethods are the methods of HTTP and WebDAV, which Apache, lighttpd and
+// LiteSpeed answer with 405 for static files rather than with 501.
+var knownMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "SEARCH", "REPORT",
+}
+
+// personaOf returns the persona of the stealth mode of cfg, or false for
+// modes without canned pages.
+func personaOf(cfg *config.Config) (persona, bool) {
+	switch cfg.StealthMode {
+	case config.StealthNginx, config.StealthAutoindex, config.StealthMirror, config.StealthError:
+		return persona{
+			name:            "Nginx",
+			server:          serverOf(cfg, stealth.NginxServer),
+			indexPaths:      []string{"/", "/index.nginx-debian.html"},
+			page:            stealth.GetNginxResponse,
+			file:            stealth.GetNginxFile,
+			plainText:       "text/plain",
+			icon:            "image/x-icon",
+			notFound:        stealth.GetNginx404,
+			forbidden:       stealth.GetNginx403,
+			badRequest:      stealth.GetNginxBadRequestResponse,
+			unauthorized:    stealth.GetNginx401,
+			tooManyRequests: stealth.GetNginx429,
+			serverError:     stealth.GetNginx50x,
+			gzip:            stealth.GzipNginx,
+			methods:         []string{http.MethodGet, http.MethodHead},
+			notAllowed:      func(string) stealth.Response { return stealth.GetNginx405() },
+			trace:           stealth.GetNginx405,
+			strictMethods:   true,
+			autoindex:       cfg.StealthMode == config.StealthAutoindex,
+			mirror:          cfg.StealthMode == config.StealthMirror,
+			errorCode:       errorCode(cfg),
+		}, true
+	case config.StealthWordPress:
+		return persona{
+			name:            "WordPress",
+			server:          serverOf(cfg, stealth.NginxServer),
+			indexPaths:      []string{"/", "/index.php"},
+			page:            stealth.GetWordPressResponse,
+			file:            stealth.GetNginxFile,
+			plainText:       "text/plain",
+			icon:            "image/x-icon",
+			notFound:        func() stealth.Response { return stealth.GetWordPress404(cfg.Domain) },
+			forbidden:       stealth.GetNginx403,
+			badRequest:      stealth.GetNginxBadRequestResponse,
+			unauthorized:    stealth.GetNginx401,
+			tooManyRequests: stealth.GetNginx429,
+			serverError:     stealth.GetNginx50x,
+			gzip:            stealth.GzipNginx,
+			// PHP takes forms and XML-RPC calls
+			methods:       []string{http.MethodGet, http.MethodHead, http.MethodPost},
+			notAllowed:    func(string) stealth.Response { return stealth.GetNginx405() },
+			trace:         stealth.GetNginx405,
+			strictMethods: true,
+			wordpress:     true,
+		}, true
+	case config.StealthApache:
+		return persona{
+			name:            "Apache",
+			server:          serverOf(cfg, stealth.ApacheServer),
+			indexPaths:      []string{"/", "/index.html"},
+			page:            stealth.GetApacheResponse,
+			file:            stealth.GetApacheFile,
+			plainText:       "text/plain",
+			icon:            "image/vnd.microsoft.icon",
+			notFound:        func() stealth.Response { return stealth.GetApache404(cfg.Domain) },
+			forbidden:       func() stealth.Response { return stealth.GetApache403(cfg.Domain) },
+			badRequest:      func() stealth.Response { return stealth.GetApacheBadRequestResponse(cfg.Domain) },
+			unauthorized:    func(realm string) stealth.Response { return stealth.GetApache401(realm, cfg.Domain) },
+			tooManyRequests: func() stealth.Response { return stealth.GetApache429(cfg.Domain) },
+			serverError:     func(code int) stealth.Response { return stealth.GetApache50x(code, cfg.Domain) },
+			gzip:            stealth.GzipApache,
+			// The default handler of Apache serves files to POST too
+			methods:        []string{http.MethodGet, http.MethodHead, http.MethodPost},
+			knownMethods:   knownMethods,
+			notAllowed:     func(method string) stealth.Response { return stealth.GetApache405(method, cfg.Domain) },
+			notImplemented: func(method string) stealth.Response { return stealth.GetApache501(method, cfg.Domain) },
+			options:        stealth.GetApacheOptions,
+			serverOptions:  stealth.GetApacheOptions,
+			trace:          func() stealth.Response { return stealth.GetApacheTrace(cfg.Domain) },
+		}, true
+	case config.StealthLighttpd:
+		return persona{
+			name:            "lighttpd",
+			server:          serverOf(cfg, stealth.LighttpdServer),
+			indexPaths:      []string{"/", "/index.lighttpd.html"},
+			page:            stealth.GetLighttpdResponse,
+			file:            stealth.GetLighttpdFile,
+			plainText:       "text/plain; charset=utf-8",
+			icon:            "image/vnd.microsoft.icon",
+			notFound:        stealth.GetLighttpd404,
+			forbidden:       stealth.GetLighttpd403,
+			badRequest:      stealth.GetLighttpdBadRequestResponse,
+			unauthorized:    stealth.GetLighttpd401,
+			tooManyRequests: stealth.GetLighttpd429,
+			methods:         []string{http.MethodGet, http.MethodHead},
+			knownMethods:    knownMethods,
+			notAllowed:      func(string) stealth.Response { return stealth.GetLighttpd405() },
+			notImplemented:  func(string) stealth.Response { return stealth.GetLighttpd501() },
+			serverOptions:   stealth.GetLighttpdOptions,
+			echoProto:       true,
+		}, true
+	case config.StealthOpenResty:
+		return persona{
+			name:            "OpenResty",
+			server:          serverOf(cfg, stealth.OpenRestyServer),
+			indexPaths:      []string{"/", "/index.html"},
+			page:            stealth.GetOpenRestyResponse,
+			file:            stealth.GetOpenRestyFile,
+			plainText:       "text/plain",
+			icon:            "image/x-icon",
+			notFound:        stealth.GetOpenResty404,
+			forbidden:       stealth.GetOpenResty403,
+			badRequest:      stealth.GetOpenRestyBadRequestResponse,
+			unauthorized:    stealth.GetOpenResty401,
+			tooManyRequests: stealth.GetOpenResty429,
+			serverError:     stealth.GetOpenResty50x,
+			methods:         []string{http.MethodGet, http.MethodHead},
+			notAllowed:      func(string) stealth.Response { return stealth.GetOpenResty405() },
+			trace:           stealth.GetOpenResty405,
+			strictMethods:   true,
+		}, true
+	case config.StealthLiteSpeed:
+		return persona{
+			name:            "LiteSpeed",
+			server:          serverOf(cfg, stealth.LiteSpeedServer),
+			indexPaths:      []string{"/", "/index.html"},
+			page:            stealth.GetLiteSpeedResponse,
+			file:            stealth.GetLiteSpeedFile,
+			plainText:       "text/plain",
+			icon:            "image/x-icon",
+			notFound:        stealth.GetLiteSpeed404,
+			forbidden:       stealth.GetLiteSpeed403,
+			badRequest:      stealth.GetLiteSpeedBadRequestResponse,
+			unauthorized:    stealth.GetLiteSpeed401,
+			tooManyRequests: stealth.GetLiteSpeed429,
+			gzip:            stealth.GzipLiteSpeed,
+			methods:         []string{http.MethodGet, http.MethodHead},
+			knownMethods:    knownMethods,
+			notAllowed:      func(string) stealth.Response { return stealth.GetLiteSpeed405() },
+			notImplemented:  func(string) stealth.Response { return stealth.GetLiteSpeed501() },
+		}, true
+	}
+	return persona{}, false
+}
+
+// defaultVhostOf returns the persona of the default server of the stealth
+// mode of cfg, which answers requests for other hosts than the domain, and
+// false if that is the persona of the mode itself. A stock install serves its
+// default page whatever the host, but the sites of the other modes are virtual
+// hosts of an nginx whose default server still has the welcome page.
+func defaultVhostOf(cfg *config.Config) (persona, bool) {
+	switch cfg.StealthMode {
+	case config.StealthAutoindex, config.StealthWordPress, config.StealthMirror, config.StealthError:
+		vhost := *cfg
+		vhost.StealthMode = config.StealthNginx
+		return personaOf(&vhost)
+	}
+	return persona{}, false
+}
+
+// errorCode returns the status code the persona of cfg answers every request
+// with, or 0 outside of the error stealth mode.
+func errorCode(cfg *config.Config) int {
+	if cfg.StealthMode != config.StealthError {
+		return 0
+	}
+	return cfg.StealthErrorCode
+}
+
+// methodResponse returns the response of the server to a request for a file
+// with method, and false if it serves files to that method.
+func (p persona) methodResponse(method string) (stealth.Response, bool) {
+	switch {
+	case slices.Contains(p.methods, method):
+		return stealth.Response{}, false
+	case p.strictMethods && strings.TrimFunc(method, func(r rune) bool { return 'A' <= r && r <= 'Z' || r == '-' || r == '_' }) != "":
+		return p.badRequest(), true
+	case p.notImplemented != nil && !slices.Contains(p.knownMethods, method):
+		return p.notImplemented(method), true
+	}
+	return p.notAllowed(method), true
+}
+
+// asteriskResponse returns the response of the server to a request with
+// method for the asterisk-form target "*", which only OPTIONS may use.
+func (p persona) asteriskResponse(method string) stealth.Response {
+	if method == http.MethodOptions && p.serverOptions != nil {
+		return p.serverOptions()
+	}
+	return p.badRequest()
+}
+
+// isIndex reports whether path is one the persona serves its default page on.
+func (p persona) isIndex(path string) bool {
+	return slices.Contains(p.indexPaths, path)
+}
+
+// extraHeaders returns the -stealth-extra-headers of cfg but Server, which
+// replaces the Server header of the persona instead.
+func extraHeaders(cfg *config.Config) []stealth.Header {
+	var headers []stealth.Header
+	for _, h := range cfg.StealthExtraHeaders {
+		// A Server header replaces that of the persona, see serverOf
+		if !strings.EqualFold(h.Name, "Server") {
+			headers = append(headers, stealth.Header{Name: h.Name, Value: h.Value})
+		}
+	}
+	return headers
+}
+
+// serverOf returns the Server header claimed by the persona of cfg, whose
+// pages are written with stock: that of -stealth-extra-headers if there is
+// one, or else a release of the server picked for -domain.
+func serverOf(cfg *config.Config, stock string) string {
+	for _, h := range cfg.StealthExtraHeaders {
+		if strings.EqualFold(h.Name, "Server") {
+			return h.Value
+		}
+	}
+	return stealth.ServerVersion(stock, cfg.Domain)
+}
+
+// forbiddenPath reports whether urlPath matches one of the -stealth-forbidden
+// patterns, either as a whole or by one of its segments.
+func forbiddenPath(urlPath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "/") {
+			if ok, _ := path.Match(pattern, urlPath); ok {
+				return true
+			}
+			continue
+		}
+		for _, segment := range strings.Split(urlPath, "/") {
+			if ok, _ := path.Match(pattern, segment); ok && segment != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// TestForbiddenPath tests matching request paths against the
+// -stealth-forbidden patterns.
+func TestForbiddenPath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		patterns []string
+		expected bool
+	}{
+		{path: "/.git/config", patterns: []string{config.DefaultStealthForbidden}, expected: true},
+		{path: "/.env", patterns: []string{config.DefaultStealthForbidden}, expected: true},
+		{path: "/blog/.htaccess", patterns: []string{config.DefaultStealthForbidden}, expected: true},
+		{path: "/", patterns: []string{config.DefaultStealthForbidden}},
+		{path: "/index.html", patterns: []string{config.DefaultStealthForbidden}},
+		{path: "/server-status", patterns: []string{"/server-status"}, expected: true},
+		{path: "/status/server-status", patterns: []string{"/server-status"}},
+		{path: "/blog/wp-config.php", patterns: []string{"wp-config.php*"}, expected: true},
+		{path: "/.env", patterns: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			assert.Equal(t, tc.expected, forbiddenPath(tc.path, tc.patterns))
+		})
+	}
+}
+
+// TestPersonaMethods checks the response of each persona to requests for a
+// file with methods it does not serve files to.
+func TestPersonaMethods(t *testing.T) {
+	testCases := []struct {
+		mode           config.StealthMode
+		method         string
+		expectedStatus string
+		expectedAllow  string
+	}{
+		{mode: config.StealthNginx, method: http.MethodGet},
+		{mode: config.StealthNginx, method: http.MethodHead},
+		{mode: config.StealthNginx, method: http.MethodPost, expectedStatus: "405 Not Allowed"},
+		{mode: config.StealthNginx, method: http.MethodDelete, expectedStatus: "405 Not Allowed"},
+		{mode: config.StealthNginx, method: http.MethodPatch, expectedStatus: "405 Not Allowed"},
+		{mode: config.StealthNginx, method: "FROB", expectedStatus: "405 Not Allowed"},
+		{mode: config.StealthNginx, method: "frob", expectedStatus: "400 Bad Request"},
+		{mode: config.StealthOpenResty, method: http.MethodDelete, expectedStatus: "405 Not Allowed"},
+		{mode: config.StealthOpenResty, method: http.MethodPatch, expectedStatus: "405 Not Allowed"},
+		{mode: config.StealthOpenResty, method: "FROB", expectedStatus: "405 Not Allowed"},
+		{mode: config.StealthMirror, method: http.MethodPost, expectedStatus: "405 Not Allowed"},
+		{mode: config.StealthWordPress, method: http.MethodPost},
+		{mode: config.StealthWordPress, method: http.MethodDelete, expectedStatus: "405 Not Allowed"},
+		{mode: config.StealthWordPress, method: "frob", expectedStatus: "400 Bad Request"},
+		{mode: config.StealthApache, method: http.MethodPost},
+		{mode: config.StealthApache, method: http.MethodDelete, expectedStatus: "405 Method Not Allowed", expectedAllow: "GET,POST,OPTIONS,HEAD"},
+		{mode: config.StealthApache, method: http.MethodPatch, expectedStatus: "405 Method Not Allowed", expectedAllow: "GET,POST,OPTIONS,HEAD"},
+		{mode: config.StealthApache, method: "FROB", expectedStatus: "501 Not Implemented", expectedAllow: "GET,POST,OPTIONS,HEAD"},
+		{mode: config.StealthLighttpd, method: http.MethodDelete, expectedStatus: "405 Method Not Allowed", expectedAllow: "GET, HEAD"},
+		{mode: config.StealthLighttpd, method: http.MethodPatch, expectedStatus: "405 Method Not Allowed", expectedAllow: "GET, HEAD"},
+		{mode: config.StealthLighttpd, method: "FROB", expectedStatus: "501 Not Implemented"},
+		{mode: config.StealthLiteSpeed, method: http.MethodDelete, expectedStatus: "405 Method Not Allowed", expectedAllow: "GET, HEAD"},
+		{mode: config.StealthLiteSpeed, method: http.MethodPatch, expectedStatus: "405 Method Not Allowed", expectedAllow: "GET, HEAD"},
+		{mode: config.StealthLiteSpeed, method: "FROB", expectedStatus: "501 Not Implemented"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.mode)+" "+tc.method, func(t *testing.T) {
+			p, ok := personaOf(&config.Config{Domain: "example.com", StealthMode: tc.mode})
+			require.True(t, ok)
+
+			response, handled := p.methodResponse(tc.method)
+			assert.Equal(t, tc.expectedStatus != "", handled)
+			assert.Equal(t, tc.expectedStatus, response.Status)
+			var allow string
+			for _, h := range response.Headers {
+				if h.Name == "Allow" {
+					allow = h.Value
+				}
+			}
+			assert.Equal(t, tc.expectedAllow, allow)
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+const (
+	// poolMaxAge is how long a pooled connection may stay idle before it is
+	// replaced, so that it is not taken just as the upstream times it out.
+	poolMaxAge = 30 * time.Second
+	// poolKeepWarm is how long after its last connection the pool of an
+	// upstream is refilled as its connections age out.
+	poolKeepWarm = 5 * time.Minute
+	// poolCheckTimeout bounds the health check of a pooled connection.
+	poolCheckTimeout = time.Millisecond
+	// clientHelloWriteAttempts is how many connections to an upstream the
+	// inner ClientHello is written to before giving up.
+	clientHelloWriteAttempts = 3
+)
+
+// upstreamPools keeps connections ready for the upstreams of routed connections.
+var upstreamPools = newConnPool(poolMaxAge, poolKeepWarm)
+
+// dialFunc connects to an upstream address.
+type dialFunc func(addr string, cfg *config.Config, logger *log.Logger) (net.Conn, error)
+
+// pooledConn is an idle connection in a pool.
+type pooledConn struct {
+	conn   net.Conn
+	expiry *time.Timer
+}
+
+// connPool holds idle connections dialed ahead to upstreams, so that routed
+// connections skip the round trip of connecting. An upstream gets a pool on
+// its first connection, which is refilled whenever a connection is taken or
+// ages out, until the upstream has not been used for keepWarm. It is safe for
+// concurrent use.
+type connPool struct {
+	maxAge   time.Duration
+	keepWarm time.Duration
+
+	mu       sync.Mutex
+	idle     map[string][]*pooledConn // Oldest first
+	lastUsed map[string]time.Time
+	dials    map[string]dialFunc // Of the last connection to take from the pool
+	filling  map[string]bool
+}
+
+// newConnPool creates a pool of connections each kept for at most maxAge.
+func newConnPool(maxAge, keepWarm time.Duration) *connPool {
+	return &connPool{
+		maxAge:   maxAge,
+		keepWarm: keepWarm,
+		idle:     make(map[string][]*pooledConn),
+		lastUsed: make(map[string]time.Time),
+		dials:    make(map[string]dialFunc),
+		filling:  make(map[string]bool),
+	}
+}
+
+// take returns a healthy idle connection to addr, or nil if there is none or
+// cfg disables the pool, and counts the outcome in st. Either way, the pool of
+// addr is refilled in the background with connections dialed with dial.
+func (p *connPool) take(addr string, dial dialFunc, st *stats.Stats, cfg *config.Config, logger *log.Logger) net.Conn {
+	if cfg.UpstreamPoolSize <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	p.lastUsed[addr] = time.Now()
+	p.dials[addr] = dial
+	p.mu.Unlock()
+	defer func() {
+		go p.fill(addr, dial, cfg, logger)
+	}()
+
+	for {
+		pc := p.pop(addr)
+		if pc == nil {
+			st.Inc("upstream_pool_misses")
+			return nil
+		}
+		if err := checkIdle(pc.conn); err != nil {
+			logger.Printf("Discarding pooled connection to upstream %s: %v", addr, err)
+			st.Inc("upstream_pool_stale")
+			pc.conn.Close()
+			continue
+		}
+		st.Inc("upstream_pool_hits")
+		return pc.conn
+	}
+}
+
+// pop removes the most recently dialed idle connection to addr from the pool.
+func (p *connPool) pop(addr string) *pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[addr]
+	if len(conns) == 0 {
+		return nil
+	}
+	pc := conns[len(conns)-1]
+	p.idle[addr] = conns[:len(conns)-1]
+	pc.expiry.Stop()
+	return pc
+}
+
+// fill dials connections to addr with dial until its pool holds
+// cfg.UpstreamPoolSize of them. Only one fill per upstream runs at a time, and
+// it gives up on the first failure, leaving the retry to the next connection.
+// An upstream left without idle connections is then forgotten, so that names
+// which do not resolve do not pile up.
+func (p *connPool) fill(addr string, dial dialFunc, cfg *config.Config, logger *log.Logger) {
+	p.mu.Lock()
+	if p.filling[addr] {
+		p.mu.Unlock()
+		return
+	}
+	p.filling[addr] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.filling, addr)
+		p.mu.Unlock()
+	}()
+
+	// The per-connection log lines of the dialer are noise here
+	quiet := log.New(io.Discard, "", 0)
+	for {
+		p.mu.Lock()
+		n := len(p.idle[addr])
+		p.mu.Unlock()
+		if n >= cfg.UpstreamPoolSize {
+			return
+		}
+
+		conn, err := dial(addr, cfg, quiet)
+		if err != nil {
+			logger.Printf("Failed to fill the connection pool of upstream %s: %v", addr, err)
+			p.mu.Lock()
+			if len(p.idle[addr]) == 0 {
+				delete(p.idle, addr)
+				delete(p.lastUsed, addr)
+				delete(p.dials, addr)
+			}
+			p.mu.Unlock()
+			return
+		}
+		p.put(addr, conn, cfg, logger)
+	}
+}
+
+// put adds an idle connection to the pool of addr, to be replaced once it
+// reaches maxAge.
+func (p *connPool) put(addr string, conn net.Conn, cfg *config.Config, logger *log.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc := &pooledConn{conn: conn}
+	pc.expiry = time.AfterFunc(p.maxAge, func() {
+		p.expire(addr, pc, cfg, logger)
+	})
+	p.idle[addr] = append(p.idle[addr], pc)
+}
+
+// expire closes a pooled connection that reached maxAge, unless it was taken
+// in the meantime, and refills the pool if addr was used within keepWarm.
+func (p *connPool) expire(addr string, pc *pooledConn, cfg *config.Config, logger *log.Logger) {
+	p.mu.Lock()
+	found := false
+	conns := p.idle[addr]
+	for i, c := range conns {
+		if c == pc {
+			p.idle[addr] = append(conns[:i:i], conns[i+1:]...)
+			found = true
+			break
+		}
+	}
+	lastUsed, ok := p.lastUsed[addr]
+	warm := ok && time.Since(lastUsed) < p.keepWarm
+	dial := p.dials[addr]
+	if !warm && len(p.idle[addr]) == 0 {
+		delete(p.idle, addr)
+		delete(p.lastUsed, addr)
+		delete(p.dials, addr)
+	}
+	p.mu.Unlock()
+
+	if !found {
+		return
+	}
+	pc.conn.Close()
+	if warm {
+		p.fill(addr, dial, cfg, logger)
+	}
+}
+
+// closeAll closes every idle connection and forgets the upstreams in use, so
+// that no pool is refilled until the next connection.
+func (p *connPool) closeAll() int {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*pooledConn)
+	p.lastUsed = make(map[string]time.Time)
+	p.dials = make(map[string]dialFunc)
+	p.mu.Unlock()
+
+	n := 0
+	for _, conns := range idle {
+		for _, pc := range conns {
+			pc.expiry.Stop()
+			pc.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// ClosePooledUpstreams closes the idle upstream connections kept by the pool,
+// see -upstream-pool-size. It returns the number of connections closed.
+func ClosePooledUpstreams() int {
+	return upstreamPools.closeAll()
+}
+
+// checkIdle returns why an idle pooled connection cannot be used. Upstreams
+// send nothing before the ClientHello, so a healthy connection has nothing to
+// read; a closed one reads EOF or a reset. A read of zero bytes returns without
+// asking the kernel in Go, so one byte is read with a short deadline instead.
+func checkIdle(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(poolCheckTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	switch {
+	case n > 0:
+		return errors.New("unexpected data from upstream")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	case err == nil:
+		return io.ErrUnexpectedEOF
+	default:
+		return err
+	}
+}
+
+// connectUpstream connects to the upstream at addr with dial and writes the
+// inner ClientHello to it. With pooled set, a connection of the pool, also
+// dialed with dial, is used when one is ready, and a new one is dialed if
+// writing to it fails. The time until connected, or the class of the dial
+// error, is recorded in stats.Dials, the other counters in st. Failures, and
+// connections leading back to this proxy, are logged and return nil.
+func connectUpstream(addr string, rawClientHello []byte, dial dialFunc, pooled bool, st *stats.Stats, cfg *config.Config, logger *log.Logger) net.Conn {
+	start := time.Now()
+	if pooled {
+		if conn := upstreamPools.take(addr, dial, st, cfg, logger); conn != nil {
+			if refuseSelf(conn, addr, st, cfg, logger) {
+				return nil
+			}
+			tuneUpstreamConn(conn, cfg, logger)
+			_, err := conn.Write(rawClientHello)
+			if err == nil {
+				stats.Dials.Success(addr, time.Since(start))
+				logger.Printf("Using pooled connection to upstream %s", addr)
+				return conn
+			}
+			logger.Printf("Pooled connection to upstream %s failed, dialing a new one: %v", addr, err)
+			st.Inc("upstream_pool_stale")
+			conn.Close()
+		}
+	}
+
+	conn, err := dial(addr, cfg, logger)
+	if err != nil {
+		class := dialErrorClass(err)
+		if class == "timeout" {
+			// Told apart from sniff timeouts, which -sniff-timeout controls
+			logger.Printf("Timed out connecting to upstream %s after %s: %v", addr, time.Since(start).Round(time.Millisecond), err)
+			st.Inc("dial_timeouts")
+		} else {
+			logger.Printf("Failed to connect to upstream %s: %v", addr, err)
+		}
+		st.Inc("upstream_dial_errors")
+		stats.Dials.Failure(addr, class)
+		return nil
+	}
+	stats.Dials.Success(addr, time.Since(start))
+	return writeClientHello(conn, addr, rawClientHello, dial, start, st, cfg, logger)
+}
+
+// writeClientHello writes the inner ClientHello to conn, a new connection to
+// the upstream at addr, and returns it, or nil if the write failed. Some
+// filters let connections be established and reset them on their first data,
+// which mostly shows only after the write went through. So while another
+// resolved address of addr is left, the first bytes of the upstream are
+// awaited within the dial timeout that began at start, and after a failed
+// write, or a reset or EOF before the first byte, the ClientHello is written
+// to a new connection to that address instead. This goes on for up to
+// clientHelloWriteAttempts connections in total and within the same dial
+// timeout. Failures and retries are counted in st.
+func writeClientHello(conn net.Conn, addr string, rawClientHello []byte, dial dialFunc, start time.Time, st *stats.Stats, cfg *config.Config, logger *log.Logger) net.Conn {
+	var tried []string
+	deadline := start.Add(dialTimeout(cfg))
+	for attempt := 1; ; attempt++ {
+		if refuseSelf(conn, addr, st, cfg, logger) {
+			return nil
+		}
+		tuneUpstreamConn(conn, cfg, logger)
+		failed := conn.RemoteAddr().String()
+		_, err := conn.Write(rawClientHello)
+		next := ""
+		// The upstream proxy is verified for its hostname, it cannot be redialed by address
+		if _, ok := conn.(*net.TCPConn); ok && attempt < clientHelloWriteAttempts {
+			tried = append(tried, failed)
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			next = nextUpstreamAddr(ctx, addr, tried, cfg)
+			cancel()
+		}
+		if err != nil {
+			logger.Printf("Failed to write inner ClientHello to upstream %s at %s: %v", addr, failed, err)
+		} else if next == "" {
+			// With nothing to fall back to, the relay reports how the upstream ends
+			return conn
+		} else {
+			answered, err := awaitUpstream(conn, deadline)
+			if err == nil {
+				return answered
+			}
+			logger.Printf("Upstream %s at %s closed the connection after the inner ClientHello: %v", addr, failed, err)
+		}
+		st.Inc("upstream_write_errors")
+		conn.Close()
+
+		remaining := time.Until(deadline)
+		if next == "" || remaining <= 0 {
+			return nil
+		}
+
+		logger.Printf("Retrying the inner ClientHello for upstream %s at %s", addr, next)
+		st.Inc("upstream_write_retries")
+		// The retry must fit in what is left of the dial timeout
+		retryCfg := *cfg
+		retryCfg.DialTimeout = remaining
+		if conn, err = dial(next, &retryCfg, logger); err != nil {
+			logger.Printf("Failed to connect to upstream %s at %s: %v", addr, next, err)
+			return nil
+		}
+	}
+}
+
+// refuseSelf closes conn, a connection to the upstream at addr, and returns
+// true if it leads back to this proxy, see pointsToSelf, counting it in st.
+// Nothing has been written to it yet, so the loop ends at the first
+// connection.
+func refuseSelf(conn net.Conn, addr string, st *stats.Stats, cfg *config.Config, logger *log.Logger) bool {
+	if !pointsToSelf(conn.RemoteAddr(), cfg) {
+		return false
+	}
+	logger.Printf("Refused upstream %s at %s, it is this proxy", addr, conn.RemoteAddr())
+	st.Inc("sni_loops")
+	conn.Close()
+	return true
+}
+
+// awaitUpstream waits until deadline for the first bytes the upstream sends
+// on conn, and returns the error if the upstream closed or reset it first.
+// Otherwise it returns conn, with the bytes read so far buffered ahead of the
+// rest. An upstream that is merely slow to answer is no failure.
+func awaitUpstream(conn net.Conn, deadline time.Time) (net.Conn, error) {
+	conn.SetReadDeadline(deadline)
+	r := bufio.NewReader(conn)
+	_, err := r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return conn, nil
+	case errors.Is(err, io.EOF):
+		return nil, io.ErrUnexpectedEOF
+	case err != nil:
+		return nil, err
+	}
+	return bufferedConn{Conn: conn, r: r}, nil
+}
@@ -0,0 +1,446 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// mockUpstream accepts connections and keeps them open until closed.
+type mockUpstream struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// startMockUpstream starts a mock upstream on a loopback port.
+func startMockUpstream(t *testing.T) *mockUpstream {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	m := &mockUpstream{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		m.closeAll()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			m.mu.Lock()
+			m.conns = append(m.conns, conn)
+			m.mu.Unlock()
+		}
+	}()
+	return m
+}
+
+// accepted returns the number of connections accepted so far.
+func (m *mockUpstream) accepted() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns)
+}
+
+// closeAll closes every accepted connection.
+func (m *mockUpstream) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, conn := range m.conns {
+		conn.Close()
+	}
+}
+
+// idleCount returns the number of idle connections pooled for addr.
+func (p *connPool) idleCount(addr string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle[addr])
+}
+
+// plainDial dials addr directly.
+func plainDial(addr string, cfg *config.Config, logger *log.Logger) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+// TestConnPoolTake checks that a pool is filled on the first connection to an
+// upstream, and refilled when a connection is taken.
+func TestConnPoolTake(t *testing.T) {
+	upstream := startMockUpstream(t)
+	addr := upstream.ln.Addr().String()
+	pool := newConnPool(time.Minute, time.Minute)
+	t.Cleanup(func() { pool.closeAll() })
+	cfg := &config.Config{UpstreamPoolSize: 2}
+	logger := log.New(io.Discard, "", 0)
+
+	assert.Nil(t, pool.take(addr, plainDial, stats.New(), cfg, logger), "the pool starts empty")
+	require.Eventually(t, func() bool { return pool.idleCount(addr) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 2, upstream.accepted())
+
+	conn := pool.take(addr, plainDial, stats.New(), cfg, logger)
+	require.NotNil(t, conn)
+	defer conn.Close()
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return pool.idleCount(addr) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 3, upstream.accepted())
+}
+
+// TestConnPoolDisabled checks that a pool size of zero never dials.
+func TestConnPoolDisabled(t *testing.T) {
+	upstream := startMockUpstream(t)
+	addr := upstream.ln.Addr().String()
+	pool := newConnPool(time.Minute, time.Minute)
+
+	assert.Nil(t, pool.take(addr, plainDial, stats.New(), &config.Config{}, log.New(io.Discard, "", 0)))
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, upstream.accepted())
+	assert.Zero(t, pool.idleCount(addr))
+}
+
+// TestConnPoolStale checks that connections closed by the upstream are
+// discarded and replaced.
+func TestConnPoolStale(t *testing.T) {
+	upstream := startMockUpstream(t)
+	addr := upstream.ln.Addr().String()
+	pool := newConnPool(time.Minute, time.Minute)
+	t.Cleanup(func() { pool.closeAll() })
+	cfg := &config.Config{UpstreamPoolSize: 2}
+	logs := &lockedBuffer{}
+	logger := log.New(logs, "", 0)
+
+	pool.take(addr, plainDial, stats.New(), cfg, logger)
+	require.Eventually(t, func() bool { return upstream.accepted() == 2 && pool.idleCount(addr) == 2 }, time.Second, 5*time.Millisecond)
+
+	upstream.closeAll()
+	// Give the FINs time to arrive
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, pool.take(addr, plainDial, stats.New(), cfg, logger), "closed connections must not be taken")
+	assert.Contains(t, logs.String(), "Discarding pooled connection to upstream "+addr)
+
+	require.Eventually(t, func() bool { return upstream.accepted() == 4 && pool.idleCount(addr) == 2 }, time.Second, 5*time.Millisecond)
+	conn := pool.take(addr, plainDial, stats.New(), cfg, logger)
+	require.NotNil(t, conn)
+	conn.Close()
+}
+
+// TestConnPoolExpiry checks that idle connections are replaced as they age
+// out while the upstream is in use, and closed for good afterwards.
+func TestConnPoolExpiry(t *testing.T) {
+	testCases := []struct {
+		name     string
+		keepWarm time.Duration
+		refilled bool
+	}{
+		{name: "Upstream in use", keepWarm: time.Minute, refilled: true},
+		{name: "Upstream unused", keepWarm: 0, refilled: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := startMockUpstream(t)
+			addr := upstream.ln.Addr().String()
+			pool := newConnPool(50*time.Millisecond, tc.keepWarm)
+			t.Cleanup(func() { pool.closeAll() })
+			cfg := &config.Config{UpstreamPoolSize: 1}
+
+			pool.take(addr, plainDial, stats.New(), cfg, log.New(io.Discard, "", 0))
+			require.Eventually(t, func() bool { return pool.idleCount(addr) == 1 }, time.Second, 5*time.Millisecond)
+			time.Sleep(200 * time.Millisecond)
+
+			if tc.refilled {
+				assert.Greater(t, upstream.accepted(), 2, "expired connections are replaced")
+				assert.Equal(t, 1, pool.idleCount(addr))
+			} else {
+				assert.Equal(t, 1, upstream.accepted())
+				assert.Zero(t, pool.idleCount(addr))
+			}
+		})
+	}
+}
+
+// TestConnPoolFillFailure checks that a failed dial leaves the pool empty,
+// and forgets the upstream so that unresolvable names are not kept.
+func TestConnPoolFillFailure(t *testing.T) {
+	pool := newConnPool(time.Minute, time.Minute)
+	refused := func(addr string, cfg *config.Config, logger *log.Logger) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	logs := &lockedBuffer{}
+
+	assert.Nil(t, pool.take("upstream.test:443", refused, stats.New(), &config.Config{UpstreamPoolSize: 2}, log.New(logs, "", 0)))
+	require.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "Failed to fill the connection pool of upstream upstream.test:443: connection refused")
+	}, time.Second, 5*time.Millisecond)
+	assert.Zero(t, pool.idleCount("upstream.test:443"))
+	assert.Eventually(t, func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return len(pool.lastUsed) == 0 && len(pool.dials) == 0 && len(pool.idle) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+// TestConnPoolCloseAll checks that closing the pool closes its connections.
+func TestConnPoolCloseAll(t *testing.T) {
+	upstream := startMockUpstream(t)
+	addr := upstream.ln.Addr().String()
+	pool := newConnPool(time.Minute, time.Minute)
+	cfg := &config.Config{UpstreamPoolSize: 2}
+
+	pool.take(addr, plainDial, stats.New(), cfg, log.New(io.Discard, "", 0))
+	require.Eventually(t, func() bool { return pool.idleCount(addr) == 2 }, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, 2, pool.closeAll())
+	assert.Zero(t, pool.idleCount(addr))
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	for _, conn := range upstream.conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	}
+}
+
+// failingWriteConn is a connection whose writes fail.
+type failingWriteConn struct {
+	net.Conn
+}
+
+func (c failingWriteConn) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+// TestConnectUpstreamPooled checks that routed connections use pooled
+// connections, and dial a new one when writing to a pooled one fails.
+func TestConnectUpstreamPooled(t *testing.T) {
+	upstream := startMockUpstream(t)
+	addr := upstream.ln.Addr().String()
+	orig := upstreamPools
+	upstreamPools = newConnPool(time.Minute, time.Minute)
+	t.Cleanup(func() {
+		upstreamPools.closeAll()
+		upstreamPools = orig
+	})
+	cfg := &config.Config{UpstreamPoolSize: 1}
+	st := stats.New()
+	logs := &lockedBuffer{}
+	logger := log.New(logs, "", 0)
+	hello := []byte("hello")
+
+	// The first connection fills the pool
+	conn := connectUpstream(addr, hello, plainDial, true, st, cfg, logger)
+	require.NotNil(t, conn)
+	conn.Close()
+	require.Eventually(t, func() bool { return upstreamPools.idleCount(addr) == 1 }, time.Second, 5*time.Millisecond)
+	accepted := upstream.accepted()
+
+	conn = connectUpstream(addr, hello, plainDial, true, st, cfg, logger)
+	require.NotNil(t, conn)
+	conn.Close()
+	assert.Contains(t, logs.String(), "Using pooled connection to upstream "+addr)
+	assert.Equal(t, accepted, upstream.accepted(), "a pooled connection needs no dial")
+
+	// Connections to decoys are never pooled
+	require.Eventually(t, func() bool { return upstreamPools.idleCount(addr) == 1 }, time.Second, 5*time.Millisecond)
+	conn = connectUpstream(addr, hello, plainDial, false, st, cfg, logger)
+	require.NotNil(t, conn)
+	conn.Close()
+	assert.Equal(t, 1, upstreamPools.idleCount(addr))
+
+	// A pooled connection that fails on write is replaced by a new dial
+	pc := upstreamPools.pop(addr)
+	require.NotNil(t, pc)
+	upstreamPools.put(addr, failingWriteConn{pc.conn}, cfg, logger)
+	conn = connectUpstream(addr, hello, plainDial, true, st, cfg, logger)
+	require.NotNil(t, conn)
+	conn.Close()
+	assert.Contains(t, logs.String(), "Pooled connection to upstream "+addr+" failed, dialing a new one: broken pipe")
+	assert.Equal(t, int64(1), st.Get("upstream_pool_misses"))
+	assert.Equal(t, int64(2), st.Get("upstream_pool_hits"))
+	assert.Equal(t, int64(1), st.Get("upstream_pool_stale"))
+}
+
+// startResettingUpstream listens on addr, and resets every connection it
+// accepts once it has read from it, like a filter that lets connections be
+// established but kills their data.
+func startResettingUpstream(t *testing.T, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Read(make([]byte, 1))
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+			}()
+		}
+	}()
+}
+
+// TestConnectUpstreamWriteFallback checks that the inner ClientHello is
+// written to the next resolved address of an upstream when the upstream
+// resets the connection before answering it, and that the connection to the
+// last address, or to a silent upstream, is handed to the relay as it is.
+func TestConnectUpstreamWriteFallback(t *testing.T) {
+	const host = "fallback.test"
+	hello := []byte("hello")
+	testCases := []struct {
+		name            string
+		ips             []string
+		resetting       []string
+		silent          string
+		expected        string
+		expectedRetries int
+	}{
+		{name: "Next address", ips: []string{"127.0.0.1", "127.0.0.2"}, resetting: []string{"127.0.0.1"}, expected: "127.0.0.2", expectedRetries: 1},
+		{name: "All addresses reset", ips: []string{"127.0.0.1", "127.0.0.2"}, resetting: []string{"127.0.0.1", "127.0.0.2"}, expected: "127.0.0.2", expectedRetries: 1},
+		{name: "Attempts exhausted", ips: []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"}, resetting: []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}, expected: "127.0.0.3", expectedRetries: 2},
+		{name: "Single address", ips: []string{"127.0.0.1"}, resetting: []string{"127.0.0.1"}, expected: "127.0.0.1"},
+		{name: "Silent upstream", ips: []string{"127.0.0.1", "127.0.0.2"}, silent: "127.0.0.1", expected: "127.0.0.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			probe, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			_, port, _ := net.SplitHostPort(probe.Addr().String())
+			probe.Close()
+			var ips []net.IP
+			for _, ip := range tc.ips {
+				ips = append(ips, net.ParseIP(ip))
+				if slices.Contains(tc.resetting, ip) {
+					startResettingUpstream(t, net.JoinHostPort(ip, port))
+					continue
+				}
+				ln, err := net.Listen("tcp", net.JoinHostPort(ip, port))
+				require.NoError(t, err)
+				t.Cleanup(func() { ln.Close() })
+				go func() {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+					if ip == tc.silent {
+						// Answers only after the dial timeout
+						time.Sleep(300 * time.Millisecond)
+					}
+					io.Copy(conn, conn)
+				}()
+			}
+			upstreamDNS.mu.Lock()
+			upstreamDNS.entries[host] = &dnsEntry{ips: ips, expires: time.Now().Add(time.Hour)}
+			upstreamDNS.mu.Unlock()
+			t.Cleanup(func() { upstreamDNS.invalidate(host) })
+
+			cfg := &config.Config{DNSCacheTTL: time.Hour, DialTimeout: 100 * time.Millisecond}
+			logs := &lockedBuffer{}
+			addr := net.JoinHostPort(host, port)
+			conn := connectUpstream(addr, hello, dialUpstream, false, stats.New(), cfg, log.New(logs, "", 0))
+			require.NotNil(t, conn)
+			defer conn.Close()
+			assert.Equal(t, net.JoinHostPort(tc.expected, port), conn.RemoteAddr().String())
+			assert.Equal(t, tc.expectedRetries, strings.Count(logs.String(), "Retrying the inner ClientHello"))
+			assert.Equal(t, tc.expectedRetries, strings.Count(logs.String(), "closed the connection after the inner ClientHello"))
+			if tc.expectedRetries > 0 {
+				assert.Contains(t, logs.String(), "Upstream "+addr+" at "+net.JoinHostPort(tc.ips[0], port)+" closed the connection after the inner ClientHello")
+				assert.Contains(t, logs.String(), "Retrying the inner ClientHello for upstream "+addr+" at "+net.JoinHostPort(tc.expected, port))
+			}
+
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			echoed := make([]byte, len(hello))
+			_, err = io.ReadFull(conn, echoed)
+			if slices.Contains(tc.resetting, tc.expected) {
+				// The relay sees the reset
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, hello, echoed)
+		})
+	}
+}
+
+// countingDialer is a net.Dialer that counts its dials.
+type countingDialer struct {
+	net.Dialer
+	dials atomic.Int32
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+// TestHandlerPooled checks that proxied connections relay through pooled
+// upstream connections, which are dialed with the dialer of the handler and
+// counted in its stats.
+func TestHandlerPooled(t *testing.T) {
+	const sni = "pool.test"
+	upstream := startTestUpstream(t, sni)
+	addr := upstream.Addr().String()
+	orig := upstreamPools
+	upstreamPools = newConnPool(time.Minute, time.Minute)
+	t.Cleanup(func() {
+		upstreamPools.closeAll()
+		upstreamPools = orig
+	})
+	cfg := &config.Config{UpstreamPoolSize: 2}
+	dialer := &countingDialer{}
+	st := stats.New()
+
+	for i := range 3 {
+		if i > 0 {
+			require.Eventually(t, func() bool { return upstreamPools.idleCount(addr) == 2 }, time.Second, 5*time.Millisecond)
+		}
+		logs := &lockedBuffer{}
+		clientConn, serverConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h := newTestHandler(cfg, log.New(logs, "", 0))
+			h.Dialer = dialer
+			h.Stats = st
+			h.Serve(serverConn, "00000001")
+		}()
+
+		hello := buildTestClientHello(t, sni)
+		_, err := clientConn.Write(append(append([]byte{}, hello...), "ping"...))
+		require.NoError(t, err)
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadFull(clientConn, make([]byte, len(hello)+4))
+		require.NoError(t, err)
+		clientConn.Close()
+		<-done
+
+		if i > 0 {
+			assert.Contains(t, logs.String(), "Using pooled connection to upstream "+addr)
+		}
+	}
+	// One direct dial, two to fill the pool and one to refill it per hit
+	assert.Eventually(t, func() bool { return dialer.dials.Load() == 5 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(1), st.Get("upstream_pool_misses"))
+	assert.Equal(t, int64(2), st.Get("upstream_pool_hits"))
+}
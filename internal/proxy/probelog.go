@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+)
+
+// Classes of the requests served by the stealth personas, reported in the
+// probe log.
+const (
+	ProbeRoot     = "root"
+	ProbeVulnScan = "vuln_scan"
+	ProbeAuth     = "auth_probe"
+	ProbeCrawler  = "crawler"
+	ProbeOther    = "other"
+)
+
+const (
+	// probeLogInterval is the minimum time between two identical probe log
+	// records from the same client.
+	probeLogInterval = time.Minute
+	// maxProbeLogEntries bounds the memory used for rate-limiting probe log
+	// records. When it is reached, the rate-limiting state starts over.
+	maxProbeLogEntries = 4096
+)
+
+// probeRule classifies the requests whose lower-cased path starts with one
+// of prefixes or contains one of substrings, or whose lower-cased User-Agent
+// contains one of userAgents.
+type probeRule struct {
+	class      string
+	prefixes   []string
+	substrings []string
+	userAgents []string
+}
+
+// probeRules are tried in order, the first matching rule giving the class of
+// a request. Requests presenting credentials, or for -stealth-auth-paths, are
+// auth probes before any rule applies.
+var probeRules = []probeRule{
+	{
+		class: ProbeAuth,
+		prefixes: []string{
+			"/wp-login.php", "/xmlrpc.php", "/wp-admin", "/admin", "/administrator", "/login",
+			"/user/login", "/phpmyadmin", "/pma", "/manager/html", "/owa/auth", "/remote/login",
+		},
+	},
+	{
+		class:    ProbeCrawler,
+		prefixes: []string{"/robots.txt", "/sitemap", "/favicon.ico", "/ads.txt", "/humans.txt", "/.well-known/"},
+	},
+	{
+		class:    ProbeRoot,
+		prefixes: []string{"/index."},
+	},
+	{
+		class: ProbeVulnScan,
+		prefixes: []string{
+			"/cgi-bin/", "/vendor/", "/actuator", "/boaform", "/hnap1", "/solr", "/console",
+			"/_ignition", "/server-status", "/debug", "/api/v1/pods", "/telescope",
+		},
+		substrings: []string{
+			"/.", "..", "wp-config", "phpinfo", "eval-stdin", "passwd", "shell",
+			".php", ".asp", ".jsp", ".cgi", ".sql", ".bak", ".zip", ".tar",
+		},
+	},
+	{
+		class:      ProbeCrawler,
+		userAgents: []string{"bot", "crawl", "spider", "slurp", "facebookexternalhit", "archiver"},
+	},
+}
+
+// classifyStealthRequest returns the class of req, whose path is auth
+// protected if it is under one of authPaths.
+func classifyStealthRequest(req *http.Request, authPaths []string) string {
+	if req.Header.Get("Authorization") != "" || authPath(req.URL.Path, authPaths) {
+		return ProbeAuth
+	}
+	urlPath := strings.ToLower(req.URL.Path)
+	userAgent := strings.ToLower(req.UserAgent())
+	for _, rule := range probeRules {
+		if hasAnyPrefix(urlPath, rule.prefixes) || containsAny(urlPath, rule.substrings) || containsAny(userAgent, rule.userAgents) {
+			return rule.class
+		}
+	}
+	if urlPath == "/" {
+		return ProbeRoot
+	}
+	return ProbeOther
+}
+
+// hasAnyPrefix reports whether s starts with one of prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny reports whether s contains one of substrings.
+func containsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeRecord describes a request served by a stealth persona.
+type probeRecord struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Host       string    `json:"host"`
+	UserAgent  string    `json:"user_agent"`
+	Status     int       `json:"status"`
+	Class      string    `json:"class"`
+	Suppressed int       `json:"suppressed,omitempty"`
+}
+
+// probeLogEvent is the event of probe records, which tells them from the
+// access records in the same log.
+const probeLogEvent = "stealth_request"
+
+// probeLogEntry is the rate-limiting state of identical records from a client.
+type probeLogEntry struct {
+	last       time.Time
+	suppressed int
+}
+
+// probeLog rate-limits identical probe log records per client.
+var probeLog = struct {
+	sync.Mutex
+	entries map[probeRecord]*probeLogEntry
+}{
+	entries: make(map[probeRecord]*probeLogEntry),
+}
+
+// logProbe writes rec to logger in the configured log format, at most once
+// per probeLogInterval for identical records from the same client. The next
+// record reports how many were not written.
+func logProbe(logger *log.Logger, format config.LogFormat, rec probeRecord) {
+	// Identical records differ only in their time
+	key := rec
+	key.Time = time.Time{}
+
+	probeLog.Lock()
+	e, ok := probeLog.entries[key]
+	if ok && rec.Time.Sub(e.last) < probeLogInterval {
+		e.suppressed++
+		probeLog.Unlock()
+		return
+	}
+	if !ok {
+		if len(probeLog.entries) >= maxProbeLogEntries {
+			clear(probeLog.entries)
+		}
+		e = &probeLogEntry{}
+		probeLog.entries[key] = e
+	}
+	rec.Suppressed = e.suppressed
+	e.last = rec.Time
+	e.suppressed = 0
+	probeLog.Unlock()
+
+	if format == config.LogFormatJSON {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			logger.Printf("Failed to encode probe log record: %v", err)
+			return
+		}
+		logger.Writer().Write(append(line, '\n'))
+		return
+	}
+
+	msg := fmt.Sprintf("Stealth request: client=%s method=%s path=%q host=%q user_agent=%q status=%d class=%s",
+		rec.ClientIP, rec.Method, rec.Path, rec.Host, rec.UserAgent, rec.Status, rec.Class)
+	if rec.Suppressed > 0 {
+		msg += fmt.Sprintf(" suppressed=%d", rec.Suppressed)
+	}
+	logger.Print(msg)
+}
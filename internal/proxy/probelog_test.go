@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// TestClassifyStealthRequest tests the rule table classifying the requests
+// of the stealth personas.
+func TestClassifyStealthRequest(t *testing.T) {
+	testCases := []struct {
+		name          string
+		path          string
+		userAgent     string
+		authorization string
+		authPaths     []string
+		expected      string
+	}{
+		{name: "Root", path: "/", expected: ProbeRoot},
+		{name: "Index file", path: "/index.nginx-debian.html", expected: ProbeRoot},
+		{name: "Hidden file", path: "/.env", expected: ProbeVulnScan},
+		{name: "Git config", path: "/.git/config", expected: ProbeVulnScan},
+		{name: "Path traversal", path: "/static/../../etc/passwd", expected: ProbeVulnScan},
+		{name: "PHPUnit", path: "/vendor/phpunit/phpunit/src/Util/PHP/eval-stdin.php", expected: ProbeVulnScan},
+		{name: "CGI", path: "/cgi-bin/luci", expected: ProbeVulnScan},
+		{name: "Any PHP script", path: "/info.PHP", expected: ProbeVulnScan},
+		{name: "Backup", path: "/backup.sql", expected: ProbeVulnScan},
+		{name: "WordPress login", path: "/wp-login.php", expected: ProbeAuth},
+		{name: "phpMyAdmin", path: "/phpMyAdmin/index.php", expected: ProbeAuth},
+		{name: "Configured auth path", path: "/private/", authPaths: []string{"/private"}, expected: ProbeAuth},
+		{name: "Credentials", path: "/", authorization: "Basic YWRtaW46YWRtaW4=", expected: ProbeAuth},
+		{name: "Robots", path: "/robots.txt", expected: ProbeCrawler},
+		{name: "Security contact", path: "/.well-known/security.txt", expected: ProbeCrawler},
+		{name: "Crawler", path: "/", userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", expected: ProbeCrawler},
+		{name: "Crawler probing", path: "/.env", userAgent: "Googlebot/2.1", expected: ProbeVulnScan},
+		{name: "Other", path: "/about", userAgent: "curl/8.5.0", expected: ProbeOther},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "https://example.com"+tc.path, nil)
+			require.NoError(t, err)
+			req.Header.Set("User-Agent", tc.userAgent)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			assert.Equal(t, tc.expected, classifyStealthRequest(req, tc.authPaths))
+		})
+	}
+}
+
+// TestLogProbe checks that identical probe records from a client are written
+// once per interval, with the number left out reported by the next one, and
+// that records differing in anything else are all written.
+func TestLogProbe(t *testing.T) {
+	probeLog.entries = make(map[probeRecord]*probeLogEntry)
+	var buf lockedBuffer
+	logger := log.New(&buf, "[test] ", 0)
+	now := time.Unix(1700000000, 0)
+	rec := probeRecord{Event: probeLogEvent, ClientIP: "192.0.2.1", Method: "GET", Path: "/.env", Host: "example.com", Status: 403, Class: ProbeVulnScan}
+	logAt := func(rec probeRecord, at time.Time) {
+		rec.Time = at
+		logProbe(logger, config.LogFormatJSON, rec)
+	}
+
+	logAt(rec, now)
+	logAt(rec, now.Add(time.Second))
+	logAt(rec, now.Add(2*time.Second))
+	other := rec
+	other.ClientIP = "192.0.2.2"
+	logAt(other, now.Add(3*time.Second))
+	logAt(rec, now.Add(probeLogInterval+time.Second))
+
+	lines := buf.Lines()
+	require.Len(t, lines, 3)
+	var records []probeRecord
+	for _, line := range lines {
+		var r probeRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &r), "JSON records must be bare lines: %s", line)
+		records = append(records, r)
+	}
+	assert.Equal(t, "192.0.2.1", records[0].ClientIP)
+	assert.Equal(t, 0, records[0].Suppressed)
+	assert.Equal(t, "192.0.2.2", records[1].ClientIP)
+	assert.Equal(t, 2, records[2].Suppressed)
+	assert.Equal(t, ProbeVulnScan, records[2].Class)
+}
+
+// TestHandlerStealthProbeLog checks that every request served by a persona
+// is recorded with its answer and class, and counted by class.
+func TestHandlerStealthProbeLog(t *testing.T) {
+	probeLog.entries = make(map[probeRecord]*probeLogEntry)
+	var buf lockedBuffer
+	h := NewHandler(&config.Config{
+		Domain:           "example.com",
+		StealthMode:      config.StealthNginx,
+		StealthForbidden: []string{config.DefaultStealthForbidden},
+		SniffTimeout:     time.Second,
+	})
+	h.Stats = stats.New()
+	h.Logger = log.New(&buf, "", 0)
+
+	exchange(h, "GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Mozilla/5.0\r\n\r\n")
+	exchange(h, "GET /.git/config HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	exchange(h, "GET /admin?user=root HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	var records []string
+	for _, line := range buf.Lines() {
+		// Text records carry the connection ID like the other messages
+		if _, record, ok := strings.Cut(line, "] Stealth request: "); ok {
+			records = append(records, record)
+		}
+	}
+	assert.Equal(t, []string{
+		`client=pipe method=GET path="/" host="example.com" user_agent="Mozilla/5.0" status=200 class=root`,
+		`client=pipe method=GET path="/.git/config" host="example.com" user_agent="" status=403 class=vuln_scan`,
+		`client=pipe method=GET path="/admin?user=root" host="example.com" user_agent="" status=404 class=auth_probe`,
+	}, records)
+	assert.Equal(t, int64(1), h.Stats.Get("probe_class:"+ProbeRoot))
+	assert.Equal(t, int64(1), h.Stats.Get("probe_class:"+ProbeVulnScan))
+	assert.Equal(t, int64(1), h.Stats.Get("probe_class:"+ProbeAuth))
+}
@@ -4,12 +4,21 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/cryptobyte"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
 )
 
 // TestSniffProtocol tests the protocol sniffing logic.
@@ -38,6 +47,24 @@ func TestSniffProtocol(t *testing.T) {
 			expectedProtocol: ProtoHTTP,
 			expectError:      false,
 		},
+		{
+			name:             "WebDAV Request",
+			input:            []byte("PROPFIND / HTTP/1.1\r\n"),
+			expectedProtocol: ProtoHTTP,
+			expectError:      false,
+		},
+		{
+			name:             "Made-up Method",
+			input:            []byte("FROB /x HTTP/1.1\r\n"),
+			expectedProtocol: ProtoHTTP,
+			expectError:      false,
+		},
+		{
+			name:             "Lower Case Method",
+			input:            []byte("frob /x HTTP/1.1\r\n"),
+			expectedProtocol: ProtoUnknown,
+			expectError:      false,
+		},
 		{
 			name:             "Unknown Protocol",
 			input:            []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07},
@@ -56,6 +83,78 @@ func TestSniffProtocol(t *testing.T) {
 			expectedProtocol: ProtoSignalTLS, // Should still be detected
 			expectError:      false,
 		},
+		{
+			name:             "Handshake byte with invalid record version",
+			input:            []byte{0x16, 0x07, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01},
+			expectedProtocol: ProtoUnknown,
+			expectError:      false,
+		},
+		{
+			name:             "Handshake byte with SSL 3.0 record version",
+			input:            []byte{0x16, 0x03, 0x00, 0x02, 0x00, 0x01, 0x00, 0x01},
+			expectedProtocol: ProtoUnknown,
+			expectError:      false,
+		},
+		{
+			name:             "Zero record length",
+			input:            []byte{0x16, 0x03, 0x01, 0x00, 0x00, 0x01, 0x00, 0x01},
+			expectedProtocol: ProtoUnknown,
+			expectError:      false,
+		},
+		{
+			name:             "Oversized record length",
+			input:            []byte{0x16, 0x03, 0x03, 0x41, 0x01, 0x01, 0x00, 0x01},
+			expectedProtocol: ProtoUnknown,
+			expectError:      false,
+		},
+		{
+			name:             "Maximum record length",
+			input:            []byte{0x16, 0x03, 0x03, 0x41, 0x00, 0x01, 0x00, 0x01},
+			expectedProtocol: ProtoSignalTLS,
+			expectError:      false,
+		},
+		{
+			name:             "Handshake type other than ClientHello",
+			input:            []byte{0x16, 0x03, 0x03, 0x00, 0x40, 0x02, 0x00, 0x00},
+			expectedProtocol: ProtoUnknown,
+			expectError:      false,
+		},
+		{
+			name:             "Short Input TLS with invalid version",
+			input:            []byte{0x16, 0x00, 0x01},
+			expectedProtocol: ProtoUnknown,
+			expectError:      false,
+		},
+		{
+			name:             "SSH banner",
+			input:            []byte("SSH-2.0-OpenSSH_9.6\r\n"),
+			expectedProtocol: ProtoSSH,
+			expectError:      false,
+		},
+		{
+			name:             "SOCKS5 greeting",
+			input:            []byte{0x05, 0x01, 0x00},
+			expectedProtocol: ProtoSOCKS5,
+			expectError:      false,
+		},
+		{
+			name:             "SOCKS4 connect request",
+			input:            []byte{0x04, 0x01, 0x01, 0xbb, 0x7f, 0x00, 0x00, 0x01, 0x00},
+			expectedProtocol: ProtoSOCKS4,
+			expectError:      false,
+		},
+		{
+			name:             "TLS alert record",
+			input:            []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28},
+			expectedProtocol: ProtoTLSAlert,
+			expectError:      false,
+		},
+		{
+			name:             "STUN binding request",
+			input:            []byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c},
+			expectedProtocol: ProtoSTUN,
+			expectError:      false,
+		},
 		{
 			name:             "Short Input Other",
 			input:            []byte{0x01, 0x02, 0x03},
@@ -79,9 +178,89 @@ func TestSniffProtocol(t *testing.T) {
 	}
 }
 
+// TestSniffProtocolShortProbes checks that probes which send a few bytes and
+// then wait for a reply are classified without waiting for more.
+func TestSniffProtocolShortProbes(t *testing.T) {
+	testCases := []struct {
+		name             string
+		input            []byte
+		expectedProtocol Protocol
+		expectedDump     []byte
+	}{
+		{name: "SOCKS5 greeting", input: []byte{0x05, 0x02, 0x00, 0x02}, expectedProtocol: ProtoSOCKS5},
+		{name: "TLS alert", input: []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x46}, expectedProtocol: ProtoTLSAlert},
+		{name: "Unknown", input: []byte{0x05, 0x00, 0xff}, expectedProtocol: ProtoUnknown, expectedDump: []byte{0x05, 0x00, 0xff}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go clientConn.Write(tc.input)
+
+			serverConn.SetReadDeadline(time.Now().Add(time.Second))
+			protocol, dump, err := sniffProtocol(bufio.NewReader(serverConn))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedProtocol, protocol)
+			assert.Equal(t, tc.expectedDump, dump)
+		})
+	}
+}
+
+// TestSniffProtocolSplitMethod checks that long methods whose space arrives
+// after the first 8 bytes are recognized, and that sniffing does not wait for
+// more once the bytes cannot be a method.
+func TestSniffProtocolSplitMethod(t *testing.T) {
+	testCases := []struct {
+		name             string
+		chunks           []string
+		expectedProtocol Protocol
+	}{
+		{name: "PROPFIND", chunks: []string{"PROPFIND", " / HTTP/1.1\r\n"}, expectedProtocol: ProtoHTTP},
+		{name: "MKCALENDAR", chunks: []string{"MKCALEND", "AR /cal HTTP/1.1\r\n"}, expectedProtocol: ProtoHTTP},
+		{name: "No path", chunks: []string{"PROPFIND", " x HTTP/1.1\r\n"}, expectedProtocol: ProtoUnknown},
+		{name: "Too long", chunks: []string{"ABCDEFGH", "IJKLMNOPQRSTUVWXYZ / HTTP/1.1\r\n"}, expectedProtocol: ProtoUnknown},
+		{name: "Not a method", chunks: []string{"abcdefgh"}, expectedProtocol: ProtoUnknown},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go func() {
+				for _, chunk := range tc.chunks {
+					if _, err := clientConn.Write([]byte(chunk)); err != nil {
+						return
+					}
+				}
+			}()
+
+			serverConn.SetReadDeadline(time.Now().Add(time.Second))
+			start := time.Now()
+			protocol, _, err := sniffProtocol(bufio.NewReader(serverConn))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedProtocol, protocol)
+			assert.Less(t, time.Since(start), 500*time.Millisecond)
+		})
+	}
+}
+
+// newTestHandler returns a handler for the connections of cfg logging to logger.
+func newTestHandler(cfg *config.Config, logger *log.Logger) *Handler {
+	h := NewHandler(cfg)
+	h.Logger = logger
+	return h
+}
+
 // buildTestClientHello creates a syntactically correct ClientHello record
 // using cryptobyte, which helps avoid manual length calculation errors.
-func buildTestClientHello(t *testing.T, serverName string) []byte {
+func buildTestClientHello(t testing.TB, serverName string) []byte {
+	return buildTestClientHelloALPN(t, serverName)
+}
+
+// buildTestClientHelloALPN is like buildTestClientHello, and adds an ALPN
+// extension offering alpn if it is not empty.
+func buildTestClientHelloALPN(t testing.TB, serverName string, alpn ...string) []byte {
 	var body, extensions, serverNameExt cryptobyte.Builder
 
 	// --- Build Extensions ---
@@ -99,6 +278,19 @@ func buildTestClientHello(t *testing.T, serverName string) []byte {
 		extensions.AddBytes(serverNameExt.BytesOrPanic())
 	}
 
+	if len(alpn) > 0 {
+		extensions.AddUint16(16) // application_layer_protocol_negotiation
+		extensions.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, protocol := range alpn {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes([]byte(protocol))
+					})
+				}
+			})
+		})
+	}
+
 	// A dummy extension to ensure the list is not empty if SNI is not present
 	// This makes the parsing logic slightly different between the two cases.
 	if serverName == "" {
@@ -140,18 +332,102 @@ func buildTestClientHello(t *testing.T, serverName string) []byte {
 	return record.BytesOrPanic()
 }
 
+// fragmentRecord splits the handshake payload of a single TLS record into
+// several records, cutting it at the given payload offsets.
+func fragmentRecord(record []byte, cuts ...int) []byte {
+	header, payload := record[:5], record[5:]
+	var out []byte
+	prev := 0
+	for _, cut := range append(cuts, len(payload)) {
+		out = append(out, header[0], header[1], header[2], byte((cut-prev)>>8), byte(cut-prev))
+		out = append(out, payload[prev:cut]...)
+		prev = cut
+	}
+	return out
+}
+
+// TestGetSNIFragmented checks that ClientHellos split across several records
+// at awkward boundaries are reassembled and forwarded unchanged.
+func TestGetSNIFragmented(t *testing.T) {
+	record := buildTestClientHello(t, "test.example.com")
+	payloadLen := len(record) - 5
+	sniOffset := bytes.Index(record, []byte("test.example.com")) - 5
+
+	// One byte per record is the most extreme legal fragmentation
+	var everyByte []int
+	for i := 1; i < payloadLen; i++ {
+		everyByte = append(everyByte, i)
+	}
+
+	testCases := []struct {
+		name string
+		cuts []int
+	}{
+		{name: "Mid message length field", cuts: []int{2}},
+		{name: "Right after the message header", cuts: []int{4}},
+		{name: "Mid server_name extension", cuts: []int{sniOffset - 3, sniOffset + 5}},
+		{name: "Last byte alone", cuts: []int{payloadLen - 1}},
+		{name: "One byte per record", cuts: everyByte},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fragmented := fragmentRecord(record, tc.cuts...)
+			trailing := []byte{0x17, 0x03, 0x03, 0x00, 0x01, 0xff} // Application data after the hello
+
+			reader := bytes.NewReader(append(append([]byte{}, fragmented...), trailing...))
+			sni, raw, err := getSNI(reader)
+			require.NoError(t, err)
+			assert.Equal(t, "test.example.com", sni)
+			assert.Equal(t, fragmented, raw, "all records should be returned exactly as received")
+			assert.Equal(t, len(trailing), reader.Len(), "no bytes beyond the ClientHello should be consumed")
+		})
+	}
+}
+
+// TestGetSNIFragmentedErrors checks the failure modes of record reassembly.
+func TestGetSNIFragmentedErrors(t *testing.T) {
+	record := buildTestClientHello(t, "test.example.com")
+
+	interleaved := fragmentRecord(record, 10)
+	interleaved[5+10] = 0x17 // The second record is application data
+
+	truncated := fragmentRecord(record, 10)
+	truncated = truncated[:len(truncated)-1]
+
+	oversized := []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x01, 0x00, 0x00} // 64 KiB ClientHello
+
+	testCases := []struct {
+		name        string
+		input       []byte
+		expectedErr error
+	}{
+		{name: "Interleaved non-handshake record", input: interleaved, expectedErr: ErrNotTLS},
+		{name: "Truncated last fragment", input: truncated, expectedErr: ErrTruncatedHello},
+		{name: "Oversized message", input: oversized, expectedErr: errClientHelloTooLarge},
+		{name: "Empty record", input: []byte{0x16, 0x03, 0x01, 0x00, 0x00}, expectedErr: ErrNotTLS},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := getSNI(bytes.NewReader(tc.input))
+			assert.ErrorIs(t, err, tc.expectedErr)
+		})
+	}
+}
+
 // TestGetSNI tests the SNI parsing from a ClientHello message.
 func TestGetSNI(t *testing.T) {
 	validCH := buildTestClientHello(t, "test.example.com")
 	noSniCH := buildTestClientHello(t, "")
 
 	testCases := []struct {
-		name           string
-		input          io.Reader
-		fullRecord     []byte
-		expectedSNI    string
-		expectError    bool
-		expectedErrMsg string
+		name        string
+		input       io.Reader
+		fullRecord  []byte
+		expectedSNI string
+		expectError bool
+		expectedErr error
 	}{
 		{
 			name:        "Valid ClientHello with SNI",
@@ -161,23 +437,23 @@ func TestGetSNI(t *testing.T) {
 			expectError: false,
 		},
 		{
-			name:           "ClientHello without SNI",
-			input:          bytes.NewReader(noSniCH),
-			fullRecord:     noSniCH,
-			expectError:    true,
-			expectedErrMsg: "SNI not found",
+			name:        "ClientHello without SNI",
+			input:       bytes.NewReader(noSniCH),
+			fullRecord:  noSniCH,
+			expectError: true,
+			expectedErr: ErrNoSNI,
 		},
 		{
-			name:           "Malformed - Not a handshake record",
-			input:          bytes.NewReader([]byte{0x17, 0x03, 0x01, 0x00, 0x01}),
-			expectError:    true,
-			expectedErrMsg: "not a TLS handshake record",
+			name:        "Malformed - Not a handshake record",
+			input:       bytes.NewReader([]byte{0x17, 0x03, 0x01, 0x00, 0x01}),
+			expectError: true,
+			expectedErr: ErrNotTLS,
 		},
 		{
-			name:           "Empty Input",
-			input:          bytes.NewReader([]byte{}),
-			expectError:    true,
-			expectedErrMsg: "failed to read TLS record header: EOF",
+			name:        "Empty Input",
+			input:       bytes.NewReader([]byte{}),
+			expectError: true,
+			expectedErr: ErrTruncatedHello,
 		},
 	}
 
@@ -187,8 +463,8 @@ func TestGetSNI(t *testing.T) {
 
 			if tc.expectError {
 				require.Error(t, err)
-				if tc.expectedErrMsg != "" {
-					assert.Contains(t, err.Error(), tc.expectedErrMsg)
+				if tc.expectedErr != nil {
+					assert.ErrorIs(t, err, tc.expectedErr)
 				}
 			} else {
 				require.NoError(t, err)
@@ -198,3 +474,445 @@ func TestGetSNI(t *testing.T) {
 		})
 	}
 }
+
+// TestParseClientHelloALPN tests the extraction of the inner ALPN list.
+func TestParseClientHelloALPN(t *testing.T) {
+	testCases := []struct {
+		name         string
+		alpn         []string
+		expectedALPN []string
+	}{
+		{name: "Missing extension", expectedALPN: nil},
+		{name: "Single protocol", alpn: []string{"http/1.1"}, expectedALPN: []string{"http/1.1"}},
+		{name: "Several protocols in order", alpn: []string{"h2", "http/1.1"}, expectedALPN: []string{"h2", "http/1.1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			record := buildTestClientHelloALPN(t, "test.example.com", tc.alpn...)
+			info, raw, err := parseClientHello(bytes.NewReader(record))
+			require.NoError(t, err)
+			assert.Equal(t, "test.example.com", info.ServerName)
+			assert.Equal(t, tc.expectedALPN, info.ALPN)
+			assert.Equal(t, record, raw, "the raw ClientHello must be replayed unchanged")
+		})
+	}
+
+	t.Run("Malformed extension", func(t *testing.T) {
+		record := buildTestClientHelloALPN(t, "test.example.com", "h2")
+		i := bytes.Index(record, []byte("h2"))
+		record[i-1] = 5 // The protocol length overruns the list
+		_, _, err := parseClientHello(bytes.NewReader(record))
+		assert.ErrorIs(t, err, ErrMalformedExtension)
+	})
+}
+
+// TestRequireALPN checks that inner ClientHellos are only proxied if they offer
+// one of the required ALPN protocols.
+func TestRequireALPN(t *testing.T) {
+	const sni = "alpn.test"
+	startTestUpstream(t, sni)
+
+	testCases := []struct {
+		name    string
+		alpn    []string
+		proxied bool
+	}{
+		{name: "Required protocol offered", alpn: []string{"h2", "http/1.1"}, proxied: true},
+		{name: "Other protocol", alpn: []string{"h2"}, proxied: false},
+		{name: "No ALPN extension", proxied: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := stats.Default.Get("alpn_rejected")
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			cfg := &config.Config{RequireALPN: []string{"http/1.1"}}
+			go newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+
+			hello := buildTestClientHelloALPN(t, sni, tc.alpn...)
+			_, err := clientConn.Write(hello)
+			require.NoError(t, err)
+
+			// The upstream echoes the ClientHello, a rejected client sees EOF.
+			clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = io.ReadFull(clientConn, make([]byte, len(hello)))
+			if tc.proxied {
+				assert.NoError(t, err)
+				assert.Equal(t, before, stats.Default.Get("alpn_rejected"))
+			} else {
+				assert.ErrorIs(t, err, io.EOF)
+				assert.Equal(t, before+1, stats.Default.Get("alpn_rejected"))
+			}
+		})
+	}
+}
+
+// TestSignalProxyPreservesBufferedBytes checks that data sent in the same segment
+// as the ClientHello, and thus already buffered while sniffing, reaches the upstream.
+func TestSignalProxyPreservesBufferedBytes(t *testing.T) {
+	const sni = "buffered.test"
+	startTestUpstream(t, sni)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newTestHandler(&config.Config{}, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+
+	hello := buildTestClientHello(t, sni)
+	extra := []byte{0x17, 0x03, 0x03, 0x00, 0x03, 'a', 'b', 'c'}
+	_, err := clientConn.Write(append(append([]byte{}, hello...), extra...))
+	require.NoError(t, err)
+
+	// The upstream echoes everything it receives.
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	echoed := make([]byte, len(hello)+len(extra))
+	_, err = io.ReadFull(clientConn, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, extra, echoed[len(hello):])
+}
+
+// TestSniffTimeout checks that stalled clients are dropped and counted, while the
+// deadline does not apply to the relay phase.
+func TestSniffTimeout(t *testing.T) {
+	const sni = "deadline.test"
+	startTestUpstream(t, sni)
+	hello := buildTestClientHello(t, sni)
+
+	testCases := []struct {
+		name    string
+		input   []byte
+		timeout bool
+	}{
+		{name: "Stalled during sniffing", input: []byte{0x16}, timeout: true},
+		{name: "Stalled during SNI parsing", input: hello[:20], timeout: true},
+		{name: "Relay outlives the deadline", input: hello, timeout: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+
+			before := stats.Default.Get("sniff_timeouts")
+			dialTimeouts := stats.Default.Get("dial_timeouts")
+			cfg := &config.Config{SniffTimeout: 50 * time.Millisecond}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+			}()
+
+			_, err := clientConn.Write(tc.input)
+			require.NoError(t, err)
+
+			if tc.timeout {
+				select {
+				case <-done:
+				case <-time.After(2 * time.Second):
+					t.Fatal("Serve did not give up on a stalled client")
+				}
+				assert.Equal(t, before+1, stats.Default.Get("sniff_timeouts"))
+				assert.Equal(t, dialTimeouts, stats.Default.Get("dial_timeouts"))
+				return
+			}
+
+			// Read the echoed ClientHello, then send more data after the deadline
+			clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = io.ReadFull(clientConn, make([]byte, len(hello)))
+			require.NoError(t, err)
+			time.Sleep(100 * time.Millisecond)
+
+			_, err = clientConn.Write([]byte("ping"))
+			require.NoError(t, err)
+			reply := make([]byte, 4)
+			_, err = io.ReadFull(clientConn, reply)
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(reply))
+			assert.Equal(t, before, stats.Default.Get("sniff_timeouts"))
+		})
+	}
+}
+
+// BenchmarkRelayCounting measures the cost of the per-connection and per-SNI
+// counters on the relay copy loop.
+func BenchmarkRelayCounting(b *testing.B) {
+	chunk := make([]byte, 16*1024)
+	buf := make([]byte, 64*1024)
+
+	b.Run("Plain", func(b *testing.B) {
+		b.SetBytes(int64(len(chunk)))
+		for i := 0; i < b.N; i++ {
+			// Hide WriterTo and ReaderFrom, like the counting wrappers do
+			io.CopyBuffer(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{bytes.NewReader(chunk)}, buf)
+		}
+	})
+
+	b.Run("Counted", func(b *testing.B) {
+		var connBytes atomic.Int64
+		sniStats := stats.NewSNITable().Get("chat.signal.org")
+		b.SetBytes(int64(len(chunk)))
+		for i := 0; i < b.N; i++ {
+			io.CopyBuffer(countingWriter{io.Discard, &sniStats.BytesOut}, countingReader{bytes.NewReader(chunk), &connBytes, nil}, buf)
+		}
+	})
+}
+
+// TestUnknownProtocolDebugDump checks that unrecognized traffic is hex-dumped
+// only with debug logging enabled.
+func TestUnknownProtocolDebugDump(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		logs := &lockedBuffer{}
+		clientConn, serverConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			newTestHandler(&config.Config{Debug: debug}, log.New(logs, "", 0)).Serve(serverConn, NewConnID())
+		}()
+
+		clientConn.Write([]byte{0x16, 0x07, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01})
+		<-done
+		clientConn.Close()
+
+		if debug {
+			assert.Contains(t, logs.buf.String(), "1607010200010001")
+		} else {
+			assert.NotContains(t, logs.buf.String(), "Debug:")
+		}
+	}
+}
+
+// TestUnknownProtocolAction checks the bytes and timing observed by a client
+// sending unrecognized traffic under each unknown protocol action.
+func TestUnknownProtocolAction(t *testing.T) {
+	shortTarpit(t, tarpitSlots, 200*time.Millisecond)
+
+	testCases := []struct {
+		name           string
+		action         config.UnknownProtocolAction
+		stealthMode    config.StealthMode
+		expectedPrefix string
+		minDuration    time.Duration
+	}{
+		{name: "Close by default", stealthMode: config.StealthNginx},
+		{name: "Close", action: config.UnknownClose, stealthMode: config.StealthNginx},
+		{name: "Nginx 400", action: config.UnknownHTTP400, stealthMode: config.StealthNginx, expectedPrefix: "HTTP/1.1 400 Bad Request\r\nServer: nginx/"},
+		{name: "Apache 400", action: config.UnknownHTTP400, stealthMode: config.StealthApache, expectedPrefix: "HTTP/1.1 400 Bad Request\r\n"},
+		{name: "OpenResty 400", action: config.UnknownHTTP400, stealthMode: config.StealthOpenResty, expectedPrefix: "HTTP/1.1 400 Bad Request\r\nServer: openresty/"},
+		{name: "LiteSpeed 400", action: config.UnknownHTTP400, stealthMode: config.StealthLiteSpeed, expectedPrefix: "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n"},
+		{name: "Lighttpd 400", action: config.UnknownHTTP400, stealthMode: config.StealthLighttpd, expectedPrefix: "HTTP/1.1 400 Bad Request\r\nContent-Type: text/html\r\n"},
+		{name: "No persona closes", action: config.UnknownHTTP400, stealthMode: config.StealthNone},
+		{name: "Tarpit", action: config.UnknownTarpit, stealthMode: config.StealthNginx, minDuration: 200 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			cfg := &config.Config{Domain: "example.com", StealthMode: tc.stealthMode, UnknownProtocolAction: tc.action}
+			go newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+
+			start := time.Now()
+			_, err := clientConn.Write([]byte("\x00\x01garbage\r\n"))
+			require.NoError(t, err)
+
+			if tc.minDuration > 0 {
+				// The tarpit keeps consuming input without answering.
+				for i := 0; i < 3; i++ {
+					_, err = clientConn.Write([]byte("more garbage"))
+					require.NoError(t, err)
+				}
+			}
+
+			clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			received, err := io.ReadAll(clientConn)
+			require.NoError(t, err)
+			elapsed := time.Since(start)
+
+			if tc.expectedPrefix == "" {
+				assert.Empty(t, received)
+			} else {
+				assert.True(t, strings.HasPrefix(string(received), tc.expectedPrefix), "unexpected response %q", received)
+			}
+			assert.GreaterOrEqual(t, elapsed, tc.minDuration)
+			if tc.minDuration == 0 {
+				assert.Less(t, elapsed, tarpits.duration)
+			}
+		})
+	}
+}
+
+
+// TestMaxConnsPerSNI stresses the per-SNI connection limit with concurrent
+// clients, and checks that every slot is released on shutdown.
+func TestMaxConnsPerSNI(t *testing.T) {
+	const sni = "limit.test"
+	const limit = 5
+	const clients = 40
+	startTestUpstream(t, sni)
+	cfg := &config.Config{MaxConnsPerSNI: limit}
+	counters := stats.SNI.Get(sni)
+	rejectedBefore := stats.Default.Get("sni_concurrency_limited")
+	hello := buildTestClientHello(t, sni)
+
+	var handlers, clientsDone sync.WaitGroup
+	var proxied atomic.Int64
+	for range clients {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+		}()
+		clientsDone.Add(1)
+		go func() {
+			defer clientsDone.Done()
+			clientConn.Write(hello)
+			// Proxied connections echo the ClientHello, rejected ones are closed
+			clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.ReadFull(clientConn, make([]byte, len(hello))); err == nil {
+				proxied.Add(1)
+			}
+		}()
+	}
+	clientsDone.Wait()
+
+	assert.Equal(t, int64(limit), proxied.Load())
+	assert.Equal(t, int64(limit), counters.Active.Load())
+	assert.Equal(t, rejectedBefore+clients-limit, stats.Default.Get("sni_concurrency_limited"))
+
+	Connections.CloseAll()
+	handlers.Wait()
+	assert.Zero(t, counters.Active.Load())
+}
+
+// panickyConn is a connection whose deadlines panic.
+type panickyConn struct {
+	net.Conn
+}
+
+func (c panickyConn) SetReadDeadline(t time.Time) error {
+	panic("SetReadDeadline")
+}
+
+// TestMaxConnsPerSNIPanic checks that a panicking handler releases its slot.
+func TestMaxConnsPerSNIPanic(t *testing.T) {
+	const sni = "limit-panic.test"
+	startTestUpstream(t, sni)
+	counters := stats.SNI.Get(sni)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go clientConn.Write(buildTestClientHello(t, sni))
+
+	assert.Panics(t, func() {
+		newTestHandler(&config.Config{MaxConnsPerSNI: 1}, log.New(io.Discard, "", 0)).Serve(panickyConn{serverConn}, NewConnID())
+	})
+	assert.Zero(t, counters.Active.Load())
+}
+
+// TestMaxBytesPerConn checks that a connection relaying more than
+// MaxBytesPerConn in both directions is closed and logged as truncated.
+func TestMaxBytesPerConn(t *testing.T) {
+	const sni = "bytelimit.test"
+	const bufferSize = 64 * 1024
+	startTestUpstream(t, sni)
+	hello := buildTestClientHello(t, sni)
+	cfg := &config.Config{LogFormat: config.LogFormatJSON, MaxBytesPerConn: int64(len(hello)) + 200000}
+	limitedBefore := stats.Default.Get("conn_byte_limited")
+
+	logs := &lockedBuffer{}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestHandler(cfg, log.New(logs, "", 0)).Serve(serverConn, NewConnID())
+	}()
+	go func() {
+		if _, err := clientConn.Write(hello); err != nil {
+			return
+		}
+		chunk := bytes.Repeat([]byte("signal"), 1000)
+		for {
+			if _, err := clientConn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	// The upstream echoes everything, so both directions count toward the limit
+	go io.Copy(io.Discard, clientConn)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed at the byte limit")
+	}
+
+	var rec accessRecord
+	lines := logs.Lines()
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &rec))
+	assert.Equal(t, CloseByteLimit, rec.Reason)
+	assert.Equal(t, DirectionProxy, rec.Direction)
+	// Each direction may relay the rest of its last read
+	assert.LessOrEqual(t, rec.BytesIn+rec.BytesOut, cfg.MaxBytesPerConn+2*bufferSize)
+	assert.Contains(t, logs.String(), "Truncated connection for "+sni)
+	assert.Equal(t, limitedBefore+1, stats.Default.Get("conn_byte_limited"))
+}
+
+// TestPassthroughRelay checks that passthrough SNIs are relayed to their
+// backends and logged apart from Signal traffic, while the Signal routes take
+// precedence.
+func TestPassthroughRelay(t *testing.T) {
+	signal := startTestUpstream(t, "signal-passthrough.test")
+	backend := startTestUpstream(t, "backend-passthrough.test")
+	cfg := &config.Config{
+		LogFormat: config.LogFormatJSON,
+		Passthrough: []config.PassthroughRoute{
+			{SNI: "matrix.test", Addr: backend.Addr().String()},
+			{SNI: "signal-passthrough.test", Addr: backend.Addr().String()},
+		},
+	}
+	testCases := []struct {
+		sni              string
+		expectedAction   string
+		expectedUpstream string
+	}{
+		{sni: "matrix.test", expectedAction: ActionPassthrough, expectedUpstream: backend.Addr().String()},
+		{sni: "signal-passthrough.test", expectedAction: ActionProxy, expectedUpstream: signal.Addr().String()},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.sni, func(t *testing.T) {
+			before := stats.Default.Get("sni_passthrough")
+			logs := &lockedBuffer{}
+			clientConn, serverConn := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newTestHandler(cfg, log.New(logs, "", 0)).Serve(serverConn, NewConnID())
+			}()
+
+			hello := buildTestClientHello(t, tc.sni)
+			_, err := clientConn.Write(hello)
+			require.NoError(t, err)
+			clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = io.ReadFull(clientConn, make([]byte, len(hello)))
+			require.NoError(t, err)
+			clientConn.Close()
+			<-done
+
+			var rec accessRecord
+			lines := logs.Lines()
+			require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &rec))
+			assert.Equal(t, tc.expectedAction, rec.Action)
+			assert.Equal(t, tc.expectedUpstream, rec.Upstream)
+			if tc.expectedAction == ActionPassthrough {
+				assert.Equal(t, before+1, stats.Default.Get("sni_passthrough"))
+			} else {
+				assert.Equal(t, before, stats.Default.Get("sni_passthrough"))
+			}
+		})
+	}
+}
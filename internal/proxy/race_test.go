@@ -0,0 +1,7 @@
+//go:build race
+
+package proxy
+
+// raceEnabled reports whether the tests run under the race detector, in which
+// sync.Pool drops items at random and allocation counts vary.
+const raceEnabled = true
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io"
+	"time"
+)
+
+// tokenBucket limits a byte rate while allowing bursts of up to burst bytes.
+// It is not safe for concurrent use; every relay direction has its own.
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket refilling at bytesPerSec.
+func newTokenBucket(bytesPerSec, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take removes n tokens and returns how long the caller must wait until the
+// bucket is no longer in debt.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// tryTake removes n tokens and reports true if the bucket holds them, and
+// leaves it untouched otherwise.
+func (b *tokenBucket) tryTake(n int) bool {
+	b.refill()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// refill adds the tokens earned since the last call, up to burst.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// rateLimitedReader throttles reads from r with a token bucket.
+type rateLimitedReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (l rateLimitedReader) Read(p []byte) (int, error) {
+	// Never read more than a burst at once, so that the wait stays short
+	if len(p) > int(l.bucket.burst) {
+		p = p[:int(l.bucket.burst)]
+	}
+	n, err := l.r.Read(p)
+	if wait := l.bucket.take(n); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// limitReader wraps r with a limit of kbps kilobits per second and bursts of
+// up to burstKB kilobytes. A zero rate returns r unchanged.
+func limitReader(r io.Reader, kbps, burstKB int) io.Reader {
+	if kbps <= 0 {
+		return r
+	}
+	return rateLimitedReader{r, newTokenBucket(kbps*1000/8, max(burstKB, 1)*1024)}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLimitReader measures the transfer time of a known payload through a
+// rate-limited pipe.
+func TestLimitReader(t *testing.T) {
+	testCases := []struct {
+		name        string
+		kbps        int
+		burstKB     int
+		payloadKB   int
+		minDuration time.Duration
+		maxDuration time.Duration
+	}{
+		{
+			// 800 kbps is 100 KB/s: the 64 KB beyond the burst take 0.64s
+			name:        "Limited above the burst",
+			kbps:        800,
+			burstKB:     16,
+			payloadKB:   80,
+			minDuration: 500 * time.Millisecond,
+			maxDuration: 900 * time.Millisecond,
+		},
+		{
+			name:        "Burst passes without delay",
+			kbps:        800,
+			burstKB:     64,
+			payloadKB:   32,
+			maxDuration: 100 * time.Millisecond,
+		},
+		{
+			name:        "Unlimited",
+			kbps:        0,
+			payloadKB:   1024,
+			maxDuration: 100 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte{'x'}, tc.payloadKB*1024)
+			writer, reader := net.Pipe()
+			go func() {
+				writer.Write(payload)
+				writer.Close()
+			}()
+
+			start := time.Now()
+			received, err := io.ReadAll(limitReader(reader, tc.kbps, tc.burstKB))
+			elapsed := time.Since(start)
+			require.NoError(t, err)
+			assert.Equal(t, len(payload), len(received))
+			assert.GreaterOrEqual(t, elapsed, tc.minDuration)
+			assert.Less(t, elapsed, tc.maxDuration)
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connections is the registry of all connections currently handled by the proxy.
+var Connections = NewRegistry()
+
+// ConnInfo is a point-in-time snapshot of an active connection.
+type ConnInfo struct {
+	ID         string        `json:"id"`
+	ClientAddr string        `json:"client_addr"`
+	Country    string        `json:"country,omitempty"`
+	Protocol   string        `json:"protocol"`
+	JA3        string        `json:"ja3,omitempty"`
+	SNI        string        `json:"sni,omitempty"`
+	Upstream   string        `json:"upstream,omitempty"`
+	BytesIn    int64         `json:"bytes_in"`
+	BytesOut   int64         `json:"bytes_out"`
+	Age        time.Duration `json:"age_ns"`
+}
+
+// TrackedConn holds the live state of a registered connection.
+type TrackedConn struct {
+	ID       string
+	conn     net.Conn
+	started  time.Time
+	bytesIn  atomic.Int64 // client -> upstream
+	bytesOut atomic.Int64 // upstream -> client
+
+	mu           sync.Mutex
+	protocol     Protocol
+	ja3          string
+	country      string
+	sni          string
+	upstream     string
+	upstreamConn net.Conn
+	closeReason  string // set when force-closed
+}
+
+// Registry tracks active connections. It is safe for concurrent use.
+type Registry struct {
+	mu    sync.RWMutex
+	conns map[string]*TrackedConn
+}
+
+// NewRegistry creates an empty connection registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		conns: make(map[string]*TrackedConn),
+	}
+}
+
+// Register adds a connection to the registry under the given ID, see NewConnID.
+func (r *Registry) Register(id string, conn net.Conn) *TrackedConn {
+	tc := &TrackedConn{
+		ID:       id,
+		conn:     conn,
+		started:  time.Now(),
+		protocol: ProtoUnknown,
+	}
+
+	r.mu.Lock()
+	r.conns[tc.ID] = tc
+	r.mu.Unlock()
+	return tc
+}
+
+// Remove deletes a connection from the registry.
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	delete(r.conns, id)
+	r.mu.Unlock()
+}
+
+// CloseAll force-closes every registered connection for shutdown and returns
+// how many were closed.
+func (r *Registry) CloseAll() int {
+	r.mu.RLock()
+	tracked := make([]*TrackedConn, 0, len(r.conns))
+	for _, tc := range r.conns {
+		tracked = append(tracked, tc)
+	}
+	r.mu.RUnlock()
+
+	for _, tc := range tracked {
+		tc.closeWith(CloseShutdown)
+	}
+	return len(tracked)
+}
+
+// Len returns the number of registered connections.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.conns)
+}
+
+// List returns a snapshot of all registered connections, oldest first.
+func (r *Registry) List() []ConnInfo {
+	r.mu.RLock()
+	tracked := make([]*TrackedConn, 0, len(r.conns))
+	for _, tc := range r.conns {
+		tracked = append(tracked, tc)
+	}
+	r.mu.RUnlock()
+
+	infos := make([]ConnInfo, 0, len(tracked))
+	for _, tc := range tracked {
+		infos = append(infos, tc.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Age > infos[j].Age
+	})
+	return infos
+}
+
+// Close force-closes the connection with the given ID, including its upstream side.
+// It reports whether the connection was found.
+func (r *Registry) Close(id string) bool {
+	r.mu.RLock()
+	tc, ok := r.conns[id]
+	r.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	tc.Close()
+	return true
+}
+
+// Info returns a snapshot of the connection state.
+func (tc *TrackedConn) Info() ConnInfo {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return ConnInfo{
+		ID:         tc.ID,
+		ClientAddr: ClientAddr(tc.conn.RemoteAddr()),
+		Country:    tc.country,
+		Protocol:   tc.protocol.String(),
+		JA3:        tc.ja3,
+		SNI:        tc.sni,
+		Upstream:   tc.upstream,
+		BytesIn:    tc.bytesIn.Load(),
+		BytesOut:   tc.bytesOut.Load(),
+		Age:        time.Since(tc.started),
+	}
+}
+
+// Close closes both the client and, if established, the upstream connection.
+func (tc *TrackedConn) Close() {
+	tc.closeWith(CloseForced)
+}
+
+// closeWith force-closes the connection, recording reason for the access log.
+// Expired deadlines are set first: they interrupt blocked reads and writes
+// immediately, whereas closing a TLS connection waits for a pending write.
+func (tc *TrackedConn) closeWith(reason string) {
+	tc.mu.Lock()
+	if tc.closeReason == "" {
+		tc.closeReason = reason
+	}
+	upstreamConn := tc.upstreamConn
+	tc.mu.Unlock()
+
+	now := time.Now()
+	tc.conn.SetDeadline(now)
+	tc.conn.Close()
+	if upstreamConn != nil {
+		upstreamConn.SetDeadline(now)
+		upstreamConn.Close()
+	}
+}
+
+// forcedCloseReason returns why the connection was force-closed through the
+// registry, or "" if it was not.
+func (tc *TrackedConn) forcedCloseReason() string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.closeReason
+}
+
+func (tc *TrackedConn) setProtocol(p Protocol) {
+	tc.mu.Lock()
+	tc.protocol = p
+	tc.mu.Unlock()
+}
+
+func (tc *TrackedConn) setJA3(ja3 string) {
+	tc.mu.Lock()
+	tc.ja3 = ja3
+	tc.mu.Unlock()
+}
+
+func (tc *TrackedConn) setCountry(country string) {
+	tc.mu.Lock()
+	tc.country = country
+	tc.mu.Unlock()
+}
+
+func (tc *TrackedConn) setSNI(sni string) {
+	tc.mu.Lock()
+	tc.sni = sni
+	tc.mu.Unlock()
+}
+
+// setUpstream records the upstream connection. If the connection was already
+// force-closed, the upstream is closed immediately and false is returned.
+func (tc *TrackedConn) setUpstream(addr string, conn net.Conn) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.upstream = addr
+	tc.upstreamConn = conn
+	if tc.closeReason != "" {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// CloseWriter is implemented by connections that can shut down their writing
+// side while still reading, such as *net.TCPConn and *tls.Conn. Connection
+// wrappers forward it to the connection they wrap.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite half-closes conn if it supports it. Other connections are left
+// open until the relay ends.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it, and fails once they exceed
+// limit. The bytes of the read exceeding it are still returned.
+type countingReader struct {
+	r       io.Reader
+	counter *atomic.Int64
+	limit   *byteLimit
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.counter.Add(int64(n))
+	if limitErr := c.limit.add(n); limitErr != nil {
+		return n, limitErr
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w       io.Writer
+	counter *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.counter.Add(int64(n))
+	return n, err
+}
+
+// lastConnID is the most recently assigned connection ID. It starts at a random
+// value so that IDs from different runs are unlikely to collide in the logs.
+var lastConnID atomic.Uint32
+
+func init() {
+	var b [4]byte
+	rand.Read(b[:])
+	lastConnID.Store(binary.BigEndian.Uint32(b[:]))
+}
+
+// NewConnID returns a short identifier (8 hex characters) for a new connection.
+// IDs are unique until 2^32 connections have been assigned one.
+func NewConnID() string {
+	return fmt.Sprintf("%08x", lastConnID.Add(1))
+}
+
+// NewConnLogger returns a logger that prefixes every message with the connection ID.
+func NewConnLogger(base *log.Logger, id string) *log.Logger {
+	return log.New(base.Writer(), base.Prefix()+"["+id+"] ", base.Flags()|log.Lmsgprefix)
+}
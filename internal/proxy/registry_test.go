@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// TestRegistryConcurrency registers, lists, and removes connections from many goroutines.
+func TestRegistryConcurrency(t *testing.T) {
+	r := NewRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+
+			tc := r.Register(NewConnID(), c1)
+			tc.setSNI("chat.signal.org")
+			tc.bytesIn.Add(10)
+			r.List()
+			r.Close(tc.ID)
+			r.Remove(tc.ID)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0, r.Len())
+}
+
+// TestRegistryUniqueIDs checks that connection IDs are unique and well-formed.
+func TestRegistryUniqueIDs(t *testing.T) {
+	r := NewRegistry()
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		c1, _ := net.Pipe()
+		tc := r.Register(NewConnID(), c1)
+		assert.Len(t, tc.ID, 8)
+		assert.False(t, seen[tc.ID], "ID %s was assigned twice", tc.ID)
+		seen[tc.ID] = true
+	}
+	assert.Equal(t, 1000, r.Len())
+}
+
+// TestNewConnLogger checks that messages carry the connection ID after the
+// standard header.
+func TestNewConnLogger(t *testing.T) {
+	var buf bytes.Buffer
+	base := log.New(&buf, "proxy: ", 0)
+
+	NewConnLogger(base, "0a1b2c3d").Printf("Inner SNI '%s' detected", "chat.signal.org")
+	assert.Equal(t, "proxy: [0a1b2c3d] Inner SNI 'chat.signal.org' detected\n", buf.String())
+}
+
+// TestRegistryCloseUnknown checks that closing an unknown ID reports false.
+func TestRegistryCloseUnknown(t *testing.T) {
+	assert.False(t, NewRegistry().Close("deadbeef"))
+}
+
+// startTestUpstream starts a TCP listener that echoes everything back and routes
+// the given SNI to it for the duration of the test.
+func startTestUpstream(t *testing.T, sni string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	signalUpstreams[sni] = ln.Addr().String()
+	t.Cleanup(func() { delete(signalUpstreams, sni) })
+	return ln
+}
+
+// waitForConn waits until the registry holds a connection with the given SNI and traffic.
+func waitForConn(t *testing.T, sni string) ConnInfo {
+	var found ConnInfo
+	require.Eventually(t, func() bool {
+		for _, info := range Connections.List() {
+			if info.SNI == sni && info.BytesOut > 0 {
+				found = info
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 10*time.Millisecond)
+	return found
+}
+
+// TestRegistryCloseWhileRelaying closes a relayed connection through the registry
+// while data is flowing and checks that the handler exits and deregisters it.
+func TestRegistryCloseWhileRelaying(t *testing.T) {
+	const sni = "relay.test"
+	startTestUpstream(t, sni)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestHandler(&config.Config{}, log.Default()).Serve(serverConn, NewConnID())
+	}()
+
+	_, err := clientConn.Write(buildTestClientHello(t, sni))
+	require.NoError(t, err)
+
+	// Keep data flowing in both directions.
+	go func() {
+		payload := make([]byte, 1024)
+		for {
+			if _, err := clientConn.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+	go io.Copy(io.Discard, clientConn)
+
+	info := waitForConn(t, sni)
+	assert.Equal(t, "signal-tls", info.Protocol)
+	assert.Equal(t, signalUpstreams[sni], info.Upstream)
+	assert.Greater(t, info.BytesIn, int64(0))
+
+	require.True(t, Connections.Close(info.ID))
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after the connection was closed")
+	}
+	for _, c := range Connections.List() {
+		assert.NotEqual(t, info.ID, c.ID, "closed connection should be removed from the registry")
+	}
+}
+
+// TestRegistryCloseAllInterruptsIdleRelay checks that a relay blocked on reads in
+// both directions returns promptly on shutdown and is logged as such.
+func TestRegistryCloseAllInterruptsIdleRelay(t *testing.T) {
+	const sni = "idle.test"
+	startTestUpstream(t, sni)
+
+	logs := &lockedBuffer{}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestHandler(&config.Config{}, log.New(logs, "", 0)).Serve(serverConn, NewConnID())
+	}()
+
+	// Wait for the echoed ClientHello, after which both sides are idle
+	hello := buildTestClientHello(t, sni)
+	_, err := clientConn.Write(hello)
+	require.NoError(t, err)
+	_, err = io.ReadFull(clientConn, make([]byte, len(hello)))
+	require.NoError(t, err)
+	waitForConn(t, sni)
+
+	start := time.Now()
+	assert.GreaterOrEqual(t, Connections.CloseAll(), 1)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after shutdown")
+	}
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	lines := logs.Lines()
+	assert.Contains(t, lines[len(lines)-1], "reason="+CloseShutdown)
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	server := <-accepted
+	require.NotNil(t, server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// TestCloseWriteThroughWrappers checks that a half-close on a wrapped connection
+// reaches the socket, while the other direction stays open.
+func TestCloseWriteThroughWrappers(t *testing.T) {
+	testCases := []struct {
+		name string
+		wrap func(net.Conn) net.Conn
+	}{
+		{name: "Plain TCP", wrap: func(c net.Conn) net.Conn { return c }},
+		{name: "Buffered", wrap: func(c net.Conn) net.Conn { return bufferedConn{c, bufio.NewReader(c)} }},
+		{name: "Nested buffered", wrap: func(c net.Conn) net.Conn {
+			inner := bufferedConn{c, bufio.NewReader(c)}
+			return bufferedConn{inner, bufio.NewReader(inner)}
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			local, peer := tcpPair(t)
+			conn := tc.wrap(local)
+			require.Implements(t, (*CloseWriter)(nil), conn)
+			require.NoError(t, closeWrite(conn))
+
+			// The peer sees EOF ...
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := peer.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, io.EOF)
+
+			// ... and can still send in the other direction.
+			_, err = peer.Write([]byte("pong"))
+			require.NoError(t, err)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			reply := make([]byte, 4)
+			_, err = io.ReadFull(conn, reply)
+			require.NoError(t, err)
+			assert.Equal(t, "pong", string(reply))
+		})
+	}
+}
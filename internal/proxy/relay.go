@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"signalgoproxy/internal/config"
+)
+
+// errByteLimit ends a relay direction once the connection exceeded -max-bytes-per-conn.
+var errByteLimit = errors.New("connection byte limit exceeded")
+
+// byteLimit caps the bytes relayed in both directions of a connection, see
+// -max-bytes-per-conn. A nil byteLimit is unlimited.
+type byteLimit struct {
+	max   int64
+	used  atomic.Int64
+	close func()
+}
+
+// newByteLimit returns a limit of max bytes of which used are already spent,
+// calling close once it is exceeded, or nil if max is not positive.
+func newByteLimit(max, used int64, close func()) *byteLimit {
+	if max <= 0 {
+		return nil
+	}
+	l := &byteLimit{max: max, close: close}
+	l.used.Store(used)
+	return l
+}
+
+// add spends n bytes, and closes the connection and returns errByteLimit if
+// this exceeds the limit.
+func (l *byteLimit) add(n int) error {
+	if l == nil || l.used.Add(int64(n)) <= l.max {
+		return nil
+	}
+	l.close()
+	return errByteLimit
+}
+
+// relayDirection copies one direction of a proxied connection from src to dst
+// until EOF or an error, adding the bytes copied to both counters and to
+// limit, which ends the copy once exceeded.
+//
+// When both ends are plain TCP sockets and no rate or byte limit applies, the copy
+// goes through net.TCPConn.ReadFrom, which on Linux moves the bytes between
+// the sockets with splice(2) instead of copying them through userspace. The
+// client end of the TLS listener is a *tls.Conn, so this only applies to
+// connections accepted without outer TLS; otherwise the bytes are copied
+// through a pooled buffer. Spliced directions update the counters only when
+// they end, and their errors cannot be told apart by side: a broken pipe is
+// attributed to dst, anything else to src. A bufferedConn source, read ahead
+// of the relay, is spliced once its buffered bytes are written.
+func relayDirection(dst net.Conn, src io.Reader, fromClient bool, connCounter, sniCounter *atomic.Int64, limit *byteLimit, cfg *config.Config) relayResult {
+	if dstTCP, ok := dst.(*net.TCPConn); ok && cfg.PerConnRateKbps == 0 && limit == nil {
+		var buffered int64
+		if bc, ok := src.(bufferedConn); ok {
+			if _, ok := bc.Conn.(*net.TCPConn); ok {
+				b, _ := bc.r.Peek(bc.r.Buffered())
+				n, err := dstTCP.Write(b)
+				bc.r.Discard(n)
+				connCounter.Add(int64(n))
+				sniCounter.Add(int64(n))
+				if err != nil {
+					return relayResult{fromClient: fromClient, bytes: int64(n), err: err}
+				}
+				buffered, src = int64(n), bc.Conn
+			}
+		}
+		if srcTCP, ok := src.(*net.TCPConn); ok {
+			n, err := dstTCP.ReadFrom(srcTCP)
+			connCounter.Add(n)
+			sniCounter.Add(n)
+			return relayResult{fromClient: fromClient, bytes: buffered + n, err: err, readErr: err != nil && !errors.Is(err, syscall.EPIPE)}
+		}
+	}
+
+	bufPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufPtr)
+	source := &errorTracker{r: src}
+	limited := limitReader(source, cfg.PerConnRateKbps, cfg.PerConnBurstKB)
+	n, err := io.CopyBuffer(countingWriter{dst, sniCounter}, countingReader{limited, connCounter, limit}, *bufPtr)
+	return relayResult{fromClient: fromClient, bytes: n, err: err, readErr: source.err != nil}
+}
+
+// clientSource returns the reader of the client bytes to relay: the sniffing
+// reader while it still buffers bytes the client sent after the ClientHello,
+// else the connection itself, so that it can be spliced.
+func clientSource(reader io.Reader, conn net.Conn) io.Reader {
+	if br, ok := reader.(*bufio.Reader); ok && br.Buffered() == 0 {
+		return conn
+	}
+	return reader
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// TestClientSource checks that the sniffing reader is bypassed once it has
+// handed out all buffered bytes.
+func TestClientSource(t *testing.T) {
+	client, server := tcpPair(t)
+	_, err := client.Write([]byte("hello world"))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(server)
+	_, err = reader.Peek(5)
+	require.NoError(t, err)
+	assert.Same(t, reader, clientSource(reader, server))
+
+	_, err = reader.Discard(reader.Buffered())
+	require.NoError(t, err)
+	assert.Equal(t, server, clientSource(reader, server))
+}
+
+// TestRelayDirection checks the bytes and counters of spliced and copied relays.
+func TestRelayDirection(t *testing.T) {
+	payload := strings.Repeat("signal", 100000)
+	testCases := []struct {
+		name      string
+		cfg       *config.Config
+		wrap      bool
+		readAhead bool
+	}{
+		{name: "Spliced", cfg: &config.Config{}},
+		{name: "Wrapped source", cfg: &config.Config{}, wrap: true},
+		{name: "Read ahead", cfg: &config.Config{}, readAhead: true},
+		{name: "Rate limited", cfg: &config.Config{PerConnRateKbps: 1 << 20, PerConnBurstKB: 1 << 10}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			feed, src := tcpPair(t)
+			dst, sink := tcpPair(t)
+			go func() {
+				io.WriteString(feed, payload)
+				feed.Close()
+			}()
+			received := make(chan []byte)
+			go func() {
+				data, _ := io.ReadAll(sink)
+				received <- data
+			}()
+
+			var reader io.Reader = src
+			if tc.wrap {
+				reader = bufio.NewReader(src)
+			}
+			if tc.readAhead {
+				// Like an upstream awaited by writeClientHello
+				br := bufio.NewReader(src)
+				_, err := br.Peek(1)
+				require.NoError(t, err)
+				reader = bufferedConn{Conn: src, r: br}
+			}
+			var connCounter, sniCounter atomic.Int64
+			r := relayDirection(dst, reader, true, &connCounter, &sniCounter, nil, tc.cfg)
+			dst.Close()
+
+			require.NoError(t, r.err)
+			assert.Equal(t, int64(len(payload)), r.bytes)
+			assert.Equal(t, int64(len(payload)), connCounter.Load())
+			assert.Equal(t, int64(len(payload)), sniCounter.Load())
+			assert.True(t, bytes.Equal([]byte(payload), <-received))
+		})
+	}
+}
+
+// TestRelayByteLimit checks that a relay exceeding its byte limit closes the
+// connection within one buffer of the limit.
+func TestRelayByteLimit(t *testing.T) {
+	const max = 100000
+	const bufferSize = 64 * 1024
+	testCases := []struct {
+		name string
+		used int64
+	}{
+		{name: "Fresh limit", used: 0},
+		{name: "Partly spent", used: 60000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			feed, src := tcpPair(t)
+			dst, sink := tcpPair(t)
+			go func() {
+				chunk := bytes.Repeat([]byte("signal"), 10000)
+				for {
+					if _, err := feed.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			received := make(chan int64)
+			go func() {
+				n, _ := io.Copy(io.Discard, sink)
+				received <- n
+			}()
+
+			var closed atomic.Int64
+			limit := newByteLimit(max, tc.used, func() {
+				closed.Add(1)
+				src.Close()
+			})
+			var connCounter, sniCounter atomic.Int64
+			r := relayDirection(dst, src, true, &connCounter, &sniCounter, limit, &config.Config{})
+			dst.Close()
+			feed.Close()
+
+			assert.ErrorIs(t, r.err, errByteLimit)
+			assert.Equal(t, int64(1), closed.Load())
+			assert.Greater(t, tc.used+r.bytes, int64(max))
+			assert.LessOrEqual(t, tc.used+r.bytes, int64(max+bufferSize))
+			assert.Equal(t, r.bytes, connCounter.Load())
+			assert.Equal(t, r.bytes, <-received)
+		})
+	}
+}
+
+// TestByteLimitUnlimited checks that no limit is created without a maximum,
+// and that a nil limit is never exceeded.
+func TestByteLimitUnlimited(t *testing.T) {
+	limit := newByteLimit(0, 0, func() { t.Fatal("closed an unlimited connection") })
+	assert.Nil(t, limit)
+	assert.NoError(t, limit.add(1<<30))
+}
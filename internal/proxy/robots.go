@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"log"
+	"os"
+
+	"signalgoproxy/internal/config"
+)
+
+const (
+	robotsAllow       = "User-agent: *\nDisallow:\n"
+	robotsDisallowAll = "User-agent: *\nDisallow: /\n"
+)
+
+// robotsTxt returns the /robots.txt of -stealth-robots, or false to answer
+// with the 404 page like a stock install without one.
+func robotsTxt(cfg *config.Config, logger *log.Logger) ([]byte, bool) {
+	switch cfg.StealthRobots {
+	case config.StealthRobotsAllow:
+		return []byte(robotsAllow), true
+	case config.StealthRobotsDisallowAll:
+		return []byte(robotsDisallowAll), true
+	case config.StealthRobotsFile:
+		// Read on every request, so that edits apply without a restart
+		body, err := os.ReadFile(cfg.StealthRobotsFile)
+		if err != nil {
+			logger.Printf("Failed to read robots.txt file %s: %v", cfg.StealthRobotsFile, err)
+			return nil, false
+		}
+		return body, true
+	}
+	return nil, false
+}
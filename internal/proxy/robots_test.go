@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// TestRobotsTxt checks the /robots.txt of every -stealth-robots choice.
+func TestRobotsTxt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "robots.txt")
+	require.NoError(t, os.WriteFile(path, []byte("User-agent: *\nDisallow: /private/\n"), 0600))
+
+	testCases := []struct {
+		name         string
+		cfg          *config.Config
+		expectedBody string
+		expectedOK   bool
+	}{
+		{name: "Default", cfg: &config.Config{}},
+		{name: "None", cfg: &config.Config{StealthRobots: config.StealthRobotsNone}},
+		{name: "Allow", cfg: &config.Config{StealthRobots: config.StealthRobotsAllow}, expectedBody: "User-agent: *\nDisallow:\n", expectedOK: true},
+		{name: "Disallow all", cfg: &config.Config{StealthRobots: config.StealthRobotsDisallowAll}, expectedBody: "User-agent: *\nDisallow: /\n", expectedOK: true},
+		{
+			name:         "File",
+			cfg:          &config.Config{StealthRobots: config.StealthRobotsFile, StealthRobotsFile: path},
+			expectedBody: "User-agent: *\nDisallow: /private/\n",
+			expectedOK:   true,
+		},
+		{
+			name: "Missing file",
+			cfg:  &config.Config{StealthRobots: config.StealthRobotsFile, StealthRobotsFile: filepath.Join(t.TempDir(), "missing.txt")},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, ok := robotsTxt(tc.cfg, log.New(io.Discard, "", 0))
+			assert.Equal(t, tc.expectedOK, ok)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
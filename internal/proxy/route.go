@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"signalgoproxy/internal/config"
+)
+
+// signalDomain is the domain whose subdomains may be routed by suffix.
+const signalDomain = "signal.org"
+
+// routerOf returns the router of cfg: its Router, else its Upstreams, else
+// the built-in routing map.
+func routerOf(cfg *config.Config) config.Router {
+	if cfg.Router != nil {
+		return cfg.Router
+	}
+	if cfg.Upstreams != nil {
+		return StaticRouter(cfg.Upstreams)
+	}
+	return StaticRouter(signalUpstreams)
+}
+
+// route returns the upstream address for an inner SNI. Names in the routing map
+// of router take precedence; with AllowSignalSuffix, other valid names under
+// signal.org are routed to port 443 of the same name, which is reported by
+// bySuffix.
+func route(serverName string, router config.Router, cfg *config.Config) (addr string, bySuffix, ok bool) {
+	name := strings.ToLower(serverName)
+
+	if addr, ok := router.Lookup(name); ok {
+		return addr, false, true
+	}
+
+	if cfg.AllowSignalSuffix && isSignalHost(name) {
+		return name + ":443", true, true
+	}
+	return "", false, false
+}
+
+// passthrough returns the backend address of an inner SNI matched by
+// config.Passthrough. Exact names take precedence over wildcards, which are
+// tried in order.
+func passthrough(serverName string, cfg *config.Config) (addr string, ok bool) {
+	name := strings.ToLower(serverName)
+	for _, r := range cfg.Passthrough {
+		if r.SNI == name {
+			return r.Addr, true
+		}
+	}
+	for _, r := range cfg.Passthrough {
+		if domain, ok := strings.CutPrefix(r.SNI, "*."); ok && strings.HasSuffix(name, "."+domain) {
+			return r.Addr, true
+		}
+	}
+	return "", false
+}
+
+// dscpFor returns the DSCP value of config.DSCP for an inner SNI. Exact names
+// take precedence over wildcards, which are tried in order, and the default
+// applies to the other names. ok is false if no mark applies.
+func dscpFor(serverName string, cfg *config.Config) (dscp int, ok bool) {
+	name := strings.ToLower(serverName)
+	for _, m := range cfg.DSCP {
+		if m.SNI == name {
+			return m.DSCP, true
+		}
+	}
+	for _, m := range cfg.DSCP {
+		if domain, ok := strings.CutPrefix(m.SNI, "*."); ok && strings.HasSuffix(name, "."+domain) {
+			return m.DSCP, true
+		}
+	}
+	for _, m := range cfg.DSCP {
+		if m.SNI == config.DSCPDefault {
+			return m.DSCP, true
+		}
+	}
+	return 0, false
+}
+
+// isSignalHost reports whether name is signal.org or a syntactically valid
+// hostname below it. name must be lower case.
+func isSignalHost(name string) bool {
+	if name != signalDomain && !strings.HasSuffix(name, "."+signalDomain) {
+		return false
+	}
+	return isValidHostname(name)
+}
+
+// isValidHostname reports whether name is a valid lower-case DNS hostname
+// (RFC 1123): dot-separated labels of letters, digits and inner hyphens.
+func isValidHostname(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// configuredRoutes returns the current routing map of cfg. A Router other than
+// a RouteTable cannot be listed and is ignored.
+func configuredRoutes(cfg *config.Config) StaticRouter {
+	if table, ok := cfg.Router.(*RouteTable); ok {
+		return table.current.Load().Upstreams
+	}
+	if cfg.Upstreams != nil {
+		return cfg.Upstreams
+	}
+	return signalUpstreams
+}
+
+// StaticRouter is a fixed routing map from lower-case inner SNI to upstream address.
+type StaticRouter map[string]string
+
+// Lookup returns the upstream address for sni, ignoring case.
+func (r StaticRouter) Lookup(sni string) (string, bool) {
+	addr, ok := r[strings.ToLower(sni)]
+	return addr, ok
+}
+
+// Routes is the content of an upstreams file: a routing map and a denylist.
+type Routes struct {
+	Upstreams StaticRouter
+	Deny      DenyList
+}
+
+// RouteTable is a Router whose routes can be replaced while it is in use.
+// Lookups never block: a replacement is a single atomic pointer store.
+type RouteTable struct {
+	current atomic.Pointer[Routes]
+}
+
+// NewRouteTable creates a table serving routes.
+func NewRouteTable(routes *Routes) *RouteTable {
+	t := &RouteTable{}
+	t.Store(routes)
+	return t
+}
+
+// Lookup returns the upstream address for sni from the current routing map.
+func (t *RouteTable) Lookup(sni string) (string, bool) {
+	return t.current.Load().Upstreams.Lookup(sni)
+}
+
+// Denied reports whether sni matches the current denylist.
+func (t *RouteTable) Denied(sni string) bool {
+	return t.current.Load().Deny.Match(sni)
+}
+
+// Store replaces the routes. routes must not be modified afterwards.
+func (t *RouteTable) Store(routes *Routes) {
+	t.current.Store(routes)
+}
+
+// Len returns the number of entries in the current routing map.
+func (t *RouteTable) Len() int {
+	return len(t.current.Load().Upstreams)
+}
+
+// upstreamsFile is the structured format of an upstreams file. A file may also
+// hold just the routing map as a flat object.
+type upstreamsFile struct {
+	Routes map[string]string `json:"routes"`
+	Deny   []string          `json:"deny"`
+}
+
+// LoadRoutes reads an upstreams file, see ParseRoutes.
+func LoadRoutes(path string) (*Routes, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRoutes(data, path)
+}
+
+// ParseRoutes parses the upstreams file read from path. The file is a JSON
+// object mapping inner SNI names to upstream "host:port" addresses, or an
+// object with that map under "routes" and a list of denied SNI patterns under
+// "deny".
+func ParseRoutes(data []byte, path string) (*Routes, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	// In a flat map every value is a string, so an object under "routes"
+	// identifies the structured format
+	var file upstreamsFile
+	var err error
+	if routes, ok := raw["routes"]; ok && len(routes) > 0 && routes[0] == '{' {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = json.Unmarshal(data, &file.Routes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	routes := &Routes{Upstreams: make(StaticRouter, len(file.Routes))}
+	for name, addr := range file.Routes {
+		name = strings.ToLower(name)
+		if !isValidHostname(name) {
+			return nil, fmt.Errorf("invalid server name '%s' in %s", name, path)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid upstream address '%s' for %s in %s: %w", addr, name, path, err)
+		}
+		routes.Upstreams[name] = addr
+	}
+	if routes.Deny, err = ParseDenyList(file.Deny); err != nil {
+		return nil, fmt.Errorf("invalid denylist in %s: %w", path, err)
+	}
+	return routes, nil
+}
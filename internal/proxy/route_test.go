@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// TestRoute tests routing of inner SNI names, with and without suffix routing.
+func TestRoute(t *testing.T) {
+	testCases := []struct {
+		name         string
+		serverName   string
+		allowSuffix  bool
+		expectedAddr string
+		bySuffix     bool
+		expectOK     bool
+	}{
+		{
+			name:         "Listed name",
+			serverName:   "ud-chat.signal.org",
+			expectedAddr: "chat.signal.org:443",
+			expectOK:     true,
+		},
+		{
+			name:         "Listed name takes precedence over suffix",
+			serverName:   "UD-Chat.Signal.org",
+			allowSuffix:  true,
+			expectedAddr: "chat.signal.org:443",
+			expectOK:     true,
+		},
+		{
+			name:       "Unlisted name denied by default",
+			serverName: "new.signal.org",
+			expectOK:   false,
+		},
+		{
+			name:         "Unlisted subdomain routed by suffix",
+			serverName:   "New.Signal.org",
+			allowSuffix:  true,
+			expectedAddr: "new.signal.org:443",
+			bySuffix:     true,
+			expectOK:     true,
+		},
+		{
+			name:         "Apex domain routed by suffix",
+			serverName:   "signal.org",
+			allowSuffix:  true,
+			expectedAddr: "signal.org:443",
+			bySuffix:     true,
+			expectOK:     true,
+		},
+		{
+			name:        "Lookalike domain denied",
+			serverName:  "evilsignal.org",
+			allowSuffix: true,
+			expectOK:    false,
+		},
+		{
+			name:        "Port smuggled in name denied",
+			serverName:  "evil.com:443#.signal.org",
+			allowSuffix: true,
+			expectOK:    false,
+		},
+		{
+			name:        "Control characters denied",
+			serverName:  "a\r\nHost: x.signal.org",
+			allowSuffix: true,
+			expectOK:    false,
+		},
+		{
+			name:        "Empty label denied",
+			serverName:  "a..signal.org",
+			allowSuffix: true,
+			expectOK:    false,
+		},
+		{
+			name:        "Leading hyphen denied",
+			serverName:  "-a.signal.org",
+			allowSuffix: true,
+			expectOK:    false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{AllowSignalSuffix: tc.allowSuffix}
+			addr, bySuffix, ok := route(tc.serverName, routerOf(cfg), cfg)
+			assert.Equal(t, tc.expectOK, ok)
+			assert.Equal(t, tc.expectedAddr, addr)
+			assert.Equal(t, tc.bySuffix, bySuffix)
+		})
+	}
+}
+
+// TestLoadRoutes tests parsing and validation of the upstreams file.
+func TestLoadRoutes(t *testing.T) {
+	testCases := []struct {
+		name           string
+		content        string
+		expectedRoutes *Routes
+		expectError    bool
+	}{
+		{
+			name:           "Valid file",
+			content:        `{"Chat.Signal.org": "chat.signal.org:443", "cdn.signal.org": "10.0.0.1:8443"}`,
+			expectedRoutes: &Routes{Upstreams: StaticRouter{"chat.signal.org": "chat.signal.org:443", "cdn.signal.org": "10.0.0.1:8443"}},
+			expectError:    false,
+		},
+		{
+			name:    "Structured file with denylist",
+			content: `{"routes": {"chat.signal.org": "chat.signal.org:443"}, "deny": ["CDN3.signal.org", "*.example.com"]}`,
+			expectedRoutes: &Routes{
+				Upstreams: StaticRouter{"chat.signal.org": "chat.signal.org:443"},
+				Deny:      DenyList{"cdn3.signal.org", "*.example.com"},
+			},
+			expectError: false,
+		},
+		{
+			name:           "Flat file with a host named routes",
+			content:        `{"routes": "routes.example:443"}`,
+			expectedRoutes: &Routes{Upstreams: StaticRouter{"routes": "routes.example:443"}},
+			expectError:    false,
+		},
+		{
+			name:        "Invalid deny pattern",
+			content:     `{"routes": {}, "deny": ["cdn*.signal.org"]}`,
+			expectError: true,
+		},
+		{
+			name:        "Invalid JSON",
+			content:     `{"chat.signal.org": `,
+			expectError: true,
+		},
+		{
+			name:        "Missing port",
+			content:     `{"chat.signal.org": "chat.signal.org"}`,
+			expectError: true,
+		},
+		{
+			name:        "Invalid server name",
+			content:     `{"chat signal": "chat.signal.org:443"}`,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "upstreams.json")
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0600))
+
+			routes, err := LoadRoutes(path)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRoutes, routes)
+		})
+	}
+}
+
+// TestRouteTableStore checks that a stored routing map replaces the previous one.
+func TestRouteTableStore(t *testing.T) {
+	table := NewRouteTable(&Routes{Upstreams: StaticRouter{"chat.signal.org": "a:443"}})
+	cfg := &config.Config{Router: table}
+
+	addr, _, ok := route("chat.signal.org", routerOf(cfg), cfg)
+	assert.True(t, ok)
+	assert.Equal(t, "a:443", addr)
+
+	table.Store(&Routes{Upstreams: StaticRouter{"cdn.signal.org": "b:443"}, Deny: DenyList{"chat.signal.org"}})
+	_, _, ok = route("chat.signal.org", routerOf(cfg), cfg)
+	assert.False(t, ok)
+	addr, _, ok = route("CDN.signal.org", routerOf(cfg), cfg)
+	assert.True(t, ok)
+	assert.Equal(t, "b:443", addr)
+	assert.True(t, denied("chat.signal.org", cfg))
+}
+
+// TestPassthrough tests matching inner SNIs against the passthrough routes.
+func TestPassthrough(t *testing.T) {
+	cfg := &config.Config{Passthrough: []config.PassthroughRoute{
+		{SNI: "*.example.com", Addr: "10.0.0.1:443"},
+		{SNI: "matrix.example.com", Addr: "127.0.0.1:8448"},
+		{SNI: "*.chat.example.com", Addr: "10.0.0.2:443"},
+	}}
+	testCases := []struct {
+		sni          string
+		expectedAddr string
+		expectedOK   bool
+	}{
+		{sni: "matrix.example.com", expectedAddr: "127.0.0.1:8448", expectedOK: true},
+		{sni: "Matrix.Example.com", expectedAddr: "127.0.0.1:8448", expectedOK: true},
+		{sni: "www.example.com", expectedAddr: "10.0.0.1:443", expectedOK: true},
+		{sni: "a.chat.example.com", expectedAddr: "10.0.0.1:443", expectedOK: true},
+		{sni: "example.com"},
+		{sni: "badexample.com"},
+		{sni: "chat.signal.org"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.sni, func(t *testing.T) {
+			addr, ok := passthrough(tc.sni, cfg)
+			assert.Equal(t, tc.expectedOK, ok)
+			assert.Equal(t, tc.expectedAddr, addr)
+		})
+	}
+}
+
+// TestDSCPFor checks the precedence of the -dscp patterns.
+func TestDSCPFor(t *testing.T) {
+	cfg := &config.Config{DSCP: []config.DSCPMark{
+		{SNI: config.DSCPDefault, DSCP: 8},
+		{SNI: "*.signal.org", DSCP: 10},
+		{SNI: "sfu.voip.signal.org", DSCP: 46},
+		{SNI: "*.voip.signal.org", DSCP: 34},
+	}}
+	testCases := []struct {
+		sni          string
+		expectedDSCP int
+	}{
+		{sni: "sfu.voip.signal.org", expectedDSCP: 46},
+		{sni: "SFU.voip.signal.org", expectedDSCP: 46},
+		{sni: "turn.voip.signal.org", expectedDSCP: 10},
+		{sni: "cdn.signal.org", expectedDSCP: 10},
+		{sni: "signal.org", expectedDSCP: 8},
+		{sni: "example.com", expectedDSCP: 8},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.sni, func(t *testing.T) {
+			dscp, ok := dscpFor(tc.sni, cfg)
+			assert.True(t, ok)
+			assert.Equal(t, tc.expectedDSCP, dscp)
+		})
+	}
+
+	t.Run("No default", func(t *testing.T) {
+		_, ok := dscpFor("cdn.signal.org", &config.Config{DSCP: []config.DSCPMark{{SNI: "sfu.voip.signal.org", DSCP: 46}}})
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// scannerScore is the score within scannerWindow from which a source is
+	// taken for a scanner, its answers then slowed by -stealth-slow-scanners.
+	// A vulnerability probe scores scannerProbePoints, and any other request
+	// answered with 404, 1: three probes or six stray 404s make a scanner,
+	// while the icons a browser looks for do not.
+	scannerScore = 6
+	// scannerProbePoints is the score of a request classed as ProbeVulnScan.
+	scannerProbePoints = 2
+	// scannerWindow is the time over which the score of a source adds up.
+	scannerWindow = 10 * time.Minute
+	// maxScannerSources bounds the number of sources scored; the least
+	// recently scored ones are forgotten first.
+	maxScannerSources = 10000
+	// maxSlowResponses bounds the number of responses slowed at once. Further
+	// ones are written at once.
+	maxSlowResponses = 64
+	// slowChunkSize is the number of body bytes written per slowInterval.
+	slowChunkSize = 4
+)
+
+// slowInterval is the time between the writes of a slowed response.
+var slowInterval = time.Second
+
+// scannerScores scores the requests of each source to the stealth personas.
+var scannerScores = newSourceCounter(scannerWindow, maxScannerSources)
+
+// slowSlots holds a token per response being slowed.
+var slowSlots = make(chan struct{}, maxSlowResponses)
+
+// scannerPoints returns the score of a request of class answered with status.
+// Crawlers fetching the usual files are not scored for missing ones.
+func scannerPoints(class string, status int) int {
+	switch {
+	case class == ProbeVulnScan:
+		return scannerProbePoints
+	case class != ProbeCrawler && status == http.StatusNotFound:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// acquireSlowSlot takes a slot for a slowed response, and reports false if
+// all are taken. The caller frees it with releaseSlowSlot.
+func acquireSlowSlot() bool {
+	select {
+	case slowSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseSlowSlot frees a slot taken by acquireSlowSlot.
+func releaseSlowSlot() {
+	<-slowSlots
+}
+
+// writeSlowly writes out to conn, its first headLen bytes at once and the
+// rest slowChunkSize bytes per slowInterval. What is left when maxDuration
+// has passed is written at once, so that the response still completes, and
+// a client that stops reading is given up on at the same time.
+func writeSlowly(conn net.Conn, out []byte, headLen int, maxDuration time.Duration) error {
+	deadline := time.Now().Add(maxDuration)
+	conn.SetWriteDeadline(deadline.Add(slowInterval))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	for sent, next := 0, headLen; ; {
+		if _, err := conn.Write(out[sent:next]); err != nil {
+			return err
+		}
+		sent = next
+		if sent == len(out) {
+			return nil
+		}
+		if time.Until(deadline) < slowInterval {
+			next = len(out)
+			continue
+		}
+		time.Sleep(slowInterval)
+		next = min(sent+slowChunkSize, len(out))
+	}
+}
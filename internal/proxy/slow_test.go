@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// TestScannerPoints tests the score of the requests towards taking their
+// source for a scanner.
+func TestScannerPoints(t *testing.T) {
+	testCases := []struct {
+		name     string
+		class    string
+		status   int
+		expected int
+	}{
+		{name: "Vulnerability probe", class: ProbeVulnScan, status: http.StatusForbidden, expected: scannerProbePoints},
+		{name: "Vulnerability probe, not found", class: ProbeVulnScan, status: http.StatusNotFound, expected: scannerProbePoints},
+		{name: "Other, not found", class: ProbeOther, status: http.StatusNotFound, expected: 1},
+		{name: "Auth probe, not found", class: ProbeAuth, status: http.StatusNotFound, expected: 1},
+		{name: "Crawler, not found", class: ProbeCrawler, status: http.StatusNotFound},
+		{name: "Root", class: ProbeRoot, status: http.StatusOK},
+		{name: "Auth probe, challenged", class: ProbeAuth, status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, scannerPoints(tc.class, tc.status))
+		})
+	}
+}
+
+// TestWriteSlowly checks that the head is written at once and the body a
+// chunk per interval, and that what is left is written at once when the time
+// is up.
+func TestWriteSlowly(t *testing.T) {
+	defer func(interval time.Duration) { slowInterval = interval }(slowInterval)
+	slowInterval = 20 * time.Millisecond
+
+	const head = "HTTP/1.1 200 OK\r\n\r\n"
+	testCases := []struct {
+		name        string
+		body        string
+		maxDuration time.Duration
+		minElapsed  time.Duration
+		maxElapsed  time.Duration
+	}{
+		// Four chunks, three intervals apart
+		{name: "Paced", body: "0123456789abcdef", maxDuration: time.Second, minElapsed: 60 * time.Millisecond, maxElapsed: 500 * time.Millisecond},
+		{name: "Capped", body: string(bytes.Repeat([]byte("x"), 1000)), maxDuration: 100 * time.Millisecond, minElapsed: 80 * time.Millisecond, maxElapsed: 500 * time.Millisecond},
+		{name: "Head only", maxDuration: time.Second, maxElapsed: 20 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			out := []byte(head + tc.body)
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() {
+				done <- writeSlowly(serverConn, out, len(head), tc.maxDuration)
+				serverConn.Close()
+			}()
+
+			buf := make([]byte, len(head))
+			_, err := io.ReadFull(clientConn, buf)
+			require.NoError(t, err)
+			assert.Less(t, time.Since(start), slowInterval)
+
+			body, err := io.ReadAll(clientConn)
+			require.NoError(t, err)
+			require.NoError(t, <-done)
+			elapsed := time.Since(start)
+			assert.Equal(t, tc.body, string(body))
+			assert.GreaterOrEqual(t, elapsed, tc.minElapsed)
+			assert.Less(t, elapsed, tc.maxElapsed)
+		})
+	}
+}
+
+// TestWriteSlowlyStalledClient checks that a client that stops reading is
+// given up on once the time is up.
+func TestWriteSlowlyStalledClient(t *testing.T) {
+	defer func(interval time.Duration) { slowInterval = interval }(slowInterval)
+	slowInterval = 20 * time.Millisecond
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	start := time.Now()
+	err := writeSlowly(serverConn, []byte("HTTP/1.1 200 OK\r\n\r\nbody"), 19, 100*time.Millisecond)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// TestHandlerStealthSlowScanners checks that the answers to a source are
+// slowed once it has been seen scanning, never before, that slowed answers
+// close the connection, and that answers are written at once when all the
+// slots are taken.
+func TestHandlerStealthSlowScanners(t *testing.T) {
+	defer func(interval time.Duration) { slowInterval = interval }(slowInterval)
+	slowInterval = 5 * time.Millisecond
+	t.Cleanup(func() {
+		scannerScores = newSourceCounter(scannerWindow, maxScannerSources)
+		slowSlots = make(chan struct{}, maxSlowResponses)
+	})
+
+	const maxDuration = 150 * time.Millisecond
+	newHandler := func(slowScanners time.Duration) *Handler {
+		scannerScores = newSourceCounter(scannerWindow, maxScannerSources)
+		h := NewHandler(&config.Config{
+			Domain:                   "example.com",
+			StealthMode:              config.StealthNginx,
+			StealthSlowScanners:      slowScanners,
+			StealthKeepAliveTimeout:  100 * time.Millisecond,
+			StealthKeepAliveRequests: 100,
+			SniffTimeout:             time.Second,
+		})
+		h.Stats = stats.New()
+		h.Logger = log.New(io.Discard, "", 0)
+		return h
+	}
+	// get returns the response to request and the time it took
+	get := func(h *Handler, request string) (*http.Response, time.Duration) {
+		start := time.Now()
+		raw := exchange(h, request)
+		elapsed := time.Since(start)
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+		require.NoError(t, err)
+		_, err = io.ReadAll(response.Body)
+		require.NoError(t, err)
+		return response, elapsed
+	}
+	const (
+		probe = "GET /.env HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"
+		index = "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"
+		icon  = "GET /apple-touch-icon.png HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"
+	)
+
+	t.Run("Scanner", func(t *testing.T) {
+		h := newHandler(maxDuration)
+		for i := 0; i < scannerScore/scannerProbePoints; i++ {
+			response, elapsed := get(h, probe)
+			assert.Equal(t, "404 Not Found", response.Status)
+			assert.Less(t, elapsed, maxDuration/2)
+		}
+		// The page is longer than the time allows for at this pace
+		response, elapsed := get(h, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, "200 OK", response.Status)
+		assert.True(t, response.Close)
+		assert.GreaterOrEqual(t, elapsed, maxDuration-slowInterval)
+		assert.Less(t, elapsed, 2*time.Second)
+		assert.Equal(t, int64(1), h.Stats.Get("stealth_slowed"))
+		assert.Len(t, slowSlots, 0)
+	})
+
+	t.Run("Visitor", func(t *testing.T) {
+		h := newHandler(maxDuration)
+		for _, request := range []string{index, icon, icon, index, index, index, index, index} {
+			_, elapsed := get(h, request)
+			assert.Less(t, elapsed, maxDuration/2)
+		}
+		assert.Zero(t, h.Stats.Get("stealth_slowed"))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		h := newHandler(0)
+		for i := 0; i < 2*scannerScore; i++ {
+			_, elapsed := get(h, probe)
+			assert.Less(t, elapsed, maxDuration/2)
+		}
+		assert.Zero(t, h.Stats.Get("stealth_slowed"))
+	})
+
+	t.Run("Full", func(t *testing.T) {
+		h := newHandler(maxDuration)
+		slowSlots = make(chan struct{}, 1)
+		slowSlots <- struct{}{}
+		for i := 0; i < scannerScore/scannerProbePoints+2; i++ {
+			_, elapsed := get(h, probe)
+			assert.Less(t, elapsed, maxDuration/2)
+		}
+		assert.Zero(t, h.Stats.Get("stealth_slowed"))
+		assert.Equal(t, int64(2), h.Stats.Get("stealth_slow_full"))
+	})
+}
@@ -3,6 +3,7 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
 	"strings"
@@ -15,11 +16,153 @@ const (
 	ProtoSignalTLS Protocol = iota // Inner TLS handshake from Signal
 	ProtoHTTP                      // Standard HTTP/HTTPS request (from a browser)
 	ProtoUnknown
+	ProtoSSH      // SSH client banner
+	ProtoSOCKS4   // SOCKS4 request, e.g. from open proxy scanners
+	ProtoSOCKS5   // SOCKS5 greeting, e.g. from open proxy scanners
+	ProtoTLSAlert // TLS alert record instead of a handshake
+	ProtoSTUN     // STUN message
 )
 
+// String returns a human-readable name of the protocol.
+func (p Protocol) String() string {
+	switch p {
+	case ProtoSignalTLS:
+		return "signal-tls"
+	case ProtoHTTP:
+		return "http"
+	case ProtoSSH:
+		return "ssh"
+	case ProtoSOCKS4:
+		return "socks4"
+	case ProtoSOCKS5:
+		return "socks5"
+	case ProtoTLSAlert:
+		return "tls-alert"
+	case ProtoSTUN:
+		return "stun"
+	default:
+		return "unknown"
+	}
+}
+
+// IsProbe reports whether p is a recognized protocol that is not served.
+func (p Protocol) IsProbe() bool {
+	return p >= ProtoSSH
+}
+
+// maxDumpLen is the number of bytes returned for unknown protocols.
+const maxDumpLen = 16
+
+// stunMagicCookie is the fixed value at offset 4 of every STUN message (RFC 5389).
+var stunMagicCookie = []byte{0x21, 0x12, 0xa4, 0x42}
+
+// maxTLSRecordLen is the largest valid length of a TLSPlaintext record
+// fragment, plus the allowance RFC 8446 makes for buggy implementations.
+const maxTLSRecordLen = 16384 + 256
+
+// looksLikeClientHello reports whether b, possibly truncated, is consistent
+// with the start of a TLS record carrying a ClientHello: content type
+// handshake, a legacy record version of TLS 1.0 to 1.3, a plausible length,
+// and handshake type client_hello. Only the bytes present are checked.
+func looksLikeClientHello(b []byte) bool {
+	if len(b) == 0 || b[0] != 0x16 {
+		return false
+	}
+	if len(b) > 1 && b[1] != 0x03 {
+		return false
+	}
+	if len(b) > 2 && (b[2] < 0x01 || b[2] > 0x04) {
+		return false
+	}
+	if len(b) > 4 {
+		if length := int(b[3])<<8 | int(b[4]); length < 1 || length > maxTLSRecordLen {
+			return false
+		}
+	}
+	if len(b) > 5 && b[5] != 0x01 {
+		return false
+	}
+	return true
+}
+
+// peekBuffered returns up to n bytes that are already buffered in reader,
+// without waiting for more.
+func peekBuffered(reader *bufio.Reader, n int) []byte {
+	b, _ := reader.Peek(min(n, reader.Buffered()))
+	return b
+}
+
+// classifyProbe recognizes the first bytes of protocols that are not served.
+func classifyProbe(b []byte) Protocol {
+	switch {
+	case len(b) >= 2 && b[0] == 0x05 && b[1] > 0:
+		return ProtoSOCKS5
+	case len(b) >= 2 && b[0] == 0x04 && (b[1] == 0x01 || b[1] == 0x02):
+		return ProtoSOCKS4
+	case len(b) >= 2 && b[0] == 0x15 && b[1] == 0x03:
+		return ProtoTLSAlert
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		return ProtoSSH
+	case len(b) >= 8 && b[0]&0xc0 == 0 && bytes.Equal(b[4:8], stunMagicCookie):
+		return ProtoSTUN
+	}
+	return ProtoUnknown
+}
+
+// looksLikeRequestLine reports whether b starts with an HTTP request line: a
+// method of upper case letters, hyphens and underscores followed by a space and
+// the start of a path.
+func looksLikeRequestLine(b []byte) bool {
+	method, rest, ok := bytes.Cut(b, []byte(" "))
+	if !ok || len(method) == 0 || len(rest) == 0 || (rest[0] != '/' && rest[0] != '*') {
+		return false
+	}
+	for _, c := range method {
+		if (c < 'A' || c > 'Z') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// peekMethod returns the buffered bytes of reader, up to maxDumpLen, after
+// waiting for the space that ends a method and the byte after it, so that
+// methods of 8 or more characters split after the first bytes are still
+// recognized. It does not wait once a byte that cannot be part of a method
+// arrives.
+func peekMethod(reader *bufio.Reader) []byte {
+	for n := 1; n < maxDumpLen; n++ {
+		b, err := reader.Peek(n)
+		if err != nil {
+			break
+		}
+		c := b[n-1]
+		if c == ' ' {
+			reader.Peek(n + 1)
+			break
+		}
+		if (c < 'A' || c > 'Z') && c != '-' && c != '_' {
+			break
+		}
+	}
+	return peekBuffered(reader, maxDumpLen)
+}
+
 // sniffProtocol peeks into the connection to determine the protocol being used
-// without consuming any bytes from the reader.
+// without consuming any bytes from the reader. For unknown protocols, it also
+// returns up to maxDumpLen of the peeked bytes.
 func sniffProtocol(reader *bufio.Reader) (Protocol, []byte, error) {
+	// SOCKS clients send a greeting of only a few bytes and TLS alerts are short,
+	// both then wait for a reply. Classify them on what has arrived, instead of
+	// waiting for more bytes than they will ever send.
+	if first, err := reader.Peek(2); err == nil && (first[0] == 0x04 || first[0] == 0x05 || first[0] == 0x15) {
+		b := peekBuffered(reader, maxDumpLen)
+		if protocol := classifyProbe(b); protocol != ProtoUnknown {
+			return protocol, nil, nil
+		}
+		return ProtoUnknown, b, nil
+	}
+
 	// Peek at the first few bytes to identify the protocol.
 	// We peek at 8 bytes, which is enough to identify common HTTP methods
 	// and the TLS handshake byte.
@@ -30,21 +173,21 @@ func sniffProtocol(reader *bufio.Reader) (Protocol, []byte, error) {
 		// we just might not be able to determine the protocol.
 		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 			// Try to identify based on what we did get.
-			if len(peekedBytes) > 0 {
-				if peekedBytes[0] == 0x16 {
-					return ProtoSignalTLS, nil, nil
-				}
-				// Not enough data for a reliable HTTP check, so we'll fall through.
+			if looksLikeClientHello(peekedBytes) {
+				return ProtoSignalTLS, nil, nil
+			}
+			// Not enough data for a reliable HTTP check.
+			if protocol := classifyProbe(peekedBytes); protocol != ProtoUnknown {
+				return protocol, nil, nil
 			}
-			return ProtoUnknown, nil, nil // Not enough data to determine.
+			return ProtoUnknown, peekedBytes, nil
 		}
 		// Any other error is a real problem.
 		return ProtoUnknown, nil, err
 	}
 
-	// 0x16 is the byte for a TLS Handshake record. If the first byte is this,
-	// we assume it's the inner TLS handshake from Signal.
-	if peekedBytes[0] == 0x16 {
+	// A TLS record carrying a ClientHello is the inner TLS handshake from Signal.
+	if looksLikeClientHello(peekedBytes) {
 		return ProtoSignalTLS, nil, nil
 	}
 
@@ -62,6 +205,25 @@ func sniffProtocol(reader *bufio.Reader) (Protocol, []byte, error) {
 		return ProtoHTTP, nil, nil
 	}
 
+	// Scanners also try WebDAV and made-up methods, which web servers answer
+	// with an error page rather than by closing the connection.
+	if looksLikeRequestLine(peekMethod(reader)) {
+		return ProtoHTTP, nil, nil
+	}
+
+	// Recognize common scanner probes, so that they can be told apart in the logs.
+	if protocol := classifyProbe(peekedBytes); protocol != ProtoUnknown {
+		return protocol, nil, nil
+	}
+
 	// If it's neither, we don't know what it is.
-	return ProtoUnknown, nil, nil
+	return ProtoUnknown, peekBuffered(reader, maxDumpLen), nil
+}
+
+// SniffProtocol identifies the protocol of a connection from its first bytes,
+// like the proxy does, without consuming them from reader. On a listener
+// without outer TLS, ProtoSignalTLS is the outer handshake of a Signal client.
+func SniffProtocol(reader *bufio.Reader) (Protocol, error) {
+	protocol, _, err := sniffProtocol(reader)
+	return protocol, err
 }
\ No newline at end of file
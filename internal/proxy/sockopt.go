@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// dscpWarning logs only the first failure to set a DSCP value, since failures
+// usually mean that the platform does not support it.
+var dscpWarning sync.Once
+
+// tuneUpstreamConn sets the socket options of an upstream connection: no Nagle
+// delay for the small writes of interactive traffic, the configured keepalive
+// and buffer sizes. Connections that are not plain TCP sockets, such as
+// tunnels wrapping the socket, are left as they are.
+func tuneUpstreamConn(conn net.Conn, cfg *config.Config, logger *log.Logger) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if err := tcpConn.SetNoDelay(true); err != nil {
+		logger.Printf("Failed to set TCP_NODELAY on upstream connection: %v", err)
+	}
+	if cfg.UpstreamKeepAlive > 0 {
+		err := tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: cfg.UpstreamKeepAlive, Interval: cfg.UpstreamKeepAlive})
+		if err != nil {
+			logger.Printf("Failed to set keepalive on upstream connection: %v", err)
+		}
+	} else if err := tcpConn.SetKeepAlive(false); err != nil {
+		logger.Printf("Failed to disable keepalive on upstream connection: %v", err)
+	}
+	if cfg.UpstreamSockBufKB > 0 {
+		size := cfg.UpstreamSockBufKB * 1024
+		if err := tcpConn.SetReadBuffer(size); err != nil {
+			logger.Printf("Failed to set receive buffer size on upstream connection: %v", err)
+		}
+		if err := tcpConn.SetWriteBuffer(size); err != nil {
+			logger.Printf("Failed to set send buffer size on upstream connection: %v", err)
+		}
+	}
+}
+
+// markDSCP sets the DSCP value of config.DSCP for serverName on the sockets of
+// the upstream and the client connection, when they are TCP sockets.
+func markDSCP(clientConn, upstreamConn net.Conn, serverName string, cfg *config.Config, logger *log.Logger) {
+	dscp, ok := dscpFor(serverName, cfg)
+	if !ok {
+		return
+	}
+	for _, conn := range []net.Conn{upstreamConn, clientConn} {
+		if err := setDSCP(conn, dscp); err != nil {
+			stats.Inc("dscp_errors")
+			dscpWarning.Do(func() {
+				logger.Printf("Failed to set DSCP %d for %s, further failures are not logged: %v", dscp, serverName, err)
+			})
+		}
+	}
+}
+
+// setDSCP sets the DSCP value of the packets sent on conn, in the upper six
+// bits of the IPv4 TOS or IPv6 traffic class field. Connections without an
+// underlying TCP socket, such as tunnels, are left as they are.
+func setDSCP(conn net.Conn, dscp int) error {
+	tcpConn, ok := tcpConnOf(conn)
+	if !ok {
+		return nil
+	}
+	// IPv4 clients of a dual-stack listener have an IPv4 address, and the
+	// kernel takes the IPv4 option for them on the IPv6 socket
+	if addr, ok := tcpConn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewConn(tcpConn).SetTOS(dscp << 2)
+	}
+	return ipv6.NewConn(tcpConn).SetTrafficClass(dscp << 2)
+}
+
+// tcpConnOf returns the TCP socket of conn, unwrapping TLS connections and
+// other wrappers that expose the connection they wrap with a NetConn method.
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
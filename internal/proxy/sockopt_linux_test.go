@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// dialLoopback returns the client side of a loopback TCP connection.
+func dialLoopback(t *testing.T) *net.TCPConn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	server, err := ln.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	return conn.(*net.TCPConn)
+}
+
+// getsockopt reads an integer socket option of conn.
+func getsockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	raw, err := conn.SyscallConn()
+	require.NoError(t, err)
+	var value int
+	var sockErr error
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, sockErr)
+	return value
+}
+
+// TestTuneUpstreamConn checks the socket options of a tuned upstream connection.
+func TestTuneUpstreamConn(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	t.Run("configured", func(t *testing.T) {
+		conn := dialLoopback(t)
+		require.NoError(t, conn.SetNoDelay(false))
+		cfg := &config.Config{UpstreamKeepAlive: 45 * time.Second, UpstreamSockBufKB: 256}
+		tuneUpstreamConn(conn, cfg, logger)
+
+		assert.Equal(t, 1, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+		assert.Equal(t, 1, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+		assert.Equal(t, 45, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+		assert.Equal(t, 45, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+		// Linux doubles the requested sizes for its bookkeeping overhead
+		assert.GreaterOrEqual(t, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF), 256*1024)
+		assert.GreaterOrEqual(t, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF), 256*1024)
+	})
+
+	t.Run("keepalive disabled", func(t *testing.T) {
+		conn := dialLoopback(t)
+		require.NoError(t, conn.SetKeepAlive(true))
+		tuneUpstreamConn(conn, &config.Config{}, logger)
+
+		assert.Equal(t, 1, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+		assert.Equal(t, 0, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	})
+
+	t.Run("wrapped connection", func(t *testing.T) {
+		conn := dialLoopback(t)
+		require.NoError(t, conn.SetNoDelay(false))
+		wrapped := bufferedConn{conn, bufio.NewReader(conn)}
+		tuneUpstreamConn(wrapped, &config.Config{UpstreamKeepAlive: time.Minute}, logger)
+
+		assert.Equal(t, 0, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	})
+}
+
+// TestSetDSCP checks the DSCP value set on IPv4, IPv6 and wrapped sockets.
+func TestSetDSCP(t *testing.T) {
+	t.Run("IPv4", func(t *testing.T) {
+		conn := dialLoopback(t)
+		require.NoError(t, setDSCP(conn, 46))
+		assert.Equal(t, 46<<2, getsockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS))
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Skipf("IPv6 loopback unavailable: %v", err)
+		}
+		defer ln.Close()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, setDSCP(conn, 46))
+		assert.Equal(t, 46<<2, getsockopt(t, conn.(*net.TCPConn), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS))
+	})
+
+	t.Run("IPv4 client of a dual-stack listener", func(t *testing.T) {
+		ln, err := net.Listen("tcp", ":0")
+		require.NoError(t, err)
+		defer ln.Close()
+		client, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)))
+		require.NoError(t, err)
+		defer client.Close()
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, setDSCP(conn, 10))
+		assert.Equal(t, 10<<2, getsockopt(t, conn.(*net.TCPConn), syscall.IPPROTO_IP, syscall.IP_TOS))
+	})
+
+	t.Run("TLS connection", func(t *testing.T) {
+		conn := dialLoopback(t)
+		require.NoError(t, setDSCP(tls.Client(conn, &tls.Config{}), 34))
+		assert.Equal(t, 34<<2, getsockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS))
+	})
+
+	t.Run("Buffered connection", func(t *testing.T) {
+		conn := dialLoopback(t)
+		require.NoError(t, setDSCP(bufferedConn{conn, bufio.NewReader(conn)}, 46))
+		assert.Equal(t, 46<<2, getsockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS))
+	})
+
+	t.Run("Not a socket", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		assert.NoError(t, setDSCP(serverConn, 46))
+	})
+}
+
+// TestMarkDSCP checks that both sockets of a connection are marked with the
+// DSCP value of its inner SNI.
+func TestMarkDSCP(t *testing.T) {
+	cfg := &config.Config{DSCP: []config.DSCPMark{{SNI: "sfu.voip.signal.org", DSCP: 46}, {SNI: config.DSCPDefault, DSCP: 0}}}
+	logger := log.New(io.Discard, "", 0)
+
+	client, upstream := dialLoopback(t), dialLoopback(t)
+	markDSCP(client, upstream, "sfu.voip.signal.org", cfg, logger)
+	assert.Equal(t, 46<<2, getsockopt(t, client, syscall.IPPROTO_IP, syscall.IP_TOS))
+	assert.Equal(t, 46<<2, getsockopt(t, upstream, syscall.IPPROTO_IP, syscall.IP_TOS))
+
+	markDSCP(client, upstream, "cdn.signal.org", cfg, logger)
+	assert.Equal(t, 0, getsockopt(t, client, syscall.IPPROTO_IP, syscall.IP_TOS))
+	assert.Equal(t, 0, getsockopt(t, upstream, syscall.IPPROTO_IP, syscall.IP_TOS))
+}
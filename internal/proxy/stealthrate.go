@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+)
+
+const (
+	// stealthRateWindow is the time over which the requests of a source are
+	// counted against -stealth-rate-per-source.
+	stealthRateWindow = time.Minute
+	// maxStealthRateSources bounds the number of sources counted; the least
+	// recently counted ones are forgotten first.
+	maxStealthRateSources = 10000
+)
+
+// Limits exceeded by a request to the stealth personas.
+const (
+	stealthRateSource = "source"
+	stealthRateGlobal = "global"
+)
+
+// stealthRates limits the requests to the stealth personas of every handler.
+var stealthRates = newStealthLimiter()
+
+// StealthRates are the rate limits of the requests to the stealth personas,
+// as read from -stealth-rate-file.
+type StealthRates struct {
+	// PerSource bounds the requests per minute of a source, or 0.
+	PerSource int `json:"per_source"`
+	// Global bounds the requests per second of all sources, or 0.
+	Global int `json:"global"`
+	// Action selects the answer to the requests over the limits.
+	Action config.StealthRateAction `json:"action"`
+}
+
+// LoadStealthRates reads a -stealth-rate-file, a JSON object with any of the
+// fields of StealthRates. Those it leaves out keep the values of the flags of
+// cfg.
+func LoadStealthRates(path string, cfg *config.Config) (StealthRates, error) {
+	rates := StealthRates{PerSource: cfg.StealthRatePerSource, Global: cfg.StealthRateGlobal, Action: cfg.StealthRateAction}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return StealthRates{}, err
+	}
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return StealthRates{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if rates.PerSource < 0 || rates.Global < 0 {
+		return StealthRates{}, fmt.Errorf("negative stealth rate in %s", path)
+	}
+	switch rates.Action {
+	case "", config.StealthRate429, config.StealthRateTarpit:
+	default:
+		return StealthRates{}, fmt.Errorf("invalid stealth rate action '%s' in %s", rates.Action, path)
+	}
+	return rates, nil
+}
+
+// SetStealthRates replaces the stealth rate limits of the flags with rates,
+// those of -stealth-rate-file. They apply from the next request on.
+func SetStealthRates(rates StealthRates) {
+	stealthRates.set(&rates)
+}
+
+// stealthLimiter counts the requests to the stealth personas against their
+// per-source and global rate limits, apart from the limits of the Signal
+// path. It is safe for concurrent use.
+type stealthLimiter struct {
+	sources *sourceCounter
+
+	mu     sync.Mutex
+	rates  *StealthRates // Of -stealth-rate-file, nil to use the flags
+	global *tokenBucket  // Refilling at rate requests per second
+	rate   int
+}
+
+// newStealthLimiter creates a limiter with the rates of the flags.
+func newStealthLimiter() *stealthLimiter {
+	return &stealthLimiter{sources: newSourceCounter(stealthRateWindow, maxStealthRateSources)}
+}
+
+// set replaces the rates of the flags with rates, or restores them if nil.
+func (l *stealthLimiter) set(rates *StealthRates) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rates = rates
+}
+
+// limit counts a request of source and returns the limit it exceeds, if any,
+// with the action configured for it. A request over the limit of its source
+// does not count against the global limit, so that a single scanner cannot
+// use it up.
+func (l *stealthLimiter) limit(source string, cfg *config.Config) (config.StealthRateAction, string) {
+	l.mu.Lock()
+	rates := StealthRates{PerSource: cfg.StealthRatePerSource, Global: cfg.StealthRateGlobal, Action: cfg.StealthRateAction}
+	if l.rates != nil {
+		rates = *l.rates
+	}
+	l.mu.Unlock()
+	action := rates.Action
+	if action == "" {
+		action = config.StealthRate429
+	}
+
+	if rates.PerSource > 0 && l.sources.add(source, 1) > rates.PerSource {
+		return action, stealthRateSource
+	}
+	if rates.Global <= 0 {
+		return action, ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.global == nil || l.rate != rates.Global {
+		// A new rate starts with a full second of requests
+		l.global = newTokenBucket(rates.Global, rates.Global)
+		l.rate = rates.Global
+	}
+	if !l.global.tryTake(1) {
+		return action, stealthRateGlobal
+	}
+	return action, ""
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// TestLoadStealthRates tests the parsing of -stealth-rate-file, whose missing
+// fields keep the values of the flags.
+func TestLoadStealthRates(t *testing.T) {
+	cfg := &config.Config{StealthRatePerSource: 60, StealthRateGlobal: 10, StealthRateAction: config.StealthRate429}
+	testCases := []struct {
+		name        string
+		content     string
+		expected    StealthRates
+		expectedErr bool
+	}{
+		{
+			name:     "All fields",
+			content:  `{"per_source": 120, "global": 50, "action": "tarpit"}`,
+			expected: StealthRates{PerSource: 120, Global: 50, Action: config.StealthRateTarpit},
+		},
+		{
+			name:     "Some fields",
+			content:  `{"global": 0}`,
+			expected: StealthRates{PerSource: 60, Action: config.StealthRate429},
+		},
+		{
+			name:     "Empty object",
+			content:  `{}`,
+			expected: StealthRates{PerSource: 60, Global: 10, Action: config.StealthRate429},
+		},
+		{name: "Invalid JSON", content: `{"per_source": }`, expectedErr: true},
+		{name: "Negative rate", content: `{"per_source": -1}`, expectedErr: true},
+		{name: "Invalid action", content: `{"action": "503"}`, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "stealth-rate.json")
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0o644))
+			rates, err := LoadStealthRates(path, cfg)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, rates)
+		})
+	}
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := LoadStealthRates(filepath.Join(t.TempDir(), "missing.json"), cfg)
+		assert.Error(t, err)
+	})
+}
+
+// TestStealthLimiter checks that exactly the number of requests allowed by
+// each limit get through, that the requests a source makes over its own limit
+// leave the global one to the others, and that new rates apply right away.
+func TestStealthLimiter(t *testing.T) {
+	t.Run("Per source", func(t *testing.T) {
+		l := newStealthLimiter()
+		now := time.Now()
+		l.sources.now = func() time.Time { return now }
+		cfg := &config.Config{StealthRatePerSource: 3}
+		for i := 0; i < 3; i++ {
+			_, exceeded := l.limit("192.0.2.1", cfg)
+			assert.Empty(t, exceeded, "request %d", i+1)
+		}
+		action, exceeded := l.limit("192.0.2.1", cfg)
+		assert.Equal(t, stealthRateSource, exceeded)
+		assert.Equal(t, config.StealthRate429, action)
+		_, exceeded = l.limit("192.0.2.2", cfg)
+		assert.Empty(t, exceeded)
+
+		// The next window starts afresh
+		now = now.Add(stealthRateWindow)
+		_, exceeded = l.limit("192.0.2.1", cfg)
+		assert.Empty(t, exceeded)
+	})
+
+	t.Run("Global", func(t *testing.T) {
+		l := newStealthLimiter()
+		cfg := &config.Config{StealthRateGlobal: 20, StealthRateAction: config.StealthRateTarpit}
+		for i := 0; i < 20; i++ {
+			_, exceeded := l.limit("192.0.2.1", cfg)
+			assert.Empty(t, exceeded, "request %d", i+1)
+		}
+		action, exceeded := l.limit("192.0.2.2", cfg)
+		assert.Equal(t, stealthRateGlobal, exceeded)
+		assert.Equal(t, config.StealthRateTarpit, action)
+
+		// A request is allowed again every 50ms
+		time.Sleep(120 * time.Millisecond)
+		_, exceeded = l.limit("192.0.2.2", cfg)
+		assert.Empty(t, exceeded)
+	})
+
+	t.Run("Source over its limit", func(t *testing.T) {
+		l := newStealthLimiter()
+		cfg := &config.Config{StealthRatePerSource: 2, StealthRateGlobal: 3}
+		for i := 0; i < 10; i++ {
+			l.limit("192.0.2.1", cfg)
+		}
+		_, exceeded := l.limit("192.0.2.2", cfg)
+		assert.Empty(t, exceeded)
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		l := newStealthLimiter()
+		cfg := &config.Config{StealthRatePerSource: 1}
+		_, exceeded := l.limit("192.0.2.1", cfg)
+		assert.Empty(t, exceeded)
+		_, exceeded = l.limit("192.0.2.1", cfg)
+		assert.Equal(t, stealthRateSource, exceeded)
+
+		// The rates of the file replace those of the flags
+		l.set(&StealthRates{PerSource: 5, Global: 1, Action: config.StealthRateTarpit})
+		action, exceeded := l.limit("192.0.2.1", cfg)
+		assert.Empty(t, exceeded)
+		assert.Equal(t, config.StealthRateTarpit, action)
+		_, exceeded = l.limit("192.0.2.1", cfg)
+		assert.Equal(t, stealthRateGlobal, exceeded)
+
+		l.set(&StealthRates{})
+		for i := 0; i < 10; i++ {
+			_, exceeded = l.limit("192.0.2.1", cfg)
+			assert.Empty(t, exceeded)
+		}
+	})
+}
+
+// TestHandlerStealthRateLimit checks that the requests over the limits get the
+// 429 page of the persona, or the tarpit, and that the responses are counted
+// by status and persona.
+func TestHandlerStealthRateLimit(t *testing.T) {
+	shortTarpit(t, tarpitSlots, 100*time.Millisecond)
+	t.Cleanup(func() { stealthRates = newStealthLimiter() })
+
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"
+	testCases := []struct {
+		name             string
+		cfg              config.Config
+		expectedStatus   string
+		expectedContains string
+		expectedLimit    string
+		expectedPersona  string
+	}{
+		{
+			name:             "Nginx, per source",
+			cfg:              config.Config{StealthMode: config.StealthNginx, StealthRatePerSource: 2},
+			expectedStatus:   "429 Too Many Requests",
+			expectedContains: "<center><h1>429 Too Many Requests</h1></center>",
+			expectedLimit:    stealthRateSource,
+			expectedPersona:  "nginx",
+		},
+		{
+			name:             "Apache, global",
+			cfg:              config.Config{StealthMode: config.StealthApache, StealthRateGlobal: 2},
+			expectedStatus:   "429 Too Many Requests",
+			expectedContains: "Server at example.com Port 443",
+			expectedLimit:    stealthRateGlobal,
+			expectedPersona:  "apache",
+		},
+		{
+			name:             "WordPress",
+			cfg:              config.Config{StealthMode: config.StealthWordPress, StealthRatePerSource: 2},
+			expectedStatus:   "429 Too Many Requests",
+			expectedContains: "<hr><center>nginx/",
+			expectedLimit:    stealthRateSource,
+			expectedPersona:  "wordpress",
+		},
+		{
+			name:            "Tarpit",
+			cfg:             config.Config{StealthMode: config.StealthLiteSpeed, StealthRatePerSource: 2, StealthRateAction: config.StealthRateTarpit},
+			expectedLimit:   stealthRateSource,
+			expectedPersona: "litespeed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stealthRates = newStealthLimiter()
+			cfg := tc.cfg
+			cfg.Domain = "example.com"
+			cfg.StealthKeepAliveTimeout = 100 * time.Millisecond
+			cfg.StealthKeepAliveRequests = 100
+			cfg.SniffTimeout = time.Second
+			h := NewHandler(&cfg)
+			h.Stats = stats.New()
+			h.Logger = log.New(io.Discard, "", 0)
+
+			for i := 0; i < 2; i++ {
+				response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(exchange(h, request))), nil)
+				require.NoError(t, err)
+				assert.Equal(t, "200 OK", response.Status)
+			}
+			assert.Zero(t, h.Stats.Get("stealth_rate_limited"))
+
+			start := time.Now()
+			raw := exchange(h, request)
+			assert.Equal(t, int64(1), h.Stats.Get("stealth_rate_limited"))
+			assert.Equal(t, int64(1), h.Stats.Get("stealth_rate_limited:"+tc.expectedLimit))
+			if tc.expectedStatus == "" {
+				// Held without an answer until the tarpit lets go
+				assert.Empty(t, raw)
+				assert.GreaterOrEqual(t, time.Since(start), tarpits.duration)
+				assert.Equal(t, int64(1), h.Stats.Get("stealth_rate_tarpitted"))
+				assert.Equal(t, int64(2), h.Stats.Get("stealth_persona:"+tc.expectedPersona))
+				return
+			}
+			response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+			require.NoError(t, err)
+			body, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, response.Status)
+			assert.Contains(t, string(body), tc.expectedContains)
+			assert.Equal(t, int64(2), h.Stats.Get("stealth_status:200"))
+			assert.Equal(t, int64(1), h.Stats.Get("stealth_status:429"))
+			assert.Equal(t, int64(3), h.Stats.Get("stealth_persona:"+tc.expectedPersona))
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+	"signalgoproxy/internal/stealth"
+)
+
+const (
+	// tarpitSlots bounds the number of connections held in the tarpit at once.
+	// Further connections are closed right away.
+	tarpitSlots = 256
+	// tarpitReadSize is the most input read from a tarpitted connection per
+	// interval. The rest stays in the socket buffers, so that the client soon
+	// finds its TCP window closed.
+	tarpitReadSize = 16
+	// tarpitDribbleSize is the number of response bytes written per interval.
+	tarpitDribbleSize = 4
+	// tarpitDuration bounds how long the tarpit holds a connection open.
+	tarpitDuration = 3 * time.Minute
+	// tarpitInterval is the time between reads from a tarpitted connection.
+	tarpitInterval = 2 * time.Second
+)
+
+// tarpits holds the connections of the unknown-protocol tarpit and of banned sources.
+var tarpits = newTarpit(tarpitSlots, tarpitDuration, tarpitInterval)
+
+// tarpit keeps unwanted connections open for a while, reading their input at a
+// trickle, to slow down scanners. It holds at most a fixed number of
+// connections, each with a small fixed buffer. It is safe for concurrent use.
+type tarpit struct {
+	duration time.Duration
+	interval time.Duration
+	slots    chan struct{}
+
+	mu    sync.Mutex
+	conns map[net.Conn]chan struct{} // Closed to release the connection
+}
+
+// newTarpit creates a tarpit holding at most slots connections, each for
+// duration, reading from it every interval.
+func newTarpit(slots int, duration, interval time.Duration) *tarpit {
+	return &tarpit{
+		duration: duration,
+		interval: interval,
+		slots:    make(chan struct{}, slots),
+		conns:    make(map[net.Conn]chan struct{}),
+	}
+}
+
+// acquire takes a slot of the tarpit, and reports false if all are taken.
+func (t *tarpit) acquire() bool {
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+		stats.Inc("tarpit_full")
+		return false
+	}
+}
+
+// hold keeps conn open for the duration of the tarpit, reading from reader at
+// a trickle and writing response a few bytes at a time, but never its last
+// byte, so that it never completes. The slot taken by acquire is freed on
+// return; the caller closes conn.
+func (t *tarpit) hold(reader io.Reader, conn net.Conn, response []byte) {
+	defer func() { <-t.slots }()
+
+	release := make(chan struct{})
+	t.mu.Lock()
+	t.conns[conn] = release
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+	}()
+
+	buf := make([]byte, tarpitReadSize)
+	deadline := time.Now().Add(t.duration)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for sent := 0; ; {
+		conn.SetReadDeadline(time.Now().Add(t.interval))
+		if _, err := reader.Read(buf); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		if n := min(tarpitDribbleSize, len(response)-1-sent); n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(t.interval))
+			if _, err := conn.Write(response[sent : sent+n]); err != nil {
+				return
+			}
+			sent += n
+		}
+
+		select {
+		case <-release:
+			return
+		case now := <-ticker.C:
+			if now.After(deadline) {
+				return
+			}
+		}
+	}
+}
+
+// releaseAll closes every held connection, ending its tarpit promptly. It
+// returns the number of connections released.
+func (t *tarpit) releaseAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for conn, release := range t.conns {
+		close(release)
+		conn.Close()
+	}
+	n := len(t.conns)
+	clear(t.conns)
+	return n
+}
+
+// TarpitBanned holds a connection from a banned source in the tarpit, see
+// -ban-action, and closes it. Without a free slot it is closed right away.
+func TarpitBanned(conn net.Conn) {
+	defer conn.Close()
+	if !tarpits.acquire() {
+		stats.Inc("banned_refused")
+		return
+	}
+	stats.Inc("banned_tarpitted")
+	tarpits.hold(conn, conn, nil)
+}
+
+// ReleaseTarpits closes the connections held in the tarpit, as on shutdown. It
+// returns the number of connections released.
+func ReleaseTarpits() int {
+	return tarpits.releaseAll()
+}
+
+// tarpitResponse returns the response dribbled to tarpitted connections of an
+// unknown protocol: the start of the stealth persona's default page if
+// -tarpit-dribble is set, nil otherwise.
+func tarpitResponse(cfg *config.Config) []byte {
+	if !cfg.TarpitDribble {
+		return nil
+	}
+	if cfg.StealthMode == config.StealthProxy {
+		return stealth.GetNginxResponse(cfg.Domain).Close().Bytes()
+	}
+	p, ok := personaOf(cfg)
+	if !ok {
+		return nil
+	}
+	var response stealth.Response
+	switch cfg.StealthMode {
+	case config.StealthError:
+		response = p.serverError(cfg.StealthErrorCode)
+	case config.StealthAutoindex:
+		response = stealth.GetNginxAutoindex(cfg.Domain, "/", autoindexFiles(cfg, cfg.Log()))
+	case config.StealthMirror:
+		response = mirrorResponse(cfg, p, "/")
+	default:
+		response = p.page(cfg.Domain)
+	}
+	return response.WithServer(p.server).Close().Bytes()
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+	"signalgoproxy/internal/stealth"
+)
+
+// shortTarpit replaces the tarpit with one of slots holding connections for d,
+// reading every few milliseconds, and releases them at the end of the test.
+func shortTarpit(t *testing.T, slots int, d time.Duration) {
+	orig := tarpits
+	tarpits = newTarpit(slots, d, 5*time.Millisecond)
+	t.Cleanup(func() {
+		tarpits.releaseAll()
+		tarpits = orig
+	})
+}
+
+// heldConns returns the number of connections held in the tarpit.
+func heldConns() int {
+	tarpits.mu.Lock()
+	defer tarpits.mu.Unlock()
+	return len(tarpits.conns)
+}
+
+// TestTarpitDribble checks that the tarpit sends the start of the persona's
+// page, a few bytes at a time, and closes before completing it.
+func TestTarpitDribble(t *testing.T) {
+	shortTarpit(t, tarpitSlots, 100*time.Millisecond)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	cfg := &config.Config{StealthMode: config.StealthNginx, UnknownProtocolAction: config.UnknownTarpit, TarpitDribble: true}
+	go newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+
+	_, err := clientConn.Write([]byte("\x00\x01garbage\r\n"))
+	require.NoError(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	received, err := io.ReadAll(clientConn)
+	require.NoError(t, err)
+
+	page := string(tarpitResponse(cfg))
+	assert.True(t, strings.HasPrefix(page, string(received[:min(len(received), 60)])), "unexpected response %q", received)
+	assert.True(t, strings.HasPrefix(string(received), "HTTP/1.1 200 OK\r\nServer: nginx/"), "unexpected response %q", received)
+	assert.Less(t, len(received), len(page)-1, "the response never completes")
+}
+
+// TestTarpitResponse checks which response is dribbled in each stealth mode.
+func TestTarpitResponse(t *testing.T) {
+	testCases := []struct {
+		name        string
+		cfg         *config.Config
+		expectedHas string
+	}{
+		{name: "Disabled", cfg: &config.Config{StealthMode: config.StealthNginx}},
+		{name: "Nginx", cfg: &config.Config{StealthMode: config.StealthNginx, TarpitDribble: true}, expectedHas: "Server: nginx/"},
+		{name: "Apache", cfg: &config.Config{StealthMode: config.StealthApache, TarpitDribble: true}, expectedHas: "Server: Apache/"},
+		{name: "Apache release", cfg: &config.Config{Domain: "example.org", StealthMode: config.StealthApache, TarpitDribble: true}, expectedHas: "Server: " + stealth.ServerVersion(stealth.ApacheServer, "example.org") + "\r\n"},
+		{name: "OpenResty", cfg: &config.Config{StealthMode: config.StealthOpenResty, TarpitDribble: true}, expectedHas: "Server: openresty/"},
+		{name: "LiteSpeed", cfg: &config.Config{StealthMode: config.StealthLiteSpeed, TarpitDribble: true}, expectedHas: "Server: LiteSpeed\r\n"},
+		{name: "Lighttpd", cfg: &config.Config{StealthMode: config.StealthLighttpd, TarpitDribble: true}, expectedHas: "Server: lighttpd/"},
+		{name: "WordPress", cfg: &config.Config{StealthMode: config.StealthWordPress, TarpitDribble: true}, expectedHas: "X-Powered-By: PHP/"},
+		{name: "Mirror", cfg: &config.Config{StealthMode: config.StealthMirror, TarpitDribble: true, Mirror: fakeMirror{"/": "<title>Bakery</title>"}}, expectedHas: "<title>Bakery</title>"},
+		{name: "Mirror, no snapshot yet", cfg: &config.Config{StealthMode: config.StealthMirror, TarpitDribble: true}, expectedHas: "Welcome to nginx!"},
+		{name: "No persona", cfg: &config.Config{StealthMode: config.StealthNone, TarpitDribble: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := tarpitResponse(tc.cfg)
+			if tc.expectedHas == "" {
+				assert.Nil(t, response)
+			} else {
+				assert.Contains(t, string(response), tc.expectedHas)
+			}
+		})
+	}
+}
+
+// TestTarpitSlots checks that the tarpit holds at most its number of slots,
+// and that connections beyond them are closed right away.
+func TestTarpitSlots(t *testing.T) {
+	shortTarpit(t, 2, time.Minute)
+	fullBefore := stats.Default.Get("tarpit_full")
+	cfg := &config.Config{UnknownProtocolAction: config.UnknownTarpit}
+
+	for range 2 {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go newTestHandler(cfg, log.New(io.Discard, "", 0)).Serve(serverConn, NewConnID())
+		_, err := clientConn.Write([]byte("\x00\x01garbage\r\n"))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return heldConns() == 2 }, time.Second, 5*time.Millisecond)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	logs := &lockedBuffer{}
+	go newTestHandler(cfg, log.New(logs, "", 0)).Serve(serverConn, NewConnID())
+	start := time.Now()
+	_, err := clientConn.Write([]byte("\x00\x01garbage\r\n"))
+	require.NoError(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadAll(clientConn)
+	require.NoError(t, err)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Contains(t, logs.String(), "tarpit full, closing connection")
+	assert.Equal(t, fullBefore+1, stats.Default.Get("tarpit_full"))
+}
+
+// TestTarpitRelease checks that releasing the tarpit closes the held
+// connections and frees their slots promptly.
+func TestTarpitRelease(t *testing.T) {
+	shortTarpit(t, tarpitSlots, time.Minute)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		TarpitBanned(serverConn)
+	}()
+	require.Eventually(t, func() bool { return heldConns() == 1 }, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, 1, ReleaseTarpits())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tarpitted connection was not released")
+	}
+	assert.Zero(t, len(tarpits.slots))
+
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := clientConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
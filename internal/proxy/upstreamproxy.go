@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// errNoPinnedKey is returned when no certificate of the upstream proxy has a pinned key.
+var errNoPinnedKey = errors.New("no certificate matches the pinned public keys")
+
+// dialUpstreamProxyVia connects to the Signal proxy at addr with dial, see
+// -upstream-proxy, and completes the outer TLS handshake with it, like a
+// Signal client configured to use that proxy. The connection is dialed like
+// any upstream, through -upstream-http-proxy if set.
+func dialUpstreamProxyVia(dial dialFunc, addr string, cfg *config.Config, logger *log.Logger) (net.Conn, error) {
+	conn, err := dial(addr, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout(cfg))
+	defer cancel()
+	tlsConn := tls.Client(conn, PinnedTLSConfig(host, cfg.UpstreamProxyPins))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		stats.Inc("upstream_proxy_tls_errors")
+		return nil, fmt.Errorf("TLS handshake with upstream proxy failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// PinnedTLSConfig returns the configuration of a TLS client connection to
+// host, such as the outer TLS connection to the upstream proxy. The server
+// certificate is verified for host, against the system roots or, if pins is
+// not empty, against the pinned keys.
+func PinnedTLSConfig(host string, pins []string) *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(pins) > 0 {
+		// The pins replace the system roots, so that a self-signed certificate can be used
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPinned(rawCerts, host, pins)
+		}
+	}
+	return tlsConfig
+}
+
+// verifyPinned checks that a certificate of the chain rawCerts has one of the
+// pinned keys, and that the leaf is valid for host and chains up to it.
+func verifyPinned(rawCerts [][]byte, host string, pins []string) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return &tls.CertificateVerificationError{UnverifiedCertificates: certs, Err: err}
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return &tls.CertificateVerificationError{Err: errors.New("no certificate")}
+	}
+
+	for i, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if !slices.Contains(pins, base64.StdEncoding.EncodeToString(hash[:])) {
+			continue
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		intermediates := x509.NewCertPool()
+		for _, intermediate := range certs[1:max(i, 1)] {
+			intermediates.AddCert(intermediate)
+		}
+		opts := x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return &tls.CertificateVerificationError{UnverifiedCertificates: certs, Err: err}
+		}
+		return nil
+	}
+	return &tls.CertificateVerificationError{UnverifiedCertificates: certs, Err: errNoPinnedKey}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"signalgoproxy/internal/testutil"
+)
+
+// spkiPin returns the pin of the public key of cert.
+func spkiPin(cert tls.Certificate) string {
+	hash := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// TestVerifyPinned checks which certificate chains of the upstream proxy are
+// accepted with pinned keys.
+func TestVerifyPinned(t *testing.T) {
+	ca := testutil.Cert(t, "Test CA", nil)
+	leaf := testutil.Cert(t, "far.test", &ca)
+	selfSigned := testutil.Cert(t, "far.test", nil)
+	other := testutil.Cert(t, "other.test", nil)
+	chain := [][]byte{leaf.Certificate[0], ca.Certificate[0]}
+
+	testCases := []struct {
+		name        string
+		rawCerts    [][]byte
+		host        string
+		pins        []string
+		expectedErr string
+	}{
+		{name: "Pinned leaf", rawCerts: chain, host: "far.test", pins: []string{spkiPin(leaf)}},
+		{name: "Pinned CA", rawCerts: chain, host: "far.test", pins: []string{spkiPin(other), spkiPin(ca)}},
+		{name: "Pinned self-signed", rawCerts: [][]byte{selfSigned.Certificate[0]}, host: "far.test", pins: []string{spkiPin(selfSigned)}},
+		{name: "Wrong host", rawCerts: chain, host: "near.test", pins: []string{spkiPin(ca)}, expectedErr: "not near.test"},
+		{name: "No pinned key", rawCerts: chain, host: "far.test", pins: []string{spkiPin(other)}, expectedErr: errNoPinnedKey.Error()},
+		{name: "No certificate", host: "far.test", pins: []string{spkiPin(leaf)}, expectedErr: "no certificate"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyPinned(tc.rawCerts, tc.host, tc.pins)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var certErr *tls.CertificateVerificationError
+			assert.ErrorAs(t, err, &certErr)
+			assert.ErrorContains(t, err, tc.expectedErr)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+)
+
+// upstreamVerifyInterval is how long the verification of an upstream holds
+// before its next use verifies it again, see -verify-upstreams.
+const upstreamVerifyInterval = time.Hour
+
+// upstreamVerifications schedules the verifications of the upstreams.
+var upstreamVerifications = newVerifySchedule(upstreamVerifyInterval)
+
+// verifySchedule tracks when each upstream was last verified. It is safe for
+// concurrent use.
+type verifySchedule struct {
+	interval time.Duration
+	now      func() time.Time
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// newVerifySchedule creates a schedule verifying each upstream at most once
+// per interval.
+func newVerifySchedule(interval time.Duration) *verifySchedule {
+	return &verifySchedule{
+		interval: interval,
+		now:      time.Now,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// due reports whether addr was not verified within the interval, and if so
+// records that its verification starts now.
+func (s *verifySchedule) due(addr string) bool {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.last[addr]; ok && now.Sub(last) < s.interval {
+		return false
+	}
+	s.last[addr] = now
+	return true
+}
+
+// forget makes the next use of addr verify it again.
+func (s *verifySchedule) forget(addr string) {
+	s.mu.Lock()
+	delete(s.last, addr)
+	s.mu.Unlock()
+}
+
+// verifyUpstreamInBackground verifies the certificate of the upstream at addr
+// for serverName in the background, if -verify-upstreams is set and addr was
+// not verified within the last upstreamVerifyInterval. The outcome is only
+// logged and counted in st: the relayed connection is left alone, as the
+// client verifies the upstream itself. The upstream is dialed with dial.
+func verifyUpstreamInBackground(addr, serverName string, dial dialFunc, st *stats.Stats, cfg *config.Config, logger *log.Logger) {
+	if !cfg.VerifyUpstreams || !upstreamVerifications.due(addr) {
+		return
+	}
+	go func() {
+		err := verifyUpstream(addr, serverName, dial, cfg)
+		switch {
+		case err == nil:
+			logger.Printf("Verified the certificate of upstream %s for %s", addr, serverName)
+			st.Inc("upstream_verified")
+		case dialErrorClass(err) == "certificate":
+			logger.Printf("WARNING: Upstream %s presented an invalid certificate for %s, DNS or routing to it may be tampered with: %v", addr, serverName, err)
+			st.Inc("upstream_verify_failed")
+		default:
+			// An unreachable upstream says nothing about its identity, retry on next use
+			upstreamVerifications.forget(addr)
+			logger.Printf("Could not verify upstream %s: %v", addr, err)
+			st.Inc("upstream_verify_errors")
+		}
+	}()
+}
+
+// verifyUpstream connects to the upstream at addr with dial, the dialer of
+// proxied connections, and completes a TLS handshake for serverName. The
+// certificate is verified for serverName, against the system roots or, with
+// cfg.UpstreamPins, against the pinned keys.
+func verifyUpstream(addr, serverName string, dial dialFunc, cfg *config.Config) error {
+	// The dial log lines would be mistaken for those of the relayed connection
+	conn, err := dial(addr, cfg, log.New(io.Discard, "", 0))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout(cfg))
+	defer cancel()
+	return tls.Client(conn, PinnedTLSConfig(serverName, cfg.UpstreamPins)).HandshakeContext(ctx)
+}
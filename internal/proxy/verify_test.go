@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+	"signalgoproxy/internal/testutil"
+)
+
+// startTLSUpstream starts a TLS server presenting cert, standing in for a
+// Signal server, and returns its address.
+func startTLSUpstream(t *testing.T, cert tls.Certificate) string {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// TestVerifyUpstream checks the verification of upstream certificates with
+// and without pins.
+func TestVerifyUpstream(t *testing.T) {
+	const sni = "verify.test"
+	cert := testutil.Cert(t, sni, nil)
+	addr := startTLSUpstream(t, cert)
+	other := testutil.Cert(t, sni, nil)
+
+	testCases := []struct {
+		name          string
+		addr          string
+		serverName    string
+		pins          []string
+		expectedClass string
+	}{
+		{name: "Pinned key", addr: addr, serverName: sni, pins: []string{spkiPin(cert)}},
+		{name: "Other key", addr: addr, serverName: sni, pins: []string{spkiPin(other)}, expectedClass: "certificate"},
+		{name: "Other name", addr: addr, serverName: "impostor.test", pins: []string{spkiPin(cert)}, expectedClass: "certificate"},
+		{name: "System roots", addr: addr, serverName: sni, expectedClass: "certificate"},
+		{name: "Unreachable", addr: closedAddr(t), serverName: sni, pins: []string{spkiPin(cert)}, expectedClass: "refused"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyUpstream(tc.addr, tc.serverName, dialUpstream, &config.Config{VerifyUpstreams: true, UpstreamPins: tc.pins})
+			if tc.expectedClass == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tc.expectedClass, dialErrorClass(err))
+		})
+	}
+}
+
+// TestVerifyUpstreamHTTPProxy checks that verifications use the configured
+// upstream HTTP proxy, like proxied connections.
+func TestVerifyUpstreamHTTPProxy(t *testing.T) {
+	cert := testutil.Cert(t, "verify-proxy.test", nil)
+	addr := startTLSUpstream(t, cert)
+	proxyAddr, tunnels := startConnectProxy(t, "")
+
+	cfg := &config.Config{
+		VerifyUpstreams:   true,
+		UpstreamPins:      []string{spkiPin(cert)},
+		UpstreamHTTPProxy: "http://" + proxyAddr,
+	}
+	require.NoError(t, verifyUpstream(addr, "verify-proxy.test", dialUpstream, cfg))
+	assert.Equal(t, int32(1), tunnels.Load())
+}
+
+// TestVerifySchedule checks that an upstream is verified on first use and
+// again once the interval passed.
+func TestVerifySchedule(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	schedule := newVerifySchedule(time.Hour)
+	schedule.now = func() time.Time { return now }
+
+	assert.True(t, schedule.due("a:443"))
+	assert.False(t, schedule.due("a:443"))
+	assert.True(t, schedule.due("b:443"))
+
+	now = now.Add(59 * time.Minute)
+	assert.False(t, schedule.due("a:443"))
+	now = now.Add(time.Minute)
+	assert.True(t, schedule.due("a:443"))
+
+	schedule.forget("b:443")
+	assert.True(t, schedule.due("b:443"))
+}
+
+// TestVerifyUpstreamInBackground checks that connections to an impostor are
+// still relayed, while the failed verification raises an alarm once. The
+// verification is dialed with the dialer of the handler and counted in its
+// stats.
+func TestVerifyUpstreamInBackground(t *testing.T) {
+	const sni = "impostor-verify.test"
+	addr := startTLSUpstream(t, testutil.Cert(t, sni, nil))
+	defer upstreamVerifications.forget(addr)
+	cfg := &config.Config{
+		Upstreams:       map[string]string{sni: addr},
+		VerifyUpstreams: true,
+		UpstreamPins:    []string{spkiPin(testutil.Cert(t, sni, nil))},
+	}
+	logs := &lockedBuffer{}
+	dialer := &countingDialer{}
+	st := stats.New()
+
+	for range 2 {
+		clientConn, serverConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h := newTestHandler(cfg, log.New(logs, "", 0))
+			h.Dialer = dialer
+			h.Stats = st
+			h.Serve(serverConn, NewConnID())
+		}()
+		_, err := clientConn.Write(buildTestClientHello(t, sni))
+		require.NoError(t, err)
+		// The upstream answers the relayed ClientHello
+		clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(clientConn, make([]byte, 5))
+		require.NoError(t, err)
+		clientConn.Close()
+		<-done
+	}
+
+	require.Eventually(t, func() bool {
+		return st.Get("upstream_verify_failed") == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	// Two relayed connections and one verification
+	assert.Equal(t, int32(3), dialer.dials.Load())
+	assert.Contains(t, logs.String(), "WARNING: Upstream "+addr+" presented an invalid certificate for "+sni)
+	assert.Equal(t, 1, strings.Count(logs.String(), "WARNING"))
+}
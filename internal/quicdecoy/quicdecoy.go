@@ -0,0 +1,143 @@
+// Package quicdecoy answers QUIC probes on UDP so that the proxy does not stand out
+// by being silent where a modern web server would speak HTTP/3.
+//
+// Only Version Negotiation is implemented (RFC 9000, Section 6): long-header packets
+// carrying a version we do not advertise get a Version Negotiation packet listing
+// QUIC v1 and v2. Packets for an advertised version are dropped, since answering
+// them would require terminating a real QUIC handshake.
+package quicdecoy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+
+	"signalgoproxy/internal/stats"
+)
+
+// minInitialSize is the smallest datagram answered. RFC 9000 requires servers to
+// drop smaller packets with unsupported versions to limit amplification.
+const minInitialSize = 1200
+
+// maxConnIDLen is the longest connection ID allowed for QUIC v1.
+const maxConnIDLen = 20
+
+// supportedVersions are the versions advertised in Version Negotiation packets.
+var supportedVersions = []uint32{
+	0x00000001, // QUIC v1
+	0x6b3343cf, // QUIC v2
+}
+
+// Responder answers QUIC probes on a UDP socket.
+type Responder struct {
+	conn net.PacketConn
+	log  *log.Logger
+}
+
+// Listen opens the UDP socket for the responder. Errors are logged to logger.
+func Listen(addr string, logger *log.Logger) (*Responder, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Responder{conn: conn, log: logger}, nil
+}
+
+// Addr returns the local address of the responder.
+func (r *Responder) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Serve answers incoming packets until the responder is closed.
+func (r *Responder) Serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.log.Printf("QUIC decoy read error: %v", err)
+			continue
+		}
+
+		response, ok := versionNegotiation(buf[:n])
+		if !ok {
+			stats.Inc("quic_dropped")
+			continue
+		}
+		if _, err := r.conn.WriteTo(response, addr); err != nil {
+			r.log.Printf("QUIC decoy write error to %s: %v", addr, err)
+			continue
+		}
+		stats.Inc("quic_version_negotiations")
+	}
+}
+
+// Close stops the responder.
+func (r *Responder) Close() error {
+	return r.conn.Close()
+}
+
+// versionNegotiation builds the Version Negotiation response for packet, if one is due.
+func versionNegotiation(packet []byte) ([]byte, bool) {
+	if len(packet) < minInitialSize {
+		return nil, false
+	}
+	// Only long-header packets carry a version.
+	if packet[0]&0x80 == 0 {
+		return nil, false
+	}
+
+	p := packet[1:]
+	if len(p) < 5 {
+		return nil, false
+	}
+	version := binary.BigEndian.Uint32(p)
+	p = p[4:]
+	// Never answer a Version Negotiation packet, or a version we advertise.
+	if version == 0 || isSupported(version) {
+		return nil, false
+	}
+
+	dcidLen := int(p[0])
+	if dcidLen > maxConnIDLen || len(p) < 1+dcidLen+1 {
+		return nil, false
+	}
+	dcid := p[1 : 1+dcidLen]
+	p = p[1+dcidLen:]
+
+	scidLen := int(p[0])
+	if scidLen > maxConnIDLen || len(p) < 1+scidLen {
+		return nil, false
+	}
+	scid := p[1 : 1+scidLen]
+
+	var first [1]byte
+	rand.Read(first[:])
+
+	// The response echoes the connection IDs with source and destination swapped.
+	response := make([]byte, 0, 7+len(scid)+len(dcid)+4*len(supportedVersions))
+	response = append(response, first[0]|0x80)
+	response = binary.BigEndian.AppendUint32(response, 0)
+	response = append(response, byte(len(scid)))
+	response = append(response, scid...)
+	response = append(response, byte(len(dcid)))
+	response = append(response, dcid...)
+	for _, v := range supportedVersions {
+		response = binary.BigEndian.AppendUint32(response, v)
+	}
+	return response, true
+}
+
+// isSupported reports whether version is advertised by the responder.
+func isSupported(version uint32) bool {
+	for _, v := range supportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package quicdecoy
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildLongHeader builds a padded long-header packet with the given version and connection IDs.
+func buildLongHeader(version uint32, dcid, scid []byte, size int) []byte {
+	packet := []byte{0xc0}
+	packet = binary.BigEndian.AppendUint32(packet, version)
+	packet = append(packet, byte(len(dcid)))
+	packet = append(packet, dcid...)
+	packet = append(packet, byte(len(scid)))
+	packet = append(packet, scid...)
+	for len(packet) < size {
+		packet = append(packet, 0)
+	}
+	return packet
+}
+
+// TestVersionNegotiation checks when a response is due and its layout.
+func TestVersionNegotiation(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	scid := []byte{9, 10, 11, 12}
+
+	testCases := []struct {
+		name     string
+		packet   []byte
+		expectVN bool
+	}{
+		{
+			name:     "Reserved version probe",
+			packet:   buildLongHeader(0x1a2a3a4a, dcid, scid, 1200),
+			expectVN: true,
+		},
+		{
+			name:     "QUIC v1 is not negotiated",
+			packet:   buildLongHeader(0x00000001, dcid, scid, 1200),
+			expectVN: false,
+		},
+		{
+			name:     "Version Negotiation is never answered",
+			packet:   buildLongHeader(0, dcid, scid, 1200),
+			expectVN: false,
+		},
+		{
+			name:     "Small datagram is dropped",
+			packet:   buildLongHeader(0x1a2a3a4a, dcid, scid, 100),
+			expectVN: false,
+		},
+		{
+			name:     "Short header is dropped",
+			packet:   append([]byte{0x40}, make([]byte, 1199)...),
+			expectVN: false,
+		},
+		{
+			name:     "Oversized connection ID",
+			packet:   buildLongHeader(0x1a2a3a4a, make([]byte, 21), scid, 1200),
+			expectVN: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, ok := versionNegotiation(tc.packet)
+			require.Equal(t, tc.expectVN, ok)
+			if !ok {
+				return
+			}
+
+			assert.NotZero(t, response[0]&0x80, "long header bit must be set")
+			assert.Equal(t, uint32(0), binary.BigEndian.Uint32(response[1:5]))
+			p := response[5:]
+			assert.Equal(t, scid, p[1:1+int(p[0])], "destination must be the client's source ID")
+			p = p[1+int(p[0]):]
+			assert.Equal(t, dcid, p[1:1+int(p[0])], "source must be the client's destination ID")
+			p = p[1+int(p[0]):]
+			require.Len(t, p, 8)
+			assert.Equal(t, uint32(1), binary.BigEndian.Uint32(p[0:4]))
+			assert.Equal(t, uint32(0x6b3343cf), binary.BigEndian.Uint32(p[4:8]))
+		})
+	}
+}
+
+// TestResponderServe exchanges packets with a running responder over loopback.
+func TestResponderServe(t *testing.T) {
+	r, err := Listen("127.0.0.1:0", log.Default())
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Serve()
+	}()
+
+	client, err := net.Dial("udp", r.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write(buildLongHeader(0x0a0a0a0a, []byte{1, 2}, []byte{3}, 1200))
+	require.NoError(t, err)
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(buf[1:5]))
+	assert.Equal(t, 5+1+1+1+2+8, n)
+
+	require.NoError(t, r.Close())
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+}
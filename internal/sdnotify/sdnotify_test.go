@@ -0,0 +1,62 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNotify checks that states are delivered as datagrams to NOTIFY_SOCKET.
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	for _, state := range []string{Ready, Reloading, Stopping} {
+		require.NoError(t, Notify(state))
+
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, state, string(buf[:n]))
+	}
+}
+
+// TestNotifyWithoutSocket checks that notifications are skipped outside systemd.
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.NoError(t, Notify(Ready))
+}
+
+// TestWatchdogInterval checks parsing of the watchdog environment variables.
+func TestWatchdogInterval(t *testing.T) {
+	testCases := []struct {
+		name     string
+		usec     string
+		pid      string
+		expected time.Duration
+	}{
+		{name: "Unset", expected: 0},
+		{name: "Enabled", usec: "30000000", expected: 30 * time.Second},
+		{name: "Own PID", usec: "2000000", pid: strconv.Itoa(os.Getpid()), expected: 2 * time.Second},
+		{name: "Other PID", usec: "2000000", pid: "1", expected: 0},
+		{name: "Invalid", usec: "soon", expected: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tc.usec)
+			t.Setenv("WATCHDOG_PID", tc.pid)
+			assert.Equal(t, tc.expected, WatchdogInterval())
+		})
+	}
+}
@@ -0,0 +1,227 @@
+// Package selftest implements the "selftest" subcommand, which verifies a deployed
+// proxy end to end without needing a Signal client.
+package selftest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// options holds the parameters shared by all checks.
+type options struct {
+	addr       string
+	serverName string
+	sni        string
+	persona    string
+	timeout    time.Duration
+	insecure   bool
+	rootCAs    *x509.CertPool
+}
+
+// check is a single named verification step.
+type check struct {
+	name string
+	run  func(o *options) error
+}
+
+// checks lists the verification steps in the order they are executed.
+var checks = []check{
+	{"outer TLS handshake", checkOuterTLS},
+	{"Signal routing via inner TLS", checkSignalRoute},
+	{"stealth page", checkStealth},
+}
+
+// Run executes the selftest subcommand with the given arguments and returns the exit code.
+func Run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	o := &options{}
+	fs.StringVar(&o.addr, "addr", "", "Address of the proxy to test, e.g. 'myproxy.example.com:443' (required).")
+	fs.StringVar(&o.sni, "sni", "chat.signal.org", "Inner SNI to request through the proxy.")
+	fs.StringVar(&o.persona, "stealth-mode", "nginx", "Expected stealth mode: 'none', 'nginx', 'apache', 'lighttpd', 'openresty', 'litespeed', 'autoindex', 'wordpress', 'mirror', 'error', or 'proxy'.")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "Timeout for each check.")
+	fs.BoolVar(&o.insecure, "insecure", false, "Skip verification of the proxy's certificate.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if o.addr == "" {
+		fmt.Fprintln(stderr, "The -addr flag is required.")
+		fs.Usage()
+		return 2
+	}
+	host, _, err := net.SplitHostPort(o.addr)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid address '%s': %v\n", o.addr, err)
+		return 2
+	}
+	o.serverName = host
+
+	return runChecks(o, stdout)
+}
+
+// runChecks runs every check, prints a pass/fail line for each, and returns
+// a nonzero exit code if any of them failed.
+func runChecks(o *options, out io.Writer) int {
+	failed := 0
+	for _, c := range checks {
+		start := time.Now()
+		err := c.run(o)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL  %s (%s): %v\n", c.name, elapsed, err)
+			continue
+		}
+		fmt.Fprintf(out, "PASS  %s (%s)\n", c.name, elapsed)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(out, "%d of %d checks failed.\n", failed, len(checks))
+		return 1
+	}
+	fmt.Fprintf(out, "All %d checks passed.\n", len(checks))
+	return 0
+}
+
+// dialOuter establishes the outer TLS connection to the proxy.
+func dialOuter(o *options) (*tls.Conn, error) {
+	dialer := &net.Dialer{Timeout: o.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", o.addr, &tls.Config{
+		ServerName:         o.serverName,
+		RootCAs:            o.rootCAs,
+		InsecureSkipVerify: o.insecure,
+		NextProtos:         []string{"http/1.1"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(o.timeout))
+	return conn, nil
+}
+
+// checkOuterTLS verifies that the proxy completes a TLS handshake with a valid certificate.
+func checkOuterTLS(o *options) error {
+	conn, err := dialOuter(o)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkSignalRoute sends an inner ClientHello through the proxy and verifies that
+// a ServerHello with a certificate for the requested SNI comes back.
+func checkSignalRoute(o *options) error {
+	outer, err := dialOuter(o)
+	if err != nil {
+		return fmt.Errorf("outer handshake failed: %w", err)
+	}
+	defer outer.Close()
+
+	// Signal's servers use certificates from Signal's own CA, so the chain is not
+	// verified against the system roots. The leaf must still match the SNI.
+	inner := tls.Client(outer, &tls.Config{
+		ServerName:         o.sni,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no certificate presented")
+			}
+			return cs.PeerCertificates[0].VerifyHostname(o.sni)
+		},
+	})
+	if err := inner.Handshake(); err != nil {
+		return fmt.Errorf("inner handshake for %s failed: %w", o.sni, err)
+	}
+	return inner.Close()
+}
+
+// checkStealth issues a plain GET and verifies that the response matches the expected persona.
+func checkStealth(o *options) error {
+	conn, err := dialOuter(o)
+	if err != nil {
+		return fmt.Errorf("outer handshake failed: %w", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+o.serverName+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if o.persona == "none" {
+		if err == nil {
+			resp.Body.Close()
+			return fmt.Errorf("expected the connection to be closed, got %s", resp.Status)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	server := resp.Header.Get("Server")
+	switch o.persona {
+	case "nginx":
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(server, "nginx") {
+			return fmt.Errorf("expected nginx welcome page, got %s from server '%s'", resp.Status, server)
+		}
+	case "apache":
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(server, "Apache") {
+			return fmt.Errorf("expected Apache default page, got %s from server '%s'", resp.Status, server)
+		}
+	case "lighttpd":
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(server, "lighttpd") {
+			return fmt.Errorf("expected lighttpd placeholder page, got %s from server '%s'", resp.Status, server)
+		}
+	case "openresty":
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(server, "openresty") {
+			return fmt.Errorf("expected OpenResty welcome page, got %s from server '%s'", resp.Status, server)
+		}
+	case "litespeed":
+		if resp.StatusCode != http.StatusOK || server != "LiteSpeed" {
+			return fmt.Errorf("expected LiteSpeed default page, got %s from server '%s'", resp.Status, server)
+		}
+	case "autoindex":
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(server, "nginx") || !strings.Contains(string(body), "<title>Index of /</title>") {
+			return fmt.Errorf("expected nginx directory listing, got %s from server '%s'", resp.Status, server)
+		}
+	case "wordpress":
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(server, "nginx") || !strings.Contains(string(body), `content="WordPress`) {
+			return fmt.Errorf("expected WordPress front page, got %s from server '%s'", resp.Status, server)
+		}
+	case "mirror":
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(server, "nginx") {
+			return fmt.Errorf("expected mirrored front page, got %s from server '%s'", resp.Status, server)
+		}
+	case "error":
+		if resp.StatusCode < 500 || !strings.HasPrefix(server, "nginx") {
+			return fmt.Errorf("expected nginx error page, got %s from server '%s'", resp.Status, server)
+		}
+	case "proxy":
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("proxied site returned %s", resp.Status)
+		}
+	default:
+		return fmt.Errorf("unknown stealth mode '%s'", o.persona)
+	}
+	return nil
+}
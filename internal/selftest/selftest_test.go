@@ -0,0 +1,133 @@
+package selftest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/stealth"
+	"signalgoproxy/internal/testutil"
+)
+
+// bufferedConn replays bytes already read into a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// startFakeProxy starts a TLS listener that behaves like a deployed proxy: inner
+// TLS is terminated with a certificate for innerHost, HTTP gets the nginx page.
+func startFakeProxy(t *testing.T, outerCert, innerCert tls.Certificate) string {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{outerCert}})
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				first, err := r.Peek(1)
+				if err != nil {
+					return
+				}
+				if first[0] == 0x16 {
+					inner := tls.Server(bufferedConn{conn, r}, &tls.Config{Certificates: []tls.Certificate{innerCert}})
+					inner.Handshake()
+					inner.Close()
+					return
+				}
+				conn.Write(stealth.GetNginxResponse("example.com").Bytes())
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// TestRunChecks runs all checks against an in-process fake proxy.
+func TestRunChecks(t *testing.T) {
+	outerCert := testutil.Cert(t, "proxy.test", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(outerCert.Leaf)
+
+	testCases := []struct {
+		name         string
+		innerHost    string
+		persona      string
+		expectedCode int
+		expectedOut  []string
+	}{
+		{
+			name:         "All checks pass",
+			innerHost:    "chat.signal.org",
+			persona:      "nginx",
+			expectedCode: 0,
+			expectedOut:  []string{"PASS  outer TLS handshake", "PASS  Signal routing", "PASS  stealth page"},
+		},
+		{
+			name:         "Wrong inner certificate",
+			innerHost:    "impostor.example",
+			persona:      "nginx",
+			expectedCode: 1,
+			expectedOut:  []string{"FAIL  Signal routing", "PASS  stealth page", "1 of 3 checks failed"},
+		},
+		{
+			name:         "Wrong persona",
+			innerHost:    "chat.signal.org",
+			persona:      "apache",
+			expectedCode: 1,
+			expectedOut:  []string{"PASS  Signal routing", "FAIL  stealth page"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := startFakeProxy(t, outerCert, testutil.Cert(t, tc.innerHost, nil))
+
+			o := &options{
+				addr:       addr,
+				serverName: "proxy.test",
+				sni:        "chat.signal.org",
+				persona:    tc.persona,
+				timeout:    5 * time.Second,
+				rootCAs:    roots,
+			}
+			var out bytes.Buffer
+			code := runChecks(o, &out)
+
+			assert.Equal(t, tc.expectedCode, code, out.String())
+			for _, expected := range tc.expectedOut {
+				assert.Contains(t, out.String(), expected)
+			}
+		})
+	}
+}
+
+// TestRunUntrustedCertificate checks that the outer certificate is verified.
+func TestRunUntrustedCertificate(t *testing.T) {
+	addr := startFakeProxy(t, testutil.Cert(t, "proxy.test", nil), testutil.Cert(t, "chat.signal.org", nil))
+
+	var stdout, stderr bytes.Buffer
+	code := Run([]string{"-addr", addr, "-timeout", "2s"}, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "FAIL  outer TLS handshake")
+}
+
+// TestRunRequiresAddr checks argument validation.
+func TestRunRequiresAddr(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, Run(nil, &stdout, &stderr))
+}
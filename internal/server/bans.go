@@ -0,0 +1,45 @@
+package server
+
+import (
+	"time"
+
+	"signalgoproxy/internal/proxy"
+)
+
+// banSaveInterval is how often the active bans are saved to -ban-file.
+const banSaveInterval = time.Minute
+
+// loadBans restores the bans saved to -ban-file. A corrupt file is logged and
+// ignored, so that it never prevents startup; it is replaced by the next save.
+func (s *Server) loadBans() {
+	n, err := proxy.Bans.Load(s.cfg.BanFile)
+	if err != nil {
+		s.log.Printf("Failed to restore bans, starting without them: %v", err)
+		return
+	}
+	if n > 0 {
+		s.log.Printf("Restored %d bans from %s", n, s.cfg.BanFile)
+	}
+}
+
+// saveBans saves the active bans to -ban-file.
+func (s *Server) saveBans() {
+	if err := proxy.Bans.Save(s.cfg.BanFile); err != nil {
+		s.log.Printf("Failed to save bans to %s: %v", s.cfg.BanFile, err)
+	}
+}
+
+// saveBansPeriodically saves the active bans every banSaveInterval until the
+// server stops.
+func (s *Server) saveBansPeriodically() {
+	ticker := time.NewTicker(banSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.saveBans()
+		case <-s.done:
+			return
+		}
+	}
+}
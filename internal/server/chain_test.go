@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/stats"
+	"signalgoproxy/internal/testutil"
+)
+
+// startProxyInstance runs a complete proxy instance with cfg and cert on a
+// loopback port, and returns its address.
+func startProxyInstance(t *testing.T, cfg *config.Config, cert tls.Certificate) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cfg.Listen = []string{listener.Addr().String()}
+	cfg.StealthMode = config.StealthNone
+	cfg.ShutdownTimeout = time.Second
+
+	s := New(cfg)
+	s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	s.SetListeners(listener)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, s.Run(ctx))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+// captureClientHello returns the ClientHello record a TLS client sends for serverName.
+func captureClientHello(t *testing.T, serverName string) []byte {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go tls.Client(clientConn, &tls.Config{ServerName: serverName}).Handshake()
+	defer clientConn.Close()
+
+	header := make([]byte, 5)
+	_, err := io.ReadFull(serverConn, header)
+	require.NoError(t, err)
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	_, err = io.ReadFull(serverConn, record[5:])
+	require.NoError(t, err)
+	return record
+}
+
+// TestUpstreamProxyChain chains two proxy instances, and checks that a Signal
+// client of the first one reaches the upstream routed by the second one, and
+// that the second one is only trusted with the pinned key.
+func TestUpstreamProxyChain(t *testing.T) {
+	const sni = "chain.test"
+	echoAddr := testutil.StartEcho(t, nil)
+	farCert := testutil.Cert(t, "localhost", nil)
+	farAddr := startProxyInstance(t, &config.Config{
+		Domain:    "far.example",
+		Upstreams: map[string]string{sni: echoAddr},
+		Logger:    log.New(io.Discard, "", 0),
+	}, farCert)
+	_, farPort, _ := net.SplitHostPort(farAddr)
+	hash := sha256.Sum256(farCert.Leaf.RawSubjectPublicKeyInfo)
+	farPin := base64.StdEncoding.EncodeToString(hash[:])
+	otherHash := sha256.Sum256(testutil.Cert(t, "localhost", nil).Leaf.RawSubjectPublicKeyInfo)
+
+	testCases := []struct {
+		name     string
+		pins     []string
+		relayed  bool
+		expected string
+	}{
+		{name: "Pinned key", pins: []string{farPin}, relayed: true},
+		{name: "Other key", pins: []string{base64.StdEncoding.EncodeToString(otherHash[:])}, expected: "no certificate matches the pinned public keys"},
+		{name: "System roots", expected: "certificate signed by unknown authority"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs syncBuffer
+			edgeAddr := startProxyInstance(t, &config.Config{
+				Domain:            "proxy.example",
+				UpstreamProxy:     net.JoinHostPort("localhost", farPort),
+				UpstreamProxyPins: tc.pins,
+				Logger:            log.New(&logs, "", 0),
+			}, testutil.Cert(t, "proxy.example", nil))
+			tlsErrors := stats.Default.Get("upstream_proxy_tls_errors")
+
+			conn, err := tls.Dial("tcp", edgeAddr, &tls.Config{ServerName: "proxy.example", InsecureSkipVerify: true})
+			require.NoError(t, err)
+			defer conn.Close()
+			hello := captureClientHello(t, sni)
+			_, err = conn.Write(append(append([]byte{}, hello...), "ping"...))
+			require.NoError(t, err)
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if tc.relayed {
+				echoed := make([]byte, len(hello)+4)
+				_, err = io.ReadFull(conn, echoed)
+				require.NoError(t, err)
+				assert.Equal(t, append(hello, "ping"...), echoed)
+				assert.Contains(t, logs.String(), "Proxying traffic for "+sni+" to localhost:"+farPort)
+				return
+			}
+
+			received, _ := io.ReadAll(conn)
+			assert.Empty(t, received)
+			assert.Contains(t, logs.String(), "Failed to connect to upstream localhost:"+farPort+": TLS handshake with upstream proxy failed")
+			assert.Contains(t, logs.String(), tc.expected)
+			assert.Equal(t, tlsErrors+1, stats.Default.Get("upstream_proxy_tls_errors"))
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
+	"syscall"
+	"time"
+
+	"signalgoproxy/internal/admin"
+	"signalgoproxy/internal/proxy"
+)
+
+// handleStateDump waits for SIGQUIT, logs a snapshot of the proxy state, and then
+// re-raises the signal so the Go runtime performs its default stack dump and exit.
+func handleStateDump(logger *log.Logger) {
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGQUIT)
+
+	go func() {
+		<-dump
+		logger.Println("SIGQUIT received, dumping proxy state before exiting...")
+		writeStateDump(logger.Writer(), admin.TakeSnapshot(proxy.Connections), proxy.Connections.List())
+
+		debug.SetTraceback("all")
+		signal.Reset(syscall.SIGQUIT)
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			if err := p.Signal(syscall.SIGQUIT); err == nil {
+				select {} // The runtime exits from the signal handler.
+			}
+		}
+		os.Exit(2)
+	}()
+}
+
+// writeStateDump writes a human-readable snapshot of the proxy state.
+func writeStateDump(w io.Writer, snap admin.Snapshot, conns []proxy.ConnInfo) {
+	fmt.Fprintf(w, "=== State dump: uptime=%ds goroutines=%d active_connections=%d\n",
+		snap.UptimeSeconds, snap.Goroutines, snap.ActiveConnections)
+
+	cert := snap.Certificate
+	if cert.Fallback {
+		fmt.Fprintln(w, "certificate: serving self-signed fallback")
+	}
+	switch {
+	case cert.NotAfter.IsZero() && cert.LastError == "":
+		fmt.Fprintln(w, "certificate: not requested yet")
+	case cert.LastError != "":
+		fmt.Fprintf(w, "certificate: not_after=%s last_error=%q at %s\n",
+			formatTime(cert.NotAfter), cert.LastError, formatTime(cert.LastErrorAt))
+	default:
+		fmt.Fprintf(w, "certificate: not_after=%s\n", formatTime(cert.NotAfter))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(snap.Counters)) {
+		fmt.Fprintf(w, "counter %s=%d\n", name, snap.Counters[name])
+	}
+
+	for _, c := range conns {
+		fmt.Fprintf(w, "conn id=%s client=%s protocol=%s ja3=%s sni=%s upstream=%s in=%d out=%d age=%s\n",
+			c.ID, c.ClientAddr, c.Protocol, c.JA3, c.SNI, c.Upstream, c.BytesIn, c.BytesOut, c.Age.Round(time.Second))
+	}
+	fmt.Fprintln(w, "=== End of state dump")
+}
+
+// formatTime formats t for the state dump, printing "-" for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
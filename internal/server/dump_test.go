@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"signalgoproxy/internal/admin"
+	"signalgoproxy/internal/proxy"
+	"signalgoproxy/internal/stats"
+)
+
+// TestWriteStateDump checks that the dump contains every part of the snapshot.
+func TestWriteStateDump(t *testing.T) {
+	snap := admin.Snapshot{
+		UptimeSeconds:     42,
+		ActiveConnections: 1,
+		Goroutines:        7,
+		Certificate:       stats.CertStatus{NotAfter: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)},
+		Counters:          map[string]int64{"sni_denied": 3, "connections_total": 10},
+	}
+	conns := []proxy.ConnInfo{{
+		ID:         "0a1b2c3d",
+		ClientAddr: "192.0.2.1:5555",
+		Protocol:   "signal-tls",
+		JA3:        "ada70206e40642a3e4461f35503241d5",
+		SNI:        "chat.signal.org",
+		Upstream:   "chat.signal.org:443",
+		BytesIn:    100,
+		BytesOut:   200,
+		Age:        90 * time.Second,
+	}}
+
+	var buf bytes.Buffer
+	writeStateDump(&buf, snap, conns)
+	out := buf.String()
+
+	assert.Contains(t, out, "uptime=42s goroutines=7 active_connections=1")
+	assert.Contains(t, out, "certificate: not_after=2030-01-02T03:04:05Z")
+	assert.Contains(t, out, "counter connections_total=10\ncounter sni_denied=3\n")
+	assert.Contains(t, out, "conn id=0a1b2c3d client=192.0.2.1:5555 protocol=signal-tls ja3=ada70206e40642a3e4461f35503241d5 sni=chat.signal.org upstream=chat.signal.org:443 in=100 out=200 age=1m30s")
+}
+
+// TestFormatStatsLine checks the periodic stats log line.
+func TestFormatStatsLine(t *testing.T) {
+	line := formatStatsLine(admin.Snapshot{
+		UptimeSeconds:     5,
+		ActiveConnections: 2,
+		Goroutines:        9,
+		Counters:          map[string]int64{"fd_open": 40, "fd_limit": 1024, "sni_denied": 1, "ja3:ada70206e40642a3e4461f35503241d5": 4},
+		Dials: []stats.DialStats{
+			{Addr: "cdn.signal.org:443", Failures: map[string]int64{"timeout": 1}},
+			{Addr: "chat.signal.org:443", Count: 10, P50Ms: 12.3, P95Ms: 40, P99Ms: 95.1, Failures: map[string]int64{"refused": 2, "dns": 1}},
+		},
+	})
+	assert.Equal(t, "Stats: uptime=5s active_connections=2 goroutines=9 fds=40/1024 sni_denied=1 "+
+		"dial_failed:cdn.signal.org:443:timeout=1 dial_ms:chat.signal.org:443=12.3/40/95.1 "+
+		"dial_failed:chat.signal.org:443:dns=1 dial_failed:chat.signal.org:443:refused=2", line)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"signalgoproxy/internal/stats"
+)
+
+// fallbackRetryInterval is how often ACME issuance is retried while the fallback
+// certificate is served.
+const fallbackRetryInterval = time.Minute
+
+// fallbackCert serves a self-signed certificate for the configured domain while
+// ACME issuance fails, and switches back once a real certificate is obtained.
+type fallbackCert struct {
+	domain         string
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	cert           *tls.Certificate
+	log            *log.Logger
+
+	active atomic.Bool
+}
+
+// newFallbackCert creates a fallback for domain in front of getCertificate.
+func newFallbackCert(domain string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), logger *log.Logger) (*fallbackCert, error) {
+	cert, err := newSelfSignedCert(domain)
+	if err != nil {
+		return nil, err
+	}
+	return &fallbackCert{
+		domain:         domain,
+		getCertificate: getCertificate,
+		cert:           cert,
+		log:            logger,
+	}, nil
+}
+
+// GetCertificate serves the fallback certificate for the configured domain while
+// issuance fails. Other names and ACME challenges are passed through unchanged.
+func (f *fallbackCert) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !strings.EqualFold(hello.ServerName, f.domain) || slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return f.getCertificate(hello)
+	}
+	// Issuance is retried in the background rather than on every handshake
+	if f.active.Load() {
+		return f.cert, nil
+	}
+
+	cert, err := f.getCertificate(hello)
+	if err != nil {
+		f.activate(err)
+		return f.cert, nil
+	}
+	return cert, nil
+}
+
+// activate switches to the fallback certificate.
+func (f *fallbackCert) activate(err error) {
+	if f.active.Swap(true) {
+		return
+	}
+	stats.Certificate.SetFallback(true)
+	f.log.Printf("WARNING: Certificate issuance for %s failed (%v). Serving a SELF-SIGNED FALLBACK certificate; clients will not trust it until issuance succeeds.", f.domain, err)
+}
+
+// retry attempts issuance every interval while the fallback is active, until done is closed.
+func (f *fallbackCert) retry(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !f.active.Load() {
+				continue
+			}
+			if _, err := f.getCertificate(f.probeHello()); err != nil {
+				f.log.Printf("Certificate issuance for %s still failing, keeping the fallback certificate: %v", f.domain, err)
+				continue
+			}
+			f.active.Store(false)
+			stats.Certificate.SetFallback(false)
+			f.log.Printf("Certificate for %s obtained, no longer serving the fallback certificate.", f.domain)
+		case <-done:
+			return
+		}
+	}
+}
+
+// probeHello returns a ClientHello for the domain that supports ECDSA
+// certificates, matching what modern clients send.
+func (f *fallbackCert) probeHello() *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        f.domain,
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+}
+
+// newSelfSignedCert generates an in-memory self-signed certificate for domain.
+func newSelfSignedCert(domain string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+	"signalgoproxy/internal/stats"
+	"signalgoproxy/internal/testutil"
+)
+
+// TestFallbackCert checks that the fallback certificate is served while issuance
+// fails and that the background retry switches back to the issued certificate.
+func TestFallbackCert(t *testing.T) {
+	issued := testutil.Cert(t, "proxy.test", nil)
+	var failing atomic.Bool
+	failing.Store(true)
+	var calls atomic.Int32
+	getCertificate := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		calls.Add(1)
+		if failing.Load() {
+			return nil, errors.New("acme: rate limited")
+		}
+		return &issued, nil
+	}
+
+	f, err := newFallbackCert("proxy.test", getCertificate, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	t.Cleanup(func() { stats.Certificate.SetFallback(false) })
+
+	cert, err := f.GetCertificate(&tls.ClientHelloInfo{ServerName: "Proxy.Test"})
+	require.NoError(t, err)
+	assert.Same(t, f.cert, cert)
+	assert.Equal(t, []string{"proxy.test"}, cert.Leaf.DNSNames)
+	assert.True(t, stats.Certificate.Status().Fallback)
+
+	// Further handshakes do not hit the ACME path
+	_, err = f.GetCertificate(&tls.ClientHelloInfo{ServerName: "proxy.test"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Other names and ACME challenges are not covered by the fallback
+	_, err = f.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"})
+	assert.Error(t, err)
+	_, err = f.GetCertificate(&tls.ClientHelloInfo{ServerName: "proxy.test", SupportedProtos: []string{acme.ALPNProto}})
+	assert.Error(t, err)
+
+	done := make(chan struct{})
+	defer close(done)
+	go f.retry(10*time.Millisecond, done)
+
+	failing.Store(false)
+	require.Eventually(t, func() bool { return !stats.Certificate.Status().Fallback }, time.Second, 10*time.Millisecond)
+
+	cert, err = f.GetCertificate(&tls.ClientHelloInfo{ServerName: "proxy.test"})
+	require.NoError(t, err)
+	assert.Same(t, &issued, cert)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"signalgoproxy/internal/fdlimit"
+	"signalgoproxy/internal/stats"
+)
+
+// fdRefuseRatio is the share of the descriptor limit above which new connections are refused.
+const fdRefuseRatio = 0.9
+
+// fdMonitor periodically samples file descriptor usage so that the accept path
+// can refuse connections cheaply before the limit is actually hit.
+type fdMonitor struct {
+	open  func() (int, error)
+	limit func() (uint64, error)
+	log   *log.Logger
+
+	overloaded atomic.Bool
+}
+
+// newFDMonitor creates a monitor for the descriptors of the current process.
+func newFDMonitor(logger *log.Logger) *fdMonitor {
+	return &fdMonitor{
+		open:  fdlimit.Open,
+		limit: fdlimit.Limit,
+		log:   logger,
+	}
+}
+
+// refresh samples the current usage and updates the overload state.
+func (m *fdMonitor) refresh() {
+	limit, err := m.limit()
+	if err != nil || limit == 0 {
+		return
+	}
+	open, err := m.open()
+	if err != nil {
+		return
+	}
+
+	stats.Set("fd_open", int64(open))
+	stats.Set("fd_limit", int64(limit))
+
+	overloaded := float64(open) >= fdRefuseRatio*float64(limit)
+	if overloaded != m.overloaded.Swap(overloaded) {
+		if overloaded {
+			m.log.Printf("File descriptor usage at %d of %d (>= %.0f%%), refusing new connections.", open, limit, fdRefuseRatio*100)
+		} else {
+			m.log.Printf("File descriptor usage back to %d of %d, accepting new connections again.", open, limit)
+		}
+	}
+}
+
+// run refreshes the usage every second until done is closed.
+func (m *fdMonitor) run(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		m.refresh()
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// allow reports whether a new connection may be accepted.
+func (m *fdMonitor) allow() bool {
+	return !m.overloaded.Load()
+}
+
+// raiseFDLimit raises the soft descriptor limit to the hard limit and logs the result.
+func raiseFDLimit(logger *log.Logger) {
+	before, after, err := fdlimit.Raise()
+	switch {
+	case errors.Is(err, fdlimit.ErrUnsupported):
+		logger.Println("File descriptor limits are not supported on this platform, skipping.")
+	case err != nil:
+		logger.Printf("Failed to raise file descriptor limit (currently %d): %v", before, err)
+	case before != after:
+		logger.Printf("File descriptor limit raised from %d to %d.", before, after)
+	default:
+		logger.Printf("File descriptor limit is %d.", after)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFDMonitor checks the overload threshold and recovery.
+func TestFDMonitor(t *testing.T) {
+	open := 0
+	m := &fdMonitor{
+		open:  func() (int, error) { return open, nil },
+		limit: func() (uint64, error) { return 1000, nil },
+		log:   log.Default(),
+	}
+
+	open = 500
+	m.refresh()
+	assert.True(t, m.allow())
+
+	open = 900
+	m.refresh()
+	assert.False(t, m.allow(), "connections should be refused at 90% usage")
+
+	open = 899
+	m.refresh()
+	assert.True(t, m.allow())
+}
+
+// TestFDMonitorUnsupported checks that an unknown limit never refuses connections.
+func TestFDMonitorUnsupported(t *testing.T) {
+	m := &fdMonitor{
+		open:  func() (int, error) { return 5000, nil },
+		limit: func() (uint64, error) { return 0, assert.AnError },
+	}
+	m.refresh()
+	assert.True(t, m.allow())
+}
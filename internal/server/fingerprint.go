@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"signalgoproxy/internal/fingerprint"
+	"signalgoproxy/internal/proxy"
+)
+
+// fingerprintListener wraps accepted connections so that their outer
+// ClientHello can be recorded for fingerprinting.
+type fingerprintListener struct {
+	net.Listener
+}
+
+// Accept waits for the next connection and wraps it.
+func (l fingerprintListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &helloConn{Conn: conn}, nil
+}
+
+// helloConn is a client connection that records its outer ClientHello.
+type helloConn struct {
+	net.Conn
+	hello *fingerprint.ClientHello
+
+	ja3Once sync.Once
+	ja3     string
+}
+
+// CloseWrite half-closes the wrapped connection, see proxy.CloseWriter.
+func (c *helloConn) CloseWrite() error {
+	if cw, ok := c.Conn.(proxy.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the wrapped connection, so that its socket options can be set.
+func (c *helloConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// JA3 returns the JA3 fingerprint of the recorded ClientHello. It is computed on
+// first use, outside of the handshake path.
+func (c *helloConn) JA3() string {
+	c.ja3Once.Do(func() {
+		if c.hello != nil {
+			c.ja3 = c.hello.JA3()
+		}
+	})
+	return c.ja3
+}
+
+// recordClientHello makes tlsConfig record the ClientHello of helloConn
+// connections, keeping any existing GetConfigForClient hook.
+func recordClientHello(tlsConfig *tls.Config) {
+	next := tlsConfig.GetConfigForClient
+	tlsConfig.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		if conn, ok := info.Conn.(*helloConn); ok {
+			hello := fingerprint.FromClientHelloInfo(info)
+			conn.hello = &hello
+		}
+		if next != nil {
+			return next(info)
+		}
+		return nil, nil
+	}
+}
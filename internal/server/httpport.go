@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/proxy"
+	"signalgoproxy/internal/stats"
+)
+
+// sniffedConn is a connection whose first bytes were peeked to sniff its
+// protocol, and are read again from reader.
+type sniffedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// NetConn returns the wrapped connection, so that its socket options can be set.
+func (c *sniffedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite half-closes the wrapped connection, see proxy.CloseWriter.
+func (c *sniffedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(proxy.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// connListener is a net.Listener for connections accepted elsewhere and
+// handed over with serve, so that an http.Server can serve them.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newConnListener creates a listener reporting addr as its address.
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for the next connection handed over with serve.
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close makes Accept fail and serve close further connections.
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the address of the listener the connections were accepted on.
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// serve hands conn over to Accept, or closes it once the listener is closed.
+func (l *connListener) serve(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// handleHTTPPort serves a connection accepted on the port 80 listener by its
+// first bytes. Some clients and probes try TLS there when port 443 is blocked:
+// the outer TLS handshake of a Signal client is terminated with the same
+// certificates as on the TLS listeners and proxied. Anything else goes to the
+// HTTP server, which answers ACME HTTP-01 challenges.
+func (s *Server) handleHTTPPort(conn net.Conn, id string, httpConns *connListener) {
+	reader := bufio.NewReader(conn)
+	if s.cfg.SniffTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.cfg.SniffTimeout))
+	}
+	protocol, err := proxy.SniffProtocol(reader)
+	conn.SetReadDeadline(time.Time{})
+	sniffed := &sniffedConn{Conn: conn, reader: reader}
+
+	if err != nil || protocol != proxy.ProtoSignalTLS {
+		httpConns.serve(sniffed)
+		return
+	}
+	stats.Inc("http_port_tls")
+	s.handle(tls.Server(&helloConn{Conn: sniffed}, s.outerTLS), id)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"signalgoproxy/internal/sdnotify"
+)
+
+// notify sends a systemd notification, logging failures.
+func (s *Server) notify(state string) {
+	if err := sdnotify.Notify(state); err != nil {
+		s.log.Printf("Failed to send %s to systemd: %v", state, err)
+	}
+}
+
+// runWatchdog pings the systemd watchdog at half its interval until the server stops.
+func (s *Server) runWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.notify(sdnotify.Watchdog)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// OnReload registers fn to run when the server is asked to reload on SIGHUP.
+func (s *Server) OnReload(fn func() error) {
+	s.reloadHooks = append(s.reloadHooks, fn)
+}
+
+// handleReload reloads the server on SIGHUP until it stops.
+func (s *Server) handleReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			s.reload()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// reload runs the reload hooks, bracketed by systemd reload notifications.
+func (s *Server) reload() {
+	s.log.Println("Reloading...")
+	s.notify(sdnotify.Reloading)
+	for _, fn := range s.reloadHooks {
+		if err := fn(); err != nil {
+			s.log.Printf("Reload error: %v", err)
+		}
+	}
+	s.notify(sdnotify.Ready)
+	s.log.Println("Reload complete.")
+}
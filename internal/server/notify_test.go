@@ -0,0 +1,46 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+)
+
+// TestReloadNotifiesSystemd checks that reload hooks run between the RELOADING=1
+// and READY=1 notifications, even if a hook fails.
+func TestReloadNotifiesSystemd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	s := New(&config.Config{Logger: log.New(io.Discard, "", 0)})
+	var calls int
+	s.OnReload(func() error {
+		calls++
+		return assert.AnError
+	})
+	s.OnReload(func() error {
+		calls++
+		return nil
+	})
+
+	s.reload()
+	assert.Equal(t, 2, calls)
+
+	for _, expected := range []string{"RELOADING=1", "READY=1"} {
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"sync"
+	"time"
+
+	"signalgoproxy/internal/proxy"
+)
+
+// routesPollInterval is how often the upstreams file is checked for changes.
+const routesPollInterval = 2 * time.Second
+
+// routeTable serves the local routes, from the upstreams file or built in,
+// merged with those of the remote upstream list. The remote routes replace
+// built-in ones, but never those of the upstreams file.
+type routeTable struct {
+	*proxy.RouteTable
+
+	mu       sync.Mutex
+	local    *proxy.Routes
+	fromFile bool
+	remote   proxy.StaticRouter
+}
+
+// newRouteTable creates a table serving local, the routes of the upstreams
+// file if fromFile is set.
+func newRouteTable(local *proxy.Routes, fromFile bool) *routeTable {
+	return &routeTable{RouteTable: proxy.NewRouteTable(local), local: local, fromFile: fromFile}
+}
+
+// setLocal replaces the local routes.
+func (t *routeTable) setLocal(local *proxy.Routes) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.local = local
+	t.update()
+}
+
+// setRemote replaces the routes of the remote upstream list.
+func (t *routeTable) setRemote(remote proxy.StaticRouter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remote = remote
+	t.update()
+}
+
+// update stores the merged routes. t.mu must be held.
+func (t *routeTable) update() {
+	routes := &proxy.Routes{Upstreams: make(proxy.StaticRouter), Deny: t.local.Deny}
+	if !t.fromFile {
+		maps.Copy(routes.Upstreams, t.local.Upstreams)
+	}
+	maps.Copy(routes.Upstreams, t.remote)
+	if t.fromFile {
+		maps.Copy(routes.Upstreams, t.local.Upstreams)
+	}
+	t.Store(routes)
+}
+
+// routeFile keeps a route table in sync with the upstreams file.
+type routeFile struct {
+	path  string
+	table *routeTable
+	log   *log.Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// openRouteFile loads the routing map from path.
+func openRouteFile(path string, logger *log.Logger) (*routeFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := proxy.LoadRoutes(path)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("Loaded %d routes and %d denied SNI patterns from %s.", len(routes.Upstreams), len(routes.Deny), path)
+	return &routeFile{
+		path:    path,
+		table:   newRouteTable(routes, true),
+		log:     logger,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}, nil
+}
+
+// reload reads the file again and swaps in the new routing map. On error the
+// previous routing map stays in use.
+func (f *routeFile) reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if info, err := os.Stat(f.path); err == nil {
+		f.modTime, f.size = info.ModTime(), info.Size()
+	}
+	routes, err := proxy.LoadRoutes(f.path)
+	if err != nil {
+		return fmt.Errorf("keeping the previous %d routes: %w", f.table.Len(), err)
+	}
+	f.table.setLocal(routes)
+	f.log.Printf("Reloaded %d routes and %d denied SNI patterns from %s.", len(routes.Upstreams), len(routes.Deny), f.path)
+	return nil
+}
+
+// changed reports whether the file was modified since it was last read.
+func (f *routeFile) changed() bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+}
+
+// watch reloads the file whenever it changes until done is closed.
+func (f *routeFile) watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !f.changed() {
+				continue
+			}
+			if err := f.reload(); err != nil {
+				f.log.Printf("Failed to reload routes: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
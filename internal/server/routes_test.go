@@ -0,0 +1,44 @@
+package server
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRouteFileReload checks that changes to the upstreams file are picked up
+// and that a broken file keeps the previous routes.
+func TestRouteFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upstreams.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"chat.signal.org": "a.example:443"}`), 0600))
+
+	var logs syncBuffer
+	routes, err := openRouteFile(path, log.New(&logs, "", 0))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	defer close(done)
+	go routes.watch(10*time.Millisecond, done)
+
+	// A broken file is reported and the previous routes stay in use
+	require.NoError(t, os.WriteFile(path, []byte(`{"chat.signal.org": `), 0600))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "Failed to reload routes")
+	}, time.Second, 10*time.Millisecond)
+	addr, ok := routes.table.Lookup("chat.signal.org")
+	assert.True(t, ok)
+	assert.Equal(t, "a.example:443", addr)
+
+	// A fixed file replaces the routes
+	require.NoError(t, os.WriteFile(path, []byte(`{"chat.signal.org": "b.example:443"}`), 0600))
+	assert.Eventually(t, func() bool {
+		addr, _ := routes.table.Lookup("chat.signal.org")
+		return addr == "b.example:443"
+	}, time.Second, 10*time.Millisecond)
+}
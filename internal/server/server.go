@@ -5,128 +5,665 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime/debug"
 	"sync"
 	"syscall"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"signalgoproxy/internal/admin"
 	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/filelock"
+	"signalgoproxy/internal/geoip"
 	"signalgoproxy/internal/proxy"
+	"signalgoproxy/internal/quicdecoy"
+	"signalgoproxy/internal/sdnotify"
+	"signalgoproxy/internal/stats"
 )
 
+// certLockFile is the name of the lock file inside the certificate cache directory.
+const certLockFile = ".lock"
+
+// drainPollInterval is how often the connection drain checks for remaining connections.
+const drainPollInterval = 50 * time.Millisecond
+
 // Server is the main server object.
 type Server struct {
-	cfg         *config.Config
-	httpServer  *http.Server
-	tlsListener net.Listener
+	cfg          *config.Config
+	log          *log.Logger
+	tlsConfig    *tls.Config
+	listeners    []net.Listener
+	httpServer   *http.Server
+	httpListener net.Listener
+	tlsListeners []net.Listener
+	adminServer  *admin.Server
+	quicDecoy    *quicdecoy.Responder
+	fallback     *fallbackCert
+	routes       *routeFile
+	certLock     *filelock.Lock
+	fds          *fdMonitor
+	done         chan struct{}
+
+	// plainListeners accept connections whose outer TLS was terminated in
+	// front of the proxy.
+	plainListeners []net.Listener
+
+	// upstreamList keeps the routes up to date with -upstream-list-url.
+	upstreamList *upstreamList
+
+	// captures writes the captures of -debug-capture.
+	captures *proxy.CaptureLog
+
+	// mirror keeps the snapshot of -mirror-url served by the mirror stealth
+	// mode.
+	mirror *proxy.Mirror
+
+	// outerTLS is the configuration of the outer TLS connection, also used
+	// for TLS arriving on the port 80 listener.
+	outerTLS *tls.Config
+
+	// reloadHooks run on SIGHUP.
+	reloadHooks []func() error
+
+	// handler serves an accepted connection under its ID. Run sets it to a
+	// proxy.Handler unless a test replaced it.
+	handler func(conn net.Conn, id string)
 }
 
 // New creates a new server instance.
 func New(cfg *config.Config) *Server {
+	logger := cfg.Log()
 	return &Server{
-		cfg: cfg,
+		cfg:  cfg,
+		log:  logger,
+		fds:  newFDMonitor(logger),
+		done: make(chan struct{}),
 	}
 }
 
-// Start launches all necessary listeners and waits for a shutdown signal.
-func (s *Server) Start() {
-	log.Println("Stage 1: Initializing...")
+// SetTLSConfig makes the server use tlsConfig for the outer TLS connection instead
+// of obtaining certificates via ACME. The ACME HTTP-01 listener is not started.
+func (s *Server) SetTLSConfig(tlsConfig *tls.Config) {
+	s.tlsConfig = tlsConfig
+}
+
+// SetListeners makes the server accept on the given TCP listeners instead of
+// binding the configured listen addresses. The server takes ownership of them.
+func (s *Server) SetListeners(listeners ...net.Listener) {
+	s.listeners = listeners
+}
+
+// Start launches all necessary listeners and serves until SIGINT or SIGTERM,
+// reloading on SIGHUP. It returns an error if a listener cannot be bound.
+func (s *Server) Start() error {
+	s.log.Printf("Configuration loaded for domain '%s' with stealth mode '%s'", s.cfg.Domain, s.cfg.StealthMode)
+
+	// Each proxied connection needs at least two descriptors
+	raiseFDLimit(s.log)
+
+	// Dump the proxy state on SIGQUIT before the default stack dump
+	handleStateDump(s.log)
+
+	// Reload on SIGHUP
+	go s.handleReload()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	certManager := &autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(s.cfg.Domain),
-		Cache:      autocert.DirCache("certs"),
+	return s.Run(ctx)
+}
+
+// Run binds all listeners, serves until ctx is cancelled, and then shuts down gracefully.
+func (s *Server) Run(ctx context.Context) error {
+	s.log.Println("Stage 1: Initializing...")
+
+	if err := s.listen(); err != nil {
+		s.closeListeners()
+		return err
 	}
 
-	tlsConfig := &tls.Config{
-		GetCertificate: certManager.GetCertificate,
-		NextProtos:     []string{"http/1.1", "acme-tls/1"},
+	// --- Stage 2: Startup ---
+	s.log.Println("Stage 2: Starting services...")
+	var wg sync.WaitGroup
+
+	// One handler serves all listeners, with the router set up by listen, and
+	// dials the health checks
+	handler := proxy.NewHandler(s.cfg)
+	if s.handler == nil {
+		s.handler = handler.Serve
 	}
 
-	// Create an HTTP server for the ACME challenge
-	s.httpServer = &http.Server{
-		Addr:    ":80",
-		Handler: certManager.HTTPHandler(nil),
+	if s.httpServer != nil {
+		// Connections are sniffed first, TLS on port 80 is proxied instead
+		httpConns := newConnListener(s.httpListener.Addr())
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.log.Printf("Starting HTTP server on %s for ACME challenges.", s.httpListener.Addr())
+			if err := s.httpServer.Serve(httpConns); !errors.Is(err, http.ErrServerClosed) {
+				s.log.Printf("HTTP server error: %v", err)
+			}
+			s.log.Println("HTTP server stopped.")
+		}()
+		go func() {
+			defer wg.Done()
+			s.acceptLoop(s.httpListener, func(conn net.Conn, id string) {
+				s.handleHTTPPort(conn, id, httpConns)
+			})
+		}()
 	}
 
-	// Create a TLS listener
-	listener, err := tls.Listen("tcp", ":443", tlsConfig)
-	if err != nil {
-		log.Fatalf("Failed to listen on :443: %v", err)
+	for _, listener := range s.tlsListeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			s.log.Printf("Starting Signal TLS Proxy on %s.", listener.Addr())
+			s.acceptLoop(listener, s.handle)
+			s.log.Printf("TLS proxy on %s stopped.", listener.Addr())
+		}(listener)
 	}
-	s.tlsListener = listener
 
-	// --- Stage 2: Startup ---
-	log.Println("Stage 2: Starting services...")
-	var wg sync.WaitGroup
-	wg.Add(2)
+	for _, listener := range s.plainListeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			s.log.Printf("Starting plaintext proxy on %s.", listener.Addr())
+			s.acceptLoop(listener, s.handlePlain)
+			s.log.Printf("Plaintext proxy on %s stopped.", listener.Addr())
+		}(listener)
+	}
 
-	go func() {
-		defer wg.Done()
-		log.Println("Starting HTTP server on :80 for ACME challenges.")
-		if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
-		}
-		log.Println("HTTP server stopped.")
-	}()
+	if s.quicDecoy != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.log.Printf("Starting QUIC decoy responder on UDP %s.", s.quicDecoy.Addr())
+			s.quicDecoy.Serve()
+			s.log.Println("QUIC decoy responder stopped.")
+		}()
+	}
 
-	go func() {
-		defer wg.Done()
-		log.Println("Starting Signal TLS Proxy on :443.")
-		s.acceptLoop()
-		log.Println("TLS proxy stopped.")
-	}()
+	if s.adminServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.adminServer.Serve()
+		}()
+	}
 
-	// --- Stage 3: Running ---
-	log.Println("Stage 3: Running. Waiting for shutdown signal...")
+	go s.fds.run(s.done)
+	go proxy.WarmDNSCache(s.cfg)
+	if s.cfg.UpstreamCheckInterval > 0 {
+		go s.checkUpstreamsPeriodically(handler, s.cfg.UpstreamCheckInterval)
+	}
+	if s.fallback != nil {
+		go s.fallback.retry(fallbackRetryInterval, s.done)
+	}
+	if s.routes != nil {
+		go s.routes.watch(routesPollInterval, s.done)
+	}
+	if s.upstreamList != nil {
+		go s.upstreamList.run(s.done)
+	}
+	if s.captures != nil {
+		go s.captures.Run(s.done, s.log)
+	}
+	if s.mirror != nil {
+		go s.mirror.Run(s.done, s.log)
+	}
+	if s.cfg.BanFile != "" {
+		go s.saveBansPeriodically()
+	}
+	if s.cfg.StatsInterval > 0 {
+		go s.logStatsPeriodically(s.cfg.StatsInterval)
+	}
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	// Tell systemd we are ready now that every listener is bound
+	s.notify(sdnotify.Ready)
+	if interval := sdnotify.WatchdogInterval(); interval > 0 {
+		s.log.Printf("systemd watchdog enabled, pinging every %s.", interval/2)
+		go s.runWatchdog(interval)
+	}
+
+	// --- Stage 3: Running ---
+	s.log.Println("Stage 3: Running. Waiting for shutdown signal...")
+	<-ctx.Done()
 
-	log.Println("Shutdown signal received...")
+	s.log.Println("Shutdown signal received...")
 	s.stop()
 
 	// Wait for all goroutines to finish
 	wg.Wait()
-	log.Println("Server shut down gracefully.")
+	s.log.Println("Server shut down gracefully.")
+	return nil
+}
+
+// localUpstreams returns the routing map used without an upstreams file.
+func (s *Server) localUpstreams() map[string]string {
+	if s.cfg.Upstreams != nil {
+		return s.cfg.Upstreams
+	}
+	return proxy.DefaultUpstreams()
+}
+
+// reloadStealthRates applies the rate limits of the stealth rate file. On
+// error the previous limits stay in force.
+func (s *Server) reloadStealthRates() error {
+	rates, err := proxy.LoadStealthRates(s.cfg.StealthRateFile, s.cfg)
+	if err != nil {
+		return fmt.Errorf("keeping the previous stealth rate limits: %w", err)
+	}
+	proxy.SetStealthRates(rates)
+	s.log.Printf("Loaded stealth rate limits from %s: %d requests per minute per source, %d per second in all.", s.cfg.StealthRateFile, rates.PerSource, rates.Global)
+	return nil
+}
+
+// listen creates the TLS configuration and binds every listener.
+func (s *Server) listen() error {
+	// The addresses of this host may have changed along with the configuration
+	s.OnReload(proxy.RefreshLocalAddrs)
+
+	// Load the routing map before accepting connections that need it
+	if s.cfg.UpstreamsFile != "" {
+		routes, err := openRouteFile(s.cfg.UpstreamsFile, s.log)
+		if err != nil {
+			return fmt.Errorf("failed to load upstreams file: %w", err)
+		}
+		s.routes = routes
+		s.cfg.Router = routes.table.RouteTable
+		s.OnReload(routes.reload)
+	}
+	if s.cfg.UpstreamListURL != "" {
+		var table *routeTable
+		switch {
+		case s.routes != nil:
+			table = s.routes.table
+		case s.cfg.Router != nil:
+			return errors.New("the upstream list cannot update a custom router")
+		default:
+			table = newRouteTable(&proxy.Routes{Upstreams: proxy.StaticRouter(s.localUpstreams())}, false)
+			s.cfg.Router = table.RouteTable
+		}
+		list, err := newUpstreamList(s.cfg, table, s.log)
+		if err != nil {
+			return err
+		}
+		s.upstreamList = list
+	}
+	if s.cfg.DebugCapture != "" {
+		s.captures = proxy.NewCaptureLog(s.cfg.DebugCapture)
+		s.cfg.DebugCapturer = s.captures
+		s.log.Printf("WARNING: Debug capture is enabled, the first bytes of failed connections, which may contain inner SNIs, are written to %s", s.cfg.DebugCapture)
+	}
+	if s.cfg.StealthMode == config.StealthMirror {
+		mirror, err := proxy.NewMirror(s.cfg)
+		if err != nil {
+			return err
+		}
+		s.mirror = mirror
+		s.cfg.Mirror = mirror
+	}
+	if s.cfg.BanFile != "" {
+		s.loadBans()
+	}
+	if s.cfg.StealthRateFile != "" {
+		if err := s.reloadStealthRates(); err != nil {
+			return fmt.Errorf("failed to load stealth rate file: %w", err)
+		}
+		s.OnReload(s.reloadStealthRates)
+	}
+	if s.cfg.GeoIPDB != "" {
+		// Countries are only informational, so connections are not refused
+		// while the database is missing
+		db := geoip.New(s.cfg.GeoIPDB)
+		if err := db.Reload(); err != nil {
+			s.log.Printf("Client countries will be reported as %s: %v", geoip.Unknown, err)
+		}
+		s.cfg.GeoIP = db
+		s.OnReload(db.Reload)
+	}
+
+	tlsConfig := s.tlsConfig
+	if tlsConfig == nil {
+		if err := s.lockCertCache(); err != nil {
+			return err
+		}
+
+		certManager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(s.cfg.Domain),
+			Cache:      autocert.DirCache(s.cfg.CertCacheDir),
+		}
+
+		getCertificate := trackCertificate(certManager.GetCertificate)
+		if s.cfg.FallbackSelfSigned {
+			fallback, err := newFallbackCert(s.cfg.Domain, getCertificate, s.log)
+			if err != nil {
+				return fmt.Errorf("failed to create fallback certificate: %w", err)
+			}
+			s.fallback = fallback
+			getCertificate = fallback.GetCertificate
+		}
+
+		tlsConfig = &tls.Config{
+			GetCertificate: getCertificate,
+			NextProtos:     []string{"http/1.1", acme.ALPNProto},
+		}
+
+		if s.cfg.ACMEChallenge == config.ACMEChallengeTLSALPN {
+			s.log.Println("HTTP-01 disabled, certificates are obtained via TLS-ALPN-01 only.")
+		} else {
+			// Create an HTTP server for the ACME challenge
+			httpListener, err := net.Listen("tcp", ":80")
+			if err != nil {
+				return fmt.Errorf("failed to listen on :80: %w", err)
+			}
+			s.httpListener = httpListener
+			s.httpServer = &http.Server{
+				Handler: certManager.HTTPHandler(nil),
+			}
+		}
+	}
+
+	// Terminate inner TLS for our own domain with the same certificates
+	if s.cfg.UnknownSNIAction == config.UnknownSNIStealth {
+		innerTLS := tlsConfig.Clone()
+		innerTLS.NextProtos = []string{"http/1.1"}
+		s.cfg.InnerTLS = innerTLS
+	}
+
+	// Optionally require client certificates on the outer TLS connection
+	if s.cfg.ClientCA != "" {
+		pool, err := loadClientCAs(s.cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to load client CA bundle: %w", err)
+		}
+		tlsConfig = tlsConfig.Clone()
+		requireClientCerts(tlsConfig, pool)
+		s.log.Printf("Mutual TLS enabled: client certificates signed by %s are required.", s.cfg.ClientCA)
+	}
+
+	// Record the outer ClientHello for fingerprinting
+	tlsConfig = tlsConfig.Clone()
+	recordClientHello(tlsConfig)
+	s.outerTLS = tlsConfig
+
+	// Create a TLS listener for every configured address, or wrap the given ones
+	if s.listeners != nil {
+		for _, listener := range s.listeners {
+			s.tlsListeners = append(s.tlsListeners, tls.NewListener(fingerprintListener{listener}, tlsConfig))
+		}
+	} else {
+		for _, addr := range s.cfg.Listen {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			}
+			s.tlsListeners = append(s.tlsListeners, tls.NewListener(fingerprintListener{listener}, tlsConfig))
+		}
+	}
+
+	// Create the optional listeners without outer TLS, fronted by an external
+	// TLS terminator
+	for _, addr := range s.cfg.PlainListen {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		s.plainListeners = append(s.plainListeners, listener)
+		if host, _, _ := net.SplitHostPort(addr); !config.IsLoopbackHost(host) {
+			s.log.Printf("WARNING: Plaintext proxy on %s is reachable from other hosts and bypasses the outer TLS layer.", listener.Addr())
+		}
+	}
+
+	// Create the optional QUIC decoy responder
+	if s.cfg.QUICListen != "" {
+		responder, err := quicdecoy.Listen(s.cfg.QUICListen, s.log)
+		if err != nil {
+			return fmt.Errorf("failed to listen on UDP %s: %w", s.cfg.QUICListen, err)
+		}
+		s.quicDecoy = responder
+	}
+
+	// Create the optional admin listener
+	if s.cfg.AdminListen != "" {
+		adminServer := admin.New(s.cfg)
+		if err := adminServer.Listen(); err != nil {
+			return fmt.Errorf("failed to listen on admin address %s: %w", s.cfg.AdminListen, err)
+		}
+		s.adminServer = adminServer
+	}
+
+	return nil
+}
+
+// lockCertCache takes the lock on the certificate cache directory, so that two
+// instances never race on ACME orders or corrupt the cached files.
+func (s *Server) lockCertCache() error {
+	if err := os.MkdirAll(s.cfg.CertCacheDir, 0700); err != nil {
+		return fmt.Errorf("failed to create certificate cache %s: %w", s.cfg.CertCacheDir, err)
+	}
+
+	lock, err := filelock.Acquire(filepath.Join(s.cfg.CertCacheDir, certLockFile))
+	switch {
+	case err == nil:
+		s.certLock = lock
+	case errors.Is(err, filelock.ErrUnsupported):
+		s.log.Println("File locking is not supported on this platform, not locking the certificate cache.")
+	case errors.Is(err, filelock.ErrLocked) && s.cfg.IgnoreCertLock:
+		s.log.Printf("WARNING: Another instance is using the certificate cache %s (%v), continuing because of -ignore-cert-lock.", s.cfg.CertCacheDir, err)
+	case errors.Is(err, filelock.ErrLocked):
+		return fmt.Errorf("another instance is using the certificate cache %s (%v); stop it or use -ignore-cert-lock", s.cfg.CertCacheDir, err)
+	default:
+		return fmt.Errorf("failed to lock certificate cache %s: %w", s.cfg.CertCacheDir, err)
+	}
+	return nil
 }
 
-// acceptLoop accepts new connections and passes them to the handler.
-func (s *Server) acceptLoop() {
+// releaseCertCache releases the certificate cache lock, if held.
+func (s *Server) releaseCertCache() {
+	if s.certLock != nil {
+		s.certLock.Release()
+		s.certLock = nil
+	}
+}
+
+// acceptLoop accepts new connections on a listener and passes them to serve.
+func (s *Server) acceptLoop(listener net.Listener, serve func(conn net.Conn, id string)) {
+	acceptCounter := "listener_accepts:" + listener.Addr().String()
 	for {
-		conn, err := s.tlsListener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			// If the error is due to the listener being closed, it's a clean exit.
 			if errors.Is(err, net.ErrClosed) {
 				break
 			}
-			log.Printf("Failed to accept connection: %v", err)
+			s.log.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+		stats.Inc(acceptCounter)
+		if !s.fds.allow() {
+			stats.Inc("fd_refused")
+			conn.Close()
 			continue
 		}
-		go proxy.HandleConnection(conn, s.cfg)
+		if s.cfg.BanDuration > 0 && proxy.Bans.Banned(proxy.SourceKey(conn.RemoteAddr(), s.cfg)) {
+			if s.cfg.BanAction == config.BanTarpit {
+				// Keep the handshake from starting, banned sources get no TLS
+				if tlsConn, ok := conn.(*tls.Conn); ok {
+					conn = tlsConn.NetConn()
+				}
+				go proxy.TarpitBanned(conn)
+				continue
+			}
+			stats.Inc("banned_refused")
+			conn.Close()
+			continue
+		}
+		go serve(conn, proxy.NewConnID())
+	}
+}
+
+// handle serves a single accepted connection. All messages about it are
+// prefixed with its ID.
+func (s *Server) handle(conn net.Conn, id string) {
+	logger := proxy.NewConnLogger(s.log, id)
+	defer s.recoverPanic(conn, logger)
+
+	if s.cfg.ClientCA != "" {
+		if err := verifyClientCert(conn, logger); err != nil {
+			logger.Printf("Client certificate verification failed for %s: %v", proxy.ClientAddr(conn.RemoteAddr()), err)
+			conn.Close()
+			return
+		}
+	}
+
+	// TLS-ALPN-01 challenges are answered during the handshake and carry no data
+	acmeChallenge, err := isACMEChallenge(conn)
+	if err != nil {
+		logger.Printf("Outer TLS handshake failed for %s: %v", proxy.ClientAddr(conn.RemoteAddr()), err)
+		stats.Inc("tls_handshake_errors")
+		conn.Close()
+		return
+	}
+	if acmeChallenge {
+		logger.Printf("Answered ACME TLS-ALPN-01 challenge from %s", proxy.ClientAddr(conn.RemoteAddr()))
+		stats.Inc("acme_tls_alpn_challenges")
+		conn.Close()
+		return
+	}
+
+	s.handler(conn, id)
+}
+
+// handlePlain serves a single connection accepted on a plaintext listener. It
+// carries the inner TLS directly, so there is no outer handshake to check.
+func (s *Server) handlePlain(conn net.Conn, id string) {
+	logger := proxy.NewConnLogger(s.log, id)
+	defer s.recoverPanic(conn, logger)
+
+	s.handler(conn, id)
+}
+
+// recoverPanic logs a panic raised while serving conn and closes the connection,
+// so that a single bad connection cannot take down the whole process.
+func (s *Server) recoverPanic(conn net.Conn, logger *log.Logger) {
+	if r := recover(); r != nil {
+		stats.Inc("panics_recovered")
+		logger.Printf("Recovered from panic while handling %s: %v\n%s", proxy.ClientAddr(conn.RemoteAddr()), r, debug.Stack())
+		conn.Close()
+	}
+}
+
+// closeListeners closes everything bound so far. It is used when startup fails.
+func (s *Server) closeListeners() {
+	if s.httpListener != nil {
+		s.httpListener.Close()
+	}
+	if s.tlsListeners != nil {
+		for _, listener := range s.tlsListeners {
+			listener.Close()
+		}
+	} else {
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
+	}
+	for _, listener := range s.plainListeners {
+		listener.Close()
+	}
+	if s.quicDecoy != nil {
+		s.quicDecoy.Close()
+	}
+	s.releaseCertCache()
+}
+
+// drainConnections waits for the active proxy connections to finish until ctx
+// is done, and then force-closes the remaining ones.
+func (s *Server) drainConnections(ctx context.Context) {
+	if n := proxy.Connections.Len(); n > 0 {
+		s.log.Printf("Waiting for %d active connections to finish...", n)
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for proxy.Connections.Len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if n := proxy.Connections.CloseAll(); n > 0 {
+				s.log.Printf("Shutdown timeout exceeded, force-closed %d connections.", n)
+			}
+			return
+		}
 	}
 }
 
 // stop performs a graceful shutdown.
 func (s *Server) stop() {
-	log.Println("Initiating graceful shutdown...")
+	s.log.Printf("Initiating graceful shutdown with a timeout of %s...", s.cfg.ShutdownTimeout)
+	s.notify(sdnotify.Stopping)
+	close(s.done)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
 	defer cancel()
 
-	// First, close the listener to stop accepting new connections
-	if err := s.tlsListener.Close(); err != nil {
-		log.Printf("Error closing TLS listener: %v", err)
+	// First, close the listeners to stop accepting new connections
+	for _, listener := range s.tlsListeners {
+		if err := listener.Close(); err != nil {
+			s.log.Printf("Error closing TLS listener %s: %v", listener.Addr(), err)
+		}
+	}
+	for _, listener := range s.plainListeners {
+		if err := listener.Close(); err != nil {
+			s.log.Printf("Error closing plaintext listener %s: %v", listener.Addr(), err)
+		}
+	}
+
+	if s.quicDecoy != nil {
+		if err := s.quicDecoy.Close(); err != nil {
+			s.log.Printf("Error closing QUIC decoy responder: %v", err)
+		}
 	}
 
 	// Then, shut down the HTTP server
-	if err := s.httpServer.Shutdown(ctx); err != nil {
-		log.Printf("HTTP server shutdown error: %v", err)
+	if s.httpServer != nil {
+		if err := s.httpListener.Close(); err != nil {
+			s.log.Printf("Error closing HTTP listener %s: %v", s.httpListener.Addr(), err)
+		}
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			s.log.Printf("HTTP server shutdown error: %v", err)
+			s.httpServer.Close()
+		}
 	}
-}
\ No newline at end of file
+
+	// Tarpitted connections would only hold up the drain
+	if n := proxy.ReleaseTarpits(); n > 0 {
+		s.log.Printf("Released %d tarpitted connections.", n)
+	}
+
+	// Wait for the proxied connections to finish
+	s.drainConnections(ctx)
+	proxy.ClosePooledUpstreams()
+
+	// Bans made while draining are saved too
+	if s.cfg.BanFile != "" {
+		s.saveBans()
+	}
+
+	if s.adminServer != nil {
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			s.log.Printf("Admin server shutdown error: %v", err)
+		}
+	}
+
+	s.releaseCertCache()
+}
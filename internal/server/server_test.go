@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/proxy"
+	"signalgoproxy/internal/stats"
+	"signalgoproxy/internal/testutil"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startTestServer runs a server with a self-signed certificate on a loopback
+// listener. It returns the server, its address and a function stopping it.
+func startTestServer(t *testing.T, shutdownTimeout time.Duration, handler func(net.Conn, string)) (*Server, string, func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		Domain:          "proxy.example",
+		Listen:          []string{listener.Addr().String()},
+		StealthMode:     config.StealthNone,
+		ShutdownTimeout: shutdownTimeout,
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	s := New(cfg)
+	s.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{testutil.Cert(t, "proxy.example", nil)},
+		NextProtos:   []string{"http/1.1", acme.ALPNProto},
+	})
+	s.SetListeners(listener)
+	if handler != nil {
+		s.handler = handler
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, s.Run(ctx))
+	}()
+	stop := sync.OnceFunc(func() {
+		cancel()
+		<-done
+	})
+	t.Cleanup(stop)
+	return s, listener.Addr().String(), stop
+}
+
+// TestHandlerPanicRecovered checks that a panicking handler is logged and counted
+// and that the server keeps accepting connections afterwards.
+func TestHandlerPanicRecovered(t *testing.T) {
+	var calls atomic.Int32
+	s, addr, _ := startTestServer(t, time.Second, func(conn net.Conn, id string) {
+		if calls.Add(1) == 1 {
+			var m map[string]int
+			m["boom"]++ // Writing to a nil map panics.
+		}
+		conn.Write([]byte("ok"))
+		conn.Close()
+	})
+	var logs syncBuffer
+	s.log.SetOutput(&logs)
+	before := stats.Default.Get("panics_recovered")
+
+	dial := func() ([]byte, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return io.ReadAll(conn)
+	}
+
+	reply, _ := dial()
+	assert.Empty(t, reply, "the panicking connection should be closed without a reply")
+
+	reply, err := dial()
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(reply))
+
+	assert.Equal(t, before+1, stats.Default.Get("panics_recovered"))
+	assert.Contains(t, logs.String(), "Recovered from panic")
+	assert.Contains(t, logs.String(), "assignment to entry in nil map")
+}
+
+// TestShutdownForceClosesAfterTimeout checks that connections still active when
+// the shutdown timeout expires are closed and reported.
+func TestShutdownForceClosesAfterTimeout(t *testing.T) {
+	handlerDone := make(chan struct{})
+	s, addr, stop := startTestServer(t, 100*time.Millisecond, func(conn net.Conn, id string) {
+		defer close(handlerDone)
+		tc := proxy.Connections.Register(id, conn)
+		defer proxy.Connections.Remove(tc.ID)
+		io.Copy(io.Discard, conn) // Blocks until the connection is closed.
+	})
+	var logs syncBuffer
+	s.log.SetOutput(&logs)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return proxy.Connections.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	stop()
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	select {
+	case <-handlerDone:
+	case <-time.After(time.Second):
+		t.Fatal("handler still running after shutdown")
+	}
+	assert.Contains(t, logs.String(), "timeout of 100ms")
+	assert.Contains(t, logs.String(), "force-closed 1 connections")
+}
+
+// TestACMEChallengeSkipsHandler checks that TLS-ALPN-01 challenge connections are
+// closed after the handshake without reaching the proxy handler.
+func TestACMEChallengeSkipsHandler(t *testing.T) {
+	var calls atomic.Int32
+	_, addr, _ := startTestServer(t, time.Second, func(conn net.Conn, id string) {
+		calls.Add(1)
+		conn.Close()
+	})
+	before := stats.Default.Get("acme_tls_alpn_challenges")
+
+	for _, protos := range [][]string{{acme.ALPNProto}, {"http/1.1"}} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+		require.NoError(t, err)
+		assert.Equal(t, protos[0], conn.ConnectionState().NegotiatedProtocol)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.ReadAll(conn)
+		conn.Close()
+	}
+
+	assert.Equal(t, int32(1), calls.Load(), "only the regular connection should reach the handler")
+	assert.Equal(t, before+1, stats.Default.Get("acme_tls_alpn_challenges"))
+}
+
+// TestClientFingerprintRecorded checks that the JA3 fingerprint of the outer
+// handshake is available to the connection handler.
+func TestClientFingerprintRecorded(t *testing.T) {
+	fingerprints := make(chan string, 1)
+	_, addr, _ := startTestServer(t, time.Second, func(conn net.Conn, id string) {
+		defer conn.Close()
+		if f, ok := conn.(*tls.Conn).NetConn().(interface{ JA3() string }); ok {
+			fingerprints <- f.JA3()
+		} else {
+			fingerprints <- ""
+		}
+	})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	select {
+	case ja3 := <-fingerprints:
+		assert.Regexp(t, "^[0-9a-f]{32}$", ja3)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+}
+
+// TestHelloConnCloseWrite checks that a half-close on the fingerprinting
+// wrapper reaches the TCP socket.
+func TestHelloConnCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	accepted, err := fingerprintListener{ln}.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+
+	require.Implements(t, (*proxy.CloseWriter)(nil), accepted)
+	require.NoError(t, accepted.(proxy.CloseWriter).CloseWrite())
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+// TestCertCacheLock checks that a second instance refuses to share the
+// certificate cache unless the lock is explicitly ignored.
+func TestCertCacheLock(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "certs")
+	newServer := func(ignoreLock bool) *Server {
+		return New(&config.Config{
+			CertCacheDir:   dir,
+			IgnoreCertLock: ignoreLock,
+			Logger:         log.New(io.Discard, "", 0),
+		})
+	}
+
+	first := newServer(false)
+	require.NoError(t, first.lockCertCache())
+	if first.certLock == nil {
+		t.Skip("file locking is not supported on this platform")
+	}
+
+	err := newServer(false).lockCertCache()
+	assert.ErrorContains(t, err, "another instance is using the certificate cache")
+	assert.NoError(t, newServer(true).lockCertCache())
+
+	first.releaseCertCache()
+	second := newServer(false)
+	require.NoError(t, second.lockCertCache())
+	second.releaseCertCache()
+}
+
+// TestPlainListener checks that connections on a plaintext listener reach the
+// handler without an outer TLS handshake, and that the listener is closed on
+// shutdown.
+func TestPlainListener(t *testing.T) {
+	// Reserve a free port for the plaintext listener
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	plainAddr := reserved.Addr().String()
+	reserved.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cfg := &config.Config{
+		Domain:          "proxy.example",
+		Listen:          []string{listener.Addr().String()},
+		PlainListen:     []string{plainAddr},
+		StealthMode:     config.StealthNone,
+		ShutdownTimeout: time.Second,
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	s := New(cfg)
+	s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{testutil.Cert(t, "proxy.example", nil)}})
+	s.SetListeners(listener)
+	s.handler = func(conn net.Conn, id string) {
+		defer conn.Close()
+		if _, ok := conn.(*tls.Conn); ok {
+			conn.Write([]byte("tls"))
+		} else {
+			conn.Write([]byte("plain"))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, s.Run(ctx))
+	}()
+	before := stats.Default.Get("listener_accepts:" + plainAddr)
+
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		conn, err = net.Dial("tcp", plainAddr)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(conn)
+	conn.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(reply))
+	assert.Equal(t, before+1, stats.Default.Get("listener_accepts:"+plainAddr))
+
+	cancel()
+	<-done
+	_, err = net.Dial("tcp", plainAddr)
+	assert.Error(t, err, "the plaintext listener must be closed on shutdown")
+}
+
+// TestHTTPPortSniffing checks that the port 80 listener proxies connections
+// starting with a TLS handshake, and passes HTTP requests to the HTTP server.
+func TestHTTPPortSniffing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpAddr := httpListener.Addr().String()
+	cfg := &config.Config{
+		Domain:          "proxy.example",
+		Listen:          []string{listener.Addr().String()},
+		StealthMode:     config.StealthNone,
+		SniffTimeout:    time.Second,
+		ShutdownTimeout: time.Second,
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	s := New(cfg)
+	s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{testutil.Cert(t, "proxy.example", nil)}})
+	s.SetListeners(listener)
+	// Stand in for the ACME HTTP-01 listener, which needs a real CA
+	s.httpListener = httpListener
+	s.httpServer = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("acme " + r.URL.Path))
+	})}
+	s.handler = func(conn net.Conn, id string) {
+		defer conn.Close()
+		_, isTLS := conn.(*tls.Conn)
+		if !isTLS {
+			return
+		}
+		inner := make([]byte, 4)
+		if _, err := io.ReadFull(conn, inner); err == nil {
+			conn.Write(append([]byte("proxied "), inner...))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, s.Run(ctx))
+	}()
+
+	t.Run("TLS", func(t *testing.T) {
+		before := stats.Default.Get("http_port_tls")
+		var conn *tls.Conn
+		require.Eventually(t, func() bool {
+			conn, err = tls.Dial("tcp", httpAddr, &tls.Config{ServerName: "proxy.example", InsecureSkipVerify: true})
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		defer conn.Close()
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "proxied ping", string(reply))
+		assert.Equal(t, before+1, stats.Default.Get("http_port_tls"))
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get("http://" + httpAddr + "/.well-known/acme-challenge/token")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "acme /.well-known/acme-challenge/token", string(body))
+	})
+
+	cancel()
+	<-done
+	_, err = net.Dial("tcp", httpAddr)
+	assert.Error(t, err, "the port 80 listener must be closed on shutdown")
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"signalgoproxy/internal/admin"
+	"signalgoproxy/internal/proxy"
+)
+
+// logStatsPeriodically logs a one-line stats summary every interval until the server stops.
+func (s *Server) logStatsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.log.Println(formatStatsLine(admin.TakeSnapshot(proxy.Connections)))
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// formatStatsLine renders a snapshot as a single log line.
+func formatStatsLine(snap admin.Snapshot) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Stats: uptime=%ds active_connections=%d goroutines=%d",
+		snap.UptimeSeconds, snap.ActiveConnections, snap.Goroutines)
+	if limit, ok := snap.Counters["fd_limit"]; ok {
+		fmt.Fprintf(&b, " fds=%d/%d", snap.Counters["fd_open"], limit)
+	}
+	for _, name := range slices.Sorted(maps.Keys(snap.Counters)) {
+		// Per-fingerprint and per-country counters are too many for one line, see /stats
+		if name == "fd_open" || name == "fd_limit" || strings.HasPrefix(name, "ja3:") || strings.HasPrefix(name, "country:") {
+			continue
+		}
+		fmt.Fprintf(&b, " %s=%d", name, snap.Counters[name])
+	}
+	for _, d := range snap.Dials {
+		if d.Count > 0 {
+			fmt.Fprintf(&b, " dial_ms:%s=%g/%g/%g", d.Addr, d.P50Ms, d.P95Ms, d.P99Ms)
+		}
+		for _, class := range slices.Sorted(maps.Keys(d.Failures)) {
+			fmt.Fprintf(&b, " dial_failed:%s:%s=%d", d.Addr, class, d.Failures[class])
+		}
+	}
+	return b.String()
+}
+
+// checkUpstreamsPeriodically checks the health of the upstreams of h now and
+// then every interval until the server stops.
+func (s *Server) checkUpstreamsPeriodically(h *proxy.Handler, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.CheckUpstreams(s.log)
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
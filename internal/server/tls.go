@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"signalgoproxy/internal/proxy"
+	"signalgoproxy/internal/stats"
+)
+
+// handshakeTimeout bounds explicit outer TLS handshakes performed by the server.
+const handshakeTimeout = 10 * time.Second
+
+// trackCertificate wraps a GetCertificate function to record the certificate
+// state for diagnostics. ACME challenge certificates are not recorded.
+func trackCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCertificate(hello)
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return cert, err
+		}
+		if err != nil {
+			stats.Certificate.RecordError(err)
+		} else if cert.Leaf != nil {
+			stats.Certificate.RecordSuccess(cert.Leaf.NotAfter)
+		}
+		return cert, err
+	}
+}
+
+// loadClientCAs reads a PEM bundle of CA certificates used to verify client certificates.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// requireClientCerts makes tlsConfig require and verify client certificates
+// signed by pool. ACME TLS-ALPN-01 challenge handshakes are exempt, since the
+// CA's validation servers never present a client certificate.
+func requireClientCerts(tlsConfig *tls.Config, pool *x509.CertPool) {
+	mtlsConfig := tlsConfig.Clone()
+	mtlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	mtlsConfig.ClientCAs = pool
+
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return nil, nil
+		}
+		return mtlsConfig, nil
+	}
+}
+
+// verifyClientCert completes the handshake on a mutual-TLS connection and logs
+// the client certificate's common name.
+func verifyClientCert(conn net.Conn, logger *log.Logger) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return errors.New("not a TLS connection")
+	}
+
+	if err := handshakeWithTimeout(tlsConn); err != nil {
+		return err
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) > 0 {
+		logger.Printf("Client certificate CN '%s' accepted from %s", state.PeerCertificates[0].Subject.CommonName, proxy.ClientAddr(conn.RemoteAddr()))
+	}
+	return nil
+}
+
+// isACMEChallenge completes the outer handshake and reports whether the client
+// negotiated acme-tls/1, i.e. whether the connection is a TLS-ALPN-01 challenge
+// that autocert has already answered during the handshake.
+func isACMEChallenge(conn net.Conn) (bool, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false, nil
+	}
+	if err := handshakeWithTimeout(tlsConn); err != nil {
+		return false, err
+	}
+	return tlsConn.ConnectionState().NegotiatedProtocol == acme.ALPNProto, nil
+}
+
+// handshakeWithTimeout runs the handshake on tlsConn bounded by handshakeTimeout.
+// It returns immediately if the handshake has already completed.
+func handshakeWithTimeout(tlsConn *tls.Conn) error {
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return tlsConn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+	"signalgoproxy/internal/testutil"
+)
+
+// handshake runs a TLS handshake between the given server and client configurations.
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (error, error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- verifyClientCert(conn, log.Default())
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err == nil {
+		// With TLS 1.3 the client learns about a rejected certificate on first
+		// read; a clean close by the server means the handshake was accepted.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		conn.Close()
+	}
+	return <-serverErr, err
+}
+
+// TestRequireClientCerts checks the mutual TLS gate on the outer connection.
+func TestRequireClientCerts(t *testing.T) {
+	ca := testutil.Cert(t, "Test CA", nil)
+	serverCert := testutil.Cert(t, "proxy.test", &ca)
+	clientCert := testutil.Cert(t, "alice", &ca)
+	rogueCert := testutil.Cert(t, "mallory", nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw}), 0600))
+	pool, err := loadClientCAs(caFile)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	testCases := []struct {
+		name        string
+		clientCerts []tls.Certificate
+		nextProtos  []string
+		expectError bool
+	}{
+		{
+			name:        "Valid client certificate",
+			clientCerts: []tls.Certificate{clientCert},
+			expectError: false,
+		},
+		{
+			name:        "Missing client certificate",
+			expectError: true,
+		},
+		{
+			name:        "Client certificate from unknown CA",
+			clientCerts: []tls.Certificate{rogueCert},
+			expectError: true,
+		},
+		{
+			name:        "ACME TLS-ALPN-01 challenge is exempt",
+			nextProtos:  []string{acme.ALPNProto},
+			expectError: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			serverConfig := &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				NextProtos:   []string{"http/1.1", acme.ALPNProto},
+			}
+			requireClientCerts(serverConfig, pool)
+
+			serverErr, clientErr := handshake(t, serverConfig, &tls.Config{
+				ServerName:   "proxy.test",
+				RootCAs:      roots,
+				Certificates: tc.clientCerts,
+				NextProtos:   tc.nextProtos,
+			})
+
+			if tc.expectError {
+				assert.Error(t, serverErr)
+				assert.Error(t, clientErr)
+			} else {
+				assert.NoError(t, serverErr)
+				assert.NoError(t, clientErr)
+			}
+		})
+	}
+}
+
+// TestLoadClientCAsInvalid checks that an empty bundle is rejected.
+func TestLoadClientCAsInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(path, []byte("not a certificate"), 0600))
+	_, err := loadClientCAs(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/proxy"
+	"signalgoproxy/internal/stats"
+)
+
+const (
+	// upstreamListTimeout bounds a fetch of the remote upstream list, including its signature.
+	upstreamListTimeout = 30 * time.Second
+	// maxUpstreamListSize is the size limit of the remote upstream list.
+	maxUpstreamListSize = 1 << 20
+)
+
+// upstreamListRetry is the first pause before fetching the remote upstream
+// list again after a failure. It doubles with every further failure, up to
+// the fetch interval.
+var upstreamListRetry = time.Minute
+
+// upstreamList keeps a route table up to date with the remote upstream list,
+// see -upstream-list-url. The document is accepted only if its detached
+// signature verifies with the configured key, and if it was served by a
+// pinned certificate when pins are configured.
+type upstreamList struct {
+	url      string
+	key      ed25519.PublicKey // nil if the document is not signed
+	interval time.Duration
+	retry    time.Duration
+	client   *http.Client
+	table    *routeTable
+	log      *log.Logger
+}
+
+// newUpstreamList creates a fetcher of the upstream list configured in cfg,
+// storing its routes in table.
+func newUpstreamList(cfg *config.Config, table *routeTable, logger *log.Logger) (*upstreamList, error) {
+	u, err := url.Parse(cfg.UpstreamListURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream list URL: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(cfg.UpstreamListPins) > 0 {
+		transport.TLSClientConfig = proxy.PinnedTLSConfig(u.Hostname(), cfg.UpstreamListPins)
+	}
+
+	l := &upstreamList{
+		url:      cfg.UpstreamListURL,
+		interval: cfg.UpstreamListInterval,
+		retry:    upstreamListRetry,
+		client:   &http.Client{Transport: transport, Timeout: upstreamListTimeout},
+		table:    table,
+		log:      logger,
+	}
+	if l.interval <= 0 {
+		l.interval = config.DefaultUpstreamListInterval
+	}
+	if cfg.UpstreamListKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cfg.UpstreamListKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid upstream list key")
+		}
+		l.key = key
+	}
+	return l, nil
+}
+
+// update fetches the upstream list and, if it is valid, merges its routes
+// into the route table. On error the previous routes stay in use.
+func (l *upstreamList) update(ctx context.Context) error {
+	routes, err := l.fetch(ctx)
+	if err != nil {
+		stats.Inc("upstream_list_errors")
+		return fmt.Errorf("keeping the previous %d routes: %w", l.table.Len(), err)
+	}
+	l.table.setRemote(routes.Upstreams)
+	stats.Inc("upstream_list_updates")
+	l.log.Printf("Updated %d routes from the upstream list at %s.", len(routes.Upstreams), l.url)
+	return nil
+}
+
+// fetch downloads, verifies and parses the upstream list.
+func (l *upstreamList) fetch(ctx context.Context) (*proxy.Routes, error) {
+	data, err := l.get(ctx, l.url)
+	if err != nil {
+		return nil, err
+	}
+	if l.key != nil {
+		encoded, err := l.get(ctx, l.url+".sig")
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the signature: %w", err)
+		}
+		signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature: %w", err)
+		}
+		if !ed25519.Verify(l.key, data, signature) {
+			return nil, errors.New("the signature does not match the upstream list")
+		}
+	}
+
+	routes, err := proxy.ParseRoutes(data, l.url)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes.Upstreams) == 0 {
+		return nil, errors.New("the upstream list has no routes")
+	}
+	return routes, nil
+}
+
+// get returns the body of the document at rawURL.
+func (l *upstreamList) get(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, rawURL)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUpstreamListSize {
+		return nil, fmt.Errorf("%s exceeds %d bytes", rawURL, maxUpstreamListSize)
+	}
+	return data, nil
+}
+
+// run fetches the upstream list now and then every interval until done is
+// closed. After a failure it retries sooner, backing off exponentially.
+func (l *upstreamList) run(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	retry := l.retry
+	for {
+		wait := l.interval
+		if err := l.update(ctx); err != nil {
+			l.log.Printf("Failed to update routes from the upstream list: %v", err)
+			wait = min(retry, l.interval)
+			retry = min(retry*2, l.interval)
+		} else {
+			retry = l.retry
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return
+		}
+	}
+}
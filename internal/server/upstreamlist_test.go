@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/proxy"
+)
+
+// listServer serves an upstream list and its signature, which tests can change.
+type listServer struct {
+	mu        sync.Mutex
+	status    int
+	list      []byte
+	signature []byte
+}
+
+func (s *listServer) set(status int, list, signature []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.list, s.signature = status, list, signature
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.status != http.StatusOK:
+		w.WriteHeader(s.status)
+	case r.URL.Path == "/upstreams.json":
+		w.Write(s.list)
+	case r.URL.Path == "/upstreams.json.sig" && s.signature != nil:
+		w.Write(s.signature)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sign returns the base64 signature of list with key.
+func sign(key ed25519.PrivateKey, list []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, list)) + "\n")
+}
+
+// TestUpstreamListUpdate checks which upstream lists are accepted, and that
+// the previous routes stay in use when one is rejected.
+func TestUpstreamListUpdate(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherPublic, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	list := []byte(`{"chat.signal.org": "chat2.signal.org:443", "new.signal.org": "new.signal.org:443"}`)
+	tampered := []byte(`{"chat.signal.org": "impostor.example:443", "new.signal.org": "new.signal.org:443"}`)
+
+	handler := &listServer{}
+	plainServer := httptest.NewServer(handler)
+	defer plainServer.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	hash := sha256.Sum256(tlsServer.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	otherHash := sha256.Sum256([]byte("other key"))
+
+	testCases := []struct {
+		name        string
+		tls         bool
+		key         ed25519.PublicKey
+		pins        []string
+		status      int
+		list        []byte
+		signature   []byte
+		expectedErr string
+	}{
+		{name: "Signed", key: public, status: http.StatusOK, list: list, signature: sign(private, list)},
+		{name: "Pinned", tls: true, pins: []string{pin}, status: http.StatusOK, list: list},
+		{name: "Signed and pinned", tls: true, key: public, pins: []string{pin}, status: http.StatusOK, list: list, signature: sign(private, list)},
+		{name: "Tampered", key: public, status: http.StatusOK, list: tampered, signature: sign(private, list), expectedErr: "signature does not match"},
+		{name: "Other key", key: otherPublic, status: http.StatusOK, list: list, signature: sign(private, list), expectedErr: "signature does not match"},
+		{name: "Signed by other key", key: public, status: http.StatusOK, list: list, signature: sign(otherPrivate, list), expectedErr: "signature does not match"},
+		{name: "Missing signature", key: public, status: http.StatusOK, list: list, expectedErr: "failed to fetch the signature"},
+		{name: "Malformed signature", key: public, status: http.StatusOK, list: list, signature: []byte("not base64!"), expectedErr: "invalid signature"},
+		{name: "Wrong pin", tls: true, pins: []string{base64.StdEncoding.EncodeToString(otherHash[:])}, status: http.StatusOK, list: list, expectedErr: "no certificate matches the pinned public keys"},
+		{name: "Bad document", key: public, status: http.StatusOK, list: []byte(`{"chat.signal.org": `), signature: sign(private, []byte(`{"chat.signal.org": `)), expectedErr: "failed to parse"},
+		{name: "Invalid route", key: public, status: http.StatusOK, list: []byte(`{"chat.signal.org": "no port"}`), signature: sign(private, []byte(`{"chat.signal.org": "no port"}`)), expectedErr: "invalid upstream address"},
+		{name: "No routes", key: public, status: http.StatusOK, list: []byte(`{}`), signature: sign(private, []byte(`{}`)), expectedErr: "has no routes"},
+		{name: "Server error", key: public, status: http.StatusInternalServerError, expectedErr: "unexpected status 500"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler.set(tc.status, tc.list, tc.signature)
+			server := plainServer
+			if tc.tls {
+				server = tlsServer
+			}
+			cfg := &config.Config{UpstreamListURL: server.URL + "/upstreams.json", UpstreamListPins: tc.pins}
+			if tc.key != nil {
+				cfg.UpstreamListKey = base64.StdEncoding.EncodeToString(tc.key)
+			}
+			table := newRouteTable(&proxy.Routes{Upstreams: proxy.DefaultUpstreams()}, false)
+			l, err := newUpstreamList(cfg, table, log.New(io.Discard, "", 0))
+			require.NoError(t, err)
+
+			err = l.update(context.Background())
+			addr, _ := table.Lookup("chat.signal.org")
+			_, added := table.Lookup("new.signal.org")
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+				assert.Equal(t, "chat.signal.org:443", addr)
+				assert.False(t, added)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "chat2.signal.org:443", addr)
+			assert.True(t, added)
+			// The built-in routes missing from the list stay
+			_, ok := table.Lookup("cdn.signal.org")
+			assert.True(t, ok)
+		})
+	}
+}
+
+// TestRouteTableLocalWins checks that the routes of the upstreams file win
+// over those of the remote upstream list, also after the file is reloaded.
+func TestRouteTableLocalWins(t *testing.T) {
+	table := newRouteTable(&proxy.Routes{Upstreams: proxy.StaticRouter{"chat.signal.org": "local.example:443"}}, true)
+	table.setRemote(proxy.StaticRouter{"chat.signal.org": "remote.example:443", "new.signal.org": "new.example:443"})
+
+	addr, _ := table.Lookup("chat.signal.org")
+	assert.Equal(t, "local.example:443", addr)
+	addr, _ = table.Lookup("new.signal.org")
+	assert.Equal(t, "new.example:443", addr)
+
+	table.setLocal(&proxy.Routes{Upstreams: proxy.StaticRouter{"new.signal.org": "local.example:443"}})
+	addr, _ = table.Lookup("chat.signal.org")
+	assert.Equal(t, "remote.example:443", addr)
+	addr, _ = table.Lookup("new.signal.org")
+	assert.Equal(t, "local.example:443", addr)
+}
+
+// TestUpstreamListRetry checks that a failed fetch is retried with backoff
+// before the next interval.
+func TestUpstreamListRetry(t *testing.T) {
+	orig := upstreamListRetry
+	upstreamListRetry = 10 * time.Millisecond
+	defer func() { upstreamListRetry = orig }()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	handler := &listServer{}
+	handler.set(http.StatusServiceUnavailable, nil, nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var logs syncBuffer
+	table := newRouteTable(&proxy.Routes{Upstreams: proxy.DefaultUpstreams()}, false)
+	l, err := newUpstreamList(&config.Config{
+		UpstreamListURL:      server.URL + "/upstreams.json",
+		UpstreamListKey:      base64.StdEncoding.EncodeToString(public),
+		UpstreamListInterval: time.Hour,
+	}, table, log.New(&logs, "", 0))
+	require.NoError(t, err)
+	done := make(chan struct{})
+	defer close(done)
+	go l.run(done)
+
+	require.Eventually(t, func() bool {
+		return strings.Count(logs.String(), "Failed to update routes from the upstream list") >= 2
+	}, 5*time.Second, 5*time.Millisecond)
+	list := []byte(`{"new.signal.org": "new.signal.org:443"}`)
+	handler.set(http.StatusOK, list, sign(private, list))
+	require.Eventually(t, func() bool {
+		_, ok := table.Lookup("new.signal.org")
+		return ok
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Contains(t, logs.String(), "Updated 1 routes from the upstream list at "+server.URL+"/upstreams.json.")
+}
@@ -0,0 +1,53 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// Certificate tracks the certificate served on the outer TLS listener.
+var Certificate = &CertState{}
+
+// CertStatus is a point-in-time view of the certificate state.
+type CertStatus struct {
+	NotAfter    time.Time `json:"not_after,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+	// Fallback is set while a self-signed fallback certificate is being served.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// CertState records the outcome of certificate lookups. It is safe for concurrent use.
+type CertState struct {
+	mu     sync.Mutex
+	status CertStatus
+}
+
+// RecordSuccess records a successfully served certificate expiring at notAfter.
+func (c *CertState) RecordSuccess(notAfter time.Time) {
+	c.mu.Lock()
+	c.status.NotAfter = notAfter
+	c.mu.Unlock()
+}
+
+// RecordError records a failed certificate lookup.
+func (c *CertState) RecordError(err error) {
+	c.mu.Lock()
+	c.status.LastError = err.Error()
+	c.status.LastErrorAt = time.Now()
+	c.mu.Unlock()
+}
+
+// SetFallback records whether the self-signed fallback certificate is being served.
+func (c *CertState) SetFallback(active bool) {
+	c.mu.Lock()
+	c.status.Fallback = active
+	c.mu.Unlock()
+}
+
+// Status returns the current certificate state.
+func (c *CertState) Status() CertStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
@@ -0,0 +1,199 @@
+package stats
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// histogramMin is the upper bound of the first histogram bucket.
+	histogramMin = 100 * time.Microsecond
+	// histogramBucketsPerDoubling sets the resolution of the histogram: each
+	// bucket bound is 2^(1/4), about 19%, above the previous one.
+	histogramBucketsPerDoubling = 4
+	// histogramBuckets is the number of bounded buckets, reaching up to about
+	// 90 seconds. Longer durations fall into a final overflow bucket.
+	histogramBuckets = 80
+)
+
+// Histogram counts durations in fixed, exponentially growing buckets, so that
+// percentiles are known within the width of a bucket without keeping the
+// samples. It is safe for concurrent use and never blocks.
+type Histogram struct {
+	counts [histogramBuckets + 1]atomic.Int64
+	total  atomic.Int64
+}
+
+// bucketBound returns the upper bound of bucket i.
+func bucketBound(i int) time.Duration {
+	return time.Duration(float64(histogramMin) * math.Exp2(float64(i)/histogramBucketsPerDoubling))
+}
+
+// bucketIndex returns the bucket counting d: the first whose bound is at least d.
+func bucketIndex(d time.Duration) int {
+	if d <= histogramMin {
+		return 0
+	}
+	i := min(int(math.Ceil(math.Log2(float64(d)/float64(histogramMin))*histogramBucketsPerDoubling)), histogramBuckets)
+	// Rounding may land one bucket off the exact bound
+	for i > 0 && bucketBound(i-1) >= d {
+		i--
+	}
+	for i < histogramBuckets && bucketBound(i) < d {
+		i++
+	}
+	return i
+}
+
+// Observe records a duration.
+func (h *Histogram) Observe(d time.Duration) {
+	h.counts[bucketIndex(d)].Add(1)
+	h.total.Add(1)
+}
+
+// Count returns the number of recorded durations.
+func (h *Histogram) Count() int64 {
+	return h.total.Load()
+}
+
+// Percentile returns the upper bound of the bucket holding the p-th percentile
+// (0 < p <= 100) of the recorded durations, or zero if there are none.
+// Durations in the overflow bucket are reported as the last bound.
+func (h *Histogram) Percentile(p float64) time.Duration {
+	var counts [histogramBuckets + 1]int64
+	var total int64
+	for i := range counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := max(int64(math.Ceil(p/100*float64(total))), 1)
+	var seen int64
+	for i, n := range counts {
+		seen += n
+		if seen >= rank {
+			return bucketBound(min(i, histogramBuckets-1))
+		}
+	}
+	return bucketBound(histogramBuckets - 1)
+}
+
+// maxDialEntries bounds the number of upstreams with dial statistics. Further
+// upstreams are counted under OtherUpstream.
+const maxDialEntries = 256
+
+// OtherUpstream is the entry that counts upstreams beyond the first maxDialEntries.
+const OtherUpstream = "other"
+
+// Dials tracks the connection latency and failures of every upstream.
+var Dials = NewDialTable()
+
+// DialCounters holds the dial statistics of one upstream.
+type DialCounters struct {
+	Latency Histogram
+
+	mu       sync.Mutex
+	failures map[string]int64 // By error class
+}
+
+// DialStats is a point-in-time view of the dials of one upstream.
+type DialStats struct {
+	Addr     string           `json:"addr"`
+	Count    int64            `json:"count"`
+	P50Ms    float64          `json:"p50_ms"`
+	P95Ms    float64          `json:"p95_ms"`
+	P99Ms    float64          `json:"p99_ms"`
+	Failures map[string]int64 `json:"failures,omitempty"`
+}
+
+// DialTable is a set of per-upstream dial statistics. It is safe for concurrent use.
+type DialTable struct {
+	mu      sync.RWMutex
+	entries map[string]*DialCounters
+}
+
+// NewDialTable creates an empty table.
+func NewDialTable() *DialTable {
+	return &DialTable{
+		entries: make(map[string]*DialCounters),
+	}
+}
+
+// get returns the counters of addr, creating them if necessary.
+func (t *DialTable) get(addr string) *DialCounters {
+	t.mu.RLock()
+	c, ok := t.entries[addr]
+	t.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok = t.entries[addr]; ok {
+		return c
+	}
+	if len(t.entries) >= maxDialEntries {
+		addr = OtherUpstream
+		if c, ok = t.entries[addr]; ok {
+			return c
+		}
+	}
+	c = &DialCounters{failures: make(map[string]int64)}
+	t.entries[addr] = c
+	return c
+}
+
+// Success records a connection to addr that took latency.
+func (t *DialTable) Success(addr string, latency time.Duration) {
+	t.get(addr).Latency.Observe(latency)
+}
+
+// Failure records a failed connection to addr, with the class of its error.
+func (t *DialTable) Failure(addr, class string) {
+	c := t.get(addr)
+	c.mu.Lock()
+	c.failures[class]++
+	c.mu.Unlock()
+}
+
+// Snapshot returns the dial statistics of all upstreams, sorted by address.
+func (t *DialTable) Snapshot() []DialStats {
+	t.mu.RLock()
+	snapshot := make([]DialStats, 0, len(t.entries))
+	for addr, c := range t.entries {
+		s := DialStats{
+			Addr:  addr,
+			Count: c.Latency.Count(),
+			P50Ms: durationMs(c.Latency.Percentile(50)),
+			P95Ms: durationMs(c.Latency.Percentile(95)),
+			P99Ms: durationMs(c.Latency.Percentile(99)),
+		}
+		c.mu.Lock()
+		if len(c.failures) > 0 {
+			s.Failures = make(map[string]int64, len(c.failures))
+			for class, n := range c.failures {
+				s.Failures[class] = n
+			}
+		}
+		c.mu.Unlock()
+		snapshot = append(snapshot, s)
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Addr < snapshot[j].Addr
+	})
+	return snapshot
+}
+
+// durationMs converts d to milliseconds with microsecond precision.
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
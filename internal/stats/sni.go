@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// maxSNIEntries bounds the number of per-SNI entries. Further names are counted
+// under OtherSNI.
+const maxSNIEntries = 256
+
+// OtherSNI is the entry that counts names beyond the first maxSNIEntries.
+const OtherSNI = "other"
+
+// SNI tracks the traffic of every routed inner SNI.
+var SNI = NewSNITable()
+
+// SNICounters holds the live counters of one SNI. All fields are updated atomically.
+type SNICounters struct {
+	Connections atomic.Int64 // connections opened
+	Active      atomic.Int64 // connections currently being proxied
+	BytesIn     atomic.Int64 // client -> upstream
+	BytesOut    atomic.Int64 // upstream -> client
+}
+
+// SNIStats is a point-in-time view of the traffic of one SNI.
+type SNIStats struct {
+	SNI         string `json:"sni"`
+	Connections int64  `json:"connections"`
+	Active      int64  `json:"active"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+}
+
+// SNITable is a set of per-SNI counters. It is safe for concurrent use.
+type SNITable struct {
+	mu      sync.RWMutex
+	entries map[string]*SNICounters
+}
+
+// NewSNITable creates an empty table.
+func NewSNITable() *SNITable {
+	return &SNITable{
+		entries: make(map[string]*SNICounters),
+	}
+}
+
+// Get returns the counters of sni, creating them if necessary.
+func (t *SNITable) Get(sni string) *SNICounters {
+	t.mu.RLock()
+	c, ok := t.entries[sni]
+	t.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok = t.entries[sni]; ok {
+		return c
+	}
+	if len(t.entries) >= maxSNIEntries {
+		sni = OtherSNI
+		if c, ok = t.entries[sni]; ok {
+			return c
+		}
+	}
+	c = new(SNICounters)
+	t.entries[sni] = c
+	return c
+}
+
+// Snapshot returns the traffic of all SNIs, highest total bytes first.
+func (t *SNITable) Snapshot() []SNIStats {
+	t.mu.RLock()
+	snapshot := make([]SNIStats, 0, len(t.entries))
+	for sni, c := range t.entries {
+		snapshot = append(snapshot, SNIStats{
+			SNI:         sni,
+			Connections: c.Connections.Load(),
+			Active:      c.Active.Load(),
+			BytesIn:     c.BytesIn.Load(),
+			BytesOut:    c.BytesOut.Load(),
+		})
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		ti := snapshot[i].BytesIn + snapshot[i].BytesOut
+		tj := snapshot[j].BytesIn + snapshot[j].BytesOut
+		if ti != tj {
+			return ti > tj
+		}
+		return snapshot[i].SNI < snapshot[j].SNI
+	})
+	return snapshot
+}
@@ -0,0 +1,110 @@
+// Package stats collects runtime counters shared by the proxy components.
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default is the process-wide counter set.
+var Default = New()
+
+// StartTime is the time the process started.
+var StartTime = time.Now()
+
+// Stats is a set of named counters. Most are monotonic; gauges are updated with Set.
+// It is safe for concurrent use.
+type Stats struct {
+	mu       sync.RWMutex
+	counters map[string]*atomic.Int64
+}
+
+// New creates an empty counter set.
+func New() *Stats {
+	return &Stats{
+		counters: make(map[string]*atomic.Int64),
+	}
+}
+
+// counter returns the counter with the given name, creating it if necessary.
+func (s *Stats) counter(name string) *atomic.Int64 {
+	s.mu.RLock()
+	c, ok := s.counters[name]
+	s.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok = s.counters[name]; !ok {
+		c = new(atomic.Int64)
+		s.counters[name] = c
+	}
+	return c
+}
+
+// Add adds delta to the named counter.
+func (s *Stats) Add(name string, delta int64) {
+	s.counter(name).Add(delta)
+}
+
+// Inc increments the named counter by one.
+func (s *Stats) Inc(name string) {
+	s.counter(name).Add(1)
+}
+
+// Set sets the named counter to value. It is used for gauges.
+func (s *Stats) Set(name string, value int64) {
+	s.counter(name).Store(value)
+}
+
+// Get returns the current value of the named counter.
+func (s *Stats) Get(name string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c, ok := s.counters[name]; ok {
+		return c.Load()
+	}
+	return 0
+}
+
+// Snapshot returns a copy of all counters.
+func (s *Stats) Snapshot() map[string]int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot := make(map[string]int64, len(s.counters))
+	for name, c := range s.counters {
+		snapshot[name] = c.Load()
+	}
+	return snapshot
+}
+
+// Names returns the sorted names of all counters.
+func (s *Stats) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.counters))
+	for name := range s.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Inc increments the named counter of the default set.
+func Inc(name string) {
+	Default.Inc(name)
+}
+
+// Add adds delta to the named counter of the default set.
+func Add(name string, delta int64) {
+	Default.Add(name, delta)
+}
+
+// Set sets the named counter of the default set to value.
+func Set(name string, value int64) {
+	Default.Set(name, value)
+}
@@ -0,0 +1,188 @@
+// Package stats collects runtime counters shared by the proxy components.
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStatsConcurrentIncrements checks that concurrent updates are not lost.
+func TestStatsConcurrentIncrements(t *testing.T) {
+	s := New()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Inc("a")
+				s.Add("b", 2)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(20000), s.Get("a"))
+	assert.Equal(t, int64(40000), s.Get("b"))
+	assert.Equal(t, int64(0), s.Get("missing"))
+	assert.Equal(t, map[string]int64{"a": 20000, "b": 40000}, s.Snapshot())
+	assert.Equal(t, []string{"a", "b"}, s.Names())
+}
+
+// TestStatsSet checks gauge updates.
+func TestStatsSet(t *testing.T) {
+	s := New()
+	s.Set("fd_open", 10)
+	s.Set("fd_open", 7)
+	assert.Equal(t, int64(7), s.Get("fd_open"))
+}
+
+// TestSNITable checks per-SNI counters, ordering and the entry cap.
+func TestSNITable(t *testing.T) {
+	table := NewSNITable()
+	table.Get("cdn.signal.org").BytesOut.Add(500)
+	chat := table.Get("chat.signal.org")
+	chat.Connections.Add(2)
+	chat.Active.Add(1)
+	chat.BytesIn.Add(100)
+	chat.BytesOut.Add(900)
+
+	assert.Equal(t, []SNIStats{
+		{SNI: "chat.signal.org", Connections: 2, Active: 1, BytesIn: 100, BytesOut: 900},
+		{SNI: "cdn.signal.org", BytesOut: 500},
+	}, table.Snapshot())
+
+	for i := 0; i < maxSNIEntries; i++ {
+		table.Get(fmt.Sprintf("host%d.signal.org", i)).Connections.Add(1)
+	}
+	assert.Len(t, table.Snapshot(), maxSNIEntries+1)
+	assert.Equal(t, int64(2), table.Get(OtherSNI).Connections.Load())
+}
+
+// TestUpstreamHealth checks health transitions, retention and ordering.
+func TestUpstreamHealth(t *testing.T) {
+	health := NewUpstreamHealth()
+
+	_, changed := health.Record("chat.signal.org:443", 20*time.Millisecond, nil)
+	assert.False(t, changed, "a healthy first check is not a change")
+	assert.False(t, health.AllUnhealthy())
+
+	down, changed := health.Record("chat.signal.org:443", time.Second, errors.New("connection refused"))
+	assert.True(t, changed)
+	assert.False(t, down.Healthy)
+	assert.Equal(t, "connection refused", down.LastError)
+	assert.True(t, health.AllUnhealthy())
+
+	still, changed := health.Record("chat.signal.org:443", time.Second, errors.New("timeout"))
+	assert.False(t, changed)
+	assert.Equal(t, down.Since, still.Since)
+
+	up, changed := health.Record("chat.signal.org:443", 1500*time.Microsecond, nil)
+	assert.True(t, changed)
+	assert.Equal(t, 1.5, up.LatencyMs)
+
+	_, changed = health.Record("cdn.signal.org:443", time.Second, errors.New("timeout"))
+	assert.True(t, changed, "a failed first check is a change")
+	snapshot := health.Snapshot()
+	require.Len(t, snapshot, 2)
+	assert.Equal(t, "cdn.signal.org:443", snapshot[0].Addr)
+	assert.Equal(t, "chat.signal.org:443", snapshot[1].Addr)
+
+	health.Retain([]string{"cdn.signal.org:443"})
+	assert.Len(t, health.Snapshot(), 1)
+	assert.True(t, health.AllUnhealthy())
+}
+
+// TestHistogramBuckets checks that every duration falls into the first bucket
+// whose bound is at least the duration.
+func TestHistogramBuckets(t *testing.T) {
+	assert.Equal(t, histogramMin, bucketBound(0))
+	assert.Equal(t, 2*histogramMin, bucketBound(histogramBucketsPerDoubling))
+	assert.Greater(t, bucketBound(histogramBuckets-1), 80*time.Second)
+
+	testCases := []struct {
+		d        time.Duration
+		expected int
+	}{
+		{d: 0, expected: 0},
+		{d: histogramMin, expected: 0},
+		{d: histogramMin + 1, expected: 1},
+		{d: bucketBound(1), expected: 1},
+		{d: bucketBound(1) + 1, expected: 2},
+		{d: 2 * histogramMin, expected: histogramBucketsPerDoubling},
+		{d: 100 * time.Millisecond, expected: 40},
+		{d: time.Hour, expected: histogramBuckets},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, bucketIndex(tc.d), "bucket of %s", tc.d)
+	}
+
+	for i := 1; i < histogramBuckets; i++ {
+		assert.Equal(t, i, bucketIndex(bucketBound(i)), "bucket of bound %d", i)
+		assert.Equal(t, i, bucketIndex(bucketBound(i-1)+1), "bucket above bound %d", i-1)
+	}
+}
+
+// TestHistogramPercentile checks percentiles of known distributions.
+func TestHistogramPercentile(t *testing.T) {
+	h := &Histogram{}
+	assert.Zero(t, h.Percentile(50))
+
+	// 1..100ms, one sample each
+	for i := 1; i <= 100; i++ {
+		h.Observe(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, int64(100), h.Count())
+	for _, p := range []float64{50, 95, 99, 100} {
+		exact := time.Duration(p) * time.Millisecond
+		got := h.Percentile(p)
+		assert.GreaterOrEqual(t, got, exact, "p%v", p)
+		assert.LessOrEqual(t, float64(got), float64(exact)*1.19, "p%v is off by more than a bucket", p)
+	}
+
+	// Overflowing durations report the last bound
+	h = &Histogram{}
+	h.Observe(time.Hour)
+	assert.Equal(t, bucketBound(histogramBuckets-1), h.Percentile(99))
+}
+
+// TestDialTable checks the dial statistics of concurrent connections.
+func TestDialTable(t *testing.T) {
+	table := NewDialTable()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				table.Success("chat.signal.org:443", 10*time.Millisecond)
+			}
+			table.Failure("chat.signal.org:443", "timeout")
+		}()
+	}
+	wg.Wait()
+	table.Failure("cdn.signal.org:443", "refused")
+
+	snapshot := table.Snapshot()
+	require.Len(t, snapshot, 2)
+	assert.Equal(t, DialStats{Addr: "cdn.signal.org:443", Failures: map[string]int64{"refused": 1}}, snapshot[0])
+	chat := snapshot[1]
+	assert.Equal(t, "chat.signal.org:443", chat.Addr)
+	assert.Equal(t, int64(1000), chat.Count)
+	assert.Equal(t, map[string]int64{"timeout": 10}, chat.Failures)
+	for _, p := range []float64{chat.P50Ms, chat.P95Ms, chat.P99Ms} {
+		assert.InDelta(t, 10, p, 2)
+	}
+
+	for i := 0; i < maxDialEntries+10; i++ {
+		table.Success(fmt.Sprintf("upstream%d:443", i), time.Millisecond)
+	}
+	assert.Len(t, table.Snapshot(), maxDialEntries+1)
+}
@@ -0,0 +1,103 @@
+package stats
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upstreams holds the results of the upstream health checks.
+var Upstreams = NewUpstreamHealth()
+
+// UpstreamStatus is the result of the latest health check of one upstream.
+type UpstreamStatus struct {
+	Addr      string    `json:"addr"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMs float64   `json:"latency_ms,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Since is when the upstream last changed between healthy and unhealthy.
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// UpstreamHealth tracks the health of upstream addresses. It is safe for concurrent use.
+type UpstreamHealth struct {
+	mu       sync.Mutex
+	upstream map[string]UpstreamStatus
+}
+
+// NewUpstreamHealth creates an empty health table.
+func NewUpstreamHealth() *UpstreamHealth {
+	return &UpstreamHealth{
+		upstream: make(map[string]UpstreamStatus),
+	}
+}
+
+// Record stores the outcome of a check of addr that took latency and failed
+// with err, if not nil. It returns the new status and whether it differs in
+// health from the previous one. Unchecked addresses count as healthy, so only
+// a failed first check is a change.
+func (h *UpstreamHealth) Record(addr string, latency time.Duration, err error) (UpstreamStatus, bool) {
+	now := time.Now()
+	status := UpstreamStatus{
+		Addr:      addr,
+		Healthy:   err == nil,
+		CheckedAt: now,
+		Since:     now,
+	}
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.LatencyMs = float64(latency.Microseconds()) / 1000
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev, ok := h.upstream[addr]
+	wasHealthy := !ok || prev.Healthy
+	changed := wasHealthy != status.Healthy
+	if ok && !changed {
+		status.Since = prev.Since
+	}
+	h.upstream[addr] = status
+	return status, changed
+}
+
+// Retain forgets every address not in addrs, e.g. after the routing map changed.
+func (h *UpstreamHealth) Retain(addrs []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for addr := range h.upstream {
+		if !slices.Contains(addrs, addr) {
+			delete(h.upstream, addr)
+		}
+	}
+}
+
+// AllUnhealthy reports whether upstreams have been checked and none of them is healthy.
+func (h *UpstreamHealth) AllUnhealthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, status := range h.upstream {
+		if status.Healthy {
+			return false
+		}
+	}
+	return len(h.upstream) > 0
+}
+
+// Snapshot returns the status of all checked upstreams, sorted by address.
+func (h *UpstreamHealth) Snapshot() []UpstreamStatus {
+	h.mu.Lock()
+	snapshot := make([]UpstreamStatus, 0, len(h.upstream))
+	for _, status := range h.upstream {
+		snapshot = append(snapshot, status)
+	}
+	h.mu.Unlock()
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Addr < snapshot[j].Addr
+	})
+	return snapshot
+}
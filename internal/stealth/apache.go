@@ -1,11 +1,6 @@
 // Package stealth provides modules for camouflaging the proxy as a standard web server.
 package stealth
 
-import (
-	"fmt"
-	"time"
-)
-
 // A standard Apache2 default page for Ubuntu.
 const apacheHTMLBody = `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
 <html xmlns="http://www.w3.org/1999/xhtml">
@@ -38,30 +33,8 @@ const apacheHTMLBody = `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitiona
   </body>
 </html>`
 
-// GetApacheResponse generates a full HTTP response that mimics a standard Apache server.
-func GetApacheResponse() []byte {
-	date := time.Now().UTC().Format(time.RFC1123)
-
-	lastModified := generatePastDate()
-
-	headers := fmt.Sprintf(
-		"HTTP/1.1 200 OK\r\n"+
-			"Date: %s\r\n"+
-			"Server: Apache/2.4.41 (Ubuntu)\r\n"+
-			"Last-Modified: %s\r\n"+
-			"ETag: \"2d-4e9a49938b880\"\r\n"+
-			"Accept-Ranges: bytes\r\n"+
-			"Content-Length: %d\r\n"+
-			"Vary: Accept-Encoding\r\n"+
-			"Content-Type: text/html\r\n"+
-			"Connection: close\r\n"+
-			"\r\n",
-		date,
-		lastModified,
-		len(apacheHTMLBody),
-	)
-
-	fullResponse := headers + apacheHTMLBody
-
-	return []byte(fullResponse)
+// GetApacheResponse generates a full HTTP response that mimics a standard Apache server
+// serving its default page for host.
+func GetApacheResponse(host string) Response {
+	return GetApacheFile(host, "text/html", []byte(apacheHTMLBody))
 }
\ No newline at end of file
@@ -0,0 +1,244 @@
+package stealth
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FakeFile is a file of the fake tree listed by the autoindex persona.
+type FakeFile struct {
+	// Path is relative to the document root. A path ending in "/" is a
+	// directory, listed even if nothing is in it.
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// fakeFileTemplates are the files a generated tree picks from, with their
+// typical sizes: the leftovers of a personal file server.
+var fakeFileTemplates = []struct {
+	path string
+	size int64
+}{
+	{"backup/db-2024-01-14.sql.gz", 48213771},
+	{"backup/db-2024-02-11.sql.gz", 49877102},
+	{"backup/site.tar.gz", 312446208},
+	{"iso/SHA256SUMS", 202},
+	{"iso/debian-12.5.0-amd64-netinst.iso", 659554304},
+	{"iso/ubuntu-22.04.4-live-server-amd64.iso", 2104408064},
+	{"pub/docs/manual.pdf", 2845117},
+	{"pub/docs/notes.txt", 5120},
+	{"pub/photos-2023.zip", 154880012},
+	{"share/keys.asc", 3178},
+	{"share/music.tar", 734003200},
+	{"README.txt", 1834},
+}
+
+// GenerateFakeFiles returns the fake tree of the server for host. Like the
+// validators of the other personas, the choice of files, their sizes and
+// their modification times are derived from host, so that the tree stays the
+// same across requests and restarts but differs between servers.
+func GenerateFakeFiles(host string) []FakeFile {
+	var files []FakeFile
+	for i, t := range fakeFileTemplates {
+		sum := sha256.Sum256([]byte(host + "\x00" + t.path))
+		n := binary.BigEndian.Uint64(sum[:])
+		// A third of the files are left out, but never the README, so that
+		// the root is not empty
+		if n%3 == 0 && i != len(fakeFileTemplates)-1 {
+			continue
+		}
+		files = append(files, FakeFile{
+			Path:     t.path,
+			Size:     t.size + int64(binary.BigEndian.Uint64(sum[8:])%uint64(t.size/8+1)),
+			Modified: modTime(host, []byte(t.path)),
+		})
+	}
+	return files
+}
+
+// indexEntry is an entry of a directory listing.
+type indexEntry struct {
+	name     string
+	dir      bool
+	size     int64
+	modified time.Time
+}
+
+// listDir returns the entries of dir in files, "" being the root and any
+// other directory ending in "/", and false if there is no such directory.
+// The modification time of a directory is the latest of the files in it.
+func listDir(files []FakeFile, dir string) ([]indexEntry, bool) {
+	found := dir == ""
+	var entries []indexEntry
+	for _, f := range files {
+		rest, ok := strings.CutPrefix(strings.TrimPrefix(f.Path, "/"), dir)
+		if !ok {
+			continue
+		}
+		found = true
+		if rest == "" {
+			continue
+		}
+		name, _, isDir := strings.Cut(rest, "/")
+		i := slices.IndexFunc(entries, func(e indexEntry) bool { return e.name == name })
+		if i < 0 {
+			entries = append(entries, indexEntry{name: name})
+			i = len(entries) - 1
+		}
+		e := &entries[i]
+		if isDir {
+			e.dir = true
+			if f.Modified.After(e.modified) {
+				e.modified = f.Modified
+			}
+			continue
+		}
+		e.size = f.Size
+		e.modified = f.Modified
+	}
+	// Like nginx, directories come first, and each kind is sorted by name
+	slices.SortFunc(entries, func(a, b indexEntry) int {
+		if a.dir != b.dir {
+			if a.dir {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.name, b.name)
+	})
+	return entries, found
+}
+
+// isFakeFile reports whether name is a file, not a directory, in files.
+func isFakeFile(files []FakeFile, name string) bool {
+	return slices.ContainsFunc(files, func(f FakeFile) bool {
+		return !strings.HasSuffix(f.Path, "/") && strings.TrimPrefix(f.Path, "/") == name
+	})
+}
+
+// autoindexNameWidth is the width in characters of the name column of nginx
+// listings, which cuts longer names.
+const autoindexNameWidth = 50
+
+// nginxHTMLEscaper escapes names like ngx_escape_html.
+var nginxHTMLEscaper = strings.NewReplacer("<", "&lt;", ">", "&gt;", "&", "&amp;", `"`, "&quot;")
+
+// nginxEscapeHref escapes a name for the href of a listing like
+// ngx_escape_uri with NGX_ESCAPE_HTML.
+func nginxEscapeHref(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"#%'<>?`, c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// nginxAutoindexBody renders the listing of uri with entries exactly like the
+// HTML format of ngx_http_autoindex_module, with sizes in bytes as by the
+// default autoindex_exact_size on. Like nginx, even the root links to its
+// parent.
+func nginxAutoindexBody(uri string, entries []indexEntry) string {
+	var b strings.Builder
+	escapedURI := nginxHTMLEscaper.Replace(uri)
+	b.WriteString("<html>\r\n<head><title>Index of " + escapedURI + "</title></head>\r\n")
+	b.WriteString("<body>\r\n<h1>Index of " + escapedURI + "</h1>")
+	b.WriteString("<hr><pre><a href=\"../\">../</a>\r\n")
+	for _, e := range entries {
+		href := nginxEscapeHref(e.name)
+		if e.dir {
+			href += "/"
+		}
+		b.WriteString(`<a href="` + href + `">`)
+
+		n := utf8.RuneCountInString(e.name)
+		if n > autoindexNameWidth {
+			runes := []rune(e.name)
+			b.WriteString(nginxHTMLEscaper.Replace(string(runes[:autoindexNameWidth-3])) + "..&gt;</a>")
+		} else {
+			b.WriteString(nginxHTMLEscaper.Replace(e.name))
+			// The slash of a directory only fits if the name is shorter
+			if e.dir && n < autoindexNameWidth {
+				b.WriteString("/")
+				n++
+			}
+			b.WriteString("</a>" + strings.Repeat(" ", autoindexNameWidth-n))
+		}
+
+		b.WriteString(" " + e.modified.UTC().Format("02-Jan-2006 15:04") + " ")
+		if e.dir {
+			b.WriteString(fmt.Sprintf("%19s", "-"))
+		} else {
+			b.WriteString(fmt.Sprintf("%19d", e.size))
+		}
+		b.WriteString("\r\n")
+	}
+	b.WriteString("</pre><hr></body>\r\n</html>\r\n")
+	return b.String()
+}
+
+const nginxMovedPermanentlyBody = "<html>\r\n" +
+	"<head><title>301 Moved Permanently</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>301 Moved Permanently</h1></center>\r\n" +
+	"<hr><center>nginx/1.18.0 (Ubuntu)</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+// GetNginxAutoindex generates the response of nginx with autoindex on and
+// files as its document root to a request for urlPath on host. A directory
+// gets its listing, or a redirect to the path with the trailing slash if that
+// is missing, and a file gets 403 Forbidden like one the server cannot read.
+// Anything else gets the 404 page.
+func GetNginxAutoindex(host, urlPath string, files []FakeFile) Response {
+	name := strings.TrimPrefix(urlPath, "/")
+	if dir, ok := strings.CutSuffix(name, "/"); ok || name == "" {
+		if name != "" {
+			dir += "/"
+		}
+		entries, found := listDir(files, dir)
+		if !found {
+			return GetNginx404()
+		}
+		body := nginxAutoindexBody(urlPath, entries)
+		return Response{
+			Status: "200 OK",
+			Headers: []Header{
+				{"Server", NginxServer},
+				{"Date", date()},
+				{"Content-Type", "text/html"},
+				{"Content-Length", strconv.Itoa(len(body))},
+				{"Connection", "keep-alive"},
+			},
+			Body: []byte(body),
+		}
+	}
+
+	if isFakeFile(files, name) {
+		return GetNginx403()
+	}
+	if _, found := listDir(files, name+"/"); found {
+		return nginxMovedPermanently("https://" + host + urlPath + "/")
+	}
+	return GetNginx404()
+}
+
+// nginxMovedPermanently builds the redirect of nginx to location, such as
+// that to a directory requested without its trailing slash.
+func nginxMovedPermanently(location string) Response {
+	r := nginxErrorPage(NginxServer, "301 Moved Permanently", nginxMovedPermanentlyBody)
+	r.Headers = r.insertAfter("Content-Length", Header{"Location", location})
+	return r
+}
@@ -0,0 +1,94 @@
+package stealth
+
+import "fmt"
+
+const nginxBadRequestBody = `<html>
+<head><title>400 Bad Request</title></head>
+<body>
+<center><h1>400 Bad Request</h1></center>
+<hr><center>nginx/1.18.0 (Ubuntu)</center>
+</body>
+</html>
+`
+
+const openRestyBadRequestBody = `<html>
+<head><title>400 Bad Request</title></head>
+<body>
+<center><h1>400 Bad Request</h1></center>
+<hr><center>openresty/1.21.4.1</center>
+</body>
+</html>
+`
+
+const liteSpeedBadRequestBody = `<!DOCTYPE html>
+<html style="height:100%">
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no" />
+<title> 400 Bad Request
+</title></head>
+<body style="color: #444; margin:0;font: normal 14px/20px Arial, Helvetica, sans-serif; height:100%; background-color: #fff;">
+<div style="height:auto; min-height:100%; ">     <div style="text-align: center; width:800px; margin-left: -400px; position:absolute; top: 30%; left:50%;">
+        <h1 style="margin:0; font-size:150px; line-height:150px; font-weight:bold;">400</h1>
+<h2 style="margin-top:20px;font-size: 30px;">Bad Request
+</h2>
+<p>It is not a valid request!</p>
+</div></div></body></html>
+`
+
+const apacheBadRequestBody = `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>400 Bad Request</title>
+</head><body>
+<h1>Bad Request</h1>
+<p>Your browser sent a request that this server could not understand.<br />
+</p>
+<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at %s Port 443</address>
+</body></html>
+`
+
+const lighttpdBadRequestBody = `<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+         "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>400 Bad Request</title>
+ </head>
+ <body>
+  <h1>400 Bad Request</h1>
+ </body>
+</html>
+`
+
+// GetNginxBadRequestResponse generates the 400 Bad Request response that nginx
+// sends for a request it cannot parse. Like every server imitated here, nginx
+// closes the connection after it.
+func GetNginxBadRequestResponse() Response {
+	return nginxErrorPage(NginxServer, "400 Bad Request", nginxBadRequestBody).Close()
+}
+
+// GetApacheBadRequestResponse generates the 400 Bad Request response that Apache
+// sends for a request it cannot parse. Apache names the server in the error page,
+// so host should be the domain the proxy serves.
+func GetApacheBadRequestResponse(host string) Response {
+	return apacheErrorPage("400 Bad Request", fmt.Sprintf(apacheBadRequestBody, host)).Close()
+}
+
+// GetLighttpdBadRequestResponse generates the 400 Bad Request response that
+// lighttpd sends for a request it cannot parse.
+func GetLighttpdBadRequestResponse() Response {
+	return lighttpdErrorPage("400 Bad Request", lighttpdBadRequestBody).Close()
+}
+
+// GetOpenRestyBadRequestResponse generates the 400 Bad Request response that
+// OpenResty sends for a request it cannot parse, the nginx one with its own
+// name.
+func GetOpenRestyBadRequestResponse() Response {
+	return nginxErrorPage(OpenRestyServer, "400 Bad Request", openRestyBadRequestBody).Close()
+}
+
+// GetLiteSpeedBadRequestResponse generates the 400 Bad Request response that
+// LiteSpeed sends for a request it cannot parse.
+func GetLiteSpeedBadRequestResponse() Response {
+	return liteSpeedErrorPage("400 Bad Request", liteSpeedBadRequestBody).Close()
+}
@@ -1,22 +1,67 @@
 package stealth
 
 import (
-	"math/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/http"
 	"time"
 )
 
-// generatePastDate creates a random date in the past (within the last year)
-// and formats it for the "Last-Modified" HTTP header.
-func generatePastDate() string {
-	// Seed the random number generator to ensure different values on each run.
-	rand.Seed(time.Now().UnixNano())
+// modTimeEnd and modTimeWindow bound the modification times of the fake
+// files: the year before a date safely in the past.
+var (
+	modTimeEnd    = time.Date(2025, time.June, 1, 0, 0, 0, 0, time.UTC)
+	modTimeWindow = 365 * 24 * time.Hour
+)
+
+// modTime returns the modification time of a fake file with body on the
+// server for host. It is derived from both, so that it stays the same across
+// requests and restarts but differs between servers, and has the sub-second
+// precision of a real file system, which headers truncate to seconds.
+func modTime(host string, body []byte) time.Time {
+	h := sha256.New()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	h.Write(body)
+	n := binary.BigEndian.Uint64(h.Sum(nil))
+	return modTimeEnd.Add(-time.Duration(n % uint64(modTimeWindow)))
+}
 
-	// Generate a random number of days to subtract, from 1 to 365.
-	daysToSubtract := rand.Intn(365) + 1
+// etagFormat is the way a server makes the ETag of a static file.
+type etagFormat int
 
-	// Get the current time and subtract the random number of days.
-	lastModifiedTime := time.Now().AddDate(0, 0, -daysToSubtract)
+const (
+	// etagNone is for servers sending no ETag, such as lighttpd on Debian.
+	etagNone etagFormat = iota
+	// etagNginx is the modification time in seconds and the length in hex,
+	// as sent by nginx and OpenResty.
+	etagNginx
+	// etagApache is the length and the modification time in microseconds in
+	// hex, as by the FileETag MTime Size default of Apache 2.4.
+	etagApache
+	// etagLiteSpeed is the length, the modification time in seconds and the
+	// inode in hex, with the suffix of LiteSpeed.
+	etagLiteSpeed
+)
+
+// fileETag returns the ETag in format of a file with body modified at mtime,
+// or "" for etagNone. As mtime is derived from the content, by modTime, a file
+// has the same ETag on every request and across restarts.
+func fileETag(format etagFormat, mtime time.Time, body []byte) string {
+	switch format {
+	case etagNginx:
+		return fmt.Sprintf(`"%x-%x"`, mtime.Unix(), len(body))
+	case etagApache:
+		return fmt.Sprintf(`"%x-%x"`, len(body), mtime.UnixMicro())
+	case etagLiteSpeed:
+		return fmt.Sprintf(`"%x-%x-%x;;;"`, len(body), mtime.Unix(), liteSpeedInode)
+	default:
+		return ""
+	}
+}
 
-	// Format the time into the standard GMT format for HTTP headers.
-	return lastModifiedTime.UTC().Format(time.RFC1123)
+// lastModified formats t for the Last-Modified header.
+func lastModified(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
 }
@@ -0,0 +1,66 @@
+package stealth
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// notModifiedDropped are the headers describing the body, which a 304 Not
+// Modified response leaves out.
+var notModifiedDropped = []string{"Content-Type", "Content-Length", "Content-Encoding", "Accept-Ranges"}
+
+// Conditional returns the 304 Not Modified form of r if the conditional
+// headers of req show the client already has its body, and r otherwise.
+// If-None-Match is compared against the ETag of r, weakly like servers do for
+// GET, and takes precedence over If-Modified-Since, which is compared against
+// its Last-Modified. Only successful responses to GET and HEAD are
+// conditional, and a malformed If-Modified-Since is ignored.
+func (r Response) Conditional(req *http.Request) Response {
+	if r.Status != "200 OK" || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return r
+	}
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag := r.Get("ETag"); etag != "" && etagMatches(ifNoneMatch, etag) {
+			return r.notModified()
+		}
+		return r
+	}
+	if ifModifiedSince := req.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return r
+		}
+		lastModified, err := http.ParseTime(r.Get("Last-Modified"))
+		if err == nil && !lastModified.After(since) {
+			return r.notModified()
+		}
+	}
+	return r
+}
+
+// notModified returns the 304 Not Modified form of r, without its body and
+// the headers describing it.
+func (r Response) notModified() Response {
+	r.Status = "304 Not Modified"
+	r.Headers = slices.DeleteFunc(slices.Clone(r.Headers), func(h Header) bool {
+		return slices.Contains(notModifiedDropped, h.Name)
+	})
+	r.Body = nil
+	return r
+}
+
+// etagMatches reports whether the If-None-Match list matches etag, ignoring
+// whether either is weak.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
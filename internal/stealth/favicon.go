@@ -0,0 +1,9 @@
+package stealth
+
+import _ "embed"
+
+// GenericFavicon is a plain 16x16 icon of a gray disc, for sites that have a
+// favicon without giving anything away.
+//
+//go:embed favicon.ico
+var GenericFavicon []byte
@@ -0,0 +1,111 @@
+package stealth
+
+import (
+	"strconv"
+	"strings"
+)
+
+// GetNginxFile generates the response of nginx serving a static file of the
+// server for host, with an ETag made of the modification time and length of
+// the file in hex. The modification time is derived from host and body, so
+// that the Last-Modified and ETag of a file are the same on every request, as
+// they are for the files below.
+func GetNginxFile(host, contentType string, body []byte) Response {
+	return nginxFile(NginxServer, host, contentType, body)
+}
+
+// GetApacheFile generates the response of Apache serving a static file, with
+// an ETag made of the length and modification time in microseconds of the
+// file in hex, as by the FileETag MTime Size default of Apache 2.4. Like the
+// other file responses, it has no Cache-Control, as stock installs leave
+// caching to the Last-Modified and ETag validators.
+func GetApacheFile(host, contentType string, body []byte) Response {
+	mtime := modTime(host, body)
+
+	headers := []Header{
+		{"Date", date()},
+		{"Server", ApacheServer},
+		{"Last-Modified", lastModified(mtime)},
+		{"ETag", fileETag(etagApache, mtime, body)},
+		{"Accept-Ranges", "bytes"},
+		{"Content-Length", strconv.Itoa(len(body))},
+	}
+	// mod_deflate of Ubuntu only compresses text, and varies on it
+	if strings.HasPrefix(contentType, "text/") {
+		headers = append(headers, Header{"Vary", "Accept-Encoding"})
+	}
+	headers = append(headers,
+		Header{"Keep-Alive", "timeout=5, max=100"},
+		Header{"Connection", "Keep-Alive"},
+		Header{"Content-Type", contentType},
+	)
+
+	return Response{Status: "200 OK", Headers: headers, Body: body}
+}
+
+// GetLighttpdFile generates the response of lighttpd serving a static file.
+// The Debian configuration sends no ETag.
+func GetLighttpdFile(host, contentType string, body []byte) Response {
+	return Response{
+		Status: "200 OK",
+		Headers: []Header{
+			{"Content-Type", contentType},
+			{"Accept-Ranges", "bytes"},
+			{"Last-Modified", lastModified(modTime(host, body))},
+			{"Content-Length", strconv.Itoa(len(body))},
+			{"Connection", ""},
+			{"Date", date()},
+			{"Server", LighttpdServer},
+		},
+		Body: body,
+	}
+}
+
+// GetOpenRestyFile generates the response of OpenResty serving a static
+// file, with nginx's headers and ETag.
+func GetOpenRestyFile(host, contentType string, body []byte) Response {
+	return nginxFile(OpenRestyServer, host, contentType, body)
+}
+
+// GetLiteSpeedFile generates the response of LiteSpeed serving a static
+// file, with an ETag made of the length, modification time and inode of the
+// file in hex.
+func GetLiteSpeedFile(host, contentType string, body []byte) Response {
+	mtime := modTime(host, body)
+
+	return Response{
+		Status: "200 OK",
+		Headers: []Header{
+			{"Connection", "Keep-Alive"},
+			{"Content-Type", contentType},
+			{"Last-Modified", lastModified(mtime)},
+			{"ETag", fileETag(etagLiteSpeed, mtime, body)},
+			{"Accept-Ranges", "bytes"},
+			{"Content-Length", strconv.Itoa(len(body))},
+			{"Date", date()},
+			{"Server", LiteSpeedServer},
+		},
+		Body: body,
+	}
+}
+
+// nginxFile builds the response of nginx, or OpenResty with its server name,
+// serving a static file.
+func nginxFile(server, host, contentType string, body []byte) Response {
+	mtime := modTime(host, body)
+
+	return Response{
+		Status: "200 OK",
+		Headers: []Header{
+			{"Server", server},
+			{"Date", date()},
+			{"Content-Type", contentType},
+			{"Content-Length", strconv.Itoa(len(body))},
+			{"Last-Modified", lastModified(mtime)},
+			{"Connection", "keep-alive"},
+			{"ETag", fileETag(etagNginx, mtime, body)},
+			{"Accept-Ranges", "bytes"},
+		},
+		Body: body,
+	}
+}
@@ -0,0 +1,90 @@
+package stealth
+
+import "fmt"
+
+const nginxForbiddenBody = "<html>\r\n" +
+	"<head><title>403 Forbidden</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>403 Forbidden</h1></center>\r\n" +
+	"<hr><center>nginx/1.18.0 (Ubuntu)</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+const openRestyForbiddenBody = "<html>\r\n" +
+	"<head><title>403 Forbidden</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>403 Forbidden</h1></center>\r\n" +
+	"<hr><center>openresty/1.21.4.1</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+const apacheForbiddenBody = `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>403 Forbidden</title>
+</head><body>
+<h1>Forbidden</h1>
+<p>You don't have permission to access this resource.</p>
+<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at %s Port 443</address>
+</body></html>
+`
+
+const lighttpdForbiddenBody = `<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+         "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>403 Forbidden</title>
+ </head>
+ <body>
+  <h1>403 Forbidden</h1>
+ </body>
+</html>
+`
+
+const liteSpeedForbiddenBody = `<!DOCTYPE html>
+<html style="height:100%">
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no" />
+<title> 403 Forbidden
+</title></head>
+<body style="color: #444; margin:0;font: normal 14px/20px Arial, Helvetica, sans-serif; height:100%; background-color: #fff;">
+<div style="height:auto; min-height:100%; ">     <div style="text-align: center; width:800px; margin-left: -400px; position:absolute; top: 30%; left:50%;">
+        <h1 style="margin:0; font-size:150px; line-height:150px; font-weight:bold;">403</h1>
+<h2 style="margin-top:20px;font-size: 30px;">Forbidden
+</h2>
+<p>Access to this resource on the server is denied!</p>
+</div></div><div style="color:#f0f0f0; font-size:12px;margin:auto;padding:0px 30px 0px 30px;position:relative;clear:both;height:100px;margin-top:-101px;background-color:#474747;border-top: 1px solid rgba(0,0,0,0.15);box-shadow: 0 1px 0 rgba(255, 255, 255, 0.3) inset;">
+<br>Proudly powered by  <a style="color:#fff;" href="http://www.litespeedtech.com/error-page">LiteSpeed Web Server</a><p>Please be advised that LiteSpeed Technologies Inc. is not a web hosting company and, as such, has no control over content found elsewhere on this site.</p></div></body></html>
+`
+
+// GetNginx403 generates the 403 Forbidden response that nginx sends for a
+// path denied by its location rules.
+func GetNginx403() Response {
+	return nginxErrorPage(NginxServer, "403 Forbidden", nginxForbiddenBody)
+}
+
+// GetApache403 generates the 403 Forbidden response that Apache sends for
+// files it denies access to, such as .htaccess. host should be the domain the
+// proxy serves.
+func GetApache403(host string) Response {
+	return apacheErrorPage("403 Forbidden", fmt.Sprintf(apacheForbiddenBody, host))
+}
+
+// GetLighttpd403 generates the 403 Forbidden response that lighttpd sends for
+// a denied path.
+func GetLighttpd403() Response {
+	return lighttpdErrorPage("403 Forbidden", lighttpdForbiddenBody)
+}
+
+// GetOpenResty403 generates the 403 Forbidden response that OpenResty sends
+// for a denied path.
+func GetOpenResty403() Response {
+	return nginxErrorPage(OpenRestyServer, "403 Forbidden", openRestyForbiddenBody)
+}
+
+// GetLiteSpeed403 generates the 403 Forbidden response that LiteSpeed sends
+// for a denied path.
+func GetLiteSpeed403() Response {
+	return liteSpeedErrorPage("403 Forbidden", liteSpeedForbiddenBody)
+}
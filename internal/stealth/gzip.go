@@ -0,0 +1,139 @@
+package stealth
+
+import (
+	"bytes"
+	"compress/gzip"
+	"slices"
+	"strings"
+)
+
+// The compression levels of the stock configurations: gzip_comp_level of
+// nginx, and the zlib default for mod_deflate of Apache and LiteSpeed.
+const (
+	nginxGzipLevel     = 1
+	apacheGzipLevel    = 6
+	liteSpeedGzipLevel = 6
+)
+
+// gzipOS is the operating system in the gzip header, Unix, as zlib sets it on
+// the servers imitated here.
+const gzipOS = 3
+
+// gzipKey identifies a precompressed body.
+type gzipKey struct {
+	body  string
+	level int
+}
+
+// precompressed holds the gzip encodings of the fixed bodies of the personas,
+// signed by each version of nginx, made once at startup instead of for every
+// response.
+var precompressed = map[gzipKey][]byte{}
+
+func init() {
+	nginxBodies := []string{nginxHTMLBody, nginxNotFoundBody, nginxForbiddenBody, nginxNotAllowedBody, nginxBadRequestBody, nginxMovedPermanentlyBody, nginxTooManyRequestsBody}
+	for _, code := range ServerErrorCodes {
+		nginxBodies = append(nginxBodies, nginxServerErrorBody(NginxServer, nginxStatusLines[code]))
+	}
+	for _, version := range serverVersions[NginxServer] {
+		for _, body := range nginxBodies {
+			body := signedBody([]byte(body), NginxServer, version)
+			precompressed[gzipKey{string(body), nginxGzipLevel}] = compress(body, nginxGzipLevel)
+		}
+	}
+	precompressed[gzipKey{apacheHTMLBody, apacheGzipLevel}] = compress([]byte(apacheHTMLBody), apacheGzipLevel)
+	for _, body := range []string{liteSpeedHTMLBody, liteSpeedNotFoundBody, liteSpeedForbiddenBody, liteSpeedBadRequestBody, liteSpeedTooManyRequestsBody} {
+		precompressed[gzipKey{body, liteSpeedGzipLevel}] = compress([]byte(body), liteSpeedGzipLevel)
+	}
+}
+
+// compress returns the gzip encoding of body at level.
+func compress(body []byte, level int) []byte {
+	var b bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		panic(err)
+	}
+	zw.OS = gzipOS
+	zw.Write(body)
+	zw.Close()
+	return b.Bytes()
+}
+
+// gzipped returns r with its body compressed at level, using the
+// precompressed body if there is one.
+func (r Response) gzipped(level int) Response {
+	body, ok := precompressed[gzipKey{string(r.Body), level}]
+	if !ok {
+		body = compress(r.Body, level)
+	}
+	return r.withBody(body)
+}
+
+// mediaType returns the media type of r, without parameters.
+func (r Response) mediaType() string {
+	mediaType, _, _ := strings.Cut(r.Get("Content-Type"), ";")
+	return strings.TrimSpace(mediaType)
+}
+
+// GzipNginx returns r compressed like nginx with the gzip settings of Ubuntu,
+// which compress only text/html and do not add Vary. nginx makes the ETag of
+// a compressed response weak and drops Accept-Ranges.
+func GzipNginx(r Response) Response {
+	if r.mediaType() != "text/html" {
+		return r
+	}
+	r = r.gzipped(nginxGzipLevel)
+	r.Headers = r.without("Accept-Ranges")
+	for i, h := range r.Headers {
+		if h.Name == "ETag" {
+			r.Headers[i].Value = "W/" + h.Value
+		}
+	}
+	r.Headers = append(r.Headers, Header{"Content-Encoding", "gzip"})
+	return r
+}
+
+// apacheDeflateTypes are the media types mod_deflate compresses in Ubuntu.
+var apacheDeflateTypes = []string{
+	"text/html", "text/plain", "text/xml", "text/css", "text/javascript",
+	"application/x-javascript", "application/javascript", "application/ecmascript",
+	"application/rss+xml", "application/wasm", "application/xml",
+}
+
+// GzipApache returns r compressed like mod_deflate in its Ubuntu
+// configuration, which marks the ETag of the compressed response and sends
+// Vary before the encoding. Like mod_deflate, it leaves empty bodies alone.
+func GzipApache(r Response) Response {
+	if len(r.Body) == 0 || !slices.Contains(apacheDeflateTypes, r.mediaType()) {
+		return r
+	}
+	r = r.gzipped(apacheGzipLevel)
+	for i, h := range r.Headers {
+		if h.Name == "ETag" {
+			r.Headers[i].Value = strings.TrimSuffix(h.Value, `"`) + `-gzip"`
+		}
+	}
+	r.Headers = r.without("Vary")
+	r.Headers = r.insertBefore("Content-Length", Header{"Vary", "Accept-Encoding"}, Header{"Content-Encoding", "gzip"})
+	return r
+}
+
+// liteSpeedCompressibleTypes are the media types LiteSpeed compresses by
+// default, besides text.
+var liteSpeedCompressibleTypes = []string{
+	"application/x-javascript", "application/javascript", "application/xml",
+	"image/svg+xml", "application/rss+xml",
+}
+
+// GzipLiteSpeed returns r compressed like LiteSpeed, which compresses text by
+// default.
+func GzipLiteSpeed(r Response) Response {
+	mediaType := r.mediaType()
+	if !strings.HasPrefix(mediaType, "text/") && !slices.Contains(liteSpeedCompressibleTypes, mediaType) {
+		return r
+	}
+	r = r.gzipped(liteSpeedGzipLevel)
+	r.Headers = r.insertBefore("Content-Length", Header{"Content-Encoding", "gzip"}, Header{"Vary", "Accept-Encoding"})
+	return r
+}
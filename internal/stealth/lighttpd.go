@@ -0,0 +1,55 @@
+package stealth
+
+// The placeholder page installed by the Debian lighttpd package.
+const lighttpdHTMLBody = `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en">
+<head>
+<meta http-equiv="content-type" content="text/html; charset=UTF-8" />
+<title>Welcome page</title>
+<style type="text/css" media="screen">
+body { background: #e7e7e7; font-family: Verdana, sans-serif; font-size: 11pt; }
+#page { background: #ffffff; margin: 50px; border: 2px solid #c0c0c0; padding: 10px; }
+#header { background: #4b6983; border: 2px solid #7590ae; text-align: center; padding: 10px; color: #ffffff; }
+#header h1 { color: #ffffff; }
+#body { padding: 10px; }
+span.tt { font-family: monospace; }
+span.bold { font-weight: bold; }
+a:link { text-decoration: none; font-weight: bold; color: #C00; background: #ffc; }
+a:visited { text-decoration: none; font-weight: bold; color: #999; background: #ffc; }
+a:active { text-decoration: none; font-weight: bold; color: #F00; background: #FC0; }
+a:hover { text-decoration: none; color: #C00; background: #FC0; }
+</style>
+</head>
+<body>
+<div id="page">
+ <div id="header">
+ <h1> Placeholder page </h1>
+ The owner of this web site has not put up any web pages yet. Please come back later.
+ </div>
+ <div id="body">
+ <h2>You should replace this page with your own web pages as soon as possible.</h2>
+ Unless you changed its configuration, your new server is configured as follows:
+ <ul>
+ <li>Configuration files can be found in <span class="tt">/etc/lighttpd</span>. Please read <span class="tt">/etc/lighttpd/conf-available/README</span> file.</li>
+ <li>The DocumentRoot, which is the directory under which all your HTML files should exist, is set to <span class="tt">/var/www/html</span>.</li>
+ <li>CGI scripts are looked for in <span class="tt">/usr/lib/cgi-bin</span>, which is where Debian packages will place their scripts. You can enable cgi module by using command &quot;<span class="bold"><span class="tt">lighty-enable-mod cgi</span></span>&quot;.</li>
+ <li>Log files are placed in <span class="tt">/var/log/lighttpd</span>, and will be rotated weekly. The frequency of rotation can be easily changed by editing <span class="tt">/etc/logrotate.d/lighttpd</span>.</li>
+ <li>The default directory index is <span class="tt">index.html</span>, meaning that requests for a directory <span class="tt">/foo/bar/</span> will give the contents of the file <span class="tt">/var/www/html/foo/bar/index.html</span> if it exists (assuming that <span class="tt">/var/www/html</span> is your DocumentRoot).</li>
+ <li>You can enable user directories by using command &quot;<span class="bold"><span class="tt">lighty-enable-mod userdir</span></span>&quot;</li>
+ </ul>
+ <h2>About this page</h2>
+ <p>This is a placeholder page installed by the Debian release of the <a href="https://packages.debian.org/lighttpd">Lighttpd server package.</a></p>
+ <p>This computer has installed the Debian GNU/Linux operating system, but it has nothing to do with the Debian Project. Please do <span class="bold">not</span> contact the Debian Project about it.</p>
+ <p>If you find a bug in this Lighttpd package, or in Lighttpd itself, please file a bug report on it using the Debian bug reporting tool <span class="tt">reportbug</span>.</p>
+ </div>
+</div>
+</body>
+</html>
+`
+
+// GetLighttpdResponse generates a full HTTP response that mimics the Debian
+// lighttpd placeholder page. Unlike nginx and Apache, lighttpd sends the
+// Date and Server headers last.
+func GetLighttpdResponse(host string) Response {
+	return GetLighttpdFile(host, "text/html; charset=utf-8", []byte(lighttpdHTMLBody))
+}
@@ -0,0 +1,40 @@
+package stealth
+
+// liteSpeedInode is the inode of the default page, part of LiteSpeed's ETags.
+// It stays the same across responses, like that of a real file.
+const liteSpeedInode = 0x1c0a83
+
+// The default index page of LiteSpeed Web Server.
+const liteSpeedHTMLBody = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Congratulations! | LiteSpeed Web Server</title>
+<style>
+body { margin: 0; background: #f7f9fb; color: #3f4c5b; font: 15px/1.6 "Helvetica Neue", Helvetica, Arial, sans-serif; }
+.wrap { max-width: 760px; margin: 80px auto; padding: 40px; background: #fff; border-top: 4px solid #1c7cd6; }
+h1 { margin: 0 0 10px; font-size: 32px; color: #1c7cd6; }
+h2 { margin: 0 0 30px; font-size: 18px; font-weight: normal; }
+a { color: #1c7cd6; }
+</style>
+</head>
+<body>
+<div class="wrap">
+<h1>Congratulations!</h1>
+<h2>LiteSpeed Web Server is successfully installed and running.</h2>
+<p>You are seeing this page because the document root of this virtual host does not contain an index file yet.</p>
+<p>Upload your website to the document root of the virtual host to replace this page. Virtual hosts are configured in the WebAdmin console, which listens on port 7080 by default.</p>
+<p>For documentation and support, please visit <a href="https://docs.litespeedtech.com/">docs.litespeedtech.com</a>.</p>
+</div>
+</body>
+</html>
+`
+
+// GetLiteSpeedResponse generates a full HTTP response that mimics the default
+// page of LiteSpeed Web Server, which names itself without a version and sends
+// the Date and Server headers last. Its ETag is made of the length,
+// modification time and inode of the page in hex.
+func GetLiteSpeedResponse(host string) Response {
+	return GetLiteSpeedFile(host, "text/html", []byte(liteSpeedHTMLBody))
+}
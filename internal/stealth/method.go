@@ -0,0 +1,183 @@
+package stealth
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+)
+
+const nginxNotAllowedBody = "<html>\r\n" +
+	"<head><title>405 Not Allowed</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>405 Not Allowed</h1></center>\r\n" +
+	"<hr><center>nginx/1.18.0 (Ubuntu)</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+const openRestyNotAllowedBody = "<html>\r\n" +
+	"<head><title>405 Not Allowed</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>405 Not Allowed</h1></center>\r\n" +
+	"<hr><center>openresty/1.21.4.1</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+const apacheNotAllowedBody = `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>405 Method Not Allowed</title>
+</head><body>
+<h1>Method Not Allowed</h1>
+<p>The requested method %s is not allowed for this URL.</p>
+<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at %s Port 443</address>
+</body></html>
+`
+
+const apacheNotImplementedBody = `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>501 Not Implemented</title>
+</head><body>
+<h1>Not Implemented</h1>
+<p>%s not supported for current URL.<br />
+</p>
+<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at %s Port 443</address>
+</body></html>
+`
+
+const lighttpdErrorBody = `<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+         "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>%[1]s</title>
+ </head>
+ <body>
+  <h1>%[1]s</h1>
+ </body>
+</html>
+`
+
+const liteSpeedErrorBody = `<!DOCTYPE html>
+<html style="height:100%%">
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no" />
+<title> %[1]s %[2]s
+</title></head>
+<body style="color: #444; margin:0;font: normal 14px/20px Arial, Helvetica, sans-serif; height:100%%; background-color: #fff;">
+<div style="height:auto; min-height:100%%; ">     <div style="text-align: center; width:800px; margin-left: -400px; position:absolute; top: 30%%; left:50%%;">
+        <h1 style="margin:0; font-size:150px; line-height:150px; font-weight:bold;">%[1]s</h1>
+<h2 style="margin-top:20px;font-size: 30px;">%[2]s
+</h2>
+<p>%[3]s</p>
+</div></div><div style="color:#f0f0f0; font-size:12px;margin:auto;padding:0px 30px 0px 30px;position:relative;clear:both;height:100px;margin-top:-101px;background-color:#474747;border-top: 1px solid rgba(0,0,0,0.15);box-shadow: 0 1px 0 rgba(255, 255, 255, 0.3) inset;">
+<br>Proudly powered by  <a style="color:#fff;" href="http://www.litespeedtech.com/error-page">LiteSpeed Web Server</a><p>Please be advised that LiteSpeed Technologies Inc. is not a web hosting company and, as such, has no control over content found elsewhere on this site.</p></div></body></html>
+`
+
+// apacheAllow is the Allow header Apache sends for static files, which its
+// default handler also serves to POST.
+const apacheAllow = "GET,POST,OPTIONS,HEAD"
+
+// lighttpdAllow is the Allow header lighttpd sends to OPTIONS for the server
+// as a whole.
+const lighttpdAllow = "OPTIONS, GET, HEAD, POST"
+
+// GetNginx405 generates the 405 Not Allowed response that nginx sends for a
+// static file requested with a method other than GET and HEAD. nginx sends
+// no Allow header with it.
+func GetNginx405() Response {
+	return nginxErrorPage(NginxServer, "405 Not Allowed", nginxNotAllowedBody)
+}
+
+// GetOpenResty405 generates the 405 Not Allowed response of OpenResty, the
+// nginx one with its own name.
+func GetOpenResty405() Response {
+	return nginxErrorPage(OpenRestyServer, "405 Not Allowed", openRestyNotAllowedBody)
+}
+
+// GetApache405 generates the 405 Method Not Allowed response that Apache
+// sends for a static file requested with a method it knows but does not
+// serve files to. The page names the method and the server, so host should
+// be the domain the proxy serves.
+func GetApache405(method, host string) Response {
+	r := apacheErrorPage("405 Method Not Allowed", fmt.Sprintf(apacheNotAllowedBody, html.EscapeString(method), host))
+	r.Headers = slices.Insert(r.Headers, 2, Header{"Allow", apacheAllow})
+	return r
+}
+
+// GetApache501 generates the 501 Not Implemented response that Apache sends
+// for a method it does not know, after which it closes the connection.
+func GetApache501(method, host string) Response {
+	r := apacheErrorPage("501 Not Implemented", fmt.Sprintf(apacheNotImplementedBody, html.EscapeString(method), host))
+	r.Headers = slices.Insert(r.Headers, 2, Header{"Allow", apacheAllow})
+	return r.Close()
+}
+
+// GetLighttpd405 generates the 405 Method Not Allowed response that lighttpd
+// sends for a static file requested with a method other than GET and HEAD.
+func GetLighttpd405() Response {
+	r := lighttpdErrorPage("405 Method Not Allowed", fmt.Sprintf(lighttpdErrorBody, "405 Method Not Allowed"))
+	r.Headers = slices.Insert(r.Headers, 0, Header{"Allow", "GET, HEAD"})
+	return r
+}
+
+// GetLighttpd501 generates the 501 Not Implemented response that lighttpd
+// sends for a method it does not know, after which it closes the connection.
+func GetLighttpd501() Response {
+	return lighttpdErrorPage("501 Not Implemented", fmt.Sprintf(lighttpdErrorBody, "501 Not Implemented")).Close()
+}
+
+// GetLiteSpeed405 generates the 405 Method Not Allowed response that
+// LiteSpeed sends for a static file requested with a method other than GET
+// and HEAD.
+func GetLiteSpeed405() Response {
+	r := liteSpeedErrorPage("405 Method Not Allowed", fmt.Sprintf(liteSpeedErrorBody, "405", "Method Not Allowed", "This type request is not allowed!"))
+	r.Headers = slices.Insert(r.Headers, 1, Header{"Allow", "GET, HEAD"})
+	return r
+}
+
+// GetLiteSpeed501 generates the 501 Not Implemented response that LiteSpeed
+// sends for a method it does not know, after which it closes the connection.
+func GetLiteSpeed501() Response {
+	return liteSpeedErrorPage("501 Not Implemented", fmt.Sprintf(liteSpeedErrorBody, "501", "Not Implemented", "The request method is not implemented!")).Close()
+}
+
+// GetApacheOptions generates the response that Apache sends to OPTIONS, for a
+// path or for the server as a whole: the methods of static files, with TRACE
+// left out as TraceEnable Off in Ubuntu has it, and an empty body.
+func GetApacheOptions() Response {
+	return Response{
+		Status: "200 OK",
+		Headers: []Header{
+			{"Date", date()},
+			{"Server", ApacheServer},
+			{"Allow", apacheAllow},
+			{"Content-Length", "0"},
+			{"Keep-Alive", "timeout=5, max=100"},
+			{"Connection", "Keep-Alive"},
+			{"Content-Type", "text/html"},
+		},
+	}
+}
+
+// GetApacheTrace generates the response that Apache sends to TRACE with
+// TraceEnable Off, the Ubuntu default, before looking at the path.
+func GetApacheTrace(host string) Response {
+	return GetApache405(http.MethodTrace, host)
+}
+
+// GetLighttpdOptions generates the response that lighttpd sends to OPTIONS *,
+// which it answers itself without looking for a path.
+func GetLighttpdOptions() Response {
+	return Response{
+		Status: "200 OK",
+		Headers: []Header{
+			{"Allow", lighttpdAllow},
+			{"Content-Length", "0"},
+			{"Connection", ""},
+			{"Date", date()},
+			{"Server", LighttpdServer},
+		},
+	}
+}
@@ -1,10 +1,5 @@
 package stealth
 
-import (
-	"fmt"
-	"time"
-)
-
 const nginxHTMLBody = `<!DOCTYPE html>
 <html>
 <head>
@@ -31,33 +26,8 @@ Commercial support is available at
 </body>
 </html>`
 
-// GetNginxResponse generates a full HTTP response that mimics a standard Nginx server.
-func GetNginxResponse() []byte {
-	// Format the current date into the standard GMT format for HTTP headers.
-	date := time.Now().UTC().Format(time.RFC1123)
-
-	// Generate a realistic "Last-Modified" date.
-	lastModified := generatePastDate()
-
-	// Assemble headers that closely resemble a real Nginx response.
-	headers := fmt.Sprintf(
-		"HTTP/1.1 200 OK\r\n"+
-			"Server: nginx/1.18.0 (Ubuntu)\r\n"+
-			"Date: %s\r\n"+
-			"Content-Type: text/html\r\n"+
-			"Content-Length: %d\r\n"+
-			"Last-Modified: %s\r\n"+
-			"Connection: close\r\n"+
-			"ETag: \"5f4e3a9c-265\"\r\n"+
-			"Accept-Ranges: bytes\r\n"+
-			"\r\n",
-		date,
-		len(nginxHTMLBody),
-		lastModified,
-	)
-
-	// Combine headers and body to form the full response.
-	fullResponse := headers + nginxHTMLBody
-
-	return []byte(fullResponse)
+// GetNginxResponse generates a full HTTP response that mimics a standard Nginx server
+// serving its default page for host.
+func GetNginxResponse(host string) Response {
+	return GetNginxFile(host, "text/html", []byte(nginxHTMLBody))
 }
\ No newline at end of file
@@ -0,0 +1,92 @@
+package stealth
+
+import "fmt"
+
+// nginx ends the lines of its built-in error pages with CRLF.
+const nginxNotFoundBody = "<html>\r\n" +
+	"<head><title>404 Not Found</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>404 Not Found</h1></center>\r\n" +
+	"<hr><center>nginx/1.18.0 (Ubuntu)</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+const openRestyNotFoundBody = "<html>\r\n" +
+	"<head><title>404 Not Found</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>404 Not Found</h1></center>\r\n" +
+	"<hr><center>openresty/1.21.4.1</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+const apacheNotFoundBody = `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>404 Not Found</title>
+</head><body>
+<h1>Not Found</h1>
+<p>The requested URL was not found on this server.</p>
+<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at %s Port 443</address>
+</body></html>
+`
+
+const lighttpdNotFoundBody = `<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+         "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>404 Not Found</title>
+ </head>
+ <body>
+  <h1>404 Not Found</h1>
+ </body>
+</html>
+`
+
+const liteSpeedNotFoundBody = `<!DOCTYPE html>
+<html style="height:100%">
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no" />
+<title> 404 Not Found
+</title></head>
+<body style="color: #444; margin:0;font: normal 14px/20px Arial, Helvetica, sans-serif; height:100%; background-color: #fff;">
+<div style="height:auto; min-height:100%; ">     <div style="text-align: center; width:800px; margin-left: -400px; position:absolute; top: 30%; left:50%;">
+        <h1 style="margin:0; font-size:150px; line-height:150px; font-weight:bold;">404</h1>
+<h2 style="margin-top:20px;font-size: 30px;">Not Found
+</h2>
+<p>The resource requested could not be found on this server!</p>
+</div></div><div style="color:#f0f0f0; font-size:12px;margin:auto;padding:0px 30px 0px 30px;position:relative;clear:both;height:100px;margin-top:-101px;background-color:#474747;border-top: 1px solid rgba(0,0,0,0.15);box-shadow: 0 1px 0 rgba(255, 255, 255, 0.3) inset;">
+<br>Proudly powered by  <a style="color:#fff;" href="http://www.litespeedtech.com/error-page">LiteSpeed Web Server</a><p>Please be advised that LiteSpeed Technologies Inc. is not a web hosting company and, as such, has no control over content found elsewhere on this site.</p></div></body></html>
+`
+
+// GetNginx404 generates the 404 Not Found response that nginx sends for a
+// path missing from its document root.
+func GetNginx404() Response {
+	return nginxErrorPage(NginxServer, "404 Not Found", nginxNotFoundBody)
+}
+
+// GetApache404 generates the 404 Not Found response that Apache sends for a
+// path missing from its document root. Like the 400 page, it names the server,
+// so host should be the domain the proxy serves.
+func GetApache404(host string) Response {
+	return apacheErrorPage("404 Not Found", fmt.Sprintf(apacheNotFoundBody, host))
+}
+
+// GetLighttpd404 generates the 404 Not Found response that lighttpd sends for
+// a path missing from its document root.
+func GetLighttpd404() Response {
+	return lighttpdErrorPage("404 Not Found", lighttpdNotFoundBody)
+}
+
+// GetOpenResty404 generates the 404 Not Found response that OpenResty sends
+// for a path missing from its document root.
+func GetOpenResty404() Response {
+	return nginxErrorPage(OpenRestyServer, "404 Not Found", openRestyNotFoundBody)
+}
+
+// GetLiteSpeed404 generates the 404 Not Found response that LiteSpeed sends
+// for a path missing from its document root, with the footer of its error
+// pages.
+func GetLiteSpeed404() Response {
+	return liteSpeedErrorPage("404 Not Found", liteSpeedNotFoundBody)
+}
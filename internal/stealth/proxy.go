@@ -2,7 +2,7 @@ package stealth
 
 import (
 	"bufio"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net"
@@ -11,25 +11,31 @@ import (
 )
 
 // ProxyRequest forwards the client's request to a specified proxy URL and streams the response.
-func ProxyRequest(clientReader *bufio.Reader, clientConn net.Conn, proxyURL string) {
+// Unless domain is empty, a request for another host gets the welcome page of
+// nginx instead, like from the default server next to the proxied site.
+func ProxyRequest(clientReader *bufio.Reader, clientConn net.Conn, proxyURL, domain string, logger *log.Logger) {
 	defer clientConn.Close()
 
 	// Read the full initial request from the client.
 	req, err := http.ReadRequest(clientReader)
 	if err != nil {
 		if err != io.EOF {
-			log.Printf("Error reading request from client: %v", err)
+			logger.Printf("Error reading request from client: %v", err)
 		}
 		return
 	}
+	if domain != "" && !MatchesHost(req.Host, domain) {
+		logger.Printf("Serving the default server page for host %q instead of proxying", req.Host)
+		clientConn.Write(GetNginxResponse(domain).Close().Bytes())
+		return
+	}
 
 	// Parse the target proxy URL.
 	targetURL, err := url.Parse(proxyURL)
 	if err != nil {
-		log.Printf("Error parsing proxy URL '%s': %v", proxyURL, err)
-		// Manually write a simple 500 error response.
-		errorResponse := "HTTP/1.0 500 Internal Server Error\r\nConnection: close\r\n\r\n"
-		clientConn.Write([]byte(errorResponse))
+		logger.Printf("Error parsing proxy URL '%s': %v", proxyURL, err)
+		// Answer like nginx with a broken proxy_pass
+		clientConn.Write(GetNginx50x(http.StatusInternalServerError).Bytes())
 		return
 	}
 
@@ -42,20 +48,23 @@ func ProxyRequest(clientReader *bufio.Reader, clientConn net.Conn, proxyURL stri
 	}
 
 	// Execute the request using the default HTTP client.
-	log.Printf("Proxying request for %s to %s", req.RemoteAddr, targetURL)
+	logger.Printf("Proxying request for %s to %s", req.RemoteAddr, targetURL)
 	resp, err := http.DefaultClient.Do(outReq)
 	if err != nil {
-		log.Printf("Error forwarding request to proxy target '%s': %v", targetURL, err)
-		// Manually write a simple 502 error response. This is more reliable
-		// than http.Response.Write for simple, bodiless error responses.
-		errorResponse := fmt.Sprintf("HTTP/1.0 %d %s\r\nConnection: close\r\n\r\n", http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
-		clientConn.Write([]byte(errorResponse))
+		logger.Printf("Error forwarding request to proxy target '%s': %v", targetURL, err)
+		// Answer like nginx in front of an upstream that is down, or too slow
+		code := http.StatusBadGateway
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			code = http.StatusGatewayTimeout
+		}
+		clientConn.Write(GetNginx50x(code).Close().Bytes())
 		return
 	}
 	defer resp.Body.Close()
 
 	// Write the response from the target back to the client.
 	if err := resp.Write(clientConn); err != nil {
-		log.Printf("Error writing proxy response to client: %v", err)
+		logger.Printf("Error writing proxy response to client: %v", err)
 	}
 }
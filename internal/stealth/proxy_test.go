@@ -3,11 +3,16 @@ package stealth
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -17,16 +22,254 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-// TestGeneratePastDate checks that the generated date is in the correct format.
-func TestGeneratePastDate(t *testing.T) {
-	dateStr := generatePastDate()
-	_, err := time.Parse(time.RFC1123, dateStr)
-	assert.NoError(t, err, "The generated date should be in RFC1123 format")
+// TestModTime checks that the modification times of the fake files are the
+// same for a file and server, differ between them, and are in the past.
+func TestModTime(t *testing.T) {
+	body := []byte("body")
+	mtime := modTime("example.com", body)
+	assert.Equal(t, mtime, modTime("example.com", body))
+	assert.NotEqual(t, mtime, modTime("example.org", body))
+	assert.NotEqual(t, mtime, modTime("example.com", []byte("other body")))
+	assert.True(t, mtime.Before(modTimeEnd))
+	assert.True(t, mtime.After(modTimeEnd.Add(-modTimeWindow)))
+
+	parsed, err := time.Parse(http.TimeFormat, lastModified(mtime))
+	require.NoError(t, err)
+	assert.Equal(t, mtime.Truncate(time.Second), parsed)
+}
+
+// TestValidators checks that the Last-Modified and ETag of each server are
+// stable across requests, in the format of the server and consistent with
+// each other and the length of the body.
+func TestValidators(t *testing.T) {
+	testCases := []struct {
+		name     string
+		response func() Response
+		etag     func(mtime time.Time, size int) string
+	}{
+		{
+			name:     "Nginx",
+			response: func() Response { return GetNginxResponse("example.com") },
+			etag:     func(mtime time.Time, size int) string { return fmt.Sprintf(`"%x-%x"`, mtime.Unix(), size) },
+		},
+		{
+			name:     "OpenResty",
+			response: func() Response { return GetOpenRestyResponse("example.com") },
+			etag:     func(mtime time.Time, size int) string { return fmt.Sprintf(`"%x-%x"`, mtime.Unix(), size) },
+		},
+		{
+			name:     "Apache",
+			response: func() Response { return GetApacheResponse("example.com") },
+			etag:     func(mtime time.Time, size int) string { return fmt.Sprintf(`"%x-%x"`, size, mtime.UnixMicro()) },
+		},
+		{
+			name:     "LiteSpeed",
+			response: func() Response { return GetLiteSpeedResponse("example.com") },
+			etag: func(mtime time.Time, size int) string {
+				return fmt.Sprintf(`"%x-%x-%x;;;"`, size, mtime.Unix(), liteSpeedInode)
+			},
+		},
+		{
+			name:     "Lighttpd",
+			response: func() Response { return GetLighttpdResponse("example.com") },
+			etag:     func(time.Time, int) string { return "" },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			first := tc.response()
+			second := tc.response()
+			assert.Equal(t, first.Get("Last-Modified"), second.Get("Last-Modified"))
+			assert.Equal(t, first.Get("ETag"), second.Get("ETag"))
+
+			mtime := modTime("example.com", first.Body)
+			assert.Equal(t, lastModified(mtime), first.Get("Last-Modified"))
+			assert.Equal(t, tc.etag(mtime, len(first.Body)), first.Get("ETag"))
+		})
+	}
+}
+
+// TestFileETag checks the ETag of each format, that the length in it is that
+// of the body, and that the ETag of a file only depends on the host and the
+// content, so that it is the same after a restart.
+func TestFileETag(t *testing.T) {
+	body := []byte(nginxHTMLBody)
+	mtime := modTime("example.com", body)
+	testCases := []struct {
+		name     string
+		format   etagFormat
+		expected string
+	}{
+		{name: "Nginx", format: etagNginx, expected: `"6789ab5e-263"`},
+		{name: "Apache", format: etagApache, expected: `"263-62bdc6b1d138a"`},
+		{name: "LiteSpeed", format: etagLiteSpeed, expected: `"263-6789ab5e-1c0a83;;;"`},
+		{name: "None", format: etagNone},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, fileETag(tc.format, mtime, body))
+		})
+	}
+
+	// The size field of nginx is the length of the body it is sent with
+	for _, response := range []Response{GetNginxResponse("example.com"), GetOpenRestyResponse("example.com"), GetNginxFile("example.org", "text/css", []byte("body {}"))} {
+		etag := strings.Trim(response.Get("ETag"), `"`)
+		_, size, ok := strings.Cut(etag, "-")
+		require.True(t, ok, "unexpected ETag %s", etag)
+		length, err := strconv.ParseInt(size, 16, 64)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(response.Body)), length)
+	}
+	assert.NotEqual(t, fileETag(etagNginx, mtime, body), GetNginxResponse("example.org").Get("ETag"))
+}
+
+// TestServerVersion checks that the version claimed for a host is one of the
+// releases of the server and the same on every call, and that hosts do not all
+// claim the same one.
+func TestServerVersion(t *testing.T) {
+	for server, versions := range serverVersions {
+		t.Run(server, func(t *testing.T) {
+			seen := map[string]bool{}
+			for i := 0; i < 100; i++ {
+				host := fmt.Sprintf("host%d.example.com", i)
+				version := ServerVersion(server, host)
+				assert.Contains(t, versions, version)
+				assert.Equal(t, version, ServerVersion(server, host))
+				seen[version] = true
+			}
+			assert.Len(t, seen, len(versions))
+		})
+	}
+	assert.Equal(t, "Caddy", ServerVersion("Caddy", "example.com"))
+}
+
+// TestWithServer checks that the Server header and the signature of the error
+// pages are rewritten, with the Content-Length of the new body, and that the
+// rewritten pages of nginx are precompressed.
+func TestWithServer(t *testing.T) {
+	testCases := []struct {
+		name             string
+		response         Response
+		server           string
+		expectedContains string
+	}{
+		{name: "Nginx page", response: GetNginxResponse("example.com"), server: "nginx/1.24.0 (Ubuntu)", expectedContains: "Welcome to nginx!"},
+		{name: "Nginx 404", response: GetNginx404(), server: "nginx/1.24.0 (Ubuntu)", expectedContains: "<hr><center>nginx/1.24.0 (Ubuntu)</center>"},
+		{name: "Nginx 502", response: GetNginx50x(http.StatusBadGateway), server: "nginx/1.22.1", expectedContains: "<hr><center>nginx/1.22.1</center>"},
+		{name: "Nginx without version", response: GetNginx403(), server: "nginx", expectedContains: "<hr><center>nginx</center>"},
+		{name: "OpenResty 405", response: GetOpenResty405(), server: "openresty/1.25.3.2", expectedContains: "<hr><center>openresty/1.25.3.2</center>"},
+		{name: "Apache 404", response: GetApache404("example.com"), server: "Apache/2.4.58 (Ubuntu)", expectedContains: "<address>Apache/2.4.58 (Ubuntu) Server at example.com Port 443</address>"},
+		{name: "Apache 401", response: GetApache401("Restricted", "example.com"), server: "Apache", expectedContains: "<address>Apache Server at example.com Port 443</address>"},
+		{name: "Lighttpd 404", response: GetLighttpd404(), server: "lighttpd/1.4.74", expectedContains: "404 Not Found"},
+		{name: "Same server", response: GetNginx404(), server: NginxServer, expectedContains: "<hr><center>" + NginxServer + "</center>"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stock := tc.response.Get("Server")
+			response := tc.response.WithServer(tc.server)
+			assert.Equal(t, tc.server, response.Get("Server"))
+			assert.Contains(t, string(response.Body), tc.expectedContains)
+			assert.Equal(t, strconv.Itoa(len(response.Body)), response.Get("Content-Length"))
+			assert.Equal(t, len(tc.response.Headers), len(response.Headers))
+			// The response rewritten is left alone
+			assert.Equal(t, stock, tc.response.Get("Server"))
+		})
+	}
+
+	for _, version := range serverVersions[NginxServer] {
+		body := GetNginx404().WithServer(version).Body
+		assert.Contains(t, precompressed, gzipKey{string(body), nginxGzipLevel}, version)
+	}
+}
+
+// TestResponseHead checks that a response is written with its headers in
+// order, and that its head parses as the response to HEAD without the body.
+func TestResponseHead(t *testing.T) {
+	response := Response{
+		Status:  "200 OK",
+		Headers: []Header{{"Server", "nginx"}, {"Content-Length", "5"}, {"Connection", "close"}},
+		Body:    []byte("hello"),
+	}
+	expectedHead := "HTTP/1.1 200 OK\r\nServer: nginx\r\nContent-Length: 5\r\nConnection: close\r\n\r\n"
+	assert.Equal(t, expectedHead, string(response.Head()))
+	assert.Equal(t, expectedHead+"hello", string(response.Bytes()))
+
+	parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response.Head())), &http.Request{Method: http.MethodHead})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), parsed.ContentLength)
+	body, err := ioutil.ReadAll(parsed.Body)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	response.Proto = "HTTP/1.0"
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nServer: nginx\r\nContent-Length: 5\r\nConnection: close\r\n\r\n", string(response.Head()))
+}
+
+// TestResponseWith checks that With sets a header in place, and leaves it
+// out but keeps its place for an empty value.
+func TestResponseWith(t *testing.T) {
+	response := GetLighttpd404()
+	kept := response.With("Connection", "keep-alive")
+	assert.Contains(t, string(kept.Head()), "Content-Length: 341\r\nConnection: keep-alive\r\nDate: ")
+	assert.Empty(t, response.Get("Connection"), "With must not change the response it is called on")
+
+	closed := response.Close().With("Connection", "")
+	assert.NotContains(t, string(closed.Head()), "Connection")
+	assert.Equal(t, "keep-alive", closed.With("Connection", "keep-alive").Get("Connection"))
+}
+
+// TestResponseKeepAlive checks the connection headers of responses kept alive
+// and closed, each in the place and form of its server.
+func TestResponseKeepAlive(t *testing.T) {
+	testCases := []struct {
+		name              string
+		response          Response
+		expectedKeepAlive string
+		expectedClose     string
+	}{
+		{
+			name:              "Nginx",
+			response:          GetNginx404(),
+			expectedKeepAlive: "Content-Length: 162\r\nConnection: keep-alive\r\n\r\n",
+			expectedClose:     "Content-Length: 162\r\nConnection: close\r\n\r\n",
+		},
+		{
+			name:              "Apache",
+			response:          GetApache404("example.com"),
+			expectedKeepAlive: "Content-Length: 274\r\nKeep-Alive: timeout=65, max=99\r\nConnection: Keep-Alive\r\nContent-Type: ",
+			expectedClose:     "Content-Length: 274\r\nConnection: close\r\nContent-Type: ",
+		},
+		{
+			name:              "Lighttpd",
+			response:          GetLighttpd404(),
+			expectedKeepAlive: "Content-Length: 341\r\nDate: ",
+			expectedClose:     "Content-Length: 341\r\nConnection: close\r\nDate: ",
+		},
+		{
+			name:              "LiteSpeed",
+			response:          GetLiteSpeed404(),
+			expectedKeepAlive: "HTTP/1.1 404 Not Found\r\nConnection: Keep-Alive\r\n",
+			expectedClose:     "HTTP/1.1 404 Not Found\r\nConnection: close\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keepAlive := tc.response.KeepAlive(65*time.Second, 99)
+			assert.Contains(t, string(keepAlive.Head()), tc.expectedKeepAlive)
+			assert.Equal(t, "", keepAlive.Close().Get("Keep-Alive"))
+			assert.Contains(t, string(keepAlive.Close().Head()), tc.expectedClose)
+			assert.NotEqual(t, "close", keepAlive.Get("Connection"), "Close must not change the response it is called on")
+		})
+	}
 }
 
 // TestGetNginxResponse checks the fake Nginx response.
 func TestGetNginxResponse(t *testing.T) {
-	responseBytes := GetNginxResponse()
+	responseBytes := GetNginxResponse("example.com").Bytes()
 	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(responseBytes)), nil)
 	require.NoError(t, err)
 
@@ -41,7 +284,7 @@ func TestGetNginxResponse(t *testing.T) {
 
 // TestGetApacheResponse checks the fake Apache response.
 func TestGetApacheResponse(t *testing.T) {
-	responseBytes := GetApacheResponse()
+	responseBytes := GetApacheResponse("example.com").Bytes()
 	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(responseBytes)), nil)
 	require.NoError(t, err)
 
@@ -54,6 +297,1374 @@ func TestGetApacheResponse(t *testing.T) {
 	assert.Contains(t, string(body), "Apache2 Ubuntu Default Page")
 }
 
+// TestGetLighttpdResponse checks the fake lighttpd response against the
+// headers of the Debian package: charset in the Content-Type, no ETag, and
+// Date and Server last.
+func TestGetLighttpdResponse(t *testing.T) {
+	responseBytes := GetLighttpdResponse("example.com").Bytes()
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(responseBytes)), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "200 OK", response.Status)
+	assert.Equal(t, "lighttpd/1.4.63", response.Header.Get("Server"))
+	assert.Equal(t, "text/html; charset=utf-8", response.Header.Get("Content-Type"))
+	assert.Empty(t, response.Header.Get("ETag"))
+	_, err = time.Parse(http.TimeFormat, response.Header.Get("Last-Modified"))
+	assert.NoError(t, err)
+	header, _, _ := strings.Cut(string(responseBytes), "\r\n\r\n")
+	assert.True(t, strings.HasSuffix(header, "\r\nServer: lighttpd/1.4.63"), "Server must be the last header")
+
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.Equal(t, response.ContentLength, int64(len(body)))
+	assert.Contains(t, string(body), "<title>Welcome page</title>")
+	assert.Contains(t, string(body), "Placeholder page")
+}
+
+// TestGetOpenRestyResponse checks the fake OpenResty response: nginx's header
+// order, and an ETag of the modification time and length.
+func TestGetOpenRestyResponse(t *testing.T) {
+	responseBytes := GetOpenRestyResponse("example.com").Bytes()
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(responseBytes)), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "200 OK", response.Status)
+	assert.Equal(t, "openresty/1.21.4.1", response.Header.Get("Server"))
+	assert.Equal(t, "text/html", response.Header.Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(string(responseBytes), "HTTP/1.1 200 OK\r\nServer: openresty/1.21.4.1\r\nDate: "))
+
+	lastModified, err := time.Parse(http.TimeFormat, response.Header.Get("Last-Modified"))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`"%x-%x"`, lastModified.Unix(), response.ContentLength), response.Header.Get("ETag"))
+
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.Equal(t, response.ContentLength, int64(len(body)))
+	assert.Contains(t, string(body), "<title>Welcome to OpenResty!</title>")
+}
+
+// TestGetLiteSpeedResponse checks the fake LiteSpeed response: a Server
+// header without version, no X-Turbo-Charged-By, and an ETag of the length,
+// modification time and inode.
+func TestGetLiteSpeedResponse(t *testing.T) {
+	responseBytes := GetLiteSpeedResponse("example.com").Bytes()
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(responseBytes)), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "200 OK", response.Status)
+	assert.Equal(t, "LiteSpeed", response.Header.Get("Server"))
+	assert.Equal(t, "text/html", response.Header.Get("Content-Type"))
+	assert.Empty(t, response.Header.Get("X-Turbo-Charged-By"))
+	_, err = time.Parse(http.TimeFormat, response.Header.Get("Date"))
+	assert.NoError(t, err)
+
+	lastModified, err := time.Parse(http.TimeFormat, response.Header.Get("Last-Modified"))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`"%x-%x-%x;;;"`, response.ContentLength, lastModified.Unix(), liteSpeedInode), response.Header.Get("ETag"))
+
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.Equal(t, response.ContentLength, int64(len(body)))
+	assert.Contains(t, string(body), "LiteSpeed Web Server is successfully installed")
+}
+
+// TestGetBadRequestResponses checks the fake 400 Bad Request responses.
+func TestGetBadRequestResponses(t *testing.T) {
+	testCases := []struct {
+		name           string
+		response       []byte
+		expectedServer string
+		expectedBody   string
+	}{
+		{
+			name:           "Nginx",
+			response:       GetNginxBadRequestResponse().Bytes(),
+			expectedServer: "nginx/1.18.0 (Ubuntu)",
+			expectedBody:   "<center><h1>400 Bad Request</h1></center>",
+		},
+		{
+			name:           "Apache",
+			response:       GetApacheBadRequestResponse("example.com").Bytes(),
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedBody:   "Server at example.com Port 443",
+		},
+		{
+			name:           "OpenResty",
+			response:       GetOpenRestyBadRequestResponse().Bytes(),
+			expectedServer: "openresty/1.21.4.1",
+			expectedBody:   "<hr><center>openresty/1.21.4.1</center>",
+		},
+		{
+			name:           "LiteSpeed",
+			response:       GetLiteSpeedBadRequestResponse().Bytes(),
+			expectedServer: "LiteSpeed",
+			expectedBody:   "<p>It is not a valid request!</p>",
+		},
+		{
+			name:           "Lighttpd",
+			response:       GetLighttpdBadRequestResponse().Bytes(),
+			expectedServer: "lighttpd/1.4.63",
+			expectedBody:   "<h1>400 Bad Request</h1>",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(tc.response)), nil)
+			require.NoError(t, err)
+
+			assert.Equal(t, "400 Bad Request", response.Status)
+			assert.Equal(t, tc.expectedServer, response.Header.Get("Server"))
+			assert.True(t, response.Close)
+
+			body, err := ioutil.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, response.ContentLength, int64(len(body)))
+			assert.Contains(t, string(body), tc.expectedBody)
+		})
+	}
+}
+
+// TestGetFileResponses checks the static file responses of each persona:
+// the given content type and body, and an ETag in the format of the server.
+func TestGetFileResponses(t *testing.T) {
+	const body = "User-agent: *\nDisallow: /\n"
+	testCases := []struct {
+		name           string
+		response       []byte
+		expectedServer string
+		expectedType   string
+		expectedETag   func(lastModified time.Time) string
+	}{
+		{
+			name:           "Nginx",
+			response:       GetNginxFile("example.com", "text/plain", []byte(body)).Bytes(),
+			expectedServer: "nginx/1.18.0 (Ubuntu)",
+			expectedType:   "text/plain",
+			expectedETag:   func(lm time.Time) string { return fmt.Sprintf(`"%x-%x"`, lm.Unix(), len(body)) },
+		},
+		{
+			name:           "Apache",
+			response:       GetApacheFile("example.com", "text/plain", []byte(body)).Bytes(),
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedType:   "text/plain",
+			expectedETag: func(lm time.Time) string {
+				// The microseconds of the modification time are not in Last-Modified
+				mtime := modTime("example.com", []byte(body))
+				if !mtime.Truncate(time.Second).Equal(lm) {
+					return "modification time differs from Last-Modified"
+				}
+				return fmt.Sprintf(`"%x-%x"`, len(body), mtime.UnixMicro())
+			},
+		},
+		{
+			name:           "Lighttpd",
+			response:       GetLighttpdFile("example.com", "text/plain; charset=utf-8", []byte(body)).Bytes(),
+			expectedServer: "lighttpd/1.4.63",
+			expectedType:   "text/plain; charset=utf-8",
+			expectedETag:   func(time.Time) string { return "" },
+		},
+		{
+			name:           "OpenResty",
+			response:       GetOpenRestyFile("example.com", "text/plain", []byte(body)).Bytes(),
+			expectedServer: "openresty/1.21.4.1",
+			expectedType:   "text/plain",
+			expectedETag:   func(lm time.Time) string { return fmt.Sprintf(`"%x-%x"`, lm.Unix(), len(body)) },
+		},
+		{
+			name:           "LiteSpeed",
+			response:       GetLiteSpeedFile("example.com", "text/plain", []byte(body)).Bytes(),
+			expectedServer: "LiteSpeed",
+			expectedType:   "text/plain",
+			expectedETag: func(lm time.Time) string {
+				return fmt.Sprintf(`"%x-%x-%x;;;"`, len(body), lm.Unix(), liteSpeedInode)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(tc.response)), nil)
+			require.NoError(t, err)
+
+			assert.Equal(t, "200 OK", response.Status)
+			assert.Equal(t, tc.expectedServer, response.Header.Get("Server"))
+			assert.Equal(t, tc.expectedType, response.Header.Get("Content-Type"))
+			lastModified, err := time.Parse(http.TimeFormat, response.Header.Get("Last-Modified"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedETag(lastModified), response.Header.Get("ETag"))
+
+			received, err := ioutil.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(received))
+		})
+	}
+}
+
+// TestGetFileBinary checks that icons are served byte for byte, and that
+// Apache only varies text responses on Accept-Encoding.
+func TestGetFileBinary(t *testing.T) {
+	// ICONDIR header: reserved, type 1 (icon), one image
+	require.Greater(t, len(GenericFavicon), 6)
+	assert.Equal(t, []byte{0, 0, 1, 0, 1, 0}, GenericFavicon[:6])
+
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(GetApacheFile("example.com", "image/vnd.microsoft.icon", GenericFavicon).Bytes())), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "image/vnd.microsoft.icon", response.Header.Get("Content-Type"))
+	assert.Equal(t, int64(len(GenericFavicon)), response.ContentLength)
+	assert.Empty(t, response.Header.Get("Vary"))
+	assert.Empty(t, response.Header.Get("Cache-Control"))
+
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.Equal(t, GenericFavicon, body)
+
+	response, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(GetApacheFile("example.com", "text/plain", []byte("text")).Bytes())), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Accept-Encoding", response.Header.Get("Vary"))
+}
+
+// TestGet404Responses compares the fake 404 Not Found responses with
+// captures of the real servers, apart from the Date header. The captures are
+// of the last response on a connection.
+func TestGet404Responses(t *testing.T) {
+	testCases := []struct {
+		name     string
+		response []byte
+		capture  string
+	}{
+		{
+			name:     "Nginx",
+			response: GetNginx404().Close().Bytes(),
+			capture: "HTTP/1.1 404 Not Found\r\n" +
+				"Server: nginx/1.18.0 (Ubuntu)\r\n" +
+				"Date: Tue, 14 Oct 2025 09:12:45 GMT\r\n" +
+				"Content-Type: text/html\r\n" +
+				"Content-Length: 162\r\n" +
+				"Connection: close\r\n" +
+				"\r\n" +
+				"<html>\r\n" +
+				"<head><title>404 Not Found</title></head>\r\n" +
+				"<body>\r\n" +
+				"<center><h1>404 Not Found</h1></center>\r\n" +
+				"<hr><center>nginx/1.18.0 (Ubuntu)</center>\r\n" +
+				"</body>\r\n" +
+				"</html>\r\n",
+		},
+		{
+			name:     "Apache",
+			response: GetApache404("example.com").Close().Bytes(),
+			capture: "HTTP/1.1 404 Not Found\r\n" +
+				"Date: Tue, 14 Oct 2025 09:12:45 GMT\r\n" +
+				"Server: Apache/2.4.41 (Ubuntu)\r\n" +
+				"Content-Length: 274\r\n" +
+				"Connection: close\r\n" +
+				"Content-Type: text/html; charset=iso-8859-1\r\n" +
+				"\r\n" +
+				"<!DOCTYPE HTML PUBLIC \"-//IETF//DTD HTML 2.0//EN\">\n" +
+				"<html><head>\n" +
+				"<title>404 Not Found</title>\n" +
+				"</head><body>\n" +
+				"<h1>Not Found</h1>\n" +
+				"<p>The requested URL was not found on this server.</p>\n" +
+				"<hr>\n" +
+				"<address>Apache/2.4.41 (Ubuntu) Server at example.com Port 443</address>\n" +
+				"</body></html>\n",
+		},
+		{
+			name:     "OpenResty",
+			response: GetOpenResty404().Close().Bytes(),
+			capture: "HTTP/1.1 404 Not Found\r\n" +
+				"Server: openresty/1.21.4.1\r\n" +
+				"Date: Tue, 14 Oct 2025 09:12:45 GMT\r\n" +
+				"Content-Type: text/html\r\n" +
+				"Content-Length: 159\r\n" +
+				"Connection: close\r\n" +
+				"\r\n" +
+				"<html>\r\n" +
+				"<head><title>404 Not Found</title></head>\r\n" +
+				"<body>\r\n" +
+				"<center><h1>404 Not Found</h1></center>\r\n" +
+				"<hr><center>openresty/1.21.4.1</center>\r\n" +
+				"</body>\r\n" +
+				"</html>\r\n",
+		},
+		{
+			name:     "Lighttpd",
+			response: GetLighttpd404().Close().Bytes(),
+			capture: "HTTP/1.1 404 Not Found\r\n" +
+				"Content-Type: text/html\r\n" +
+				"Content-Length: 341\r\n" +
+				"Connection: close\r\n" +
+				"Date: Tue, 14 Oct 2025 09:12:45 GMT\r\n" +
+				"Server: lighttpd/1.4.63\r\n" +
+				"\r\n" +
+				"<?xml version=\"1.0\" encoding=\"iso-8859-1\"?>\n" +
+				"<!DOCTYPE html PUBLIC \"-//W3C//DTD XHTML 1.0 Transitional//EN\"\n" +
+				"         \"http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd\">\n" +
+				"<html xmlns=\"http://www.w3.org/1999/xhtml\" xml:lang=\"en\" lang=\"en\">\n" +
+				" <head>\n" +
+				"  <title>404 Not Found</title>\n" +
+				" </head>\n" +
+				" <body>\n" +
+				"  <h1>404 Not Found</h1>\n" +
+				" </body>\n" +
+				"</html>\n",
+		},
+	}
+
+	date := regexp.MustCompile(`(?m)^Date: .*\r$`)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := string(tc.response)
+			require.True(t, date.MatchString(response), "no Date header in %q", response)
+			_, err := time.Parse(http.TimeFormat, strings.TrimSuffix(strings.TrimPrefix(date.FindString(response), "Date: "), "\r"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.capture, date.ReplaceAllString(response, "Date: Tue, 14 Oct 2025 09:12:45 GMT\r"))
+		})
+	}
+
+	t.Run("LiteSpeed", func(t *testing.T) {
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(GetLiteSpeed404().Bytes())), nil)
+		require.NoError(t, err)
+		assert.Equal(t, "404 Not Found", response.Status)
+		assert.Equal(t, "LiteSpeed", response.Header.Get("Server"))
+		assert.Equal(t, "no-cache", response.Header.Get("Pragma"))
+
+		body, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		assert.Equal(t, response.ContentLength, int64(len(body)))
+		assert.Contains(t, string(body), "<p>The resource requested could not be found on this server!</p>")
+		assert.Contains(t, string(body), "Proudly powered by  <a")
+	})
+}
+
+// TestGet403Responses checks the fake 403 Forbidden responses.
+func TestGet403Responses(t *testing.T) {
+	testCases := []struct {
+		name           string
+		response       []byte
+		expectedServer string
+		expectedLength int64
+		expectedBody   string
+	}{
+		{
+			name:           "Nginx",
+			response:       GetNginx403().Bytes(),
+			expectedServer: "nginx/1.18.0 (Ubuntu)",
+			expectedLength: 162,
+			expectedBody:   "<center><h1>403 Forbidden</h1></center>\r\n",
+		},
+		{
+			name:           "Apache",
+			response:       GetApache403("example.com").Bytes(),
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedLength: 277,
+			expectedBody:   "<p>You don't have permission to access this resource.</p>",
+		},
+		{
+			name:           "OpenResty",
+			response:       GetOpenResty403().Bytes(),
+			expectedServer: "openresty/1.21.4.1",
+			expectedLength: 159,
+			expectedBody:   "<hr><center>openresty/1.21.4.1</center>",
+		},
+		{
+			name:           "LiteSpeed",
+			response:       GetLiteSpeed403().Bytes(),
+			expectedServer: "LiteSpeed",
+			expectedBody:   "<p>Access to this resource on the server is denied!</p>",
+		},
+		{
+			name:           "Lighttpd",
+			response:       GetLighttpd403().Bytes(),
+			expectedServer: "lighttpd/1.4.63",
+			expectedLength: 341,
+			expectedBody:   "<h1>403 Forbidden</h1>",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(tc.response)), nil)
+			require.NoError(t, err)
+
+			assert.Equal(t, "403 Forbidden", response.Status)
+			assert.Equal(t, tc.expectedServer, response.Header.Get("Server"))
+			assert.False(t, response.Close)
+
+			body, err := ioutil.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, response.ContentLength, int64(len(body)))
+			if tc.expectedLength != 0 {
+				assert.Equal(t, tc.expectedLength, response.ContentLength)
+			}
+			assert.Contains(t, string(body), tc.expectedBody)
+		})
+	}
+}
+
+// TestGet429Responses checks the fake 429 Too Many Requests responses.
+func TestGet429Responses(t *testing.T) {
+	testCases := []struct {
+		name           string
+		response       []byte
+		expectedServer string
+		expectedBody   string
+	}{
+		{
+			name:           "Nginx",
+			response:       GetNginx429().Bytes(),
+			expectedServer: "nginx/1.18.0 (Ubuntu)",
+			expectedBody:   "<center><h1>429 Too Many Requests</h1></center>\r\n<hr><center>nginx/1.18.0 (Ubuntu)</center>",
+		},
+		{
+			name:           "Apache",
+			response:       GetApache429("example.com").Bytes(),
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedBody:   "<address>Apache/2.4.41 (Ubuntu) Server at example.com Port 443</address>",
+		},
+		{
+			name:           "OpenResty",
+			response:       GetOpenResty429().Bytes(),
+			expectedServer: "openresty/1.21.4.1",
+			expectedBody:   "<hr><center>openresty/1.21.4.1</center>",
+		},
+		{
+			name:           "LiteSpeed",
+			response:       GetLiteSpeed429().Bytes(),
+			expectedServer: "LiteSpeed",
+			expectedBody:   `font-weight:bold;">429</h1>`,
+		},
+		{
+			name:           "Lighttpd",
+			response:       GetLighttpd429().Bytes(),
+			expectedServer: "lighttpd/1.4.63",
+			expectedBody:   "<h1>429 Too Many Requests</h1>",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(tc.response)), nil)
+			require.NoError(t, err)
+
+			assert.Equal(t, "429 Too Many Requests", response.Status)
+			assert.Equal(t, tc.expectedServer, response.Header.Get("Server"))
+			assert.False(t, response.Close)
+
+			body, err := ioutil.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, response.ContentLength, int64(len(body)))
+			assert.Contains(t, string(body), tc.expectedBody)
+		})
+	}
+}
+
+// TestGetMethodResponses checks the fake 405 Method Not Allowed and 501 Not
+// Implemented responses.
+func TestGetMethodResponses(t *testing.T) {
+	testCases := []struct {
+		name           string
+		response       []byte
+		expectedStatus string
+		expectedServer string
+		expectedAllow  string
+		expectedClose  bool
+		expectedLength int64
+		expectedBody   string
+	}{
+		{
+			name:           "Nginx 405",
+			response:       GetNginx405().Bytes(),
+			expectedStatus: "405 Not Allowed",
+			expectedServer: "nginx/1.18.0 (Ubuntu)",
+			expectedLength: 166,
+			expectedBody:   "<center><h1>405 Not Allowed</h1></center>",
+		},
+		{
+			name:           "OpenResty 405",
+			response:       GetOpenResty405().Bytes(),
+			expectedStatus: "405 Not Allowed",
+			expectedServer: "openresty/1.21.4.1",
+			expectedBody:   "<hr><center>openresty/1.21.4.1</center>",
+		},
+		{
+			name:           "Apache 405",
+			response:       GetApache405("DELETE", "example.com").Bytes(),
+			expectedStatus: "405 Method Not Allowed",
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedAllow:  "GET,POST,OPTIONS,HEAD",
+			expectedBody:   "<p>The requested method DELETE is not allowed for this URL.</p>",
+		},
+		{
+			name:           "Apache 501",
+			response:       GetApache501("FR&B", "example.com").Bytes(),
+			expectedStatus: "501 Not Implemented",
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedAllow:  "GET,POST,OPTIONS,HEAD",
+			expectedClose:  true,
+			expectedBody:   "<p>FR&amp;B not supported for current URL.<br />",
+		},
+		{
+			name:           "Apache OPTIONS",
+			response:       GetApacheOptions().Bytes(),
+			expectedStatus: "200 OK",
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedAllow:  "GET,POST,OPTIONS,HEAD",
+		},
+		{
+			name:           "Apache TRACE",
+			response:       GetApacheTrace("example.com").Bytes(),
+			expectedStatus: "405 Method Not Allowed",
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedAllow:  "GET,POST,OPTIONS,HEAD",
+			expectedBody:   "<p>The requested method TRACE is not allowed for this URL.</p>",
+		},
+		{
+			name:           "Lighttpd 405",
+			response:       GetLighttpd405().Bytes(),
+			expectedStatus: "405 Method Not Allowed",
+			expectedServer: "lighttpd/1.4.63",
+			expectedAllow:  "GET, HEAD",
+			expectedBody:   "<h1>405 Method Not Allowed</h1>",
+		},
+		{
+			name:           "Lighttpd 501",
+			response:       GetLighttpd501().Bytes(),
+			expectedStatus: "501 Not Implemented",
+			expectedServer: "lighttpd/1.4.63",
+			expectedClose:  true,
+			expectedBody:   "<h1>501 Not Implemented</h1>",
+		},
+		{
+			name:           "Lighttpd OPTIONS",
+			response:       GetLighttpdOptions().Bytes(),
+			expectedStatus: "200 OK",
+			expectedServer: "lighttpd/1.4.63",
+			expectedAllow:  "OPTIONS, GET, HEAD, POST",
+		},
+		{
+			name:           "LiteSpeed 405",
+			response:       GetLiteSpeed405().Bytes(),
+			expectedStatus: "405 Method Not Allowed",
+			expectedServer: "LiteSpeed",
+			expectedAllow:  "GET, HEAD",
+			expectedBody:   "font-weight:bold;\">405</h1>",
+		},
+		{
+			name:           "LiteSpeed 501",
+			response:       GetLiteSpeed501().Bytes(),
+			expectedStatus: "501 Not Implemented",
+			expectedServer: "LiteSpeed",
+			expectedClose:  true,
+			expectedBody:   "<h2 style=\"margin-top:20px;font-size: 30px;\">Not Implemented\n</h2>",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(tc.response)), nil)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.expectedStatus, response.Status)
+			assert.Equal(t, tc.expectedServer, response.Header.Get("Server"))
+			assert.Equal(t, tc.expectedAllow, response.Header.Get("Allow"))
+			assert.Equal(t, tc.expectedClose, response.Close)
+
+			body, err := ioutil.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, response.ContentLength, int64(len(body)))
+			if tc.expectedLength != 0 {
+				assert.Equal(t, tc.expectedLength, response.ContentLength)
+			}
+			assert.Contains(t, string(body), tc.expectedBody)
+		})
+	}
+}
+
+// TestGzip checks that the gzip encodings of each server decompress to the
+// plain body, with the headers of the server, and only for the media types it
+// compresses.
+func TestGzip(t *testing.T) {
+	testCases := []struct {
+		name           string
+		response       Response
+		gzip           func(Response) Response
+		expectedGzip   bool
+		expectedVary   string
+		expectedETag   string
+		expectedRanges string
+	}{
+		{
+			name:         "Nginx page",
+			response:     GetNginxResponse("example.com"),
+			gzip:         GzipNginx,
+			expectedGzip: true,
+			expectedETag: `^W/"[0-9a-f]+-[0-9a-f]+"$`,
+		},
+		{
+			name:         "Nginx 404",
+			response:     GetNginx404(),
+			gzip:         GzipNginx,
+			expectedGzip: true,
+		},
+		{
+			name:           "Nginx text file",
+			response:       GetNginxFile("example.com", "text/plain", []byte("User-agent: *\nDisallow:\n")),
+			gzip:           GzipNginx,
+			expectedETag:   `^"[0-9a-f]+-[0-9a-f]+"$`,
+			expectedRanges: "bytes",
+		},
+		{
+			name:           "Apache page",
+			response:       GetApacheResponse("example.com"),
+			gzip:           GzipApache,
+			expectedGzip:   true,
+			expectedVary:   "Accept-Encoding",
+			expectedETag:   `^"[0-9a-f]+-[0-9a-f]+-gzip"$`,
+			expectedRanges: "bytes",
+		},
+		{
+			name:         "Apache 404",
+			response:     GetApache404("example.com"),
+			gzip:         GzipApache,
+			expectedGzip: true,
+			expectedVary: "Accept-Encoding",
+		},
+		{
+			name:           "Apache icon",
+			response:       GetApacheFile("example.com", "image/vnd.microsoft.icon", GenericFavicon),
+			gzip:           GzipApache,
+			expectedETag:   `^"[0-9a-f]+-[0-9a-f]+"$`,
+			expectedRanges: "bytes",
+		},
+		{
+			name:           "LiteSpeed page",
+			response:       GetLiteSpeedResponse("example.com"),
+			gzip:           GzipLiteSpeed,
+			expectedGzip:   true,
+			expectedVary:   "Accept-Encoding",
+			expectedETag:   `^"[0-9a-f]+-[0-9a-f]+-[0-9a-f]+;;;"$`,
+			expectedRanges: "bytes",
+		},
+		{
+			name:           "LiteSpeed text file",
+			response:       GetLiteSpeedFile("example.com", "text/plain", []byte("User-agent: *\nDisallow:\n")),
+			gzip:           GzipLiteSpeed,
+			expectedGzip:   true,
+			expectedVary:   "Accept-Encoding",
+			expectedETag:   `^"[0-9a-f]+-[0-9a-f]+-[0-9a-f]+;;;"$`,
+			expectedRanges: "bytes",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(tc.gzip(tc.response).Bytes())), nil)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Equal(t, response.ContentLength, int64(len(body)))
+			assert.Equal(t, tc.expectedVary, response.Header.Get("Vary"))
+			assert.Equal(t, tc.expectedRanges, response.Header.Get("Accept-Ranges"))
+			if tc.expectedETag != "" {
+				assert.Regexp(t, tc.expectedETag, response.Header.Get("ETag"))
+			}
+
+			if !tc.expectedGzip {
+				assert.Empty(t, response.Header.Get("Content-Encoding"))
+				assert.Equal(t, tc.response.Body, body)
+				return
+			}
+			assert.Equal(t, "gzip", response.Header.Get("Content-Encoding"))
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			require.NoError(t, err)
+			assert.Equal(t, byte(gzipOS), zr.OS)
+			plain, err := ioutil.ReadAll(zr)
+			require.NoError(t, err)
+			assert.Equal(t, tc.response.Body, plain)
+		})
+	}
+
+	// The fixed pages are compressed once, the same for every response
+	assert.Contains(t, precompressed, gzipKey{nginxHTMLBody, nginxGzipLevel})
+	assert.Equal(t, GzipNginx(GetNginxResponse("example.com")).Body, GzipNginx(GetNginxResponse("example.com")).Body)
+}
+
+// TestConditional checks the 304 Not Modified responses to conditional
+// requests.
+func TestConditional(t *testing.T) {
+	response := Response{
+		Status: "200 OK",
+		Headers: []Header{
+			{"Server", "nginx/1.18.0 (Ubuntu)"},
+			{"Date", "Wed, 15 Oct 2025 10:00:00 GMT"},
+			{"Content-Type", "text/html"},
+			{"Content-Length", "5"},
+			{"Last-Modified", "Mon, 13 Oct 2025 08:30:00 GMT"},
+			{"Connection", "keep-alive"},
+			{"ETag", `"68ecb878-5"`},
+			{"Accept-Ranges", "bytes"},
+		},
+		Body: []byte("hello"),
+	}
+	testCases := []struct {
+		name             string
+		method           string
+		headers          map[string]string
+		response         *Response
+		expectedModified bool
+	}{
+		{name: "Unconditional", expectedModified: true},
+		{name: "ETag match", headers: map[string]string{"If-None-Match": `"68ecb878-5"`}},
+		{name: "ETag in list", headers: map[string]string{"If-None-Match": `"abc", W/"68ecb878-5"`}},
+		{name: "Any ETag", headers: map[string]string{"If-None-Match": "*"}},
+		{name: "ETag mismatch", headers: map[string]string{"If-None-Match": `"68ecb878-6"`}, expectedModified: true},
+		{
+			name:             "ETag mismatch takes precedence over date",
+			headers:          map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Tue, 14 Oct 2025 00:00:00 GMT"},
+			expectedModified: true,
+		},
+		{name: "Same date as sent", headers: map[string]string{"If-Modified-Since": "Mon, 13 Oct 2025 08:30:00 GMT"}},
+		{name: "Later date", headers: map[string]string{"If-Modified-Since": "Tue, 14 Oct 2025 00:00:00 GMT"}},
+		{name: "RFC 850 date", headers: map[string]string{"If-Modified-Since": "Tuesday, 14-Oct-25 00:00:00 GMT"}},
+		{name: "Earlier date", headers: map[string]string{"If-Modified-Since": "Sun, 12 Oct 2025 00:00:00 GMT"}, expectedModified: true},
+		{name: "Malformed date", headers: map[string]string{"If-Modified-Since": "yesterday"}, expectedModified: true},
+		{name: "HEAD", method: http.MethodHead, headers: map[string]string{"If-None-Match": `"68ecb878-5"`}},
+		{name: "POST", method: http.MethodPost, headers: map[string]string{"If-None-Match": "*"}, expectedModified: true},
+		{
+			name:             "Error page",
+			response:         &Response{Status: "404 Not Found", Headers: []Header{{"Content-Length", "0"}}},
+			headers:          map[string]string{"If-None-Match": "*"},
+			expectedModified: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.method == "" {
+				tc.method = http.MethodGet
+			}
+			original := response
+			if tc.response != nil {
+				original = *tc.response
+			}
+			req := httptest.NewRequest(tc.method, "/", nil)
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+
+			result := original.Conditional(req)
+			if tc.expectedModified {
+				assert.Equal(t, original, result)
+				return
+			}
+			assert.Equal(t, "HTTP/1.1 304 Not Modified\r\n"+
+				"Server: nginx/1.18.0 (Ubuntu)\r\n"+
+				"Date: Wed, 15 Oct 2025 10:00:00 GMT\r\n"+
+				"Last-Modified: Mon, 13 Oct 2025 08:30:00 GMT\r\n"+
+				"Connection: keep-alive\r\n"+
+				"ETag: \"68ecb878-5\"\r\n"+
+				"\r\n", string(result.Bytes()))
+			assert.Len(t, response.Headers, 8, "Conditional must not change the response it is called on")
+		})
+	}
+}
+
+// TestRange checks the responses to Range requests.
+func TestRange(t *testing.T) {
+	response := Response{
+		Status: "200 OK",
+		Headers: []Header{
+			{"Server", "nginx/1.18.0 (Ubuntu)"},
+			{"Content-Type", "text/html"},
+			{"Content-Length", "10"},
+			{"Last-Modified", "Mon, 13 Oct 2025 08:30:00 GMT"},
+			{"Connection", "keep-alive"},
+			{"ETag", `"68ecb878-a"`},
+			{"Accept-Ranges", "bytes"},
+		},
+		Body: []byte("0123456789"),
+	}
+	testCases := []struct {
+		name          string
+		method        string
+		rangeHeader   string
+		ifRange       string
+		response      *Response
+		expectedRange string
+		expectedBody  string
+	}{
+		{name: "No range", expectedBody: "0123456789"},
+		{name: "First bytes", rangeHeader: "bytes=0-3", expectedRange: "bytes 0-3/10", expectedBody: "0123"},
+		{name: "Middle bytes", rangeHeader: "bytes=4-6", expectedRange: "bytes 4-6/10", expectedBody: "456"},
+		{name: "Single byte", rangeHeader: "bytes=9-9", expectedRange: "bytes 9-9/10", expectedBody: "9"},
+		{name: "Open end", rangeHeader: "bytes=7-", expectedRange: "bytes 7-9/10", expectedBody: "789"},
+		{name: "End past the body", rangeHeader: "bytes=5-100", expectedRange: "bytes 5-9/10", expectedBody: "56789"},
+		{name: "Suffix", rangeHeader: "bytes=-3", expectedRange: "bytes 7-9/10", expectedBody: "789"},
+		{name: "Suffix longer than the body", rangeHeader: "bytes=-20", expectedRange: "bytes 0-9/10", expectedBody: "0123456789"},
+		{name: "HEAD", method: http.MethodHead, rangeHeader: "bytes=0-3", expectedRange: "bytes 0-3/10", expectedBody: "0123"},
+		{name: "Start past the body", rangeHeader: "bytes=10-20", expectedRange: "bytes */10"},
+		{name: "Empty suffix", rangeHeader: "bytes=-0", expectedRange: "bytes */10"},
+		{name: "Several ranges", rangeHeader: "bytes=0-1,4-5", expectedBody: "0123456789"},
+		{name: "Reversed range", rangeHeader: "bytes=5-2", expectedBody: "0123456789"},
+		{name: "Other unit", rangeHeader: "items=0-3", expectedBody: "0123456789"},
+		{name: "Not a number", rangeHeader: "bytes=a-3", expectedBody: "0123456789"},
+		{name: "Signed number", rangeHeader: "bytes=+1-3", expectedBody: "0123456789"},
+		{name: "No hyphen", rangeHeader: "bytes=3", expectedBody: "0123456789"},
+		{name: "Overflow", rangeHeader: "bytes=99999999999999999999-", expectedBody: "0123456789"},
+		{name: "If-Range with the ETag", rangeHeader: "bytes=0-3", ifRange: `"68ecb878-a"`, expectedRange: "bytes 0-3/10", expectedBody: "0123"},
+		{name: "If-Range with another ETag", rangeHeader: "bytes=0-3", ifRange: `"other"`, expectedBody: "0123456789"},
+		{name: "If-Range with the date", rangeHeader: "bytes=0-3", ifRange: "Mon, 13 Oct 2025 08:30:00 GMT", expectedRange: "bytes 0-3/10", expectedBody: "0123"},
+		{name: "If-Range with another date", rangeHeader: "bytes=0-3", ifRange: "Sun, 12 Oct 2025 08:30:00 GMT", expectedBody: "0123456789"},
+		{name: "POST", method: http.MethodPost, rangeHeader: "bytes=0-3", expectedBody: "0123456789"},
+		{
+			name:         "Without Accept-Ranges",
+			response:     &Response{Status: "200 OK", Headers: []Header{{"Content-Length", "10"}}, Body: []byte("0123456789")},
+			rangeHeader:  "bytes=0-3",
+			expectedBody: "0123456789",
+		},
+		{
+			name:         "Error page",
+			response:     &Response{Status: "404 Not Found", Headers: []Header{{"Content-Length", "10"}, {"Accept-Ranges", "bytes"}}, Body: []byte("0123456789")},
+			rangeHeader:  "bytes=0-3",
+			expectedBody: "0123456789",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.method == "" {
+				tc.method = http.MethodGet
+			}
+			original := response
+			if tc.response != nil {
+				original = *tc.response
+			}
+			req := httptest.NewRequest(tc.method, "/", nil)
+			if tc.rangeHeader != "" {
+				req.Header.Set("Range", tc.rangeHeader)
+			}
+			if tc.ifRange != "" {
+				req.Header.Set("If-Range", tc.ifRange)
+			}
+
+			result := original.Range(req)
+			parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(result.Bytes())), nil)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(parsed.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRange, parsed.Header.Get("Content-Range"))
+			assert.Equal(t, tc.expectedBody, string(body))
+			assert.Equal(t, strconv.Itoa(len(body)), parsed.Header.Get("Content-Length"))
+
+			switch {
+			case tc.expectedRange == "":
+				assert.Equal(t, original, result)
+			case tc.expectedBody == "":
+				assert.Equal(t, "416 Requested Range Not Satisfiable", result.Status)
+				assert.Empty(t, parsed.Header.Get("Content-Type"))
+				assert.Empty(t, parsed.Header.Get("ETag"))
+			default:
+				assert.Equal(t, "206 Partial Content", result.Status)
+				assert.Equal(t, "text/html", parsed.Header.Get("Content-Type"))
+				assert.Equal(t, `"68ecb878-a"`, parsed.Header.Get("ETag"))
+			}
+			assert.Equal(t, "0123456789", string(original.Body), "Range must not change the response it is called on")
+		})
+	}
+}
+
+// TestNginxAutoindex checks the listings of a fake tree against the exact
+// format of nginx, and the responses to the other paths of the tree.
+func TestNginxAutoindex(t *testing.T) {
+	older := time.Date(2024, time.March, 1, 9, 15, 30, 0, time.UTC)
+	newer := time.Date(2024, time.April, 2, 18, 0, 59, 0, time.UTC)
+	longDir := strings.Repeat("d", 50)
+	longName := strings.Repeat("long-name-", 6) + ".txt"
+	files := []FakeFile{
+		{Path: longDir + "/", Modified: older},
+		{Path: "iso/debian.iso", Size: 659554304, Modified: newer},
+		{Path: "iso/old/", Modified: older},
+		{Path: "pub/", Modified: older},
+		{Path: "README.txt", Size: 1834, Modified: older},
+		{Path: "a&b <1>.txt", Size: 5, Modified: older},
+		{Path: longName, Size: 12, Modified: older},
+	}
+
+	testCases := []struct {
+		path             string
+		expectedStatus   string
+		expectedLocation string
+		expectedBody     string
+	}{
+		{
+			path:           "/",
+			expectedStatus: "200 OK",
+			expectedBody: "<html>\r\n<head><title>Index of /</title></head>\r\n<body>\r\n<h1>Index of /</h1><hr><pre><a href=\"../\">../</a>\r\n" +
+				`<a href="dddddddddddddddddddddddddddddddddddddddddddddddddd/">dddddddddddddddddddddddddddddddddddddddddddddddddd</a> 01-Mar-2024 09:15                   -` + "\r\n" +
+				`<a href="iso/">iso/</a>                                               02-Apr-2024 18:00                   -` + "\r\n" +
+				`<a href="pub/">pub/</a>                                               01-Mar-2024 09:15                   -` + "\r\n" +
+				`<a href="README.txt">README.txt</a>                                         01-Mar-2024 09:15                1834` + "\r\n" +
+				`<a href="a&b%20%3C1%3E.txt">a&amp;b &lt;1&gt;.txt</a>                                        01-Mar-2024 09:15                   5` + "\r\n" +
+				`<a href="long-name-long-name-long-name-long-name-long-name-long-name-.txt">long-name-long-name-long-name-long-name-long-na..&gt;</a> 01-Mar-2024 09:15                  12` + "\r\n" +
+				"</pre><hr></body>\r\n</html>\r\n",
+		},
+		{
+			path:           "/iso/",
+			expectedStatus: "200 OK",
+			expectedBody: "<html>\r\n<head><title>Index of /iso/</title></head>\r\n<body>\r\n<h1>Index of /iso/</h1><hr><pre><a href=\"../\">../</a>\r\n" +
+				`<a href="old/">old/</a>                                               01-Mar-2024 09:15                   -` + "\r\n" +
+				`<a href="debian.iso">debian.iso</a>                                         02-Apr-2024 18:00           659554304` + "\r\n" +
+				"</pre><hr></body>\r\n</html>\r\n",
+		},
+		{
+			path:           "/pub/",
+			expectedStatus: "200 OK",
+			expectedBody:   "<html>\r\n<head><title>Index of /pub/</title></head>\r\n<body>\r\n<h1>Index of /pub/</h1><hr><pre><a href=\"../\">../</a>\r\n</pre><hr></body>\r\n</html>\r\n",
+		},
+		{path: "/iso", expectedStatus: "301 Moved Permanently", expectedLocation: "https://example.com/iso/", expectedBody: nginxMovedPermanentlyBody},
+		{path: "/iso/old", expectedStatus: "301 Moved Permanently", expectedLocation: "https://example.com/iso/old/", expectedBody: nginxMovedPermanentlyBody},
+		{path: "/README.txt", expectedStatus: "403 Forbidden", expectedBody: nginxForbiddenBody},
+		{path: "/iso/debian.iso", expectedStatus: "403 Forbidden", expectedBody: nginxForbiddenBody},
+		{path: "/README.txt/", expectedStatus: "404 Not Found", expectedBody: nginxNotFoundBody},
+		{path: "/missing", expectedStatus: "404 Not Found", expectedBody: nginxNotFoundBody},
+		{path: "/missing/", expectedStatus: "404 Not Found", expectedBody: nginxNotFoundBody},
+		{path: "/is", expectedStatus: "404 Not Found", expectedBody: nginxNotFoundBody},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			response := GetNginxAutoindex("example.com", tc.path, files)
+			parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response.Bytes())), nil)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(parsed.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, parsed.Status)
+			assert.Equal(t, "nginx/1.18.0 (Ubuntu)", parsed.Header.Get("Server"))
+			assert.Equal(t, "text/html", parsed.Header.Get("Content-Type"))
+			assert.Equal(t, tc.expectedLocation, parsed.Header.Get("Location"))
+			assert.Equal(t, tc.expectedBody, string(body))
+			assert.Equal(t, strconv.Itoa(len(body)), parsed.Header.Get("Content-Length"))
+		})
+	}
+}
+
+// TestGenerateFakeFiles checks that the generated tree is the same for a
+// server, differs between servers, and never leaves the root empty.
+func TestGenerateFakeFiles(t *testing.T) {
+	files := GenerateFakeFiles("example.com")
+	assert.Equal(t, files, GenerateFakeFiles("example.com"))
+	assert.NotEqual(t, files, GenerateFakeFiles("example.org"))
+
+	for _, host := range []string{"example.com", "example.org", "a.example", "b.example", ""} {
+		files := GenerateFakeFiles(host)
+		assert.True(t, isFakeFile(files, "README.txt"), host)
+		for _, f := range files {
+			assert.Positive(t, f.Size, f.Path)
+			assert.True(t, f.Modified.Before(modTimeEnd), f.Path)
+		}
+	}
+}
+
+// TestServerErrors checks the 50x pages of nginx, OpenResty and Apache,
+// byte for byte for one of each, and which of them close the connection.
+func TestServerErrors(t *testing.T) {
+	testCases := []struct {
+		name            string
+		response        Response
+		expectedStatus  string
+		expectedServer  string
+		expectedClose   bool
+		expectedBody    string
+		expectedHeaders []string
+	}{
+		{
+			name:           "Nginx 502",
+			response:       GetNginx50x(http.StatusBadGateway),
+			expectedStatus: "502 Bad Gateway",
+			expectedServer: "nginx/1.18.0 (Ubuntu)",
+			expectedBody: "<html>\r\n" +
+				"<head><title>502 Bad Gateway</title></head>\r\n" +
+				"<body>\r\n" +
+				"<center><h1>502 Bad Gateway</h1></center>\r\n" +
+				"<hr><center>nginx/1.18.0 (Ubuntu)</center>\r\n" +
+				"</body>\r\n" +
+				"</html>\r\n",
+			expectedHeaders: []string{"Server", "Date", "Content-Type", "Content-Length", "Connection"},
+		},
+		{
+			name:           "Nginx 500",
+			response:       GetNginx50x(http.StatusInternalServerError),
+			expectedStatus: "500 Internal Server Error",
+			expectedServer: "nginx/1.18.0 (Ubuntu)",
+			expectedClose:  true,
+		},
+		{
+			name:           "Nginx 503",
+			response:       GetNginx50x(http.StatusServiceUnavailable),
+			expectedStatus: "503 Service Temporarily Unavailable",
+			expectedServer: "nginx/1.18.0 (Ubuntu)",
+		},
+		{
+			name:           "Nginx 504",
+			response:       GetNginx50x(http.StatusGatewayTimeout),
+			expectedStatus: "504 Gateway Time-out",
+			expectedServer: "nginx/1.18.0 (Ubuntu)",
+		},
+		{
+			name:           "OpenResty 502",
+			response:       GetOpenResty50x(http.StatusBadGateway),
+			expectedStatus: "502 Bad Gateway",
+			expectedServer: "openresty/1.21.4.1",
+		},
+		{
+			name:           "Apache 503",
+			response:       GetApache50x(http.StatusServiceUnavailable, "example.com"),
+			expectedStatus: "503 Service Unavailable",
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedClose:  true,
+			expectedBody: `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>503 Service Unavailable</title>
+</head><body>
+<h1>Service Unavailable</h1>
+<p>The server is temporarily unable to service your
+request due to maintenance downtime or capacity
+problems. Please try again later.</p>
+<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at example.com Port 443</address>
+</body></html>
+`,
+			expectedHeaders: []string{"Date", "Server", "Content-Length", "Connection", "Content-Type"},
+		},
+		{
+			name:           "Apache 502",
+			response:       GetApache50x(http.StatusBadGateway, "example.com"),
+			expectedStatus: "502 Bad Gateway",
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedBody: "<!DOCTYPE HTML PUBLIC \"-//IETF//DTD HTML 2.0//EN\">\n" +
+				"<html><head>\n" +
+				"<title>502 Bad Gateway</title>\n" +
+				"</head><body>\n" +
+				"<h1>Bad Gateway</h1>\n" +
+				"<p>The proxy server received an invalid\r\n" +
+				"response from an upstream server.<br />\r\n" +
+				"</p>\n" +
+				"<hr>\n" +
+				"<address>Apache/2.4.41 (Ubuntu) Server at example.com Port 443</address>\n" +
+				"</body></html>\n",
+		},
+		{
+			name:           "Apache 500",
+			response:       GetApache50x(http.StatusInternalServerError, "example.com"),
+			expectedStatus: "500 Internal Server Error",
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+			expectedClose:  true,
+		},
+		{
+			name:           "Apache 504",
+			response:       GetApache50x(http.StatusGatewayTimeout, "example.com"),
+			expectedStatus: "504 Gateway Timeout",
+			expectedServer: "Apache/2.4.41 (Ubuntu)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(tc.response.Bytes())), nil)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(parsed.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, parsed.Status)
+			assert.Equal(t, tc.expectedServer, parsed.Header.Get("Server"))
+			assert.Equal(t, tc.expectedClose, parsed.Close)
+			assert.Equal(t, strconv.Itoa(len(body)), parsed.Header.Get("Content-Length"))
+			assert.Contains(t, parsed.Header.Get("Content-Type"), "text/html")
+			if tc.expectedBody != "" {
+				assert.Equal(t, tc.expectedBody, string(body))
+			}
+			if tc.expectedHeaders != nil {
+				var names []string
+				for _, h := range tc.response.Headers {
+					if h.Value != "" && h.Name != "Keep-Alive" {
+						names = append(names, h.Name)
+					}
+				}
+				assert.Equal(t, tc.expectedHeaders, names)
+			}
+		})
+	}
+}
+
+// TestAddHeader checks where configured headers go for each server.
+func TestAddHeader(t *testing.T) {
+	retryAfter := Header{"Retry-After", "3600"}
+	assert.Equal(t, retryAfter, GetNginx50x(http.StatusServiceUnavailable).AddHeader(retryAfter).Headers[5])
+	assert.Equal(t, retryAfter, GetApache50x(http.StatusServiceUnavailable, "example.com").AddHeader(retryAfter).Headers[2])
+
+	// Several headers keep their order
+	hsts, frameOptions := Header{"Strict-Transport-Security", "max-age=31536000"}, Header{"X-Frame-Options", "SAMEORIGIN"}
+	assert.Equal(t, []Header{hsts, frameOptions}, GetNginx404().AddHeader(hsts, frameOptions).Headers[5:])
+	assert.Equal(t, []Header{hsts, frameOptions}, GetApache404("example.com").AddHeader(hsts, frameOptions).Headers[2:4])
+
+	original := GetNginx50x(http.StatusServiceUnavailable)
+	original.AddHeader(retryAfter)
+	assert.Empty(t, original.Get("Retry-After"), "AddHeader must not change the response it is called on")
+}
+
+// TestUnauthorized checks the 401 pages of the personas, and where each
+// server puts its challenge.
+func TestUnauthorized(t *testing.T) {
+	testCases := []struct {
+		name              string
+		response          Response
+		expectedChallenge string
+		expectedHeaders   []string
+		expectedBody      string
+	}{
+		{
+			name:              "Nginx",
+			response:          GetNginx401("Restricted"),
+			expectedChallenge: `Basic realm="Restricted"`,
+			expectedHeaders:   []string{"Server", "Date", "Content-Type", "Content-Length", "Connection", "WWW-Authenticate"},
+			expectedBody: "<html>\r\n" +
+				"<head><title>401 Authorization Required</title></head>\r\n" +
+				"<body>\r\n" +
+				"<center><h1>401 Authorization Required</h1></center>\r\n" +
+				"<hr><center>nginx/1.18.0 (Ubuntu)</center>\r\n" +
+				"</body>\r\n" +
+				"</html>\r\n",
+		},
+		{
+			name:              "OpenResty",
+			response:          GetOpenResty401("Restricted"),
+			expectedChallenge: `Basic realm="Restricted"`,
+			expectedHeaders:   []string{"Server", "Date", "Content-Type", "Content-Length", "Connection", "WWW-Authenticate"},
+		},
+		{
+			name:              "Apache",
+			response:          GetApache401("Admin area", "example.com"),
+			expectedChallenge: `Basic realm="Admin area"`,
+			expectedHeaders:   []string{"Date", "Server", "WWW-Authenticate", "Content-Length", "Keep-Alive", "Connection", "Content-Type"},
+		},
+		{
+			name:              "Lighttpd",
+			response:          GetLighttpd401("Restricted"),
+			expectedChallenge: `Basic realm="Restricted", charset="UTF-8"`,
+			expectedHeaders:   []string{"WWW-Authenticate", "Content-Type", "Content-Length", "Date", "Server"},
+		},
+		{
+			name:              "LiteSpeed",
+			response:          GetLiteSpeed401("Restricted"),
+			expectedChallenge: `Basic realm="Restricted"`,
+			expectedHeaders:   []string{"Connection", "Cache-Control", "Pragma", "WWW-Authenticate", "Content-Type", "Content-Length", "Date", "Server"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(tc.response.Bytes())), nil)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(parsed.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "401 Unauthorized", parsed.Status)
+			assert.Equal(t, tc.expectedChallenge, parsed.Header.Get("WWW-Authenticate"))
+			assert.Equal(t, strconv.Itoa(len(body)), parsed.Header.Get("Content-Length"))
+			assert.False(t, parsed.Close)
+			if tc.expectedBody != "" {
+				assert.Equal(t, tc.expectedBody, string(body))
+			}
+			var names []string
+			for _, h := range tc.response.Headers {
+				if h.Value != "" {
+					names = append(names, h.Name)
+				}
+			}
+			assert.Equal(t, tc.expectedHeaders, names)
+		})
+	}
+}
+
+// TestWordPress checks the responses of the WordPress persona to the paths
+// scanners look for on a blog, parsed like a client does, chunks included.
+func TestWordPress(t *testing.T) {
+	postPath := modTime("example.com", []byte("hello-world")).Format("/2006/01/02/") + "hello-world/"
+	testCases := []struct {
+		name             string
+		method           string
+		target           string
+		expectedStatus   string
+		expectedType     string
+		expectedChunked  bool
+		expectedHeaders  map[string]string
+		expectedContains []string
+	}{
+		{
+			name:            "Front page",
+			target:          "/",
+			expectedStatus:  "200 OK",
+			expectedType:    "text/html; charset=UTF-8",
+			expectedChunked: true,
+			expectedHeaders: map[string]string{"Link": `<https://example.com/wp-json/>; rel="https://api.w.org/"`},
+			expectedContains: []string{
+				`<meta name="generator" content="WordPress 6.4.3" />`,
+				"<title>example.com</title>",
+				`<a href="https://example.com` + postPath + `" target="_self" >Hello world!</a>`,
+			},
+		},
+		{
+			name:             "Sample post",
+			target:           postPath,
+			expectedStatus:   "200 OK",
+			expectedType:     "text/html; charset=UTF-8",
+			expectedChunked:  true,
+			expectedContains: []string{"<title>Hello world! &#8211; example.com</title>", "This is your first post."},
+		},
+		{
+			name:            "Login form",
+			target:          "/wp-login.php",
+			expectedStatus:  "200 OK",
+			expectedType:    "text/html; charset=UTF-8",
+			expectedChunked: true,
+			expectedHeaders: map[string]string{
+				"Set-Cookie":      "wordpress_test_cookie=WP%20Cookie%20check; path=/; secure",
+				"X-Frame-Options": "SAMEORIGIN",
+				"Cache-Control":   "no-cache, must-revalidate, max-age=0",
+			},
+			expectedContains: []string{
+				"<title>Log In &lsaquo; example.com &#8212; WordPress</title>",
+				`<input type="hidden" name="redirect_to" value="https://example.com/wp-admin/" />`,
+			},
+		},
+		{
+			name:             "Login form redirecting back",
+			target:           "/wp-login.php?redirect_to=%22%3E%3Cscript%3E&reauth=1",
+			expectedStatus:   "200 OK",
+			expectedType:     "text/html; charset=UTF-8",
+			expectedChunked:  true,
+			expectedContains: []string{`<input type="hidden" name="redirect_to" value="&quot;&gt;&lt;script&gt;" />`},
+		},
+		{
+			name:            "Dashboard",
+			target:          "/wp-admin/",
+			expectedStatus:  "302 Moved Temporarily",
+			expectedType:    "text/html; charset=UTF-8",
+			expectedChunked: true,
+			expectedHeaders: map[string]string{
+				"Location":      "https://example.com/wp-login.php?redirect_to=https%3A%2F%2Fexample.com%2Fwp-admin%2F&reauth=1",
+				"X-Redirect-By": "WordPress",
+			},
+		},
+		{
+			name:            "Dashboard script",
+			target:          "/wp-admin/options.php?page=x",
+			expectedStatus:  "302 Moved Temporarily",
+			expectedType:    "text/html; charset=UTF-8",
+			expectedChunked: true,
+			expectedHeaders: map[string]string{"Location": "https://example.com/wp-login.php?redirect_to=https%3A%2F%2Fexample.com%2Fwp-admin%2Foptions.php%3Fpage%3Dx&reauth=1"},
+		},
+		{
+			name:            "Dashboard without slash",
+			target:          "/wp-admin",
+			expectedStatus:  "301 Moved Permanently",
+			expectedType:    "text/html",
+			expectedHeaders: map[string]string{"Location": "https://example.com/wp-admin/"},
+		},
+		{
+			name:             "AJAX without action",
+			target:           "/wp-admin/admin-ajax.php",
+			expectedStatus:   "400 Bad Request",
+			expectedType:     "text/html; charset=UTF-8",
+			expectedChunked:  true,
+			expectedContains: []string{"0"},
+		},
+		{
+			name:             "XML-RPC GET",
+			target:           "/xmlrpc.php",
+			expectedStatus:   "405 Not Allowed",
+			expectedType:     "text/plain;charset=UTF-8",
+			expectedChunked:  true,
+			expectedHeaders:  map[string]string{"Allow": "POST"},
+			expectedContains: []string{"XML-RPC server accepts POST requests only."},
+		},
+		{
+			name:             "XML-RPC POST",
+			method:           http.MethodPost,
+			target:           "/xmlrpc.php",
+			expectedStatus:   "200 OK",
+			expectedType:     "text/xml; charset=UTF-8",
+			expectedContains: []string{"<name>faultCode</name>\n          <value><int>-32700</int></value>"},
+		},
+		{
+			name:            "REST API",
+			target:          "/wp-json/",
+			expectedStatus:  "200 OK",
+			expectedType:    "application/json; charset=UTF-8",
+			expectedChunked: true,
+			expectedHeaders: map[string]string{"X-Robots-Tag": "noindex", "Allow": "GET"},
+			expectedContains: []string{
+				`{"name":"example.com","description":"","url":"https:\/\/example.com",`,
+				`"namespaces":["oembed\/1.0","wp\/v2",`,
+			},
+		},
+		{
+			name:            "Missing page",
+			target:          "/about/",
+			expectedStatus:  "404 Not Found",
+			expectedType:    "text/html; charset=UTF-8",
+			expectedChunked: true,
+			expectedHeaders: map[string]string{
+				"Expires":       "Wed, 11 Jan 1984 05:00:00 GMT",
+				"Cache-Control": "no-cache, must-revalidate, max-age=0",
+			},
+			expectedContains: []string{"<title>Page not found &#8211; example.com</title>", `<body class="error404 wp-embed-responsive">`},
+		},
+		{
+			name:             "Missing script",
+			target:           "/phpinfo.php",
+			expectedStatus:   "404 Not Found",
+			expectedType:     "text/html",
+			expectedContains: []string{"<center>nginx/1.18.0 (Ubuntu)</center>"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(tc.target)
+			require.NoError(t, err)
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := GetWordPress("example.com", method, u)
+
+			parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(r.Bytes())), nil)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(parsed.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, parsed.Status)
+			assert.Equal(t, "nginx/1.18.0 (Ubuntu)", parsed.Header.Get("Server"))
+			assert.Equal(t, tc.expectedType, parsed.Header.Get("Content-Type"))
+			if tc.expectedChunked {
+				assert.Equal(t, []string{"chunked"}, parsed.TransferEncoding)
+				assert.Equal(t, "PHP/8.1.2-1ubuntu2.14", parsed.Header.Get("X-Powered-By"))
+			} else {
+				assert.Equal(t, strconv.Itoa(len(body)), parsed.Header.Get("Content-Length"))
+			}
+			for name, value := range tc.expectedHeaders {
+				assert.Equal(t, value, parsed.Header.Get(name), name)
+			}
+			for _, s := range tc.expectedContains {
+				assert.Contains(t, string(body), s)
+			}
+			// Like a cached site, nothing starts a PHP session
+			assert.NotContains(t, parsed.Header.Get("Set-Cookie"), "PHPSESSID")
+		})
+	}
+}
+
 // TestProxyRequest from original file
 func TestProxyRequest(t *testing.T) {
 	// 1. Create a mock destination server
@@ -70,7 +1681,7 @@ func TestProxyRequest(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		ProxyRequest(bufio.NewReader(serverConn), serverConn, mockDestServer.URL)
+		ProxyRequest(bufio.NewReader(serverConn), serverConn, mockDestServer.URL, "", log.Default())
 	}()
 
 	// 4. Write a sample HTTP request to the client side of the pipe
@@ -139,12 +1750,75 @@ func TestProxyRequest_BadGateway(t *testing.T) {
 	}()
 
 	// The "server" side runs the function under test
-	ProxyRequest(bufio.NewReader(proxyConn), proxyConn, mockTargetServer.URL)
+	ProxyRequest(bufio.NewReader(proxyConn), proxyConn, mockTargetServer.URL, "", log.Default())
 
 	wg.Wait()
 
 	// Now, check the results after the goroutine has finished.
 	require.NoError(t, readErr)
 	require.True(t, len(respBytes) > 0, "Should have read some bytes")
-	assert.True(t, strings.HasPrefix(string(respBytes), "HTTP/1.0 502 Bad Gateway"), "Response should be 502")
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respBytes)), nil)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "502 Bad Gateway", resp.Status, "Response should be the 502 page of nginx")
+	assert.Equal(t, "nginx/1.18.0 (Ubuntu)", resp.Header.Get("Server"))
+	assert.True(t, resp.Close)
+	assert.Equal(t, nginxServerErrorBody("nginx/1.18.0 (Ubuntu)", "502 Bad Gateway"), string(body))
+}
+
+// TestProxyRequest_DefaultVhost checks that a request for another host than
+// the domain gets the welcome page of nginx without reaching the target.
+func TestProxyRequest_DefaultVhost(t *testing.T) {
+	var proxied bool
+	mockTargetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+		fmt.Fprint(w, "Hello, World")
+	}))
+	defer mockTargetServer.Close()
+
+	clientConn, proxyConn := net.Pipe()
+	var respBytes []byte
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer clientConn.Close()
+		clientConn.Write([]byte("GET / HTTP/1.1\r\nHost: 192.0.2.1\r\n\r\n"))
+		respBytes, _ = ioutil.ReadAll(clientConn)
+	}()
+	ProxyRequest(bufio.NewReader(proxyConn), proxyConn, mockTargetServer.URL, "example.com", log.Default())
+	wg.Wait()
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respBytes)), nil)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "200 OK", resp.Status)
+	assert.Equal(t, nginxHTMLBody, string(body))
+	assert.False(t, proxied)
+}
+
+// TestMatchesHost tests matching the Host header against the domain.
+func TestMatchesHost(t *testing.T) {
+	testCases := []struct {
+		host     string
+		expected bool
+	}{
+		{host: "example.com", expected: true},
+		{host: "Example.COM", expected: true},
+		{host: "example.com:443", expected: true},
+		{host: "example.com.", expected: true},
+		{host: "www.example.com"},
+		{host: "192.0.2.1"},
+		{host: "192.0.2.1:443"},
+		{host: "[2001:db8::1]:443"},
+		{host: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			assert.Equal(t, tc.expected, MatchesHost(tc.host, "example.com"))
+		})
+	}
 }
@@ -0,0 +1,120 @@
+package stealth
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// errUnsatisfiable is returned by byteRange for a range that starts past the
+// end of the body.
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+// errIgnoredRange is returned by byteRange for a Range header that is
+// malformed or asks for several ranges, which get the whole body.
+var errIgnoredRange = errors.New("range ignored")
+
+// rangeDropped are the headers of the whole body that a 416 response leaves
+// out.
+var rangeDropped = []string{"Content-Type", "Last-Modified", "ETag", "Accept-Ranges", "Content-Encoding"}
+
+// Range returns the response to the Range header of req. A single range
+// within the body gets the 206 Partial Content form of r with those bytes, and
+// one past its end gets 416 with the length of the body in Content-Range.
+// Like nginx, a malformed header or one with several ranges gets r with the
+// whole body, as does a range ruled out by the If-Range of req. Only
+// successful responses to GET and HEAD that accept ranges are cut.
+func (r Response) Range(req *http.Request) Response {
+	header := req.Header.Get("Range")
+	if header == "" || r.Status != "200 OK" || r.Get("Accept-Ranges") != "bytes" ||
+		(req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return r
+	}
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" && !r.ifRangeMatches(ifRange) {
+		return r
+	}
+
+	size := len(r.Body)
+	start, end, err := byteRange(header, size)
+	switch {
+	case errors.Is(err, errUnsatisfiable):
+		r.Status = "416 Requested Range Not Satisfiable"
+		r.Headers = slices.DeleteFunc(slices.Clone(r.Headers), func(h Header) bool {
+			return slices.Contains(rangeDropped, h.Name)
+		})
+		r = r.withBody(nil)
+		r.Headers = r.insertAfter("Content-Length", Header{"Content-Range", "bytes */" + strconv.Itoa(size)})
+		return r
+	case err != nil:
+		return r
+	}
+
+	r.Status = "206 Partial Content"
+	r = r.withBody(r.Body[start : end+1])
+	r.Headers = r.insertAfter("Content-Length", Header{"Content-Range", "bytes " + strconv.Itoa(start) + "-" + strconv.Itoa(end) + "/" + strconv.Itoa(size)})
+	return r
+}
+
+// ifRangeMatches reports whether If-Range allows a partial response: an
+// entity tag must equal the strong ETag of r, a date its Last-Modified.
+func (r Response) ifRangeMatches(ifRange string) bool {
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := r.Get("ETag")
+		return !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+	return ifRange == r.Get("Last-Modified")
+}
+
+// byteRange parses a Range header for a body of size bytes and returns the
+// first and last byte of its single range.
+func byteRange(header string, size int) (start, end int, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errIgnoredRange
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errIgnoredRange
+	}
+
+	if first == "" {
+		// A suffix range of the last bytes
+		n, err := parseRangeNumber(last)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errUnsatisfiable
+		}
+		return max(size-n, 0), size - 1, nil
+	}
+
+	start, err = parseRangeNumber(first)
+	if err != nil {
+		return 0, 0, err
+	}
+	end = size - 1
+	if last != "" {
+		if end, err = parseRangeNumber(last); err != nil || end < start {
+			return 0, 0, errIgnoredRange
+		}
+	}
+	if start >= size {
+		return 0, 0, errUnsatisfiable
+	}
+	return start, min(end, size-1), nil
+}
+
+// parseRangeNumber parses a byte position of a range, which is only digits.
+func parseRangeNumber(s string) (int, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, errIgnoredRange
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errIgnoredRange
+	}
+	return n, nil
+}
@@ -0,0 +1,230 @@
+package stealth
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Header is a header field of a Response.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Response is a canned HTTP/1.x response. Its headers are kept in the order
+// the imitated server sends them, as that order tells web servers apart, and
+// apart from the body, so that the response to HEAD is just its Head.
+//
+// The generators build responses for a connection that is kept alive, as
+// real servers do by default; Close turns one into the last response on its
+// connection. A header with an empty value is left out, which keeps the place
+// of a Connection header that a server only sends to close.
+type Response struct {
+	// Proto is the protocol version of the status line, "HTTP/1.1" if empty,
+	// which most servers answer with whatever the version of the request.
+	Proto string
+	// Status is the status code and reason phrase, e.g. "200 OK".
+	Status  string
+	Headers []Header
+	Body    []byte
+}
+
+// Head returns the status line and headers of r, up to and including the
+// blank line that ends them.
+func (r Response) Head() []byte {
+	var b bytes.Buffer
+	proto := r.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	b.WriteString(proto + " " + r.Status + "\r\n")
+	for _, h := range r.Headers {
+		if h.Value == "" {
+			continue
+		}
+		b.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// Bytes returns the whole response, head and body. The body of a response
+// with "Transfer-Encoding: chunked", like those of dynamic pages, is sent as a
+// single chunk.
+func (r Response) Bytes() []byte {
+	if r.Get("Transfer-Encoding") == "chunked" {
+		return append(r.Head(), chunked(r.Body)...)
+	}
+	return append(r.Head(), r.Body...)
+}
+
+// chunked returns body in the chunked transfer coding.
+func chunked(body []byte) []byte {
+	var b bytes.Buffer
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "%x\r\n", len(body))
+		b.Write(body)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("0\r\n\r\n")
+	return b.Bytes()
+}
+
+// Get returns the value of the header of r named name, or "" if there is none.
+func (r Response) Get(name string) string {
+	for _, h := range r.Headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// With returns r with the value of its header named name set to value, which
+// leaves the header out if empty but keeps its place.
+func (r Response) With(name, value string) Response {
+	r.Headers = slices.Clone(r.Headers)
+	for i, h := range r.Headers {
+		if h.Name == name {
+			r.Headers[i].Value = value
+		}
+	}
+	return r
+}
+
+// Close returns r as the last response on its connection, with
+// "Connection: close" and without the Keep-Alive header of Apache.
+func (r Response) Close() Response {
+	r.Headers = slices.Clone(r.Headers)
+	r.Headers = slices.DeleteFunc(r.Headers, func(h Header) bool { return h.Name == "Keep-Alive" })
+	for i, h := range r.Headers {
+		if h.Name == "Connection" {
+			r.Headers[i].Value = "close"
+		}
+	}
+	return r
+}
+
+// KeepAlive returns r with the Keep-Alive header of Apache, if it has one,
+// announcing the idle timeout of the connection and the number of requests
+// it will still serve.
+func (r Response) KeepAlive(timeout time.Duration, max int) Response {
+	r.Headers = slices.Clone(r.Headers)
+	for i, h := range r.Headers {
+		if h.Name == "Keep-Alive" {
+			r.Headers[i].Value = fmt.Sprintf("timeout=%d, max=%d", int(timeout.Seconds()), max)
+		}
+	}
+	return r
+}
+
+// withBody returns r with body and Content-Length adjusted to it.
+func (r Response) withBody(body []byte) Response {
+	r.Body = body
+	r.Headers = slices.Clone(r.Headers)
+	for i, h := range r.Headers {
+		if h.Name == "Content-Length" {
+			r.Headers[i].Value = strconv.Itoa(len(body))
+		}
+	}
+	return r
+}
+
+// without returns the headers of r other than those named name.
+func (r Response) without(name string) []Header {
+	return slices.DeleteFunc(slices.Clone(r.Headers), func(h Header) bool { return h.Name == name })
+}
+
+// insertBefore returns the headers of r with headers inserted before the one
+// named name.
+func (r Response) insertBefore(name string, headers ...Header) []Header {
+	i := slices.IndexFunc(r.Headers, func(h Header) bool { return h.Name == name })
+	if i < 0 {
+		i = len(r.Headers)
+	}
+	return slices.Insert(slices.Clone(r.Headers), i, headers...)
+}
+
+// insertAfter returns the headers of r with headers inserted after the one
+// named name, or at the end if there is none.
+func (r Response) insertAfter(name string, headers ...Header) []Header {
+	i := slices.IndexFunc(r.Headers, func(h Header) bool { return h.Name == name })
+	if i < 0 {
+		i = len(r.Headers) - 1
+	}
+	return slices.Insert(slices.Clone(r.Headers), i+1, headers...)
+}
+
+// date returns the current time for the Date header.
+func date() string {
+	return time.Now().UTC().Format(http.TimeFormat)
+}
+
+// nginxErrorPage builds an error response of nginx, or of OpenResty with its
+// server name.
+func nginxErrorPage(server, status, body string) Response {
+	return Response{
+		Status: status,
+		Headers: []Header{
+			{"Server", server},
+			{"Date", date()},
+			{"Content-Type", "text/html"},
+			{"Content-Length", strconv.Itoa(len(body))},
+			{"Connection", "keep-alive"},
+		},
+		Body: []byte(body),
+	}
+}
+
+// apacheErrorPage builds an error response of Apache.
+func apacheErrorPage(status, body string) Response {
+	return Response{
+		Status: status,
+		Headers: []Header{
+			{"Date", date()},
+			{"Server", ApacheServer},
+			{"Content-Length", strconv.Itoa(len(body))},
+			{"Keep-Alive", "timeout=5, max=100"},
+			{"Connection", "Keep-Alive"},
+			{"Content-Type", "text/html; charset=iso-8859-1"},
+		},
+		Body: []byte(body),
+	}
+}
+
+// lighttpdErrorPage builds an error response of lighttpd.
+func lighttpdErrorPage(status, body string) Response {
+	return Response{
+		Status: status,
+		Headers: []Header{
+			{"Content-Type", "text/html"},
+			{"Content-Length", strconv.Itoa(len(body))},
+			{"Connection", ""},
+			{"Date", date()},
+			{"Server", LighttpdServer},
+		},
+		Body: []byte(body),
+	}
+}
+
+// liteSpeedErrorPage builds an error response of LiteSpeed, which forbids
+// caching them.
+func liteSpeedErrorPage(status, body string) Response {
+	return Response{
+		Status: status,
+		Headers: []Header{
+			{"Connection", "Keep-Alive"},
+			{"Cache-Control", "private, no-cache, no-store, must-revalidate, max-age=0"},
+			{"Pragma", "no-cache"},
+			{"Content-Type", "text/html"},
+			{"Content-Length", strconv.Itoa(len(body))},
+			{"Date", date()},
+			{"Server", LiteSpeedServer},
+		},
+		Body: []byte(body),
+	}
+}
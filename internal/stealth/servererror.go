@@ -0,0 +1,125 @@
+package stealth
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ServerErrorCodes are the 50x status codes with generated error pages, those
+// a web server in front of a broken application answers with.
+var ServerErrorCodes = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// nginxStatusLines are the status lines of nginx for ServerErrorCodes, which
+// keep the reason phrases of older RFCs.
+var nginxStatusLines = map[int]string{
+	http.StatusInternalServerError: "500 Internal Server Error",
+	http.StatusBadGateway:          "502 Bad Gateway",
+	http.StatusServiceUnavailable:  "503 Service Temporarily Unavailable",
+	http.StatusGatewayTimeout:      "504 Gateway Time-out",
+}
+
+// nginxServerErrorBody is the built-in error page of nginx for status on
+// server, which ends its lines with CRLF like the other error pages.
+func nginxServerErrorBody(server, status string) string {
+	return "<html>\r\n" +
+		"<head><title>" + status + "</title></head>\r\n" +
+		"<body>\r\n" +
+		"<center><h1>" + status + "</h1></center>\r\n" +
+		"<hr><center>" + server + "</center>\r\n" +
+		"</body>\r\n" +
+		"</html>\r\n"
+}
+
+// nginxServerError builds the 50x page of nginx or OpenResty. Like for 400,
+// nginx closes the connection after a 500 but keeps it after the others.
+func nginxServerError(server string, code int) Response {
+	status, ok := nginxStatusLines[code]
+	if !ok {
+		panic(fmt.Sprintf("stealth: no error page for status %d", code))
+	}
+	r := nginxErrorPage(server, status, nginxServerErrorBody(server, status))
+	if code == http.StatusInternalServerError {
+		return r.Close()
+	}
+	return r
+}
+
+// GetNginx50x generates the response that nginx sends with status code, one
+// of ServerErrorCodes, such as 502 Bad Gateway for an upstream that refuses
+// connections.
+func GetNginx50x(code int) Response {
+	return nginxServerError(NginxServer, code)
+}
+
+// GetOpenResty50x generates the response that OpenResty sends with status
+// code, one of ServerErrorCodes.
+func GetOpenResty50x(code int) Response {
+	return nginxServerError(OpenRestyServer, code)
+}
+
+const apacheServerErrorBody = `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>%d %s</title>
+</head><body>
+<h1>%s</h1>
+%s<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at %s Port 443</address>
+</body></html>
+`
+
+// apacheServerErrorMessages are the paragraphs of the Apache error pages for
+// ServerErrorCodes. The one for 502 has the CRLF line endings of the source.
+var apacheServerErrorMessages = map[int]string{
+	http.StatusInternalServerError: "<p>The server encountered an internal error or\n" +
+		"misconfiguration and was unable to complete\n" +
+		"your request.</p>\n" +
+		"<p>Please contact the server administrator at \n" +
+		" webmaster@localhost to inform them of the time this error occurred,\n" +
+		" and the actions you performed just before this error.</p>\n" +
+		"<p>More information about this error may be available\n" +
+		"in the server error log.</p>\n",
+	http.StatusBadGateway: "<p>The proxy server received an invalid\r\n" +
+		"response from an upstream server.<br />\r\n" +
+		"</p>\n",
+	http.StatusServiceUnavailable: "<p>The server is temporarily unable to service your\n" +
+		"request due to maintenance downtime or capacity\n" +
+		"problems. Please try again later.</p>\n",
+	http.StatusGatewayTimeout: "<p>The gateway did not receive a timely response\n" +
+		"from the upstream server or application.</p>\n",
+}
+
+// GetApache50x generates the response that Apache sends with status code, one
+// of ServerErrorCodes. Like the 404 page, it names the server, so host should
+// be the domain the proxy serves. Apache closes the connection after a 500 or
+// a 503, but keeps it after the others.
+func GetApache50x(code int, host string) Response {
+	message, ok := apacheServerErrorMessages[code]
+	if !ok {
+		panic(fmt.Sprintf("stealth: no error page for status %d", code))
+	}
+	text := http.StatusText(code)
+	r := apacheErrorPage(fmt.Sprintf("%d %s", code, text), fmt.Sprintf(apacheServerErrorBody, code, text, text, message, host))
+	if code == http.StatusInternalServerError || code == http.StatusServiceUnavailable {
+		return r.Close()
+	}
+	return r
+}
+
+// AddHeader returns r with headers added in order as by the configuration of
+// the server, such as Retry-After during maintenance. nginx sends such headers
+// after its own, and Apache right after Server.
+func (r Response) AddHeader(headers ...Header) Response {
+	if strings.HasPrefix(r.Get("Server"), "Apache") {
+		r.Headers = r.insertAfter("Server", headers...)
+		return r
+	}
+	r.Headers = append(slices.Clone(r.Headers), headers...)
+	return r
+}
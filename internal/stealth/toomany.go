@@ -0,0 +1,92 @@
+package stealth
+
+import "fmt"
+
+const nginxTooManyRequestsBody = "<html>\r\n" +
+	"<head><title>429 Too Many Requests</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>429 Too Many Requests</h1></center>\r\n" +
+	"<hr><center>nginx/1.18.0 (Ubuntu)</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+const openRestyTooManyRequestsBody = "<html>\r\n" +
+	"<head><title>429 Too Many Requests</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>429 Too Many Requests</h1></center>\r\n" +
+	"<hr><center>openresty/1.21.4.1</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+const apacheTooManyRequestsBody = `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>429 Too Many Requests</title>
+</head><body>
+<h1>Too Many Requests</h1>
+<p>The user has sent too many requests
+in a given amount of time.</p>
+<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at %s Port 443</address>
+</body></html>
+`
+
+const lighttpdTooManyRequestsBody = `<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+         "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>429 Too Many Requests</title>
+ </head>
+ <body>
+  <h1>429 Too Many Requests</h1>
+ </body>
+</html>
+`
+
+const liteSpeedTooManyRequestsBody = `<!DOCTYPE html>
+<html style="height:100%">
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no" />
+<title> 429 Too Many Requests
+</title></head>
+<body style="color: #444; margin:0;font: normal 14px/20px Arial, Helvetica, sans-serif; height:100%; background-color: #fff;">
+<div style="height:auto; min-height:100%; ">     <div style="text-align: center; width:800px; margin-left: -400px; position:absolute; top: 30%; left:50%;">
+        <h1 style="margin:0; font-size:150px; line-height:150px; font-weight:bold;">429</h1>
+<h2 style="margin-top:20px;font-size: 30px;">Too Many Requests
+</h2>
+<p>The user has sent too many requests in a given amount of time.</p>
+</div></div><div style="color:#f0f0f0; font-size:12px;margin:auto;padding:0px 30px 0px 30px;position:relative;clear:both;height:100px;margin-top:-101px;background-color:#474747;border-top: 1px solid rgba(0,0,0,0.15);box-shadow: 0 1px 0 rgba(255, 255, 255, 0.3) inset;">
+<br>Proudly powered by  <a style="color:#fff;" href="http://www.litespeedtech.com/error-page">LiteSpeed Web Server</a><p>Please be advised that LiteSpeed Technologies Inc. is not a web hosting company and, as such, has no control over content found elsewhere on this site.</p></div></body></html>
+`
+
+// GetNginx429 generates the 429 Too Many Requests response that nginx sends
+// for a request over the rate of a limit_req zone set to reject with 429.
+func GetNginx429() Response {
+	return nginxErrorPage(NginxServer, "429 Too Many Requests", nginxTooManyRequestsBody)
+}
+
+// GetApache429 generates the 429 Too Many Requests response that Apache sends
+// for a request over the rate of a limiting module. Like the 404 page, it
+// names the server, so host should be the domain the proxy serves.
+func GetApache429(host string) Response {
+	return apacheErrorPage("429 Too Many Requests", fmt.Sprintf(apacheTooManyRequestsBody, host))
+}
+
+// GetLighttpd429 generates the 429 Too Many Requests response that lighttpd
+// sends for a request over a rate limit.
+func GetLighttpd429() Response {
+	return lighttpdErrorPage("429 Too Many Requests", lighttpdTooManyRequestsBody)
+}
+
+// GetOpenResty429 generates the 429 Too Many Requests response that OpenResty
+// sends for a request over the rate of a limit_req zone set to reject with
+// 429.
+func GetOpenResty429() Response {
+	return nginxErrorPage(OpenRestyServer, "429 Too Many Requests", openRestyTooManyRequestsBody)
+}
+
+// GetLiteSpeed429 generates the 429 Too Many Requests response that LiteSpeed
+// sends for a request over its per-client throttling.
+func GetLiteSpeed429() Response {
+	return liteSpeedErrorPage("429 Too Many Requests", liteSpeedTooManyRequestsBody)
+}
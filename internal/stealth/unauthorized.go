@@ -0,0 +1,102 @@
+package stealth
+
+import "fmt"
+
+const apacheUnauthorizedBody = `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>401 Unauthorized</title>
+</head><body>
+<h1>Unauthorized</h1>
+<p>This server could not verify that you
+are authorized to access the document
+requested.  Either you supplied the wrong
+credentials (e.g., bad password), or your
+browser doesn't understand how to supply
+the credentials required.</p>
+<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at %s Port 443</address>
+</body></html>
+`
+
+const lighttpdUnauthorizedBody = `<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+         "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>401 Unauthorized</title>
+ </head>
+ <body>
+  <h1>401 Unauthorized</h1>
+ </body>
+</html>
+`
+
+const liteSpeedUnauthorizedBody = `<!DOCTYPE html>
+<html style="height:100%">
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no" />
+<title> 401 Unauthorized
+</title></head>
+<body style="color: #444; margin:0;font: normal 14px/20px Arial, Helvetica, sans-serif; height:100%; background-color: #fff;">
+<div style="height:auto; min-height:100%; ">     <div style="text-align: center; width:800px; margin-left: -400px; position:absolute; top: 30%; left:50%;">
+        <h1 style="margin:0; font-size:150px; line-height:150px; font-weight:bold;">401</h1>
+<h2 style="margin-top:20px;font-size: 30px;">Unauthorized
+</h2>
+<p>This request requires HTTP authentication.</p>
+</div></div><div style="color:#f0f0f0; font-size:12px;margin:auto;padding:0px 30px 0px 30px;position:relative;clear:both;height:100px;margin-top:-101px;background-color:#474747;border-top: 1px solid rgba(0,0,0,0.15);box-shadow: 0 1px 0 rgba(255, 255, 255, 0.3) inset;">
+<br>Proudly powered by  <a style="color:#fff;" href="http://www.litespeedtech.com/error-page">LiteSpeed Web Server</a><p>Please be advised that LiteSpeed Technologies Inc. is not a web hosting company and, as such, has no control over content found elsewhere on this site.</p></div></body></html>
+`
+
+// basicChallenge returns the WWW-Authenticate header asking for the
+// credentials of realm with the Basic scheme.
+func basicChallenge(realm string) Header {
+	return Header{"WWW-Authenticate", `Basic realm="` + realm + `"`}
+}
+
+// nginxUnauthorized builds the 401 page of nginx or OpenResty for an
+// auth_basic location, whose title keeps the reason phrase of RFC 2068.
+func nginxUnauthorized(server, realm string) Response {
+	r := nginxErrorPage(server, "401 Unauthorized", nginxServerErrorBody(server, "401 Authorization Required"))
+	r.Headers = append(r.Headers, basicChallenge(realm))
+	return r
+}
+
+// GetNginx401 generates the response that nginx sends for a location
+// protected with auth_basic realm, to requests without valid credentials.
+func GetNginx401(realm string) Response {
+	return nginxUnauthorized(NginxServer, realm)
+}
+
+// GetOpenResty401 generates the response that OpenResty sends for a location
+// protected with auth_basic realm.
+func GetOpenResty401(realm string) Response {
+	return nginxUnauthorized(OpenRestyServer, realm)
+}
+
+// GetApache401 generates the response that Apache sends for a directory
+// protected with AuthType Basic and AuthName realm. host should be the domain
+// the proxy serves.
+func GetApache401(realm, host string) Response {
+	r := apacheErrorPage("401 Unauthorized", fmt.Sprintf(apacheUnauthorizedBody, host))
+	r.Headers = r.insertAfter("Server", basicChallenge(realm))
+	return r
+}
+
+// GetLighttpd401 generates the response that lighttpd sends for a path
+// protected by mod_auth with realm, which announces the charset of the
+// credentials as RFC 7617 allows.
+func GetLighttpd401(realm string) Response {
+	r := lighttpdErrorPage("401 Unauthorized", lighttpdUnauthorizedBody)
+	h := basicChallenge(realm)
+	h.Value += `, charset="UTF-8"`
+	r.Headers = r.insertBefore("Content-Type", h)
+	return r
+}
+
+// GetLiteSpeed401 generates the response that LiteSpeed sends for a realm
+// protected path.
+func GetLiteSpeed401(realm string) Response {
+	r := liteSpeedErrorPage("401 Unauthorized", liteSpeedUnauthorizedBody)
+	r.Headers = r.insertBefore("Content-Type", basicChallenge(realm))
+	return r
+}
@@ -0,0 +1,89 @@
+package stealth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// The Server headers the pages of this package are written with. WithServer
+// rewrites them into the version claimed by a persona.
+const (
+	NginxServer     = "nginx/1.18.0 (Ubuntu)"
+	ApacheServer    = "Apache/2.4.41 (Ubuntu)"
+	LighttpdServer  = "lighttpd/1.4.63"
+	OpenRestyServer = "openresty/1.21.4.1"
+	LiteSpeedServer = "LiteSpeed"
+)
+
+// serverVersions are the Server headers of the releases of each server in the
+// distributions still in use, by the Server header of its pages. They are
+// limited to releases answering like the pages, with the same headers and
+// ETags: Apache to Ubuntu, whose default page it serves, and LiteSpeed to its
+// header without a version, which is all a stock install shows.
+var serverVersions = map[string][]string{
+	NginxServer: {
+		NginxServer,             // Ubuntu 20.04 and 22.04
+		"nginx/1.24.0 (Ubuntu)", // Ubuntu 24.04
+		"nginx/1.22.1",          // Debian 12
+		"nginx/1.26.3",          // Debian 13
+	},
+	ApacheServer: {
+		ApacheServer,             // Ubuntu 20.04
+		"Apache/2.4.52 (Ubuntu)", // Ubuntu 22.04
+		"Apache/2.4.58 (Ubuntu)", // Ubuntu 24.04
+	},
+	LighttpdServer: {
+		"lighttpd/1.4.55", // Ubuntu 20.04
+		LighttpdServer,    // Ubuntu 22.04
+		"lighttpd/1.4.69", // Debian 12
+		"lighttpd/1.4.74", // Ubuntu 24.04
+	},
+	OpenRestyServer: {
+		OpenRestyServer,
+		"openresty/1.21.4.3",
+		"openresty/1.25.3.1",
+		"openresty/1.25.3.2",
+		"openresty/1.27.1.1",
+	},
+	LiteSpeedServer: {LiteSpeedServer},
+}
+
+// ServerVersion returns the Server header claimed on host by the server whose
+// pages send server, one of the Server constants above. It is picked from the
+// releases in use by a hash of host, so that a server keeps its version across
+// restarts while servers for different hosts do not all claim the same one.
+func ServerVersion(server, host string) string {
+	versions, ok := serverVersions[server]
+	if !ok {
+		return server
+	}
+	h := sha256.New()
+	h.Write([]byte(server))
+	h.Write([]byte{0})
+	h.Write([]byte(host))
+	n := binary.BigEndian.Uint64(h.Sum(nil))
+	return versions[n%uint64(len(versions))]
+}
+
+// WithServer returns r as sent by the same server claiming to be server: with
+// it as the Server header, and in the signature of the error pages of nginx,
+// OpenResty and Apache. Content-Length follows the body.
+func (r Response) WithServer(server string) Response {
+	old := r.Get("Server")
+	if old == "" || old == server {
+		return r
+	}
+	r = r.With("Server", server)
+	if body := signedBody(r.Body, old, server); !bytes.Equal(body, r.Body) {
+		r = r.withBody(body)
+	}
+	return r
+}
+
+// signedBody returns body with the signature of server old replaced by that
+// of server: the footer of nginx error pages, and the address line of Apache.
+func signedBody(body []byte, old, server string) []byte {
+	body = bytes.ReplaceAll(body, []byte("<center>"+old+"</center>"), []byte("<center>"+server+"</center>"))
+	return bytes.ReplaceAll(body, []byte("<address>"+old+" Server at "), []byte("<address>"+server+" Server at "))
+}
@@ -0,0 +1,17 @@
+package stealth
+
+import (
+	"net"
+	"strings"
+)
+
+// MatchesHost reports whether host, the Host header of a request, names
+// domain, ignoring case, the port and a trailing dot. Like on a real server,
+// an empty host, as from an HTTP/1.0 client, and an IP address name no
+// virtual host, and get the default server.
+func MatchesHost(host, domain string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return host != "" && strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(domain, "."))
+}
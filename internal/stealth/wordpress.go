@@ -0,0 +1,294 @@
+package stealth
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The WordPress persona is a fresh blog on the stock LEMP stack of Ubuntu
+// 22.04: nginx 1.18 passing PHP to php-fpm 8.1, with pretty permalinks.
+const (
+	wordPressVersion = "6.4.3"
+	wordPressPHP     = "PHP/8.1.2-1ubuntu2.14"
+	// wordPressPostSlug is the slug of the sample post of every install.
+	wordPressPostSlug = "hello-world"
+)
+
+// wordPressEscaper escapes attribute values like esc_attr.
+var wordPressEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&#039;")
+
+// wordPressNoCache are the headers of nocache_headers(), which WordPress sends
+// for 404s and the pages that must not be cached.
+var wordPressNoCache = []Header{
+	{"Expires", "Wed, 11 Jan 1984 05:00:00 GMT"},
+	{"Cache-Control", "no-cache, must-revalidate, max-age=0"},
+}
+
+// The theme pages are those of Twenty Twenty-Four, the default theme of
+// WordPress 6.4, with the site title in the header.
+const wordPressPageHTML = `<!DOCTYPE html>
+<html lang="en-US">
+<head>
+	<meta charset="UTF-8" />
+	<meta name="viewport" content="width=device-width, initial-scale=1" />
+<meta name='robots' content='max-image-preview:large' />
+<title>%[3]s</title>
+<link rel="https://api.w.org/" href="https://%[1]s/wp-json/" />
+<meta name="generator" content="WordPress ` + wordPressVersion + `" />
+</head>
+
+<body class="%[4]s wp-embed-responsive">
+
+<div class="wp-site-blocks"><header class="wp-block-template-part">
+<div class="wp-block-group alignwide has-base-background-color has-background is-layout-flow wp-block-group-is-layout-flow">
+<p class="wp-block-site-title"><a href="https://%[1]s" target="_self" rel="home">%[2]s</a></p>
+</div>
+</header>
+
+<main class="wp-block-group is-layout-flow wp-block-group-is-layout-flow">
+%[5]s</main>
+
+<footer class="wp-block-template-part">
+<div class="wp-block-group alignwide is-layout-flow wp-block-group-is-layout-flow">
+<p class="has-text-align-center has-small-font-size">Designed with <a href="https://wordpress.org" rel="nofollow">WordPress</a></p>
+</div>
+</footer></div>
+</body>
+</html>
+`
+
+const wordPressHomeMain = `<h1 class="wp-block-heading has-text-align-center">Blog</h1>
+<ul class="wp-block-post-template is-layout-flow wp-block-post-template-is-layout-flow"><li class="wp-block-post post-1 post type-post status-publish format-standard hentry category-uncategorized">
+<h2 class="wp-block-post-title"><a href="%[1]s" target="_self" >Hello world!</a></h2>
+<div class="wp-block-post-excerpt"><p class="wp-block-post-excerpt__excerpt">Welcome to WordPress. This is your first post. Edit or delete it, then start writing! </p></div>
+<div class="wp-block-post-date"><time datetime="%[2]s">%[3]s</time></div>
+</li></ul>
+`
+
+const wordPressPostMain = `<h1 class="wp-block-post-title">Hello world!</h1>
+<div class="wp-block-post-date"><time datetime="%[1]s">%[2]s</time></div>
+<div class="entry-content wp-block-post-content is-layout-constrained wp-block-post-content-is-layout-constrained">
+<p>Welcome to WordPress. This is your first post. Edit or delete it, then start writing!</p>
+</div>
+`
+
+const wordPressNotFoundMain = `<h1 class="wp-block-heading">Page Not Found</h1>
+<p>The page you are looking for does not exist, or it has been moved. Please try searching using the form below.</p>
+<form role="search" method="get" action="https://%[1]s/" class="wp-block-search__button-outside wp-block-search__text-button wp-block-search"><label class="wp-block-search__label screen-reader-text" for="wp-block-search__input-1" >Search</label><div class="wp-block-search__inside-wrapper " ><input class="wp-block-search__input" id="wp-block-search__input-1" placeholder="Search..." value="" type="search" name="s" required /><button aria-label="Search" class="wp-block-search__button wp-element-button" type="submit" >Search</button></div></form>
+`
+
+const wordPressLoginHTML = `<!DOCTYPE html>
+	<html lang="en-US">
+	<head>
+	<meta http-equiv="Content-Type" content="text/html; charset=UTF-8" />
+	<title>Log In &lsaquo; %[2]s &#8212; WordPress</title>
+	<meta name='robots' content='max-image-preview:large, noindex, noarchive' />
+<link rel='stylesheet' id='login-css' href='https://%[1]s/wp-admin/css/login.min.css?ver=` + wordPressVersion + `' media='all' />
+	<meta name='referrer' content='strict-origin-when-cross-origin' />
+		<meta name="viewport" content="width=device-width" />
+		</head>
+	<body class="login no-js login-action-login wp-core-ui  locale-en-us">
+	<script type="text/javascript">
+/* <![CDATA[ */
+document.body.className = document.body.className.replace('no-js','js');
+/* ]]> */
+</script>
+				<div id="login">
+		<h1><a href="https://wordpress.org/">Powered by WordPress</a></h1>
+
+		<form name="loginform" id="loginform" action="https://%[1]s/wp-login.php" method="post">
+			<p>
+				<label for="user_login">Username or Email Address</label>
+				<input type="text" name="log" id="user_login" class="input" value="" size="20" autocapitalize="off" autocomplete="username" required="required" />
+			</p>
+
+			<div class="user-pass-wrap">
+				<label for="user_pass">Password</label>
+				<div class="wp-pwd">
+					<input type="password" name="pwd" id="user_pass" class="input password-input" value="" size="20" autocomplete="current-password" spellcheck="false" required="required" />
+					<button type="button" class="button button-secondary wp-hide-pw hide-if-no-js" data-toggle="0" aria-label="Show password">
+						<span class="dashicons dashicons-visibility" aria-hidden="true"></span>
+					</button>
+				</div>
+			</div>
+						<p class="forgetmenot"><input name="rememberme" type="checkbox" id="rememberme" value="forever"  /> <label for="rememberme">Remember Me</label></p>
+			<p class="submit">
+				<input type="submit" name="wp-submit" id="wp-submit" class="button button-primary button-large" value="Log In" />
+									<input type="hidden" name="redirect_to" value="%[3]s" />
+									<input type="hidden" name="testcookie" value="1" />
+			</p>
+		</form>
+
+					<p id="nav">
+				<a href="https://%[1]s/wp-login.php?action=lostpassword">Lost your password?</a>			</p>
+					<script type="text/javascript">
+/* <![CDATA[ */
+function wp_attempt_focus() {setTimeout( function() {try {d = document.getElementById( "user_login" );d.focus(); d.select();} catch( er ) {}}, 200);}
+wp_attempt_focus();
+if ( typeof wpOnload === 'function' ) { wpOnload() }
+/* ]]> */
+</script>
+				<p id="backtoblog">
+			<a href="https://%[1]s/">&larr; Go to %[2]s</a>		</p>
+			</div>
+				<div class="privacy-policy-page-link"></div>
+	</body>
+	</html>
+	`
+
+// wordPressXMLRPCGetBody is the answer of xmlrpc.php to anything but POST.
+const wordPressXMLRPCGetBody = "XML-RPC server accepts POST requests only."
+
+// wordPressXMLRPCFault is the fault xmlrpc.php answers a POST with when the
+// body is not a method call it can parse.
+const wordPressXMLRPCFault = `<?xml version="1.0" encoding="UTF-8"?>
+<methodResponse>
+  <fault>
+    <value>
+      <struct>
+        <member>
+          <name>faultCode</name>
+          <value><int>-32700</int></value>
+        </member>
+        <member>
+          <name>faultString</name>
+          <value><string>parse error. not well formed</string></value>
+        </member>
+      </struct>
+    </value>
+  </fault>
+</methodResponse>
+
+`
+
+// wordPressIndexJSON is the index of the REST API, trimmed to its own route,
+// with slashes escaped like PHP's json_encode does.
+const wordPressIndexJSON = `{"name":"%[2]s","description":"","url":"https:\/\/%[1]s","home":"https:\/\/%[1]s","gmt_offset":"0","timezone_string":"","namespaces":["oembed\/1.0","wp\/v2","wp-site-health\/v1","wp-block-editor\/v1"],"authentication":[],"routes":{"\/":{"namespace":"","methods":["GET"],"endpoints":[{"methods":["GET"],"args":{"context":{"default":"view","required":false}}}],"_links":{"self":[{"href":"https:\/\/%[1]s\/wp-json\/"}]}}},"site_logo":0,"site_icon":0,"site_icon_url":"","_links":{"help":[{"href":"https:\/\/developer.wordpress.org\/rest-api\/"}]}}`
+
+// wordPressResponse builds a response of PHP behind nginx, which streams it
+// chunked and sends the headers of PHP after its own.
+func wordPressResponse(status, contentType, body string, headers ...Header) Response {
+	return Response{
+		Status: status,
+		Headers: append([]Header{
+			{"Server", NginxServer},
+			{"Date", date()},
+			{"Content-Type", contentType},
+			{"Transfer-Encoding", "chunked"},
+			{"Connection", "keep-alive"},
+			{"X-Powered-By", wordPressPHP},
+		}, headers...),
+		Body: []byte(body),
+	}
+}
+
+// wordPressAPILink is the Link header to the REST API of every theme page.
+func wordPressAPILink(host string) Header {
+	return Header{"Link", `<https://` + host + `/wp-json/>; rel="https://api.w.org/"`}
+}
+
+// wordPressPostPath returns the permalink path of the sample post, dated like
+// the modification times of the other personas, so that it differs between
+// servers but not across requests.
+func wordPressPostPath(host string) string {
+	return modTime(host, []byte(wordPressPostSlug)).Format("/2006/01/02/") + wordPressPostSlug + "/"
+}
+
+// wordPressPage renders a theme page of the blog of host.
+func wordPressPage(host, title, bodyClass, main string) string {
+	return fmt.Sprintf(wordPressPageHTML, host, host, title, bodyClass, main)
+}
+
+// GetWordPressResponse generates the front page of the WordPress blog of host,
+// which lists its sample post.
+func GetWordPressResponse(host string) Response {
+	published := modTime(host, []byte(wordPressPostSlug))
+	main := fmt.Sprintf(wordPressHomeMain, "https://"+host+wordPressPostPath(host), published.Format("2006-01-02T15:04:05+00:00"), published.Format("January 2, 2006"))
+	return wordPressResponse("200 OK", "text/html; charset=UTF-8", wordPressPage(host, host, "home blog", main), wordPressAPILink(host))
+}
+
+// GetWordPress404 generates the 404 page of the theme, which WordPress sends
+// for any path it does not know, with the headers forbidding caching.
+func GetWordPress404(host string) Response {
+	main := fmt.Sprintf(wordPressNotFoundMain, host)
+	headers := append(append([]Header{}, wordPressNoCache...), wordPressAPILink(host))
+	return wordPressResponse("404 Not Found", "text/html; charset=UTF-8", wordPressPage(host, "Page not found &#8211; "+host, "error404", main), headers...)
+}
+
+// GetWordPress generates the response of the WordPress blog of host to a
+// request for u with method: the front page and the sample post, the login
+// form, redirects from the dashboard to it, the XML-RPC and REST API
+// endpoints, and the 404 page of the theme for anything else. A missing PHP
+// script gets the 404 page of nginx, which only passes existing ones to PHP.
+func GetWordPress(host, method string, u *url.URL) Response {
+	switch p := u.Path; {
+	case p == "/" || p == "/index.php":
+		return GetWordPressResponse(host)
+	case p == wordPressPostPath(host):
+		published := modTime(host, []byte(wordPressPostSlug))
+		main := fmt.Sprintf(wordPressPostMain, published.Format("2006-01-02T15:04:05+00:00"), published.Format("January 2, 2006"))
+		return wordPressResponse("200 OK", "text/html; charset=UTF-8", wordPressPage(host, "Hello world! &#8211; "+host, "post-template-default single single-post postid-1 single-format-standard", main),
+			wordPressAPILink(host),
+			Header{"Link", `<https://` + host + `/wp-json/wp/v2/posts/1>; rel="alternate"; type="application/json"`},
+			Header{"Link", `<https://` + host + `/?p=1>; rel=shortlink`})
+	case p == "/wp-login.php":
+		return getWordPressLogin(host, u.Query().Get("redirect_to"))
+	case p == "/wp-admin":
+		// A real directory, which nginx redirects to with the slash
+		return nginxMovedPermanently("https://" + host + "/wp-admin/")
+	case p == "/wp-admin/admin-ajax.php":
+		// Without an action, admin-ajax.php dies with "0"
+		return wordPressResponse("400 Bad Request", "text/html; charset=UTF-8", "0",
+			Header{"Access-Control-Allow-Origin", "https://" + host},
+			Header{"Access-Control-Allow-Credentials", "true"},
+			Header{"X-Robots-Tag", "noindex"},
+			Header{"X-Content-Type-Options", "nosniff"},
+			wordPressNoCache[0], wordPressNoCache[1],
+			Header{"X-Frame-Options", "SAMEORIGIN"},
+			Header{"Referrer-Policy", "strict-origin-when-cross-origin"})
+	case p == "/wp-admin/" || strings.HasPrefix(p, "/wp-admin/") && strings.HasSuffix(p, ".php"):
+		// The dashboard sends visitors who are not logged in to log in
+		location := "https://" + host + "/wp-login.php?redirect_to=" + url.QueryEscape("https://"+host+u.RequestURI()) + "&reauth=1"
+		r := wordPressResponse("302 Moved Temporarily", "text/html; charset=UTF-8", "",
+			wordPressNoCache[0], wordPressNoCache[1], Header{"X-Redirect-By", "WordPress"})
+		r.Headers = r.insertBefore("Transfer-Encoding", Header{"Location", location})
+		return r
+	case p == "/xmlrpc.php":
+		if method != http.MethodPost {
+			return wordPressResponse("405 Not Allowed", "text/plain;charset=UTF-8", wordPressXMLRPCGetBody, Header{"Allow", "POST"})
+		}
+		// IXR sets the length itself, so nginx does not chunk
+		r := wordPressResponse("200 OK", "text/xml; charset=UTF-8", wordPressXMLRPCFault)
+		r.Headers = r.without("Transfer-Encoding")
+		r.Headers = r.insertBefore("Connection", Header{"Content-Length", strconv.Itoa(len(wordPressXMLRPCFault))})
+		return r
+	case p == "/wp-json" || p == "/wp-json/":
+		return wordPressResponse("200 OK", "application/json; charset=UTF-8", fmt.Sprintf(wordPressIndexJSON, host, host),
+			Header{"X-Robots-Tag", "noindex"},
+			wordPressAPILink(host),
+			Header{"X-Content-Type-Options", "nosniff"},
+			Header{"Access-Control-Expose-Headers", "X-WP-Total, X-WP-TotalPages, Link"},
+			Header{"Access-Control-Allow-Headers", "Authorization, X-WP-Nonce, Content-Disposition, Content-MD5, Content-Type"},
+			Header{"Allow", "GET"})
+	case strings.HasSuffix(p, ".php"):
+		return GetNginx404()
+	}
+	return GetWordPress404(host)
+}
+
+// getWordPressLogin generates the login form of the blog of host, which sets
+// the cookie WordPress checks cookies are enabled with, and no other.
+func getWordPressLogin(host, redirectTo string) Response {
+	if redirectTo == "" {
+		redirectTo = "https://" + host + "/wp-admin/"
+	}
+	body := fmt.Sprintf(wordPressLoginHTML, host, host, wordPressEscaper.Replace(redirectTo))
+	return wordPressResponse("200 OK", "text/html; charset=UTF-8", body,
+		wordPressNoCache[0], wordPressNoCache[1],
+		Header{"Set-Cookie", "wordpress_test_cookie=WP%20Cookie%20check; path=/; secure"},
+		Header{"X-Frame-Options", "SAMEORIGIN"},
+		Header{"Referrer-Policy", "strict-origin-when-cross-origin"})
+}
@@ -0,0 +1,43 @@
+package signalproxy_test
+
+import (
+	"context"
+	"log"
+	"os/signal"
+	"syscall"
+
+	"signalgoproxy/pkg/signalproxy"
+)
+
+// This example runs the proxy with ACME certificates until SIGINT or SIGTERM.
+func Example() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err := signalproxy.Run(ctx, signalproxy.Options{
+		Domain:      "proxy.example.com",
+		StealthMode: "nginx",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// This example routes an additional inner SNI name on top of the Signal servers.
+func ExampleNew() {
+	upstreams := signalproxy.DefaultUpstreams()
+	upstreams["chat.staging.signal.org"] = "chat.staging.signal.org:443"
+
+	srv, err := signalproxy.New(signalproxy.Options{
+		Domain:    "proxy.example.com",
+		Addrs:     []string{":443", ":8443"},
+		Upstreams: upstreams,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := srv.Run(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,219 @@
+// Package signalproxy embeds the Signal TLS proxy in other Go programs.
+//
+// A Server accepts outer TLS connections, routes Signal traffic by the inner SNI
+// to the configured upstreams and answers everything else with the stealth
+// responder. Unlike the command, the package never parses the flags of the
+// process or exits it; all problems are reported as errors.
+//
+// Some state of the proxy is kept per process rather than per Server: the ban
+// list, the counters, the upstream connection pools, the tarpit and the
+// stealth rate limits. Only one Server may run in a process at a time: New
+// and Run return ErrAlreadyRunning while another one runs.
+package signalproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"signalgoproxy/internal/config"
+	"signalgoproxy/internal/proxy"
+	"signalgoproxy/internal/server"
+)
+
+// Options configures a Server.
+type Options struct {
+	// Domain is the public domain of the proxy. Certificates are requested for it
+	// via ACME unless TLSConfig is set. Required.
+	Domain string
+
+	// Addrs are the TCP addresses to listen on. Defaults to ":443".
+	// Ignored if Listeners is set.
+	Addrs []string
+	// Listeners are used instead of binding Addrs. The server takes ownership of
+	// them and closes them when Run returns.
+	Listeners []net.Listener
+
+	// TLSConfig provides the certificate for the outer TLS connection. If nil,
+	// certificates are obtained via ACME and an HTTP-01 challenge listener is
+	// bound on :80.
+	TLSConfig *tls.Config
+	// CertCacheDir is the directory for cached ACME certificates. Defaults to "certs".
+	CertCacheDir string
+	// ACMEChallenge is "any" (default) to answer both TLS-ALPN-01 and HTTP-01,
+	// or "tls-alpn-01" to leave port 80 unbound.
+	ACMEChallenge string
+
+	// StealthMode selects the response to non-Signal traffic: "none", "nginx",
+	// "apache", "lighttpd", "openresty", "litespeed", "autoindex", "wordpress",
+	// "mirror", "error" or "proxy".
+	// Defaults to "nginx".
+	StealthMode string
+	// ProxyURL is the target of the "proxy" stealth mode.
+	ProxyURL string
+	// MirrorURL is the site whose front page the "mirror" stealth mode
+	// serves a snapshot of.
+	MirrorURL string
+
+	// Upstreams maps inner SNI names to upstream addresses. Nil uses the
+	// built-in Signal routing map, see DefaultUpstreams.
+	Upstreams map[string]string
+
+	// ShutdownTimeout bounds the graceful shutdown after ctx is cancelled.
+	// Connections still active when it expires are closed. Zero closes them
+	// immediately.
+	ShutdownTimeout time.Duration
+
+	// Logger receives all log output. Nil uses the standard logger.
+	Logger *log.Logger
+}
+
+// ErrAlreadyRunning is returned by New and Run while another Server runs in
+// the process, as the two would share and tear down each other's state.
+var ErrAlreadyRunning = errors.New("a signalproxy server is already running in this process")
+
+// running is set while a Server runs.
+var running atomic.Bool
+
+// Server is an embeddable Signal TLS proxy. Only one may run in a process at
+// a time, see the package documentation.
+type Server struct {
+	srv *server.Server
+}
+
+// DefaultUpstreams returns a copy of the built-in routing map for Signal servers.
+func DefaultUpstreams() map[string]string {
+	return proxy.DefaultUpstreams()
+}
+
+// New validates opts and creates a Server. No sockets are bound until Run.
+// It returns ErrAlreadyRunning while another Server runs.
+func New(opts Options) (*Server, error) {
+	if running.Load() {
+		return nil, ErrAlreadyRunning
+	}
+	cfg := &config.Config{
+		Domain:                   opts.Domain,
+		ProxyURL:                 opts.ProxyURL,
+		MirrorURL:                opts.MirrorURL,
+		MirrorInterval:           config.DefaultMirrorInterval,
+		MirrorMaxSizeKB:          config.DefaultMirrorMaxSizeKB,
+		Listen:                   opts.Addrs,
+		CertCacheDir:             opts.CertCacheDir,
+		SniffTimeout:             config.DefaultSniffTimeout,
+		StealthForbidden:         []string{config.DefaultStealthForbidden},
+		StealthAuthRealm:         config.DefaultStealthAuthRealm,
+		StealthAuthDelay:         config.DefaultStealthAuthDelay,
+		StealthKeepAliveTimeout:  config.DefaultStealthKeepAliveTimeout,
+		StealthKeepAliveRequests: config.DefaultStealthKeepAliveRequests,
+		StealthErrorCode:         config.DefaultStealthErrorCode,
+		StealthErrorRetryAfter:   config.DefaultStealthErrorRetryAfter,
+		DNSCacheTTL:              config.DefaultDNSCacheTTL,
+		ACMEChallenge:            config.ACMEChallenge(opts.ACMEChallenge),
+		ShutdownTimeout:          opts.ShutdownTimeout,
+		Logger:                   opts.Logger,
+	}
+
+	if opts.StealthMode == "" {
+		cfg.StealthMode = config.StealthNginx
+	} else {
+		mode, err := config.ParseStealthMode(opts.StealthMode)
+		if err != nil {
+			return nil, err
+		}
+		cfg.StealthMode = mode
+	}
+
+	if len(opts.Listeners) > 0 {
+		cfg.Listen = nil
+		for _, listener := range opts.Listeners {
+			if listener == nil {
+				return nil, errors.New("nil listener")
+			}
+			cfg.Listen = append(cfg.Listen, listener.Addr().String())
+		}
+	} else if len(cfg.Listen) == 0 {
+		cfg.Listen = []string{":443"}
+	}
+	if cfg.CertCacheDir == "" {
+		cfg.CertCacheDir = "certs"
+	}
+
+	// Inner SNI names are matched in lower case
+	if opts.Upstreams != nil {
+		cfg.Upstreams = make(map[string]string, len(opts.Upstreams))
+		for name, addr := range opts.Upstreams {
+			cfg.Upstreams[strings.ToLower(name)] = addr
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	srv := server.New(cfg)
+	if opts.TLSConfig != nil {
+		srv.SetTLSConfig(opts.TLSConfig)
+	}
+	if len(opts.Listeners) > 0 {
+		srv.SetListeners(opts.Listeners...)
+	}
+	return &Server{srv: srv}, nil
+}
+
+// NewFromArgs creates a Server configured like the signalgoproxy command,
+// from its flags in args, without the program name, and the environment
+// variables some of them fall back to. The flags are parsed on a flag set of
+// their own, which prints the usage and flag errors to standard error. It
+// returns flag.ErrHelp if args ask for the usage, and ErrAlreadyRunning
+// while another Server runs.
+func NewFromArgs(args []string) (*Server, error) {
+	if running.Load() {
+		return nil, ErrAlreadyRunning
+	}
+	cfg, err := config.Parse(flag.NewFlagSet("signalgoproxy", flag.ContinueOnError), args)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{srv: server.New(cfg)}, nil
+}
+
+// Run binds the listeners and serves until ctx is cancelled, then shuts down
+// gracefully. It returns an error if a listener cannot be bound, and
+// ErrAlreadyRunning if another Server runs. Run may only be called once.
+func (s *Server) Run(ctx context.Context) error {
+	if !running.CompareAndSwap(false, true) {
+		return ErrAlreadyRunning
+	}
+	defer running.Store(false)
+	return s.srv.Run(ctx)
+}
+
+// RunWithSignals runs the server like the signalgoproxy command: it raises the
+// limit of open files, reloads the configuration files on SIGHUP, dumps the
+// proxy state on SIGQUIT and shuts down gracefully on SIGINT or SIGTERM. As it
+// takes over these signals for the rest of the process, it belongs in the
+// main function of a program. Like Run, it may only be called once, and
+// returns ErrAlreadyRunning if another Server runs.
+func (s *Server) RunWithSignals() error {
+	if !running.CompareAndSwap(false, true) {
+		return ErrAlreadyRunning
+	}
+	defer running.Store(false)
+	return s.srv.Start()
+}
+
+// Run creates a Server from opts and runs it until ctx is cancelled.
+func Run(ctx context.Context, opts Options) error {
+	s, err := New(opts)
+	if err != nil {
+		return err
+	}
+	return s.Run(ctx)
+}
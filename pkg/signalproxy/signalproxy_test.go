@@ -0,0 +1,200 @@
+package signalproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"signalgoproxy/internal/testutil"
+)
+
+// TestNewValidation checks that invalid options are reported as errors.
+func TestNewValidation(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    Options
+		wantErr string
+	}{
+		{
+			name:    "Missing domain",
+			opts:    Options{},
+			wantErr: "domain is required",
+		},
+		{
+			name:    "Invalid stealth mode",
+			opts:    Options{Domain: "proxy.example", StealthMode: "iis"},
+			wantErr: "invalid stealth mode",
+		},
+		{
+			name:    "Proxy mode without URL",
+			opts:    Options{Domain: "proxy.example", StealthMode: "proxy"},
+			wantErr: "proxy URL is required",
+		},
+		{
+			name:    "Invalid address",
+			opts:    Options{Domain: "proxy.example", Addrs: []string{"443"}},
+			wantErr: "invalid listen address",
+		},
+		{
+			name: "Valid options",
+			opts: Options{Domain: "proxy.example", StealthMode: "Apache"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.opts)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestNewFromArgs checks that the flags of the command are reported as errors
+// instead of exiting.
+func TestNewFromArgs(t *testing.T) {
+	t.Setenv("DOMAIN", "")
+	t.Setenv("STEALTH_MODE", "")
+	testCases := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "Missing domain", args: nil, wantErr: "Domain is required"},
+		{name: "Invalid stealth mode", args: []string{"-domain", "proxy.example", "-stealth-mode", "iis"}, wantErr: "invalid stealth mode"},
+		{name: "Invalid configuration", args: []string{"-domain", "proxy.example", "-dial-timeout", "-1s"}, wantErr: "Invalid configuration"},
+		{name: "Valid flags", args: []string{"-domain", "proxy.example", "-stealth-mode", "apache"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewFromArgs(tc.args)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestServerRoutesToCustomUpstream runs an embedded server on a test listener
+// and completes an inner TLS handshake with a custom upstream through it.
+func TestServerRoutesToCustomUpstream(t *testing.T) {
+	upstreamAddr := testutil.StartEcho(t, testutil.TLSConfig(t, "chat.example"))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := New(Options{
+		Domain:      "proxy.example",
+		Listeners:   []net.Listener{listener},
+		TLSConfig:   testutil.TLSConfig(t, "proxy.example"),
+		StealthMode: "none",
+		Upstreams:   map[string]string{"Chat.Example": upstreamAddr},
+		Logger:      log.New(io.Discard, "", 0),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+
+	outer, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer outer.Close()
+
+	inner := tls.Client(outer, &tls.Config{ServerName: "chat.example", InsecureSkipVerify: true})
+	inner.SetDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, inner.Handshake())
+
+	_, err = inner.Write([]byte("ping"))
+	require.NoError(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(inner, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+}
+
+// TestRunListenError checks that a bind failure is returned instead of exiting.
+func TestRunListenError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	err = Run(context.Background(), Options{
+		Domain:    "proxy.example",
+		Addrs:     []string{busy.Addr().String()},
+		TLSConfig: testutil.TLSConfig(t, "proxy.example"),
+		Logger:    log.New(io.Discard, "", 0),
+	})
+	assert.ErrorContains(t, err, "failed to listen")
+}
+
+// TestDefaultUpstreamsIsCopy checks that callers cannot modify the built-in map.
+func TestDefaultUpstreamsIsCopy(t *testing.T) {
+	upstreams := DefaultUpstreams()
+	assert.Equal(t, "chat.signal.org:443", upstreams["chat.signal.org"])
+
+	upstreams["chat.signal.org"] = "127.0.0.1:1"
+	assert.Equal(t, "chat.signal.org:443", DefaultUpstreams()["chat.signal.org"])
+}
+
+// TestSingleServer checks that no second Server is created or run while one
+// runs, and that one may be once it has returned.
+func TestSingleServer(t *testing.T) {
+	opts := func() Options {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { listener.Close() })
+		return Options{
+			Domain:      "proxy.example",
+			Listeners:   []net.Listener{listener},
+			TLSConfig:   testutil.TLSConfig(t, "proxy.example"),
+			StealthMode: "none",
+			Logger:      log.New(io.Discard, "", 0),
+		}
+	}
+	first, err := New(opts())
+	require.NoError(t, err)
+	second, err := New(opts())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- first.Run(ctx) }()
+	require.Eventually(t, running.Load, time.Second, 5*time.Millisecond)
+
+	_, err = New(opts())
+	assert.ErrorIs(t, err, ErrAlreadyRunning)
+	_, err = NewFromArgs([]string{"-domain", "proxy.example"})
+	assert.ErrorIs(t, err, ErrAlreadyRunning)
+	assert.ErrorIs(t, second.Run(context.Background()), ErrAlreadyRunning)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+	_, err = New(opts())
+	assert.NoError(t, err)
+}